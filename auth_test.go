@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"client"
+	"io"
+	"net"
+	"server"
+	"testing"
+	. "util"
+)
+
+// registerAndLeave registers name on the hub at addr, and waits for its
+// session to end
+func registerAndLeave(t *testing.T, hub *server.Hub, addr string, name Username) {
+	t.Helper()
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte(string(ActionRegister) + "\n" + string(name) + "\n1234\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(conn)
+	for {
+		line, err := ScanLine(scanner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == ServerResponsePrefix+string(AuthResponseID)+IdSeparator+string(ResponseOk) {
+			break
+		}
+	}
+	conn.Close()
+	waitForSessionEnd(t, hub, name)
+}
+
+// startUnauthedClient runs a client at its first prompt
+func startUnauthedClient(t *testing.T, addr string) (io.Writer, <-chan ReadInput) {
+	t.Helper()
+	userInput, typed := io.Pipe()
+	shown, userOutput := io.Pipe()
+	t.Cleanup(func() {
+		typed.Close()
+		shown.Close()
+	})
+	go client.RunClientWithOptions(addr, userInput, userOutput, client.ClientOptions{})
+	return typed, ReadAsyncIntoChan(bufio.NewScanner(shown))
+}
+
+// registerTakenName runs a client that tries registering alice, who's taken
+func registerTakenName(t *testing.T) (io.Writer, <-chan ReadInput) {
+	t.Helper()
+	hub := server.NewHub()
+	addr := listenOnLoopback(hub, t)
+	registerAndLeave(t, hub, addr, "alice")
+
+	typed, output := startUnauthedClient(t, addr)
+	typeLines(t, typed, "r", "alice", "1234", "1234")
+	waitForLine(t, output, string(ResponseUsernameExists))
+	waitForLine(t, output, "That name is taken — press l to try logging in with the same credentials, or r to pick a new name")
+	return typed, output
+}
+
+// TestRegisterTakenNameLogsIn logs in with the credentials typed to register
+func TestRegisterTakenNameLogsIn(t *testing.T) {
+	typed, output := registerTakenName(t)
+	typeLines(t, typed, "l")
+	waitForLine(t, output, "Logged in as alice")
+}
+
+// TestRegisterTakenNamePicksAnother registers under a new name instead
+func TestRegisterTakenNamePicksAnother(t *testing.T) {
+	typed, output := registerTakenName(t)
+	typeLines(t, typed, "r")
+	waitForLine(t, output, "Username:")
+	typeLines(t, typed, "bob", "1234", "1234")
+	waitForLine(t, output, "Logged in as bob")
+}
+
+// TestRegisterConfirmsPassword has a password confirmed as another one, which
+// is asked for again rather than registered
+func TestRegisterConfirmsPassword(t *testing.T) {
+	hub := server.NewHub()
+	typed, output := startUnauthedClient(t, listenOnLoopback(hub, t))
+	typeLines(t, typed, "r", "alice", "1234", "1243")
+	waitForLine(t, output, "The passwords don't match")
+	waitForLine(t, output, "Type r to register, l to login")
+	if users := hub.ActiveUsers(); len(users) != 0 {
+		t.Fatalf("expected no one registered, got %v", users)
+	}
+	typeLines(t, typed, "r", "alice", "1234", "1234")
+	waitForLine(t, output, "Logged in as alice")
+}
+
+// TestRegisterThenLogin registers on a server that only creates the account,
+// and logs in to it as the client asks next
+func TestRegisterThenLogin(t *testing.T) {
+	hub := server.NewHubWithOptions(server.ServerOptions{RegisterThenLogin: true})
+	typed, output := startUnauthedClient(t, listenOnLoopback(hub, t))
+	typeLines(t, typed, "r", "alice", "1234", "1234")
+	waitForLine(t, output, string(ResponseRegisteredPleaseLogin))
+	waitForLine(t, output, "Password for alice:")
+	if users := hub.ActiveUsers(); len(users) != 0 {
+		t.Fatalf("expected registering not to log in, got %v", users)
+	}
+	typeLines(t, typed, "4321")
+	waitForLine(t, output, string(ResponseInvalidCredentials))
+	typeLines(t, typed, "l", "alice", "1234")
+	waitForLine(t, output, "Logged in as alice")
+}
@@ -11,6 +11,7 @@ validateClientOutput() {
       (assert (= (read-line) \"Type r to register, l to login\"))
       (assert (= (read-line) \"Username:\"))
       (assert (= (read-line) \"Password:\"))
+      (assert (= (read-line) \"Confirm password:\"))
       (assert (= (read-line) \"Logged in as $NAME\"))
       (assert (= (read-line) \"\"))
       ;(println \"$NAME: received \" (count (line-seq (java.io.BufferedReader. *in*))))
@@ -25,6 +26,7 @@ loginAndSendMsgs() {
       bb "(println \"r\")
           (println \"$NAME\")
           (println \"1234\")
+          (println \"1234\")
           (Thread/sleep 2100) ; wait for other clients to login
           (dotimes [i $MSGS_COUNT]
             (when (= (rem i 20) 0)
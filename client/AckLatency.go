@@ -0,0 +1,108 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	. "util"
+)
+
+// LatencyCmd shows how long our last messages took to be acked, "lat N" over
+// the last N only
+const LatencyCmd Cmd = "lat"
+
+// latencySamples is how many of the last messages' ack times are kept
+const latencySamples = 100
+
+type latencySample struct {
+	latency time.Duration
+	// timedOut samples are censored: the ack took more than MsgAckTimeout, if
+	// it came at all, so they have no latency
+	timedOut bool
+}
+
+// ackLatencies keeps the ack times of our last messages in a ring
+type ackLatencies struct {
+	lock    sync.Mutex
+	samples [latencySamples]latencySample
+	// next is where the next sample goes, count how many samples there are
+	next, count int
+}
+
+func (l *ackLatencies) add(sample latencySample) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.samples[l.next] = sample
+	l.next = (l.next + 1) % len(l.samples)
+	if l.count < len(l.samples) {
+		l.count++
+	}
+}
+
+// last returns the last n samples, or all of them if there are fewer or n is 0
+func (l *ackLatencies) last(n int) []latencySample {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if n <= 0 || n > l.count {
+		n = l.count
+	}
+	samples := make([]latencySample, n)
+	for i := range samples {
+		samples[i] = l.samples[(l.next-n+i+len(l.samples))%len(l.samples)]
+	}
+	return samples
+}
+
+// summarizeLatencies describes samples by the min, average and 95th percentile
+// of the acked ones, with the timed out ones counted separately
+func summarizeLatencies(samples []latencySample) string {
+	var acked []time.Duration
+	var total time.Duration
+	for _, sample := range samples {
+		if !sample.timedOut {
+			acked = append(acked, sample.latency)
+			total += sample.latency
+		}
+	}
+	timedOut := len(samples) - len(acked)
+	if len(acked) == 0 {
+		if timedOut == 0 {
+			return "No messages acked yet"
+		}
+		return fmt.Sprintf("None of the last %d messages were acked in time", timedOut)
+	}
+	sort.Slice(acked, func(i, j int) bool { return acked[i] < acked[j] })
+	// nearest rank
+	p95 := acked[(len(acked)*95+99)/100-1]
+	summary := fmt.Sprintf("Ack latency over the last %d messages: min %s, avg %s, p95 %s",
+		len(samples), roundLatency(acked[0]),
+		roundLatency(total/time.Duration(len(acked))), roundLatency(p95))
+	if timedOut != 0 {
+		summary += fmt.Sprintf(", %d timed out", timedOut)
+	}
+	return summary
+}
+
+// roundLatency keeps sub-millisecond latencies, as on loopback, from showing
+// as 0s
+func roundLatency(d time.Duration) time.Duration {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(time.Millisecond)
+}
+
+func (client *Client) showLatency(args string) {
+	n := 0
+	if args != "" {
+		var err error
+		n, err = strconv.Atoi(args)
+		if err != nil || n <= 0 {
+			fmt.Fprintln(client.userOutput, "Usage: /lat [N]")
+			return
+		}
+	}
+	fmt.Fprintln(client.userOutput, summarizeLatencies(client.latencies.last(n)))
+}
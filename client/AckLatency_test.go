@@ -0,0 +1,59 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAckLatencies(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name    string
+		samples []latencySample
+		n       int
+		summary string
+	}{
+		{"none", nil, 0, "No messages acked yet"},
+		{"one", []latencySample{{latency: 230 * ms}}, 0,
+			"Ack latency over the last 1 messages: min 230ms, avg 230ms, p95 230ms"},
+		{"timeouts apart", []latencySample{{latency: 10 * ms}, {timedOut: true}, {latency: 30 * ms}}, 0,
+			"Ack latency over the last 3 messages: min 10ms, avg 20ms, p95 30ms, 1 timed out"},
+		{"only timeouts", []latencySample{{timedOut: true}, {timedOut: true}}, 0,
+			"None of the last 2 messages were acked in time"},
+		{"last n", []latencySample{{latency: time.Second}, {latency: 2 * ms}, {latency: 4 * ms}}, 2,
+			"Ack latency over the last 2 messages: min 2ms, avg 3ms, p95 4ms"},
+		{"sub-millisecond", []latencySample{{latency: 250 * time.Microsecond}}, 0,
+			"Ack latency over the last 1 messages: min 250µs, avg 250µs, p95 250µs"},
+	}
+	for _, test := range tests {
+		var latencies ackLatencies
+		for _, sample := range test.samples {
+			latencies.add(sample)
+		}
+		if got := summarizeLatencies(latencies.last(test.n)); got != test.summary {
+			t.Errorf("%s: expected %q, got %q", test.name, test.summary, got)
+		}
+	}
+}
+
+func TestAckLatenciesRing(t *testing.T) {
+	var latencies ackLatencies
+	// the first 20 are pushed out of the ring
+	for i := 1; i <= latencySamples+20; i++ {
+		latencies.add(latencySample{latency: time.Duration(i) * time.Millisecond})
+	}
+	samples := latencies.last(0)
+	if len(samples) != latencySamples {
+		t.Fatalf("expected %d samples, got %d", latencySamples, len(samples))
+	}
+	if samples[0].latency != 21*time.Millisecond ||
+		samples[len(samples)-1].latency != (latencySamples+20)*time.Millisecond {
+		t.Errorf("expected samples 21ms to %dms, got %s to %s", latencySamples+20,
+			samples[0].latency, samples[len(samples)-1].latency)
+	}
+	// p95 by nearest rank of 21..120ms is the 95th, 115ms
+	const expected = "Ack latency over the last 100 messages: min 21ms, avg 71ms, p95 115ms"
+	if got := summarizeLatencies(samples); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
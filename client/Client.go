@@ -3,6 +3,9 @@ package client
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -18,17 +21,188 @@ import (
 	. "util"
 )
 
+type ClientOptions struct {
+	// TraceWriter, when set, gets every protocol line sent to or received from
+	// the server, with passwords redacted
+	TraceWriter io.Writer
+	// Quality configures pinging the server to watch the connection's quality
+	Quality QualityOptions
+	// MaxReconnects is how many times in a row the client tries to reconnect
+	// before giving up, 0 meaning forever. Logging in resets the count.
+	MaxReconnects int
+	// ReconnectDelay is the wait before reconnecting, 5 seconds by default
+	ReconnectDelay time.Duration
+	// OutboxPath, when set, is a file keeping the messages that weren't acked
+	// yet, so they can be resent after a crash
+	OutboxPath string
+	// ResendOutbox decides what to do with the messages a previous session
+	// left in the outbox, resending them by default
+	ResendOutbox OutboxResend
+	// TLS, when set, is used to connect to the server over TLS
+	TLS *tls.Config
+	// Dialer, when set, connects to the server instead of TCP, e.g over a
+	// unix socket. TLS is then up to it.
+	Dialer Dialer
+	// OnLogin are commands run after each login, e.g "/subscribe", as if the
+	// user typed them. A failing one doesn't stop the others or the login.
+	OnLogin []string
+	// ShowAckLatency shows how long each message took to be acked, once it is
+	ShowAckLatency bool
+	// MaxOddLines is how many lines a connection's server may send that make
+	// no sense to us before the client takes its output as out of sync and
+	// reconnects, 10 by default. When negative they're only logged.
+	MaxOddLines int
+	// Filters decide which kinds of lines from the server are shown, all of
+	// them by default. The user changes them with FilterCmd.
+	Filters *Filters
+	// Hooks are called as the client connects and logs in and out. With
+	// RunSession, whose caller connects, only the login ones are.
+	Hooks Hooks
+	// Framing is what the client asks the server to write in, and writes in
+	// itself, DefaultFraming by default. Lines from the server are read in
+	// either framing.
+	Framing Framing
+	// AuthAction, when set, is answered to the register or login prompt
+	// without asking, e.g ActionLogin for users who always log in. The user is
+	// asked instead right after the server refuses it.
+	AuthAction AuthAction
+	// Version is the version reported to the server, BinaryVersion() by
+	// default
+	Version string
+	// Name, when set, starts the client's log lines, to tell apart the clients
+	// running in the same process, e.g in tests. It's never sent to the
+	// server.
+	Name string
+	// LogThrottleWindow is how long repeated errors, e.g responses we didn't
+	// expect, are suppressed for after one is logged, before they're summed
+	// up. DefaultLogThrottleWindow when 0, and every one is logged when
+	// negative.
+	LogThrottleWindow time.Duration
+	// Debug logs what's only worth knowing while debugging, e.g the errors
+	// that came after the one that ended a connection
+	Debug bool
+}
+
+func (o ClientOptions) withDefaults() ClientOptions {
+	if o.ReconnectDelay == 0 {
+		o.ReconnectDelay = time.Second * 5
+	}
+	if o.Dialer == nil {
+		o.Dialer = NetDialer{Network: "tcp4", TLS: o.TLS}
+	}
+	if o.MaxOddLines == 0 {
+		o.MaxOddLines = 10
+	}
+	if o.Filters == nil {
+		o.Filters = NewFilters()
+	}
+	o.Hooks = o.Hooks.withDefaults()
+	if o.Framing == 0 {
+		o.Framing = DefaultFraming
+	}
+	if o.Version == "" {
+		o.Version = BinaryVersion()
+	}
+	return o
+}
+
+// newLogger logs to out, with the client's Name if it has one
+func (o ClientOptions) newLogger(out io.Writer) *log.Logger {
+	prefix := ""
+	if o.Name != "" {
+		prefix = o.Name + " "
+	}
+	return log.New(out, prefix, log.LstdFlags)
+}
+
 func RunClient(port string, in io.Reader, out io.Writer) {
-	userInput := ReadAsyncIntoChan(bufio.NewScanner(in))
+	err := RunClientWithOptions(port, in, out, ClientOptions{ResendOutbox: OutboxAsk})
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// RunClientWithOptions returns once the user quits, or with an error if the
+// client can't get to the server. The user can connect to more servers with
+// ConnectCmd, see MultiClient.
+func RunClientWithOptions(port string, in io.Reader, out io.Writer, options ClientOptions) error {
+	client := NewMultiClient(in, out, options)
+	err := client.Connect(port, port)
+	if err != nil {
+		return err
+	}
+	return client.Run()
+}
+
+// runReconnecting runs the client with the server at port, reconnecting as
+// needed, until the user quits or the server can't be reached
+func runReconnecting(port string, userInput <-chan ReadInput, out io.Writer,
+	options ClientOptions) error {
+	limit := &reconnectLimit{max: options.MaxReconnects}
+	// one outbox for all the sessions, since they share its file
+	box := loadOutbox(options.OutboxPath, options.newLogger(out))
+	// one reporter for all the sessions, since an outage outlasts them
+	retries := newRetryReporter(options.newLogger(out))
+	// what's typed while reconnecting waits for the next login
+	typed := newTypeAhead(userInput, out, options.newLogger(out), options.Filters)
+	defer typed.stop()
+	for {
+		end, err := runClientUntilDisconnected(port, typed, out, options, limit, box, retries)
+		if err != nil {
+			return err
+		} else if end.err != nil {
+			return end.err
+		}
+		if !end.shouldReconnect {
+			return nil
+		}
+		typed.setOnline(false)
+		if end.loggedIn {
+			limit.reset()
+		}
+		if err := limit.fail(); err != nil {
+			return err
+		}
+		if end.reconnectTo != "" {
+			port = end.reconnectTo
+		}
+	}
+}
+
+var ErrTooManyReconnects = errors.New("too many failed reconnects, giving up")
+
+// reconnectLimit counts the reconnect attempts since the client last logged in
+type reconnectLimit struct {
+	max    int
+	failed int
+}
 
-	shouldReconnect := true
-	for shouldReconnect {
-		shouldReconnect = runClientUntilDisconnected(port, userInput, out)
+// fail counts an attempt, and returns ErrTooManyReconnects once they're over
+// the limit
+func (l *reconnectLimit) fail() error {
+	l.failed++
+	if l.max != 0 && l.failed > l.max {
+		return ErrTooManyReconnects
 	}
+	return nil
+}
+
+func (l *reconnectLimit) reset() {
+	l.failed = 0
+}
+
+// sessionEnd tells how a session ended
+type sessionEnd struct {
+	shouldReconnect bool
+	// reconnectTo is where the server told us to reconnect
+	reconnectTo string
+	loggedIn    bool
+	// err is what made the session fail, if it did
+	err error
 }
 
 type UnauthenticatedClient struct {
-	errs chan error
+	errs *errorSink
 
 	receiveResponse <-chan ServerResponse
 	receiveMsg      <-chan string
@@ -37,15 +211,61 @@ type UnauthenticatedClient struct {
 	pendingResponsesForMsgs map[MsgID]chan<- Response
 	// a pointer to avoid copying when turning into an authenticated client
 	pendingResponsesLock *sync.Mutex
+	// noPendingResponses is closed while pendingResponsesForMsgs is empty,
+	// see finishSending. Guarded by pendingResponsesLock, and a pointer for
+	// the same reason.
+	noPendingResponses *chan struct{}
+	// lateResponses are acks that arrived while logging in, delivered once we
+	// are logged in
+	lateResponses []ServerResponse
+	// heldMsgs are messages that came while prompting, shown once we're
+	// logged in
+	heldMsgs []string
+	// reconnectTo is where the server told us to reconnect
+	reconnectTo string
+	loggedIn    bool
+	// err is what made the client exit, if it failed
+	err error
+	// outbox is nil unless OutboxPath is set. unsent are the messages previous
+	// sessions left in it, dealt with after logging in.
+	outbox *outbox
+	unsent []outboxEntry
+	// typeAhead has the messages typed while reconnecting, sent after logging
+	// in. It's nil unless the client reconnects by itself.
+	typeAhead *typeAhead
+	// retries tells the user about outages, shared with the sessions before
+	// and after this one
+	retries *retryReporter
+	// latencies are our messages' ack times, for LatencyCmd
+	latencies *ackLatencies
+	// ids are the ids of the messages we send
+	ids *msgIDs
+	// errLog logs the errors that come in bursts, see
+	// ClientOptions.LogThrottleWindow
+	errLog *LogThrottle
+	// ended is closed once the session is over, so the goroutines still
+	// waiting for acks stop waiting
+	ended chan struct{}
 
 	userInput  <-chan ReadInput
 	userOutput io.Writer
+	// prompts is userOutput, which prompts are shown through
+	prompts *promptOutput
+	// logger writes to userOutput, without touching the global logger other
+	// clients or a server in the same process may use
+	logger  *log.Logger
+	options ClientOptions
 }
 
 type Client struct {
 	UnauthenticatedClient
 	creds *UserCredentials
 	relog chan struct{}
+	// clockOffset is how far the server's clock is ahead of ours, as of the
+	// last TimeCmd. Atomic, since it's set while messages are shown.
+	clockOffset int64
+	// dms start over with each login, which may well be as someone else
+	dms recentDMs
 }
 
 func parseIncomingMsg(s string) (msg string, ok bool) {
@@ -56,59 +276,224 @@ func parseIncomingMsg(s string) (msg string, ok bool) {
 	return s, true
 }
 
-func splitServerOutputAsync(output io.Reader, errs chan<- error) (
+func renderPresenceEvent(event PresenceEvent) string {
+	if event.Online {
+		return "* " + string(event.Name) + " joined"
+	}
+	return "* " + string(event.Name) + " left"
+}
+
+// ErrDesynced is the server sending more than MaxOddLines lines we can't make
+// sense of, likely since we lost track of where its lines start
+var ErrDesynced = errors.New("server output out of sync")
+
+// splitServerOutputAsync stops with ErrDesynced after maxOddLines odd lines,
+// unless it's negative. The lines filters hide aren't sent on msgs. Responses
+// are passed to onResponse before they're sent on responses, see
+// Hooks.Response.
+func splitServerOutputAsync(output io.Reader, errs *errorSink, logger *log.Logger,
+	maxOddLines int, filters *Filters, onResponse func(ServerResponse)) (
 	responses_ <-chan ServerResponse,
 	msgs_ <-chan string,
 ) {
-	scanner := bufio.NewScanner(output)
+	scanner := NewProtocolScanner(output)
 	responses := make(chan ServerResponse, 32870)
 	msgs := make(chan string, 32870)
 	go func() {
 		defer close(responses)
 		defer close(msgs)
+		oddLines := 0
 		for {
 			str, err := ScanLine(scanner)
 			if err != nil {
-				errs <- err
+				errs.send(err)
 				return
 			}
+			// whatever framing we asked for, the server might not know it
+			str = Unframe(str)
 			if serverResponse, ok := ParseServerResponse(str); ok {
+				if !isPingID(serverResponse.Id) {
+					onResponse(serverResponse)
+				}
 				responses <- serverResponse
 			} else if msg, ok := parseIncomingMsg(str); ok {
 				msgs <- msg
+			} else if event, ok := ParsePresenceEvent(str); ok {
+				if filters.Shows(LineJoins) {
+					msgs <- renderPresenceEvent(event)
+				}
+			} else if notice, ok := ParseRoomNotice(str); ok {
+				if filters.Shows(LineSystem) {
+					msgs <- notice
+				}
+			} else if caps, ok := ParseCapabilities(str); ok && caps.Version() != "" {
+				// the server answering the version we reported
+				logger.Printf("Server version: %s\n", caps.Version())
+			} else if addr, ok := ParseReconnectNotice(str); ok {
+				errs.send(&ReconnectRequest{Addr: addr})
+			} else if order, ok := parseReconnectOrder(str); ok {
+				// reading on, for the responses to what we're still sending
+				errs.send(&ReconnectRequest{Addr: order.Addr, Delay: order.Delay, ordered: true})
+			} else if position, ok := ParseQueuePosition(str); ok {
+				if position == 0 {
+					logger.Println("The server has room for us now")
+				} else {
+					logger.Printf("The server is full, waiting in line: number %d\n", position)
+				}
+			} else if reason, ok := ParseRefusal(str); ok {
+				// the server closes next, which isn't worth retrying
+				errs.send(&RefusedError{reason})
+				return
+			} else if IsCmd(str) {
+				if err := parseServerCmd(UnserializeStrToCmd(str)); err != nil {
+					// the server closes next, which is no news
+					errs.send(err)
+					return
+				}
+				logger.Printf("Unknown command from server: %s\n", str)
 			} else {
-				fmt.Printf("odd output from server: %s\n", str)
+				logger.Printf("odd output from server: %s\n", str)
+				oddLines++
+				if maxOddLines >= 0 && oddLines > maxOddLines {
+					logger.Printf("%d odd lines from server, its output is likely out of sync\n",
+						oddLines)
+					errs.send(ErrDesynced)
+					return
+				}
 			}
 		}
 	}()
 	return responses, msgs
 }
 
-func startSession(port string, userInput <-chan ReadInput, out io.Writer) *UnauthenticatedClient {
-	serverConn, err := connectToPortWithRetry(port, out)
-	if err != nil {
-		log.Fatalln(err)
+func newUnauthenticatedClient(server io.ReadWriter, userInput <-chan ReadInput,
+	out io.Writer, logger *log.Logger, options ClientOptions) *UnauthenticatedClient {
+	prompts := &promptOutput{out: out}
+	// so log lines don't hide prompts either
+	logger = log.New(prompts, logger.Prefix(), logger.Flags())
+	errLog := NewLogThrottle(logger, options.LogThrottleWindow)
+	var debugLog *LogThrottle
+	if options.Debug {
+		debugLog = errLog
 	}
-	log.Printf("Connected to %s\n", serverConn.RemoteAddr())
-	errs := make(chan error, 128)
-	responses, msgs := splitServerOutputAsync(serverConn, errs)
-	serverInput := serverConn.(io.Writer)
+	errs := newErrorSink(debugLog)
+	responses, msgs := splitServerOutputAsync(server, errs, logger, options.MaxOddLines,
+		options.Filters, options.Hooks.Response)
 	pendingAcks := make(map[MsgID]chan<- Response)
+	noPendingAcks := make(chan struct{})
+	close(noPendingAcks)
+
+	return &UnauthenticatedClient{errs, responses, msgs, server, pendingAcks,
+		&sync.Mutex{}, &noPendingAcks, nil, nil, "", false, nil, nil, nil, nil, nil, &ackLatencies{},
+		newMsgIDs(), errLog, make(chan struct{}),
+		userInput, prompts, prompts, logger, options}
+}
+
+var lastSessionID int64 = 0
+
+func runClientUntilDisconnected(port string, typed *typeAhead, out io.Writer,
+	options ClientOptions, limit *reconnectLimit, box *outbox,
+	retries *retryReporter) (sessionEnd, error) {
+	logger := options.newLogger(out)
+	serverConn, err := connectToPortWithRetry(port, retries, options.ReconnectDelay, limit,
+		options.Dialer)
+	if err != nil {
+		return sessionEnd{}, err
+	}
+	addr := serverConn.RemoteAddr().String()
+	logger.Printf("Connected to %s\n", addr)
+	options.Hooks.Connected(addr)
+	typed.setOnline(true)
+	if options.TraceWriter != nil {
+		id := strconv.FormatInt(atomic.AddInt64(&lastSessionID, 1), 10)
+		serverConn = NewTracedConn(serverConn, options.TraceWriter, id,
+			RedactPasswords(TraceOut))
+	}
+
+	end := runSession(serverConn, typed.lines, typed, out, logger, options, box, retries)
+	ClosePrintErr(serverConn)
+	options.Hooks.Disconnected(addr, end.err)
+	return end, nil
+}
+
+// ReconnectRequest is sent on errs when a draining server tells us to
+// reconnect, to Addr or to the same address if it's empty, or when a server
+// shedding load orders us to, see ReconnectOrder
+type ReconnectRequest struct {
+	Addr string
+	// Delay is how long to wait before reconnecting
+	Delay time.Duration
+	// ordered is for a ReconnectOrder, after which we finish sending first
+	ordered bool
+}
+
+func (r *ReconnectRequest) Error() string {
+	if r.Addr == "" {
+		return "server asked us to reconnect"
+	}
+	return "server asked us to reconnect to " + r.Addr
+}
 
-	return &UnauthenticatedClient{errs, responses, msgs, serverInput, pendingAcks, &sync.Mutex{}, userInput, out}
+// LoggedOutError is the server logging us out, for Reason
+type LoggedOutError struct {
+	Reason LogoutReason
 }
 
-func runClientUntilDisconnected(port string, userInput <-chan ReadInput, out io.Writer) (shouldReconnect bool) {
-	log.SetOutput(out)
-	unauthedClient := startSession(port, userInput, out)
-	defer ClosePrintErr(unauthedClient.serverInput.(net.Conn))
+func (e *LoggedOutError) Error() string {
+	return "the server logged us out: " + e.Reason.String()
+}
+
+// RefusedError is the server refusing to serve us, which retrying won't fix
+type RefusedError struct {
+	Reason string
+}
+
+func (e *RefusedError) Error() string {
+	return "the server refused the connection: " + e.Reason
+}
+
+// RunSession runs the client over an already established connection to the
+// server, until the user quits or the connection fails. The caller still owns
+// server and in, and should close them: a read of in that's still blocked when
+// the session ends only ends with in.
+func RunSession(server io.ReadWriter, in io.Reader, out io.Writer,
+	options ClientOptions) (shouldReconnect bool) {
+	inputDone := make(chan struct{})
+	defer close(inputDone)
+	userInput := ReadAsyncIntoChanUntil(bufio.NewScanner(in), inputDone)
+	logger := options.newLogger(out)
+	end := runSession(server, userInput, nil, out, logger, options.withDefaults(),
+		loadOutbox(options.OutboxPath, logger), newRetryReporter(logger))
+	if end.err != nil {
+		logger.Println(end.err)
+	}
+	return end.shouldReconnect
+}
+
+func runSession(server io.ReadWriter, userInput <-chan ReadInput, typed *typeAhead,
+	out io.Writer, logger *log.Logger, options ClientOptions, box *outbox,
+	retries *retryReporter) sessionEnd {
+	unauthedClient := newUnauthenticatedClient(server, userInput, out, logger, options)
+	defer close(unauthedClient.ended)
+	unauthedClient.outbox = box
+	unauthedClient.retries = retries
+	unauthedClient.unsent = box.unsent()
+	unauthedClient.typeAhead = typed
+	// the server only uses the protocol features we advertise
+	caps := ClientCapabilities().WithFraming(options.Framing).WithVersion(options.Version)
+	_, err := server.Write([]byte(caps.Serialize() + "\n"))
+	if err != nil {
+		logger.Println(err)
+		return sessionEnd{shouldReconnect: true}
+	}
 
 	action := RetryActionShouldOnlyRelog
 	for action == RetryActionShouldOnlyRelog {
 		action = unauthedClient.runUntilLoggedOut()
 	}
 
-	return action == RetryActionShouldReconnect
+	return sessionEnd{action == RetryActionShouldReconnect,
+		unauthedClient.reconnectTo, unauthedClient.loggedIn, unauthedClient.err}
 }
 
 type RetryAction int
@@ -122,40 +507,158 @@ const (
 func (unauthedClient *UnauthenticatedClient) runUntilLoggedOut() RetryAction {
 	client, err := authenticateWithRetry(unauthedClient)
 	if err != nil {
-		if err == io.EOF {
-			fmt.Fprintln(unauthedClient.userOutput, "Server closed, retrying")
+		if errors.Is(err, io.EOF) || errors.Is(err, ErrTruncatedLine) {
+			unauthedClient.retries.lost("Server closed", 0)
 			return RetryActionShouldOnlyRelog
 		}
-		log.Fatalln(err)
+		var request *ReconnectRequest
+		if errors.As(err, &request) {
+			return unauthedClient.reconnect(request)
+		}
+		var loggedOut *LoggedOutError
+		if errors.As(err, &loggedOut) {
+			return unauthedClient.loggedOut(loggedOut)
+		}
+		if errors.Is(err, ErrDesynced) {
+			return unauthedClient.resync()
+		}
+		// only this session fails, others in the same process go on
+		unauthedClient.err = err
+		return RetryActionShouldExit
 	}
 	fmt.Fprintf(unauthedClient.userOutput, "Logged in as %s\n\n", client.creds.Name)
-	defer log.Println("Logged out")
+	unauthedClient.loggedIn = true
+	client.options.Hooks.LoggedIn(client.creds.Name)
+	defer client.options.Hooks.LoggedOut(client.creds.Name)
+	if len(unauthedClient.unsent) != 0 {
+		err := client.handleUnsent(unauthedClient.unsent)
+		if err != nil {
+			client.logger.Println(err)
+			return RetryActionShouldExit
+		}
+		unauthedClient.unsent = nil
+	}
+	lateResponses := unauthedClient.lateResponses
+	unauthedClient.lateResponses = nil
+	for _, serverResponse := range lateResponses {
+		// the message may have timed out meanwhile, which isn't an error here
+		client.deliverResponse(serverResponse)
+	}
+	// the client has its own copy, for receiveMsgsLoop
+	unauthedClient.heldMsgs = nil
+	defer client.logger.Println("Logged out")
+	client.runOnLogin()
+	client.sendTypedAhead()
 
 	ctx, cancel := context.WithCancel(context.Background())
+	var loops sync.WaitGroup
+	// the loops read the same channels as the next login does, so they must be
+	// done before we return
+	defer loops.Wait()
 	defer cancel()
-	go client.handleResponsesLoop(ctx)
-	go client.handleUserInputLoop(ctx)
-	go client.receiveMsgsLoop(ctx)
+	loopFuncs := []func(context.Context){
+		client.handleResponsesLoop, client.handleUserInputLoop, client.receiveMsgsLoop}
+	if client.options.Quality.PingInterval != 0 {
+		loopFuncs = append(loopFuncs, client.pingLoop)
+	}
+	for _, loop := range loopFuncs {
+		loops.Add(1)
+		go func(loop func(context.Context)) {
+			defer loops.Done()
+			loop(ctx)
+		}(loop)
+	}
 	select {
 	case <-client.relog:
 		return RetryActionShouldOnlyRelog
-	case err := <-client.errs:
-		switch err {
-		case nil:
+	case <-client.errs.Done():
+		err := client.errs.Err()
+		var request *ReconnectRequest
+		if errors.As(err, &request) && request.ordered {
+			client.finishSending()
+		}
+		// what the user types while we wait to reconnect is for the next
+		// session, so this one's loops must stop reading it first
+		cancel()
+		loops.Wait()
+		if !errors.Is(err, ErrUserHasQuit) {
+			client.typeAhead.setOnline(false)
+		}
+		if request != nil {
+			return unauthedClient.reconnect(request)
+		}
+		var loggedOut *LoggedOutError
+		if errors.As(err, &loggedOut) {
+			return unauthedClient.loggedOut(loggedOut)
+		}
+		switch {
+		case err == nil:
 			panic("unreachable, mainClientLoop should return only on error")
-		case ErrUserHasQuit:
+		case errors.Is(err, ErrUserHasQuit):
 			return RetryActionShouldExit
-		case io.EOF, ErrServerTimedOut, net.ErrClosed:
-			log.Println("Server closed, retrying in 5 seconds")
-			time.Sleep(5 * time.Second)
+		case errors.Is(err, ErrConnectionLost):
+			// the server may well be fine, so there's no waiting
+			client.logger.Println("Reconnecting")
+			return RetryActionShouldReconnect
+		case errors.Is(err, ErrDesynced):
+			return unauthedClient.resync()
+		case errors.Is(err, io.EOF), errors.Is(err, ErrTruncatedLine),
+			errors.Is(err, ErrServerTimedOut), errors.Is(err, net.ErrClosed):
+			client.retries.lost("Server closed", client.options.ReconnectDelay)
+			time.Sleep(client.options.ReconnectDelay)
 			return RetryActionShouldReconnect
 		default:
-			log.Println(err)
+			client.logger.Println(err)
 			return RetryActionShouldExit
 		}
 	}
 }
 
+// loggedOut only reconnects after a shutdown, waiting as long as the server
+// asked. Being kicked or banned is the client's error, since reconnecting
+// wouldn't help.
+func (unauthedClient *UnauthenticatedClient) loggedOut(err *LoggedOutError) RetryAction {
+	unauthedClient.logger.Printf("Logged out by the server: %s\n", err.Reason)
+	if err.Reason.Code != LogoutShutdown {
+		unauthedClient.err = err
+		return RetryActionShouldExit
+	}
+	delay := err.Reason.RetryAfter
+	if delay == 0 {
+		delay = unauthedClient.options.ReconnectDelay
+	}
+	unauthedClient.logger.Printf("Reconnecting in %s\n", delay)
+	time.Sleep(delay)
+	return RetryActionShouldReconnect
+}
+
+// resync reconnects right away after the server's output got out of sync, so
+// its lines make sense again
+func (unauthedClient *UnauthenticatedClient) resync() RetryAction {
+	unauthedClient.logger.Println("Reconnecting to resync with the server")
+	return RetryActionShouldReconnect
+}
+
+// reconnect doesn't wait before reconnecting like when the server closes, since
+// a draining server only asks once the address is ready. Even if it isn't, the
+// connection is retried. A server shedding load says how long to wait instead.
+func (unauthedClient *UnauthenticatedClient) reconnect(request *ReconnectRequest) RetryAction {
+	if request.ordered {
+		unauthedClient.logger.Printf("Server is shedding load, reconnecting in %s\n",
+			request.Delay)
+		unauthedClient.reconnectTo = request.Addr
+		time.Sleep(request.Delay)
+		return RetryActionShouldReconnect
+	}
+	if request.Addr == "" {
+		unauthedClient.logger.Println("Server is restarting, reconnecting")
+	} else {
+		unauthedClient.logger.Printf("Server moved to %s, reconnecting\n", request.Addr)
+		unauthedClient.reconnectTo = request.Addr
+	}
+	return RetryActionShouldReconnect
+}
+
 func (client *Client) handleResponsesLoop(ctx context.Context) {
 	for {
 		select {
@@ -173,76 +676,171 @@ func (client *Client) handleResponsesLoop(ctx context.Context) {
 var ErrResponseForUnexpectedId = errors.New("got a response for an id we didn't send")
 
 func (client *Client) handleIncomingResponse(serverResponse ServerResponse) {
+	if !client.deliverResponse(serverResponse) {
+		if isPingID(serverResponse.Id) {
+			// a ping answered after it counted as missed
+			return
+		}
+		client.errLog.Printf("Response for an id we didn't expect",
+			"Response for an id we didn't expect: %s\n", serverResponse.Id)
+		client.errs.send(ErrResponseForUnexpectedId)
+	}
+}
+
+// deliverResponse returns false if no message is waiting for the response
+func (client *Client) deliverResponse(serverResponse ServerResponse) bool {
 	client.pendingResponsesLock.Lock()
 	defer client.pendingResponsesLock.Unlock()
 	respond, exists := client.pendingResponsesForMsgs[serverResponse.Id]
 	if !exists {
-		fmt.Printf("id we didn't expect: id = %s\n", string(serverResponse.Id))
-		client.errs <- ErrResponseForUnexpectedId
-		return
+		return false
 	}
 	respond <- serverResponse.Response
+	return true
 }
 
 var ErrUserHasQuit = errors.New("client has quit")
 
+// refusedAuth is an auth attempt the server refused, which the next prompt
+// follows up on, or a registration it had us log in to separately
+type refusedAuth struct {
+	creds    *UserCredentials
+	action   AuthAction
+	response Response
+}
+
 func authenticateWithRetry(client *UnauthenticatedClient) (*Client, error) {
+	var refused *refusedAuth
 	for {
-		creds, action, err := promptForAuthTypeAndUser(client.userInput, client.userOutput)
+		creds, action, err := client.promptForAuthTypeAndUser(refused)
+		if errors.Is(err, ErrEmptyUsernameOrPassword) {
+			fmt.Fprintln(client.userOutput, "Username and password can't be empty")
+			refused = nil
+			continue
+		} else if errors.Is(err, ErrPasswordsDontMatch) {
+			fmt.Fprintln(client.userOutput, "The passwords don't match")
+			refused = nil
+			continue
+		}
 		if err != nil {
-			if err == ErrClientHasQuit {
+			if errors.Is(err, ErrClientHasQuit) {
 				return nil, ErrUserHasQuit
 			}
 			return nil, err
 		}
 
 		client, err := client.authenticateWithServer(creds, action)
-		if err != ErrInvalidAuth {
+		var refusal *AuthRefusedError
+		if !errors.As(err, &refusal) {
 			return client, err
 		}
+		if refusal.Response == ResponseClientTooOld {
+			// no credentials get past it, only upgrading does
+			return nil, err
+		}
+		refused = &refusedAuth{creds, action, refusal.Response}
 	}
 }
 
 func errIsConnectionRefused(err error) bool {
-	if oerr, ok := err.(*net.OpError); ok {
-		if serr, ok := oerr.Err.(*os.SyscallError); ok && serr.Err == syscall.ECONNREFUSED {
-			return true
-		}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// TLSHandshakeTimeout bounds connecting over TLS, e.g to a server that doesn't
+// speak it and waits for a line instead
+const TLSHandshakeTimeout = time.Second * 10
+
+// Dialer connects to the server at addr. Refused connections are retried, as
+// long as the error says so like net's do.
+type Dialer interface {
+	Dial(addr string) (net.Conn, error)
+}
+
+// NetDialer dials with net, over TLS when TLS is set
+type NetDialer struct {
+	// Network is as for net.Dial, e.g "tcp4" or "unix"
+	Network string
+	TLS     *tls.Config
+}
+
+func (d NetDialer) Dial(addr string) (net.Conn, error) {
+	if d.TLS != nil {
+		dialer := &net.Dialer{Timeout: TLSHandshakeTimeout}
+		return tls.DialWithDialer(dialer, d.Network, addr, d.TLS)
 	}
-	return false
+	return net.Dial(d.Network, addr)
 }
-func connectToPortWithRetry(port string, out io.Writer) (net.Conn, error) {
-	for {
-		serverConn, err := net.Dial("tcp4", port)
 
+// connectToPortWithRetry only retries refused connections. Anything else, like
+// a failed TLS handshake, won't go away by retrying.
+func connectToPortWithRetry(port string, retries *retryReporter, delay time.Duration,
+	limit *reconnectLimit, dialer Dialer) (net.Conn, error) {
+	for {
+		serverConn, err := dialer.Dial(port)
 		if err != nil {
 			if errIsConnectionRefused(err) {
-				log.SetOutput(out)
-				log.Println("Connection refused, retrying in 5 seconds")
-				time.Sleep(5 * time.Second)
+				if err := limit.fail(); err != nil {
+					retries.gaveUp()
+					return nil, err
+				}
+				retries.failed("Connection refused", delay)
+				time.Sleep(delay)
 				continue
 			}
 			return nil, err
 		}
-
+		retries.connected()
 		return serverConn, nil
 	}
 }
 
+// receiveMsgsLoop shows the messages until the session ends, and then those
+// that came before it ended, e.g before the server answered our logout
 func (client *Client) receiveMsgsLoop(ctx context.Context) {
+	client.showHeldMsgs()
 	for {
 		select {
 		case msg, ok := <-client.receiveMsg:
 			if !ok {
 				return
 			}
-			fmt.Fprintln(client.userOutput, msg)
+			client.showMsg(msg)
 		case <-ctx.Done():
+			client.showReceivedMsgs()
 			return
 		}
 	}
 }
 
+// showReceivedMsgs shows the messages received so far, without waiting for
+// more
+func (client *Client) showReceivedMsgs() {
+	for {
+		select {
+		case msg, ok := <-client.receiveMsg:
+			if !ok {
+				return
+			}
+			client.showMsg(msg)
+		default:
+			return
+		}
+	}
+}
+
+func (client *Client) showMsg(msg string) {
+	if text, ok := ParseAnnouncement(MsgPrefix + msg); ok {
+		fmt.Fprintf(client.userOutput, "*** %s %s ***\n", AnnouncementTag, text)
+		return
+	}
+	if dm, ok := ParseDirectMsg(MsgPrefix + msg); ok {
+		client.dms.add(dm.Sender, true)
+		fmt.Fprintln(client.userOutput, client.renderDM(dm))
+		return
+	}
+	fmt.Fprintln(client.userOutput, client.localizeServerTime(msg))
+}
+
 func (client *Client) handleUserInputLoop(ctx context.Context) {
 	for {
 		select {
@@ -251,15 +849,19 @@ func (client *Client) handleUserInputLoop(ctx context.Context) {
 				return
 			}
 			if line.Err != nil {
-				if line.Err == io.EOF {
-					client.errs <- ErrUserHasQuit
+				if errors.Is(line.Err, io.EOF) {
+					client.errs.send(ErrUserHasQuit)
 					return
 				}
-				client.errs <- line.Err
+				client.errs.send(line.Err)
 				return
 			}
 			if IsCmd(line.Val) {
-				client.dispatchCmd(UnserializeStrToCmd(line.Val))
+				if loggedOut := client.dispatchCmd(UnserializeStrToCmd(line.Val)); loggedOut {
+					// what the user types next is for the next login, not
+					// messages for this session
+					return
+				}
 			} else {
 				client.sendMsgExpectAsyncResponse(line.Val)
 			}
@@ -271,41 +873,202 @@ func (client *Client) handleUserInputLoop(ctx context.Context) {
 
 const QuitCmd Cmd = "quit"
 
-func (client *Client) dispatchCmd(cmd Cmd) {
-	switch cmd {
+// quit logs out once the server answers, which it does after the last lines
+// it wrote for the session, so those are shown before we're logged out rather
+// than after. Older servers don't answer, so it's waited for as long as a
+// response is.
+func (client *Client) quit(cmd Cmd) {
+	id := client.ids.next()
+	answered := client.insertExpectedResponseId(id)
+	defer client.removeExpectedResponseId(id)
+	if err := client.sendMsgWithTimeout(id, cmd.Serialize()); err != nil {
+		client.errs.send(err)
+		return
+	}
+	select {
+	case <-answered:
+	case <-time.After(MsgSendTimeout):
+	}
+	client.relog <- struct{}{}
+}
+
+func (client *Client) dispatchCmd(cmd Cmd) (loggedOut bool) {
+	name, args := cmd.Split()
+	switch name {
 	case QuitCmd:
-		err := client.sendMsgWithTimeout("", cmd.Serialize())
-		if err != nil {
-			client.errs <- err
-		}
-		// no waiting for response
-		client.relog <- struct{}{}
+		client.quit(cmd)
+		return true
+	case TimeCmd:
+		client.syncClock()
+		return false
+	case LatencyCmd:
+		client.showLatency(args)
+		return false
+	case DirectMsgCmd:
+		client.sendDM(args)
+		return false
+	case ReplyCmd:
+		client.reply(args)
+		return false
+	case FilterCmd:
+		client.filter(args)
+		return false
 	default:
-		_, err := client.userOutput.Write([]byte("Unknown command"))
-		if err != nil {
-			client.errs <- err
-			return
+		// the rest of the commands are handled by the server
+		client.sendMsgExpectAsyncResponse(cmd.Serialize())
+		return false
+	}
+}
+
+// runOnLogin dispatches the OnLogin commands. Their responses come once the
+// response loop runs, and errors among them are shown like for typed commands.
+func (client *Client) runOnLogin() {
+	for _, line := range client.options.OnLogin {
+		if !IsCmd(line) {
+			fmt.Fprintf(client.userOutput, "Skipping on-login line %q: not a command\n", line)
+			continue
+		}
+		cmd := UnserializeStrToCmd(line)
+		if name, _ := cmd.Split(); name == QuitCmd {
+			// logging out would undo the login the script runs for
+			fmt.Fprintf(client.userOutput, "Skipping on-login line %q\n", line)
+			continue
+		}
+		client.dispatchCmd(cmd)
+	}
+}
+
+// ReadOnLoginFile reads OnLogin commands from a file, one per line, skipping
+// empty lines and lines starting with '#'
+func ReadOnLoginFile(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// syncClock asks for the server's time, to correct the times it sends by our
+// clock's offset from it
+func (client *Client) syncClock() {
+	id := client.ids.next()
+	ack := client.insertExpectedResponseId(id)
+	sent := time.Now()
+	err := client.sendMsgWithTimeout(id, TimeCmd.Serialize())
+	if err != nil {
+		client.errs.send(err)
+		return
+	}
+	go func() {
+		defer client.removeExpectedResponseId(id)
+		select {
+		case <-time.After(MsgAckTimeout):
+			client.logger.Printf("Time request %s wasn't answered", id)
+		case <-client.ended:
+		case response := <-ack:
+			serverTime, err := ParseServerTime(response)
+			if err != nil {
+				fmt.Fprintln(client.userOutput, response)
+				return
+			}
+			offset := ClockOffset(serverTime, sent, time.Now())
+			atomic.StoreInt64(&client.clockOffset, int64(offset))
+			fmt.Fprintf(client.userOutput, "Server time: %s (%s ahead of ours)\n",
+				serverTime.Local().Format("15:04:05"), offset.Round(time.Millisecond))
 		}
+	}()
+}
+
+// localizeServerTime shows the server time a history line starts with in our
+// time zone and clock
+func (client *Client) localizeServerTime(msg string) string {
+	if !strings.HasPrefix(msg, HistoryNoticePrefix) {
+		return msg
+	}
+	stamp, rest, _ := strings.Cut(strings.TrimPrefix(msg, HistoryNoticePrefix), " ")
+	serverTime, err := time.Parse(time.RFC3339, stamp)
+	if err != nil {
+		return msg
 	}
+	offset := time.Duration(atomic.LoadInt64(&client.clockOffset))
+	return HistoryNoticePrefix + serverTime.Add(-offset).Local().Format("15:04:05") + " " + rest
 }
 
 func (client *Client) sendMsgExpectAsyncResponse(msgContent string) {
-	id := getUniqueID()
+	id := client.ids.next()
+	if !IsCmd(msgContent) {
+		client.outbox.add(id, msgContent)
+	}
+	client.sendMsgWithIDExpectAsyncResponse(id, msgContent)
+}
 
+func (client *Client) sendMsgWithIDExpectAsyncResponse(id MsgID, msgContent string) {
 	ack := client.insertExpectedResponseId(id)
+	sent := time.Now()
 	err := client.sendMsgWithTimeout(id, msgContent)
 	if err != nil {
-		client.errs <- err
+		client.errs.send(err)
 		return
 	}
-	go client.expectResponseFromChanWithTimeout(id, ack, ResponseOk)
+	go client.expectResponseFromChanWithTimeout(id, ack, ResponseOk, sent, !IsCmd(msgContent))
 }
 
-var globalID int64 = 0
+// handleUnsent resends or discards the messages a previous session left in the
+// outbox, as the ResendOutbox option says. They keep their ids, so the server
+// can tell the ones it already got.
+func (client *Client) handleUnsent(unsent []outboxEntry) error {
+	resend := client.options.ResendOutbox == OutboxResendAll
+	if client.options.ResendOutbox == OutboxAsk {
+		plural := "s"
+		if len(unsent) == 1 {
+			plural = ""
+		}
+		fmt.Fprintf(client.userOutput,
+			"%d unsent message%s from your last session \u2014 send them now? [y/n]\n",
+			len(unsent), plural)
+		answer := <-client.userInput
+		if answer.Err != nil {
+			return answer.Err
+		}
+		resend = answer.Val == "y" || answer.Val == "yes"
+	}
+	for _, entry := range unsent {
+		if resend {
+			client.sendMsgWithIDExpectAsyncResponse(entry.id, entry.content)
+		} else {
+			client.outbox.remove(entry.id)
+		}
+	}
+	return nil
+}
 
-func getUniqueID() MsgID {
-	new_ := atomic.AddInt64(&globalID, 1)
-	return MsgID(strconv.FormatInt(new_, 10))
+// msgIDs numbers a client's messages after a random prefix of its own, so ids
+// stay unique across clients and restarts, which the server relies on to spot
+// resent messages. Clients in the same process, e.g in tests, or the same
+// user's clients one after the other, don't share a counter.
+type msgIDs struct {
+	prefix string
+	last   atomic.Int64
+}
+
+func newMsgIDs() *msgIDs {
+	var random [6]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		// the clock, which still differs across restarts
+		return &msgIDs{prefix: strconv.FormatInt(time.Now().UnixNano(), 36)}
+	}
+	return &msgIDs{prefix: hex.EncodeToString(random[:])}
+}
+
+func (ids *msgIDs) next() MsgID {
+	return MsgID(ids.prefix + "-" + strconv.FormatInt(ids.last.Add(1), 10))
 }
 
 func (client *Client) insertExpectedResponseId(id MsgID) <-chan Response {
@@ -314,71 +1077,164 @@ func (client *Client) insertExpectedResponseId(id MsgID) <-chan Response {
 	client.pendingResponsesLock.Lock()
 	defer client.pendingResponsesLock.Unlock()
 
+	if len(client.pendingResponsesForMsgs) == 0 {
+		*client.noPendingResponses = make(chan struct{})
+	}
 	client.pendingResponsesForMsgs[id] = ack
 	return ack
 }
 func (client *Client) removeExpectedResponseId(id MsgID) {
 	client.pendingResponsesLock.Lock()
 	defer client.pendingResponsesLock.Unlock()
+	if _, exists := client.pendingResponsesForMsgs[id]; !exists {
+		return
+	}
 	delete(client.pendingResponsesForMsgs, id)
+	if len(client.pendingResponsesForMsgs) == 0 {
+		close(*client.noPendingResponses)
+	}
 }
 
-func (client *Client) expectResponseFromChanWithTimeout(id MsgID, ack <-chan Response, expected Response) {
+// expectResponseFromChanWithTimeout waits for the response to the message id
+// sent at sent, recording how long it took if timed
+func (client *Client) expectResponseFromChanWithTimeout(id MsgID, ack <-chan Response,
+	expected Response, sent time.Time, timed bool) {
 	select {
 	case <-time.After(MsgAckTimeout):
-		log.Printf("Msg %s wasn't acked", id)
+		client.logger.Printf("Msg %s wasn't acked", id)
 		// skip err, i.e don't send it to client.errs
+		if timed {
+			client.latencies.add(latencySample{timedOut: true})
+		}
 	case response := <-ack:
+		latency := time.Since(sent)
+		client.outbox.remove(id)
+		if timed {
+			client.latencies.add(latencySample{latency: latency})
+		}
 		if response != expected {
-			fmt.Printf("Response was unexpectedly %s\n", response)
+			fmt.Fprintln(client.userOutput, response)
+		} else if timed && client.options.ShowAckLatency {
+			fmt.Fprintf(client.userOutput, "Delivered (%s)\n", roundLatency(latency))
 		}
+	case <-client.ended:
+		// the message stays in the outbox for the next session
 	}
 	client.removeExpectedResponseId(id)
 }
 
-func (client *Client) runCmd(cmd Cmd) {
-	switch cmd {
-	case LogoutCmd:
-		client.errs <- ErrServerLoggedUsOut
-	default:
-		log.Printf("Unknown command from server: %s", cmd)
-		// skip err, i.e don't send it to client.errs
+// parseReconnectOrder parses a ReconnectCmd line
+func parseReconnectOrder(str string) (ReconnectOrder, bool) {
+	if !IsCmd(str) {
+		return ReconnectOrder{}, false
 	}
+	name, args := UnserializeStrToCmd(str).Split()
+	if name != ReconnectCmd {
+		return ReconnectOrder{}, false
+	}
+	return ParseReconnectOrder(args)
 }
 
-var ErrInvalidCast = errors.New("couldn't cast")
+// finishSending waits for the responses to the messages sent so far, for as
+// long as they may take
+func (client *Client) finishSending() {
+	client.pendingResponsesLock.Lock()
+	finished := *client.noPendingResponses
+	client.pendingResponsesLock.Unlock()
+	select {
+	case <-finished:
+	case <-time.After(MsgSendTimeout):
+	}
+}
+
+// parseServerCmd returns the error a command line from the server ends the
+// session with, or nil if there's no such command
+func parseServerCmd(cmd Cmd) error {
+	name, args := cmd.Split()
+	if name != LogoutCmd {
+		return nil
+	}
+	if reason, ok := ParseLogoutReason(args); ok {
+		return &LoggedOutError{reason}
+	}
+	// older servers give no reason
+	return ErrServerLoggedUsOut
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
 
+// sendMsgWithTimeout only times out if the connection to the server supports
+// write deadlines, as net.Conn does
 func (client *Client) sendMsgWithTimeout(id MsgID, msg string) error {
-	conn, ok := client.serverInput.(net.Conn)
-	if !ok {
-		return ErrInvalidCast
+	conn, hasDeadline := client.serverInput.(writeDeadliner)
+	if hasDeadline {
+		err := conn.SetWriteDeadline(time.Now().Add(MsgSendTimeout))
+		if err != nil {
+			return err
+		}
 	}
-	err := conn.SetWriteDeadline(time.Now().Add(MsgSendTimeout))
+	line := client.options.Framing.Frame(MsgPrefix + string(id) + IdSeparator + msg)
+	_, err := client.serverInput.Write([]byte(line + "\n"))
 	if err != nil {
 		return err
 	}
-	_, err = conn.Write([]byte(MsgPrefix + string(id) + IdSeparator + msg + "\n"))
-	if err != nil {
-		return err
+	if hasDeadline {
+		err = conn.SetWriteDeadline(time.Time{})
 	}
-	err = conn.SetWriteDeadline(time.Time{})
 	return err
 }
 
 var ErrServerTimedOut = errors.New("server timed out")
 
-func promptForAuthTypeAndUser(userInput <-chan ReadInput, out io.Writer) (*UserCredentials, AuthAction, error) {
-	action, err := ChooseLoginOrRegister(userInput, out)
-	if err != nil {
-		return nil, action, err
+// promptForAuthTypeAndUser asks how to authenticate and as who. After
+// registering a taken name, it offers to log in with the same credentials
+// instead, rather than having them typed again. After registering on a server
+// that has us log in separately, it logs in as the name registered.
+func (unauthedClient *UnauthenticatedClient) promptForAuthTypeAndUser(refused *refusedAuth) (*UserCredentials, AuthAction, error) {
+	var action AuthAction
+	var err error
+	if refused != nil && refused.response == ResponseRegisteredPleaseLogin {
+		creds, err := unauthedClient.promptForPassword(refused.creds.Name)
+		return creds, ActionLogin, err
+	} else if refused != nil && refused.action == ActionRegister && refused.response == ResponseUsernameExists {
+		action, err = unauthedClient.chooseAfterNameTaken()
+		if err != nil || action == ActionLogin {
+			return refused.creds, action, err
+		}
+	} else if refused == nil && unauthedClient.options.AuthAction != ActionIOErr {
+		action = unauthedClient.options.AuthAction
+	} else {
+		action, err = unauthedClient.ChooseLoginOrRegister()
+		if err != nil {
+			return nil, action, err
+		}
 	}
 
-	creds, err := promptForUsernameAndPassword(userInput, out)
-	return creds, action, nil
+	creds, err := unauthedClient.promptForUsernameAndPassword(action)
+	return creds, action, err
 }
 
-var ErrInvalidAuth = errors.New("username exists and such")
+// ErrInvalidAuth is the server refusing an auth attempt, see AuthRefusedError
+var ErrInvalidAuth = errors.New("the server refused the credentials")
+
+// AuthRefusedError is the server refusing an auth attempt with Response, e.g
+// ResponseUsernameExists. It is ErrInvalidAuth.
+type AuthRefusedError struct {
+	Response Response
+}
 
+func (e *AuthRefusedError) Error() string {
+	return ErrInvalidAuth.Error() + ": " + string(e.Response)
+}
+
+func (e *AuthRefusedError) Is(target error) bool {
+	return target == ErrInvalidAuth
+}
+
+// authenticateWithServer returns an AuthRefusedError when the server refuses
+// creds
 func (unauthedClient *UnauthenticatedClient) authenticateWithServer(creds *UserCredentials, action AuthAction) (*Client, error) {
 	err, response := unauthedClient.authenticate(action, creds)
 	if err != nil {
@@ -386,17 +1242,34 @@ func (unauthedClient *UnauthenticatedClient) authenticateWithServer(creds *UserC
 	}
 	if response != ResponseOk {
 		fmt.Fprintln(unauthedClient.userOutput, response)
-		return nil, ErrInvalidAuth
+		return nil, &AuthRefusedError{response}
 	}
-	client := &Client{*unauthedClient, creds, make(chan struct{})}
+	// relog is buffered so signaling it can't block if we're done due to an error
+	client := &Client{UnauthenticatedClient: *unauthedClient, creds: creds,
+		relog: make(chan struct{}, 1)}
 	return client, nil
 }
 
-func ChooseLoginOrRegister(userInput <-chan ReadInput, out io.Writer) (AuthAction, error) {
+func (unauthedClient *UnauthenticatedClient) ChooseLoginOrRegister() (AuthAction, error) {
 	for {
-		fmt.Fprintln(out, "Type "+ActionRegister+" to register, "+ActionLogin+" to login")
+		answer := unauthedClient.ask(string("Type " + ActionRegister + " to register, " + ActionLogin + " to login"))
+		if answer.Err != nil {
+			return ActionIOErr, answer.Err
+		}
+		action := AuthAction(answer.Val)
+		switch action {
+		case ActionLogin, ActionRegister:
+			return action, nil
+		}
+	}
+}
 
-		answer := <-userInput
+// chooseAfterNameTaken asks whether to log in as the name that was just
+// found taken, ActionLogin, or to register another one, ActionRegister
+func (unauthedClient *UnauthenticatedClient) chooseAfterNameTaken() (AuthAction, error) {
+	for {
+		answer := unauthedClient.ask(string("That name is taken — press " + ActionLogin +
+			" to try logging in with the same credentials, or " + ActionRegister + " to pick a new name"))
 		if answer.Err != nil {
 			return ActionIOErr, answer.Err
 		}
@@ -410,10 +1283,13 @@ func ChooseLoginOrRegister(userInput <-chan ReadInput, out io.Writer) (AuthActio
 
 var ErrEmptyUsernameOrPassword = errors.New("empty username or password")
 
-func promptForUsernameAndPassword(userInput <-chan ReadInput, out io.Writer) (*UserCredentials, error) {
-	fmt.Fprintf(out, "Username:\n")
+// ErrPasswordsDontMatch is a new account's password confirmed as another
+var ErrPasswordsDontMatch = errors.New("the passwords don't match")
 
-	inputtedUsername := <-userInput
+// promptForUsernameAndPassword asks for the credentials to authenticate with,
+// the password twice for registering, so a typo doesn't become it
+func (unauthedClient *UnauthenticatedClient) promptForUsernameAndPassword(action AuthAction) (*UserCredentials, error) {
+	inputtedUsername := unauthedClient.ask("Username:")
 	if inputtedUsername.Err != nil {
 		return nil, inputtedUsername.Err
 	}
@@ -421,43 +1297,90 @@ func promptForUsernameAndPassword(userInput <-chan ReadInput, out io.Writer) (*U
 		return nil, ErrEmptyUsernameOrPassword
 	}
 
-	fmt.Fprintf(out, "Password:\n")
-	inputtedPassword := <-userInput
+	inputtedPassword := unauthedClient.ask("Password:")
 	if inputtedPassword.Err != nil {
 		return nil, inputtedPassword.Err
 	}
 	if inputtedPassword.Val == "" {
 		return nil, ErrEmptyUsernameOrPassword
 	}
+	if action == ActionRegister {
+		confirmed := unauthedClient.ask("Confirm password:")
+		if confirmed.Err != nil {
+			return nil, confirmed.Err
+		} else if confirmed.Val != inputtedPassword.Val {
+			return nil, ErrPasswordsDontMatch
+		}
+	}
 	return &UserCredentials{Name: Username(inputtedUsername.Val),
 		Password: Password(inputtedPassword.Val)}, nil
 }
 
+// promptForPassword asks for name's password, the name being known already
+func (unauthedClient *UnauthenticatedClient) promptForPassword(name Username) (*UserCredentials, error) {
+	inputtedPassword := unauthedClient.ask("Password for " + string(name) + ":")
+	if inputtedPassword.Err != nil {
+		return nil, inputtedPassword.Err
+	}
+	if inputtedPassword.Val == "" {
+		return nil, ErrEmptyUsernameOrPassword
+	}
+	return &UserCredentials{Name: name, Password: Password(inputtedPassword.Val)}, nil
+}
+
 func (unauthedClient *UnauthenticatedClient) authenticate(action AuthAction, creds *UserCredentials) (error, Response) {
 	_, err := unauthedClient.serverInput.Write([]byte(
 		string(action) + "\n" +
 			string(creds.Name) + "\n" +
 			string(creds.Password) + "\n"))
 	if err != nil {
-		return err, ResponseIoErrorOccurred
+		return unauthedClient.explainErr(err), ResponseIoErrorOccurred
 	}
 
-	var response Response
-	select {
-	case serverResponse := <-unauthedClient.receiveResponse:
-		response = serverResponse.Response
-	case err := <-unauthedClient.errs:
+	response, err := unauthedClient.receiveAuthResponse()
+	if err != nil {
 		return err, ResponseIoErrorOccurred
 	}
-	// ignore serverResponse.id since we didn't send an id (and there's only one msg
-	// the server could be responding to)
 
 	if response == ResponseOk ||
 		response == ResponseUserAlreadyOnline ||
 		response == ResponseUsernameExists ||
-		response == ResponseInvalidCredentials {
+		response == ResponseInvalidCredentials ||
+		response == ResponseRegistrationClosed ||
+		response == ResponseRegistrationFull ||
+		response == ResponseRegisteredPleaseLogin ||
+		response == ResponseClientTooOld {
 		return nil, response
 	}
-	log.Println(response)
-	return ErrOddOutput, ResponseUnknown
+	return &OddOutputError{Line: string(response)}, ResponseUnknown
+}
+
+// explainErr returns the error the server's output ended with if there's one,
+// e.g a RefusedError, which says more than err, a symptom of the same end
+func (unauthedClient *UnauthenticatedClient) explainErr(err error) error {
+	if reason := unauthedClient.errs.Err(); reason != nil {
+		return reason
+	}
+	return err
+}
+
+// receiveAuthResponse waits for the response to our auth attempt. Other
+// responses are late acks for messages sent before we logged out, and are kept
+// for after we log in. Message lines meanwhile wait in receiveMsg, which isn't
+// read until then, like the ones held while prompting.
+func (unauthedClient *UnauthenticatedClient) receiveAuthResponse() (Response, error) {
+	for {
+		select {
+		case serverResponse, ok := <-unauthedClient.receiveResponse:
+			if !ok {
+				return ResponseIoErrorOccurred, unauthedClient.explainErr(io.EOF)
+			}
+			if serverResponse.Id == AuthResponseID {
+				return serverResponse.Response, nil
+			}
+			unauthedClient.lateResponses = append(unauthedClient.lateResponses, serverResponse)
+		case <-unauthedClient.errs.Done():
+			return ResponseIoErrorOccurred, unauthedClient.errs.Err()
+		}
+	}
 }
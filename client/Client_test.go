@@ -0,0 +1,361 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	. "util"
+)
+
+func TestGivesUpReconnecting(t *testing.T) {
+	// a port nothing listens on, so connecting is refused
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	var out bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- RunClientWithOptions(addr, strings.NewReader(""), &out, ClientOptions{
+			MaxReconnects:  3,
+			ReconnectDelay: time.Millisecond,
+		})
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrTooManyReconnects) {
+			t.Fatalf("expected %v, got %v", ErrTooManyReconnects, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the client didn't give up")
+	}
+	// the first attempt and 3 retries, reported once they're over
+	if !strings.Contains(out.String(), "Gave up after 0s, 4 attempts") ||
+		strings.Count(out.String(), "Connection refused") != 1 {
+		t.Errorf("expected the retries reported once:\n%s", out.String())
+	}
+}
+
+// TestNamedClientLogs runs two clients in the process at once, whose log lines
+// are told apart by their names
+func TestNamedClientLogs(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	outs := map[string]*lockedBuffer{"alice-1": {}, "alice-2": {}}
+	var clients sync.WaitGroup
+	for name, out := range outs {
+		clients.Add(1)
+		go func(name string, out *lockedBuffer) {
+			defer clients.Done()
+			RunClientWithOptions(addr, strings.NewReader(""), out, ClientOptions{
+				MaxReconnects: 1, ReconnectDelay: time.Millisecond, Name: name})
+		}(name, out)
+	}
+	clients.Wait()
+	for name, out := range outs {
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		for _, line := range lines {
+			if !strings.HasPrefix(line, name+" ") {
+				t.Fatalf("expected %s's log lines to start with its name, got %q", name, lines)
+			}
+		}
+	}
+}
+
+func TestReconnectDelayHonored(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	userInput, typed := io.Pipe()
+	defer typed.Close()
+	shown, userOutput := io.Pipe()
+	defer shown.Close()
+	go RunClientWithOptions(listener.Addr().String(), userInput, userOutput,
+		ClientOptions{ReconnectDelay: delay})
+	loggedIn := make(chan struct{})
+	go func() {
+		output := bufio.NewScanner(shown)
+		for output.Scan() && output.Text() != "Logged in as alice" {
+		}
+		close(loggedIn)
+		io.Copy(io.Discard, shown)
+	}()
+	go typed.Write([]byte("l\nalice\n1234\n"))
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(conn)
+	// the capabilities line, then the auth's three lines
+	for i := 0; i < 4; i++ {
+		if !scanner.Scan() {
+			t.Fatalf("expected the client's line %d, got %v", i, scanner.Err())
+		}
+	}
+	if _, err := conn.Write([]byte("rauth;Ok\n")); err != nil {
+		t.Fatal(err)
+	}
+	// logged in before we close, so the client takes it as the server closing
+	<-loggedIn
+	conn.Close()
+	closed := time.Now()
+
+	conn, err = listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if waited := time.Since(closed); waited < delay || waited > delay+time.Second {
+		t.Fatalf("reconnected after %s, expected %s", waited, delay)
+	}
+}
+
+// TestSessionGoroutinesEnd ends a session with a message still waiting for its
+// ack, then types a line no session reads, and checks the session's
+// goroutines all end well before the ack would have timed out
+func TestSessionGoroutinesEnd(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	server, clientSide := net.Pipe()
+	userInput, typed := io.Pipe()
+	defer typed.Close()
+	go func() {
+		defer server.Close()
+		scanner := bufio.NewScanner(server)
+		// the capabilities line, then the auth's three lines
+		for i := 0; i < 4; i++ {
+			if !scanner.Scan() {
+				return
+			}
+		}
+		if _, err := server.Write([]byte("rauth;Ok\n")); err != nil {
+			return
+		}
+		// the message, which is never acked
+		scanner.Scan()
+	}()
+	go typed.Write([]byte("l\nalice\n1234\nhello\n"))
+
+	RunSession(clientSide, userInput, io.Discard, ClientOptions{ReconnectDelay: time.Millisecond})
+	clientSide.Close()
+	if _, err := typed.Write([]byte("late\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	var now int
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if now = runtime.NumGoroutine(); now <= baseline {
+			return
+		}
+	}
+	buf := make([]byte, 1<<20)
+	t.Fatalf("%d goroutines, up from %d:\n%s", now, baseline, buf[:runtime.Stack(buf, true)])
+}
+
+// TestErrorBurstEndsSession has the server answer thousands of messages we
+// never sent, each an error, and checks the first ends the session while the
+// rest neither block its goroutines nor flood the log
+func TestErrorBurstEndsSession(t *testing.T) {
+	const errCount = 5000
+	baseline := runtime.NumGoroutine()
+	server, clientSide := net.Pipe()
+	go func() {
+		defer server.Close()
+		scanner := bufio.NewScanner(server)
+		// the capabilities line, then the auth's three lines
+		for i := 0; i < 4; i++ {
+			if !scanner.Scan() {
+				return
+			}
+		}
+		if _, err := server.Write([]byte("rauth;Ok\n")); err != nil {
+			return
+		}
+		for i := 0; i < errCount; i++ {
+			if _, err := fmt.Fprintf(server, "r%d;Ok\n", 1000000+i); err != nil {
+				return
+			}
+		}
+		// open until the client hangs up, so its errors end the session rather
+		// than our closing
+		for scanner.Scan() {
+		}
+	}()
+	// left open, so it's the server's errors that end the session
+	userInput, typed := io.Pipe()
+	go typed.Write([]byte("l\nalice\n1234\n"))
+	var output lockedBuffer
+	ended := make(chan bool, 1)
+	go func() {
+		ended <- RunSession(clientSide, userInput, &output, ClientOptions{Debug: true})
+	}()
+	select {
+	case reconnect := <-ended:
+		if reconnect {
+			t.Fatal("expected the client to exit")
+		}
+	case <-time.After(5 * time.Second):
+		buf := make([]byte, 1<<20)
+		t.Fatalf("the session didn't end:\n%s", buf[:runtime.Stack(buf, true)])
+	}
+	clientSide.Close()
+	typed.Close()
+	if shown := output.String(); !strings.Contains(shown, ErrResponseForUnexpectedId.Error()) ||
+		strings.Count(shown, "Error after the connection's end") > 1 {
+		t.Fatalf("expected the first error logged and the rest throttled, got:\n%s", shown)
+	}
+
+	var now int
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if now = runtime.NumGoroutine(); now <= baseline {
+			return
+		}
+	}
+	buf := make([]byte, 1<<20)
+	t.Fatalf("%d goroutines, up from %d:\n%s", now, baseline, buf[:runtime.Stack(buf, true)])
+}
+
+// lockedBuffer lets the test read the output while the client is writing it
+type lockedBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// acceptLoggedIn accepts the client's connection and logs it in, whatever the
+// credentials
+func acceptLoggedIn(t *testing.T, listener net.Listener) net.Conn {
+	t.Helper()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(conn)
+	// the capabilities line, then the auth's three lines
+	for i := 0; i < 4; i++ {
+		if !scanner.Scan() {
+			t.Fatalf("expected the client's line %d, got %v", i, scanner.Err())
+		}
+	}
+	if _, err := conn.Write([]byte("rauth;Ok\n")); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestLogoutReasons(t *testing.T) {
+	for _, test := range []struct {
+		line string
+		// shown is what the user is told
+		shown     string
+		reconnect bool
+		// exitErr is whether the client exits with a LoggedOutError
+		exitErr bool
+	}{
+		{LogoutReason{Code: LogoutKicked, Text: "spamming"}.Cmd().Serialize(),
+			"Logged out by the server: kicked (spamming)", false, true},
+		{LogoutReason{Code: LogoutBanned, Text: "spamming again"}.Cmd().Serialize(),
+			"Logged out by the server: banned (spamming again)", false, true},
+		{LogoutReason{Code: LogoutShutdown, Text: "maintenance",
+			RetryAfter: 200 * time.Millisecond}.Cmd().Serialize(),
+			"Logged out by the server: shutdown (maintenance)", true, false},
+		// from older servers
+		{LogoutCmd.Serialize(), ErrServerLoggedUsOut.Error(), false, false},
+	} {
+		t.Run(test.line, func(t *testing.T) {
+			listener, err := net.Listen("tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			userInput, typed := io.Pipe()
+			defer typed.Close()
+			go typed.Write([]byte("l\nalice\n1234\n"))
+			var out lockedBuffer
+			done := make(chan error, 1)
+			go func() {
+				done <- RunClientWithOptions(listener.Addr().String(), userInput, &out,
+					ClientOptions{ReconnectDelay: time.Minute})
+			}()
+
+			conn := acceptLoggedIn(t, listener)
+			if _, err := conn.Write([]byte(test.line + "\n")); err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			loggedOut := time.Now()
+
+			if test.reconnect {
+				conn, err = listener.Accept()
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+				// RetryAfter rather than ReconnectDelay
+				if waited := time.Since(loggedOut); waited < 200*time.Millisecond ||
+					waited > 10*time.Second {
+					t.Fatalf("reconnected after %s, expected 200ms", waited)
+				}
+			} else {
+				select {
+				case err := <-done:
+					if _, isLoggedOut := err.(*LoggedOutError); isLoggedOut != test.exitErr {
+						t.Fatalf("unexpected exit error %v", err)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("the client didn't exit")
+				}
+			}
+			if !strings.Contains(out.String(), test.shown) {
+				t.Fatalf("expected the user to be told %q, got:\n%s", test.shown, out.String())
+			}
+		})
+	}
+}
+
+func TestAuthErrorsWrapped(t *testing.T) {
+	refused := fmt.Errorf("logging in: %w", &AuthRefusedError{ResponseUsernameExists})
+	var refusal *AuthRefusedError
+	if !errors.Is(refused, ErrInvalidAuth) || !errors.As(refused, &refusal) ||
+		refusal.Response != ResponseUsernameExists {
+		t.Errorf("expected the wrapped refusal to be %v, got %v", ErrInvalidAuth, refused)
+	}
+	odd := fmt.Errorf("logging in: %w", &OddOutputError{Line: "huh"})
+	if !errors.Is(odd, ErrOddOutput) || errors.Is(odd, ErrInvalidAuth) {
+		t.Errorf("expected the wrapped odd output to be %v only, got %v", ErrOddOutput, odd)
+	}
+	dropped := &net.OpError{Op: "dial", Err: fmt.Errorf("dialing: %w", syscall.ECONNREFUSED)}
+	if !errIsConnectionRefused(dropped) {
+		t.Errorf("expected %v to be a refused connection", dropped)
+	}
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	. "util"
+)
+
+type ConnectionQuality int
+
+const (
+	QualityGood ConnectionQuality = iota
+	QualityDegraded
+	QualityLost
+)
+
+func (q ConnectionQuality) String() string {
+	switch q {
+	case QualityGood:
+		return "good"
+	case QualityDegraded:
+		return "degraded"
+	default:
+		return "lost"
+	}
+}
+
+// QualityOptions configure the pings the client uses to tell how well its
+// connection is doing. Pinging is off unless PingInterval is set, the rest
+// have defaults.
+type QualityOptions struct {
+	PingInterval time.Duration
+	// SlowPing is the round trip above which a ping counts as slow
+	SlowPing time.Duration
+	// PingTimeout is how long until an unanswered ping counts as missed
+	PingTimeout time.Duration
+	// DegradedAfter slow or missed pings in a row degrade the connection
+	DegradedAfter int
+	// LostAfter missed pings in a row make the connection lost, and the client
+	// reconnects
+	LostAfter int
+}
+
+func (o QualityOptions) withDefaults() QualityOptions {
+	if o.SlowPing == 0 {
+		o.SlowPing = time.Second
+	}
+	if o.PingTimeout == 0 {
+		o.PingTimeout = time.Second * 5
+	}
+	if o.DegradedAfter == 0 {
+		o.DegradedAfter = 3
+	}
+	if o.LostAfter == 0 {
+		o.LostAfter = 3
+	}
+	return o
+}
+
+// qualityDetector turns a sequence of ping results into a ConnectionQuality
+type qualityDetector struct {
+	options QualityOptions
+	quality ConnectionQuality
+	// slowInARow counts missed pings too
+	slowInARow   int
+	missedInARow int
+}
+
+func newQualityDetector(options QualityOptions) *qualityDetector {
+	return &qualityDetector{options: options.withDefaults()}
+}
+
+// observe takes a ping's round trip, or missed if it wasn't answered. It
+// returns a line describing the new quality if it changed, and "" otherwise.
+func (d *qualityDetector) observe(rtt time.Duration, missed bool) (transition string) {
+	switch {
+	case missed:
+		d.slowInARow++
+		d.missedInARow++
+	case rtt > d.options.SlowPing:
+		d.slowInARow++
+		d.missedInARow = 0
+	default:
+		d.slowInARow = 0
+		d.missedInARow = 0
+	}
+
+	previous := d.quality
+	switch {
+	case d.missedInARow >= d.options.LostAfter:
+		d.quality = QualityLost
+	case d.slowInARow >= d.options.DegradedAfter:
+		d.quality = QualityDegraded
+	default:
+		d.quality = QualityGood
+	}
+	if d.quality == previous {
+		return ""
+	}
+	switch d.quality {
+	case QualityLost:
+		return fmt.Sprintf("connection lost: last %d pings unanswered", d.missedInARow)
+	case QualityDegraded:
+		return fmt.Sprintf("connection degraded: last %d pings >%s",
+			d.slowInARow, d.options.SlowPing)
+	default:
+		return "connection good again"
+	}
+}
+
+var ErrConnectionLost = errors.New("connection lost")
+
+// pingIDPrefix marks the ids of pings, so an answer that comes after the ping
+// was counted as missed isn't mistaken for a bogus response
+const pingIDPrefix = "ping"
+
+func isPingID(id MsgID) bool {
+	return strings.HasPrefix(string(id), pingIDPrefix)
+}
+
+// pingLoop pings the server every PingInterval, printing the connection's
+// quality when it changes. A lost connection is reported on errs so we
+// reconnect, rather than waiting for a write to fail.
+func (client *Client) pingLoop(ctx context.Context) {
+	options := client.options.Quality.withDefaults()
+	detector := newQualityDetector(options)
+	for {
+		sent := time.Now()
+		rtt, missed, err := client.ping(ctx, options.PingTimeout)
+		if err != nil {
+			client.errs.send(err)
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if transition := detector.observe(rtt, missed); transition != "" {
+			client.logger.Println(transition)
+			if detector.quality == QualityLost {
+				client.errs.send(ErrConnectionLost)
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(sent.Add(options.PingInterval))):
+		}
+	}
+}
+
+func (client *Client) ping(ctx context.Context, timeout time.Duration) (
+	rtt time.Duration, missed bool, err error) {
+	id := pingIDPrefix + client.ids.next()
+	ack := client.insertExpectedResponseId(id)
+	defer client.removeExpectedResponseId(id)
+
+	sent := time.Now()
+	err = client.sendMsgWithTimeout(id, PingCmd.Serialize())
+	if err != nil {
+		return 0, false, err
+	}
+	select {
+	case <-ack:
+		return time.Since(sent), false, nil
+	case <-time.After(timeout):
+		return 0, true, nil
+	case <-ctx.Done():
+		return 0, false, nil
+	}
+}
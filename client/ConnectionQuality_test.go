@@ -0,0 +1,40 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQualityDetector(t *testing.T) {
+	const missed = -1
+	fast, slow := 100*time.Millisecond, 2*time.Second
+	tests := []struct {
+		name string
+		rtts []time.Duration
+		// transitions has the line observe returns for each rtt
+		transitions []string
+	}{
+		{"fast", []time.Duration{fast, fast, fast}, []string{"", "", ""}},
+		{"slow", []time.Duration{slow, slow, slow, slow},
+			[]string{"", "", "connection degraded: last 3 pings >1s", ""}},
+		{"slow then fast", []time.Duration{slow, slow, fast, slow, slow},
+			[]string{"", "", "", "", ""}},
+		{"recovers", []time.Duration{slow, slow, slow, fast},
+			[]string{"", "", "connection degraded: last 3 pings >1s", "connection good again"}},
+		{"missed counts as slow", []time.Duration{slow, missed, slow},
+			[]string{"", "", "connection degraded: last 3 pings >1s"}},
+		{"lost", []time.Duration{missed, missed, missed},
+			[]string{"", "", "connection lost: last 3 pings unanswered"}},
+		{"slow resets missed", []time.Duration{missed, missed, slow, missed},
+			[]string{"", "", "connection degraded: last 3 pings >1s", ""}},
+	}
+	for _, test := range tests {
+		detector := newQualityDetector(QualityOptions{})
+		for i, rtt := range test.rtts {
+			got := detector.observe(rtt, rtt == missed)
+			if got != test.transitions[i] {
+				t.Errorf("%s: ping %d: expected %q, got %q", test.name, i, test.transitions[i], got)
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	. "util"
+)
+
+// ReplyCmd sends a DM to whoever last sent us one, "r CONTENT"
+const ReplyCmd Cmd = "r"
+
+// maxRecentDMNames is how many of the users we last DMed with are listed
+const maxRecentDMNames = 10
+
+// recentDMs are who we DMed with lately, as of this login
+type recentDMs struct {
+	lock sync.Mutex
+	// lastSender is who last sent us a DM, the one ReplyCmd replies to
+	lastSender Username
+	// names are the users we last DMed with, either way, most recent first
+	names []Username
+}
+
+func (r *recentDMs) add(name Username, received bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if received {
+		r.lastSender = name
+	}
+	names := []Username{name}
+	for _, other := range r.names {
+		if other != name && len(names) < maxRecentDMNames {
+			names = append(names, other)
+		}
+	}
+	r.names = names
+}
+
+func (r *recentDMs) replyTo() Username {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lastSender
+}
+
+func (r *recentDMs) recent() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	names := make([]string, len(r.names))
+	for i, name := range r.names {
+		names[i] = string(name)
+	}
+	return names
+}
+
+// renderDM shows a DM apart from the room's messages, e.g "[dm] bob: hey".
+// One that waited for us to log in shows when it was sent, on our clock.
+func (client *Client) renderDM(dm DirectMsg) string {
+	if dm.Sent.IsZero() {
+		return fmt.Sprintf("[dm] %s: %s", dm.Sender, dm.Content)
+	}
+	offset := time.Duration(atomic.LoadInt64(&client.clockOffset))
+	return fmt.Sprintf("[dm %s] %s: %s", dm.Sent.Add(-offset).Local().Format("15:04:05"),
+		dm.Sender, dm.Content)
+}
+
+// sendDM handles DirectMsgCmd. Without arguments it lists the users we DMed
+// with lately, to pick from.
+func (client *Client) sendDM(args string) {
+	to, content, _ := strings.Cut(args, " ")
+	if to == "" {
+		fmt.Fprintln(client.userOutput, "Recent DMs: "+strings.Join(client.dms.recent(), ", "))
+		return
+	}
+	if content != "" {
+		client.dms.add(Username(to), false)
+	}
+	client.sendMsgExpectAsyncResponse(DirectMsgCmd.Serialize() + " " + args)
+}
+
+func (client *Client) reply(content string) {
+	to := client.dms.replyTo()
+	if to == "" {
+		fmt.Fprintln(client.userOutput, "No DM to reply to")
+		return
+	}
+	client.sendDM(string(to) + " " + content)
+}
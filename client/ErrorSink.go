@@ -0,0 +1,60 @@
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+	. "util"
+)
+
+// errorSink gets the errors that end a connection, from whichever of its
+// goroutines runs into one. The first one wins and ends the connection, and
+// the rest, e.g the other goroutines noticing the same end, are only counted,
+// and logged with ClientOptions.Debug. Sending never blocks, however many
+// errors come.
+type errorSink struct {
+	once sync.Once
+	// err is the first error, set before done is closed
+	err  error
+	done chan struct{}
+	// dropped counts the errors after the first
+	dropped int64
+	// debug logs the errors after the first, nil to only count them
+	debug *LogThrottle
+}
+
+func newErrorSink(debug *LogThrottle) *errorSink {
+	return &errorSink{done: make(chan struct{}), debug: debug}
+}
+
+// send ends the connection with err, unless an error ended it already
+func (sink *errorSink) send(err error) {
+	first := false
+	sink.once.Do(func() {
+		sink.err = err
+		close(sink.done)
+		first = true
+	})
+	if first {
+		return
+	}
+	dropped := atomic.AddInt64(&sink.dropped, 1)
+	if sink.debug != nil {
+		sink.debug.Printf("Error after the connection's end",
+			"Error after the connection's end (%d so far): %s\n", dropped, err)
+	}
+}
+
+// Done is closed once an error is sent
+func (sink *errorSink) Done() <-chan struct{} {
+	return sink.done
+}
+
+// Err is the error that ended the connection, nil while none did
+func (sink *errorSink) Err() error {
+	select {
+	case <-sink.done:
+		return sink.err
+	default:
+		return nil
+	}
+}
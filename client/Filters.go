@@ -0,0 +1,164 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	. "util"
+)
+
+// FilterCmd hides or shows a kind of line from the server, "filter joins off"
+// or "filter system on". "filter show" lists the filters.
+const FilterCmd Cmd = "filter"
+
+// LineKind is a kind of line from the server that can be hidden. The lines of
+// no kind, like messages, answers to our commands and being kicked, always
+// show.
+type LineKind string
+
+const (
+	// LineJoins are users joining and leaving, see PresenceEvent
+	LineJoins LineKind = "joins"
+	// LineSystem are the server's notices to everyone, e.g reaction tallies,
+	// see RoomNoticePrefix
+	LineSystem LineKind = "system"
+)
+
+// lineKinds are all the kinds, in the order they're listed
+var lineKinds = []LineKind{LineJoins, LineSystem}
+
+// Filters are the chain the lines from the server go through before they're
+// shown, one filter per kind hiding its lines or not, all showing by default.
+// They're shared by the sessions with every server, and safe for concurrent
+// use.
+type Filters struct {
+	lock   sync.Mutex
+	hidden map[LineKind]bool
+	// set are the filters changed with Set or loaded, the ones saved
+	set map[LineKind]bool
+	// path, when set, is the file the filters are saved to
+	path string
+}
+
+func NewFilters() *Filters {
+	return &Filters{hidden: make(map[LineKind]bool), set: make(map[LineKind]bool)}
+}
+
+// LoadFilters reads the filters saved at path, all showing if there's no file
+// yet. Changes made with Set are saved there.
+func LoadFilters(path string) (*Filters, error) {
+	filters := NewFilters()
+	filters.path = path
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return filters, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		kind, shown, ok := parseFilter(line)
+		if !ok {
+			return nil, fmt.Errorf("%s: bad filter %q", path, line)
+		}
+		filters.hidden[kind] = !shown
+		filters.set[kind] = shown
+	}
+	return filters, nil
+}
+
+// parseFilter parses "KIND on" or "KIND off"
+func parseFilter(s string) (kind LineKind, shown bool, ok bool) {
+	kindArg, state, _ := strings.Cut(strings.TrimSpace(s), " ")
+	kind = LineKind(kindArg)
+	if !kind.isValid() || (state != "on" && state != "off") {
+		return "", false, false
+	}
+	return kind, state == "on", true
+}
+
+func (kind LineKind) isValid() bool {
+	for _, known := range lineKinds {
+		if kind == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Shows tells whether lines of kind go through the chain
+func (f *Filters) Shows(kind LineKind) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return !f.hidden[kind]
+}
+
+// Hide hides kind without saving it, e.g for a command line flag
+func (f *Filters) Hide(kind LineKind) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.hidden[kind] = true
+}
+
+// Set shows or hides kind, saving the filters if they have a file
+func (f *Filters) Set(kind LineKind, shown bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.hidden[kind] = !shown
+	f.set[kind] = shown
+	if f.path == "" {
+		return nil
+	}
+	var content strings.Builder
+	for _, kind := range lineKinds {
+		if shown, isSet := f.set[kind]; isSet {
+			fmt.Fprintln(&content, kind, onOff(shown))
+		}
+	}
+	return os.WriteFile(f.path, []byte(content.String()), 0600)
+}
+
+// String lists the filters, e.g "joins off, system on"
+func (f *Filters) String() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	listed := make([]string, len(lineKinds))
+	for i, kind := range lineKinds {
+		listed[i] = string(kind) + " " + onOff(!f.hidden[kind])
+	}
+	return strings.Join(listed, ", ")
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// filter runs FilterCmd
+func (client *Client) filter(args string) {
+	runFilterCmd(client.options.Filters, args, client.userOutput, client.logger)
+}
+
+// runFilterCmd runs FilterCmd on filters, also while there's no client to
+// run it, see typeAhead
+func runFilterCmd(filters *Filters, args string, out io.Writer, logger *log.Logger) {
+	if args != "show" {
+		kind, shown, ok := parseFilter(args)
+		if !ok {
+			fmt.Fprintf(out, "Usage: /%s show, or /%s joins|system on|off\n",
+				FilterCmd, FilterCmd)
+			return
+		}
+		if err := filters.Set(kind, shown); err != nil {
+			logger.Printf("Couldn't save the filters: %s\n", err)
+		}
+	}
+	fmt.Fprintf(out, "Filters: %s\n", filters)
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestFilterChain feeds the same lines through each filter configuration, and
+// checks which are shown
+func TestFilterChain(t *testing.T) {
+	stream := strings.Join([]string{
+		"malice: hi",
+		"p+bob",
+		"nReactions to #1 (alice: hi): 👍 1",
+		"r1;Ok",
+		"mOnline: alice, bob",
+		"p-bob",
+		"/quit kicked:spamming",
+	}, "\n") + "\n"
+	for _, test := range []struct {
+		hidden []LineKind
+		shown  []string
+	}{
+		{nil, []string{"alice: hi", "* bob joined", "Reactions to #1 (alice: hi): 👍 1",
+			"Online: alice, bob", "* bob left"}},
+		{[]LineKind{LineJoins}, []string{"alice: hi", "Reactions to #1 (alice: hi): 👍 1",
+			"Online: alice, bob"}},
+		{[]LineKind{LineSystem}, []string{"alice: hi", "* bob joined", "Online: alice, bob",
+			"* bob left"}},
+		{[]LineKind{LineJoins, LineSystem}, []string{"alice: hi", "Online: alice, bob"}},
+	} {
+		filters := NewFilters()
+		for _, kind := range test.hidden {
+			filters.Hide(kind)
+		}
+		errs := newErrorSink(nil)
+		responses, msgs := splitServerOutputAsync(strings.NewReader(stream), errs,
+			log.New(io.Discard, "", 0), 10, filters, Hooks{}.withDefaults().Response)
+		var shown []string
+		for msg := range msgs {
+			shown = append(shown, msg)
+		}
+		if !reflect.DeepEqual(shown, test.shown) {
+			t.Errorf("with %v hidden, expected %q shown, got %q", test.hidden, test.shown, shown)
+		}
+		if response := <-responses; response.Id != "1" {
+			t.Errorf("expected the response through, got %+v", response)
+		}
+		if _, ok := errs.Err().(*LoggedOutError); !ok {
+			t.Errorf("expected the kick through")
+		}
+	}
+}
+
+func TestFiltersSaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters")
+	filters, err := LoadFilters(path)
+	if err != nil || filters.String() != "joins on, system on" {
+		t.Fatalf("expected all the filters on without a file, got %q, %v", filters, err)
+	}
+	// hidden for this run, but not saved
+	filters.Hide(LineJoins)
+	if err := filters.Set(LineSystem, false); err != nil {
+		t.Fatal(err)
+	}
+	if filters.String() != "joins off, system off" {
+		t.Fatalf("expected both off, got %q", filters)
+	}
+
+	filters, err = LoadFilters(path)
+	if err != nil || filters.String() != "joins on, system off" {
+		t.Fatalf("expected only the set filter saved, got %q, %v", filters, err)
+	}
+	os.WriteFile(path, []byte("joins maybe\n"), 0600)
+	if _, err := LoadFilters(path); err == nil {
+		t.Fatal("expected a bad filter file to fail loading")
+	}
+}
@@ -0,0 +1,43 @@
+package client
+
+import . "util"
+
+// Hooks let a program embedding the client follow its sessions, e.g to update
+// its UI. Each is called from the client's goroutines, in the order the events
+// happen with each server, and must not block for long. Unset ones do
+// nothing.
+type Hooks struct {
+	// Connected is called once connected to the server at addr, including
+	// after reconnecting
+	Connected func(addr string)
+	// Disconnected is called once the connection to addr is closed. err is
+	// what failed the client, nil if it's reconnecting or the user quit.
+	Disconnected func(addr string, err error)
+	// LoggedIn is called once logged in as name
+	LoggedIn func(name Username)
+	// LoggedOut is called once name's login is over, whatever ended it
+	LoggedOut func(name Username)
+	// Response is called with each response the server sends, as it's read,
+	// e.g the one to logging in, whose Id is AuthResponseID, or a message's
+	// ack. The client's pings' aren't passed on.
+	Response func(response ServerResponse)
+}
+
+func (h Hooks) withDefaults() Hooks {
+	if h.Connected == nil {
+		h.Connected = func(string) {}
+	}
+	if h.Disconnected == nil {
+		h.Disconnected = func(string, error) {}
+	}
+	if h.LoggedIn == nil {
+		h.LoggedIn = func(Username) {}
+	}
+	if h.LoggedOut == nil {
+		h.LoggedOut = func(Username) {}
+	}
+	if h.Response == nil {
+		h.Response = func(ServerResponse) {}
+	}
+	return h
+}
@@ -0,0 +1,236 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	. "util"
+)
+
+// commands the client handles itself, for juggling servers
+const (
+	ConnectCmd Cmd = "connect"
+	SwitchCmd  Cmd = "switch"
+)
+
+var ErrServerNameTaken = errors.New("there's already a server by that name")
+var ErrNoSuchServer = errors.New("no server by that name")
+
+// MultiClient runs the client with several servers at once. Each server has its
+// own credentials, pending acks and reconnect loop. What the user types goes to
+// the active server, and once there's more than one, the lines each server
+// shows are tagged with its name.
+type MultiClient struct {
+	userInput <-chan ReadInput
+	out       io.Writer
+	options   ClientOptions
+
+	// lock guards the fields below
+	lock    sync.Mutex
+	servers map[string]*serverSession
+	active  *serverSession
+
+	// outLock keeps the servers' lines whole when they interleave
+	outLock sync.Mutex
+	ended   chan serverEnd
+}
+
+type serverSession struct {
+	name  string
+	input chan ReadInput
+}
+
+type serverEnd struct {
+	server *serverSession
+	err    error
+}
+
+func NewMultiClient(in io.Reader, out io.Writer, options ClientOptions) *MultiClient {
+	return &MultiClient{
+		userInput: ReadAsyncIntoChan(bufio.NewScanner(in)),
+		out:       out,
+		options:   options.withDefaults(),
+		servers:   make(map[string]*serverSession),
+		ended:     make(chan serverEnd),
+	}
+}
+
+// Connect starts running the client with the server at addr, under name. The
+// new server becomes the active one.
+func (mc *MultiClient) Connect(name, addr string) error {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	if _, exists := mc.servers[name]; exists || name == "" {
+		return ErrServerNameTaken
+	}
+	server := &serverSession{name, make(chan ReadInput, 128)}
+	mc.servers[name] = server
+	mc.active = server
+
+	options := mc.options
+	if options.OutboxPath != "" {
+		// named by address, so each server's unsent messages go back to it
+		// whatever order the servers are connected in
+		options.OutboxPath += "-" + outboxSuffix(addr)
+	}
+	go func() {
+		err := runReconnecting(addr, server.input, &taggedWriter{mc: mc, name: name}, options)
+		mc.ended <- serverEnd{server, err}
+	}()
+	return nil
+}
+
+// outboxSuffix makes addr fit in a file name
+func outboxSuffix(addr string) string {
+	return strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' ||
+			r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, addr)
+}
+
+// Switch makes typed lines go to the server by the given name
+func (mc *MultiClient) Switch(name string) error {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	server, exists := mc.servers[name]
+	if !exists {
+		return ErrNoSuchServer
+	}
+	mc.active = server
+	return nil
+}
+
+// Run routes what the user types until every server is done, i.e the user
+// quit or they can't be reached. It returns the first error a server ended
+// with.
+func (mc *MultiClient) Run() error {
+	var firstErr error
+	for {
+		select {
+		case line := <-mc.userInput:
+			if line.Err != nil {
+				// every server sees the end of input, and quits
+				mc.lock.Lock()
+				for _, server := range mc.servers {
+					server.input <- line
+				}
+				mc.lock.Unlock()
+				continue
+			}
+			if mc.runLocalCmd(line.Val) {
+				continue
+			}
+			mc.lock.Lock()
+			active := mc.active
+			mc.lock.Unlock()
+			if active == nil {
+				mc.println("Not connected, use " + ConnectCmd.Serialize() + " NAME HOST:PORT")
+				continue
+			}
+			active.input <- line
+		case end := <-mc.ended:
+			if end.err != nil && firstErr == nil {
+				firstErr = end.err
+			}
+			if mc.removeServer(end.server) == 0 {
+				return firstErr
+			}
+		}
+	}
+}
+
+// removeServer returns how many servers are left. If the active one is
+// removed, the first of the rest by name becomes active.
+func (mc *MultiClient) removeServer(server *serverSession) (left int) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	delete(mc.servers, server.name)
+	if mc.active == server {
+		mc.active = nil
+		names := make([]string, 0, len(mc.servers))
+		for name := range mc.servers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) != 0 {
+			mc.active = mc.servers[names[0]]
+		}
+	}
+	return len(mc.servers)
+}
+
+func (mc *MultiClient) serverCount() int {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return len(mc.servers)
+}
+
+// runLocalCmd runs line if it's one of the commands for juggling servers
+func (mc *MultiClient) runLocalCmd(line string) (handled bool) {
+	if !IsCmd(line) {
+		return false
+	}
+	name, args := UnserializeStrToCmd(line).Split()
+	switch name {
+	case ConnectCmd:
+		serverName, addr, ok := strings.Cut(args, " ")
+		if !ok {
+			mc.println("Usage: " + ConnectCmd.Serialize() + " NAME HOST:PORT")
+			return true
+		}
+		if err := mc.Connect(serverName, addr); err != nil {
+			mc.println(err.Error())
+		}
+	case SwitchCmd:
+		if err := mc.Switch(args); err != nil {
+			mc.println(err.Error())
+			return true
+		}
+		mc.println("Switched to " + args)
+	default:
+		return false
+	}
+	return true
+}
+
+func (mc *MultiClient) println(line string) {
+	mc.outLock.Lock()
+	defer mc.outLock.Unlock()
+	fmt.Fprintln(mc.out, line)
+}
+
+// taggedWriter prefixes the lines a server shows with its name, once there's
+// more than one server
+type taggedWriter struct {
+	mc      *MultiClient
+	name    string
+	partial []byte
+}
+
+func (w *taggedWriter) Write(b []byte) (int, error) {
+	tagged := w.mc.serverCount() > 1
+	w.mc.outLock.Lock()
+	defer w.mc.outLock.Unlock()
+	w.partial = append(w.partial, b...)
+	for {
+		i := strings.IndexByte(string(w.partial), '\n')
+		if i == -1 {
+			return len(b), nil
+		}
+		line := w.partial[:i+1]
+		if tagged && len(line) > 1 {
+			line = append([]byte("["+w.name+"] "), line...)
+		}
+		w.partial = w.partial[i+1:]
+		if _, err := w.mc.out.Write(line); err != nil {
+			return len(b), err
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	. "util"
+)
+
+// TestDesyncedServerOutput has the server send garbage once the client logs in,
+// which the client shows, until there's too much of it and it reconnects
+func TestDesyncedServerOutput(t *testing.T) {
+	server, clientSide := net.Pipe()
+	defer server.Close()
+	userInput, typed := io.Pipe()
+	defer typed.Close()
+	shown, userOutput := io.Pipe()
+	defer shown.Close()
+	shouldReconnect := make(chan bool, 1)
+	go func() {
+		shouldReconnect <- RunSession(clientSide, userInput, userOutput,
+			ClientOptions{MaxOddLines: 2})
+	}()
+	output := ReadAsyncIntoChan(bufio.NewScanner(shown))
+	serverLines := ReadAsyncIntoChan(bufio.NewScanner(server))
+	// the capabilities line
+	<-serverLines
+
+	expectShown := func(expected string) {
+		t.Helper()
+		select {
+		case line := <-output:
+			if line.Err != nil || !strings.HasSuffix(line.Val, expected) {
+				t.Fatalf("expected %q to be shown, got %q, %v", expected, line.Val, line.Err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+	expectShown("Type r to register, l to login")
+	go typed.Write([]byte("l\nalice\n1234\n"))
+	expectShown("Username:")
+	expectShown("Password:")
+	for i := 0; i < 3; i++ {
+		<-serverLines
+	}
+	_, err := server.Write([]byte(ServerResponsePrefix + string(AuthResponseID) + IdSeparator +
+		string(ResponseOk) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectShown("Logged in as alice")
+	expectShown("")
+	// the rest of a line cut in two, and the start of the next. The pipe
+	// doesn't buffer, so the lines are sent while we read what's shown.
+	go server.Write([]byte("b: hello\n" + MsgPrefix + "bob: in sync again\nllo\n\x00\x01\n"))
+
+	// messages are shown apart from the log, so only the log's order is known
+	var shownLines []string
+	resynced := func() bool {
+		return len(shownLines) != 0 &&
+			strings.HasSuffix(shownLines[len(shownLines)-1], "resync with the server")
+	}
+	for !resynced() {
+		select {
+		case line := <-output:
+			if line.Err != nil {
+				t.Fatalf("expected the client to resync, got %q, %v", shownLines, line.Err)
+			}
+			shownLines = append(shownLines, line.Val)
+		case <-time.After(time.Second):
+			t.Fatalf("expected the client to resync, got %q", shownLines)
+		}
+	}
+	expected := []string{"odd output from server: b: hello", "odd output from server: llo",
+		"odd output from server: \x00\x01",
+		"3 odd lines from server, its output is likely out of sync",
+		"Reconnecting to resync with the server"}
+	sawMsg := false
+	for _, line := range shownLines {
+		if line == "bob: in sync again" {
+			// lines that make sense still get through
+			sawMsg = true
+		} else if len(expected) != 0 && strings.HasSuffix(line, expected[0]) {
+			expected = expected[1:]
+		}
+	}
+	if !sawMsg || len(expected) != 0 {
+		t.Fatalf("expected the message and %q, got %q", expected, shownLines)
+	}
+	select {
+	case reconnect := <-shouldReconnect:
+		if !reconnect {
+			t.Fatal("expected the client to reconnect")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the session didn't end")
+	}
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	. "util"
+)
+
+// OutboxResend decides what happens to messages a previous session left
+// unacked in the outbox
+type OutboxResend int
+
+const (
+	// OutboxResendAll is the default since it's safe: the server spots the ids
+	// it already got
+	OutboxResendAll OutboxResend = iota
+	// OutboxAsk asks the user after logging in, which takes their next line
+	// as the answer, so it's for interactive clients only
+	OutboxAsk
+	OutboxDiscard
+)
+
+type outboxEntry struct {
+	id      MsgID
+	content string
+}
+
+// outbox keeps the messages that weren't acked yet in a file, so they survive
+// the client crashing or the machine rebooting. The file has a line per
+// message, the id and content separated like in a message line.
+type outbox struct {
+	path    string
+	logger  *log.Logger
+	lock    sync.Mutex
+	entries []outboxEntry
+}
+
+// loadOutbox reads the messages left in the outbox at path, or returns nil if
+// path is empty. A corrupt file isn't an error, its bad lines are skipped, and
+// an unreadable one is logged and taken as empty.
+func loadOutbox(path string, logger *log.Logger) *outbox {
+	if path == "" {
+		return nil
+	}
+	box := &outbox{path: path, logger: logger}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return box
+	} else if err != nil {
+		logger.Printf("Can't read the outbox: %s\n", err)
+		return box
+	}
+	defer ClosePrintErr(f)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		id, content, ok := strings.Cut(scanner.Text(), IdSeparator)
+		if !ok || !MsgID(id).IsValid() {
+			logger.Printf("Skipping a corrupt outbox entry: %q\n", scanner.Text())
+			continue
+		}
+		box.entries = append(box.entries, outboxEntry{MsgID(id), content})
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Printf("Can't read all of the outbox: %s\n", err)
+	}
+	return box
+}
+
+// unsent returns the messages still waiting for an ack, e.g from a session
+// that crashed or lost its connection
+func (box *outbox) unsent() []outboxEntry {
+	if box == nil {
+		return nil
+	}
+	box.lock.Lock()
+	defer box.lock.Unlock()
+	return append([]outboxEntry(nil), box.entries...)
+}
+
+// add and remove do nothing on a nil outbox, i.e when it's disabled
+func (box *outbox) add(id MsgID, content string) {
+	if box == nil {
+		return
+	}
+	box.lock.Lock()
+	defer box.lock.Unlock()
+	box.entries = append(box.entries, outboxEntry{id, content})
+	box.save()
+}
+
+func (box *outbox) remove(id MsgID) {
+	if box == nil {
+		return
+	}
+	box.lock.Lock()
+	defer box.lock.Unlock()
+	for i, entry := range box.entries {
+		if entry.id == id {
+			box.entries = append(box.entries[:i], box.entries[i+1:]...)
+			box.save()
+			return
+		}
+	}
+}
+
+// save writes the entries to a temporary file first, so a crash midway leaves
+// the previous outbox intact. Should be called with lock held.
+func (box *outbox) save() {
+	var content strings.Builder
+	for _, entry := range box.entries {
+		content.WriteString(string(entry.id) + IdSeparator + entry.content + "\n")
+	}
+	err := os.MkdirAll(filepath.Dir(box.path), 0700)
+	if err == nil {
+		err = os.WriteFile(box.path+".tmp", []byte(content.String()), 0600)
+	}
+	if err == nil {
+		err = os.Rename(box.path+".tmp", box.path)
+	}
+	if err != nil {
+		box.logger.Printf("Can't save the outbox: %s\n", err)
+	}
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testsupport"
+	"time"
+)
+
+// loginSteps are a session's steps up to logging in as alice
+const loginSteps = `
+C: cpresence,queue,reconnect,roomnotices,version={*}
+O: Type r to register, l to login
+U: l
+O: Username:
+U: alice
+O: Password:
+U: 1234
+C: l
+C: alice
+C: 1234
+S: rauth;Ok
+O: Logged in as alice
+O:
+`
+
+// replayOnce replays the session's lines against a new client, which is left
+// running afterwards like a crashed one
+func replayOnce(lines string, options ClientOptions, t *testing.T) {
+	t.Helper()
+	session, err := testsupport.ParseSession(t.Name(), strings.NewReader(lines))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSide, clientSide := net.Pipe()
+	t.Cleanup(func() { serverSide.Close() })
+	userInput, typed := io.Pipe()
+	shown, userOutput := io.Pipe()
+	t.Cleanup(func() { shown.Close() })
+	go RunSession(clientSide, userInput, userOutput, options)
+	if err := session.ReplayAgainstClient(serverSide, typed, shown); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitForFileContent(path, expected string, t *testing.T) {
+	t.Helper()
+	var content []byte
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		content, _ = os.ReadFile(path)
+		if string(content) == expected {
+			return
+		}
+	}
+	t.Fatalf("expected %s to hold %q, got %q", path, expected, content)
+}
+
+// TestOutboxSurvivesCrash has a client crash with messages unacked, and a new
+// client on the same outbox offer to resend them. The resend itself is covered
+// by the outbox_resend session.
+func TestOutboxSurvivesCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	options := ClientOptions{OutboxPath: path, ResendOutbox: OutboxAsk}
+
+	replayOnce(loginSteps+`
+U: acked
+C: m{acked};acked
+U: hello
+C: m{hello};hello
+U: /who
+C: m{who};/who
+U: world
+C: m{world};world
+S: r{acked};Ok
+`, options, t)
+	// commands aren't kept, they'd make little sense later
+	content := waitForOutboxEntries(path, []string{"hello", "world"}, t)
+
+	// the same ids, so the server can tell if it already got them
+	entries := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	replayOnce(loginSteps+`
+O: 2 unsent messages from your last session — send them now? [y/n]
+U: y
+C: m`+entries[0]+`
+C: m`+entries[1]+`
+S: r`+strings.Split(entries[0], ";")[0]+`;Ok
+S: r`+strings.Split(entries[1], ";")[0]+`;Ok
+`, options, t)
+	waitForFileContent(path, "", t)
+}
+
+// waitForOutboxEntries waits for the outbox to hold exactly the given contents,
+// and returns it
+func waitForOutboxEntries(path string, contents []string, t *testing.T) string {
+	t.Helper()
+	var content string
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		data, _ := os.ReadFile(path)
+		content = string(data)
+		lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+		if len(lines) != len(contents) {
+			continue
+		}
+		matches := true
+		for i, line := range lines {
+			matches = matches && strings.HasSuffix(line, ";"+contents[i])
+		}
+		if matches {
+			return content
+		}
+	}
+	t.Fatalf("expected %s to hold %q, got %q", path, contents, content)
+	return ""
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"io"
+	"sync"
+	. "util"
+)
+
+// promptOutput is the user's output, which shows the pending prompt again
+// after anything written while the user is answering it, e.g a late ack from
+// the last login, so the prompt is always the last thing shown
+type promptOutput struct {
+	lock sync.Mutex
+	out  io.Writer
+	// prompt is "" when there's none pending
+	prompt string
+}
+
+func (o *promptOutput) Write(p []byte) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	n, err := o.out.Write(p)
+	if err == nil && o.prompt != "" {
+		_, err = io.WriteString(o.out, o.prompt)
+	}
+	return n, err
+}
+
+func (o *promptOutput) show(prompt string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.prompt = prompt
+	io.WriteString(o.out, prompt)
+}
+
+func (o *promptOutput) answered() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.prompt = ""
+}
+
+// ask shows prompt, a whole line, and waits for the user's answer. Messages
+// from the server meanwhile are held rather than shown over the prompt, and
+// shown once we're logged in, see showHeldMsgs.
+func (unauthedClient *UnauthenticatedClient) ask(prompt string) ReadInput {
+	unauthedClient.prompts.show(prompt + "\n")
+	defer unauthedClient.prompts.answered()
+	msgs := unauthedClient.receiveMsg
+	for {
+		select {
+		case answer := <-unauthedClient.userInput:
+			return answer
+		case msg, ok := <-msgs:
+			if !ok {
+				// the server is gone, which the auth attempt finds out
+				msgs = nil
+				continue
+			}
+			unauthedClient.heldMsgs = append(unauthedClient.heldMsgs, msg)
+		}
+	}
+}
+
+// showHeldMsgs shows the messages that came while the user was answering
+// prompts, in the order they came, before any that came since
+func (client *Client) showHeldMsgs() {
+	for _, msg := range client.heldMsgs {
+		client.showMsg(msg)
+	}
+	client.heldMsgs = nil
+}
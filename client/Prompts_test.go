@@ -0,0 +1,76 @@
+package client
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	. "util"
+)
+
+// TestPromptsHoldIncomingLines has the server send messages while each auth
+// prompt waits for the user, and checks they're only shown once logged in, in
+// order, with the prompts answered as usual
+func TestPromptsHoldIncomingLines(t *testing.T) {
+	server, clientSide := net.Pipe()
+	defer server.Close()
+	userInput, typed := io.Pipe()
+	defer typed.Close()
+	shown, userOutput := io.Pipe()
+	defer shown.Close()
+	go RunSession(clientSide, userInput, userOutput, ClientOptions{})
+	output := ReadAsyncIntoChan(bufio.NewScanner(shown))
+	serverLines := ReadAsyncIntoChan(bufio.NewScanner(server))
+
+	expectShown := func(expected string) {
+		t.Helper()
+		select {
+		case line := <-output:
+			if line.Err != nil || line.Val != expected {
+				t.Fatalf("expected %q to be shown, got %q, %v", expected, line.Val, line.Err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+	serverSends := func(line string) {
+		t.Helper()
+		if _, err := server.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the capabilities line
+	<-serverLines
+
+	expectShown("Type r to register, l to login")
+	serverSends(MsgPrefix + "bob: one")
+	// something shown over the prompt shows it again
+	serverSends("?")
+	line := <-output
+	if !strings.HasSuffix(line.Val, "odd output from server: ?") {
+		t.Fatalf("expected the odd line to be logged, got %q", line.Val)
+	}
+	expectShown("Type r to register, l to login")
+	go typed.Write([]byte("l\n"))
+	expectShown("Username:")
+	serverSends(MsgPrefix + "bob: two")
+	go typed.Write([]byte("alice\n"))
+	expectShown("Password:")
+	serverSends(PresenceEvent{Name: "carol", Online: true}.Serialize())
+	go typed.Write([]byte("1234\n"))
+
+	for _, expected := range []string{string(ActionLogin), "alice", "1234"} {
+		if line := <-serverLines; line.Val != expected {
+			t.Fatalf("expected the client to send %q, got %q, %v", expected, line.Val, line.Err)
+		}
+	}
+	serverSends(ServerResponsePrefix + string(AuthResponseID) + IdSeparator + string(ResponseOk))
+	serverSends(MsgPrefix + "bob: after")
+	expectShown("Logged in as alice")
+	expectShown("")
+	for _, expected := range []string{"bob: one", "bob: two", "* carol joined", "bob: after"} {
+		expectShown(expected)
+	}
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"log"
+	"time"
+)
+
+// RetryReportInterval is how often retryReporter says it's still retrying,
+// when nothing else changed
+const RetryReportInterval = time.Minute
+
+// retryReporter tells the user about an outage without a line per attempt: the
+// first failure, then only when the delay between attempts changes or once
+// per RetryReportInterval, then a summary once we're back. It's only used by
+// the goroutine reconnecting to one server, so it isn't locked.
+type retryReporter struct {
+	logger *log.Logger
+	// now is the clock the outage is timed by, replaceable for tests
+	now func() time.Time
+
+	// retrying is whether there's an outage, which started at start
+	retrying bool
+	start    time.Time
+	// attempts counts the failed connection attempts in the outage
+	attempts int
+	delay    time.Duration
+	reported time.Time
+}
+
+func newRetryReporter(logger *log.Logger) *retryReporter {
+	return &retryReporter{logger: logger, now: time.Now}
+}
+
+// lost starts an outage, with the connection lost for reason, unless there's
+// one already
+func (r *retryReporter) lost(reason string, delay time.Duration) {
+	r.report(reason, delay)
+}
+
+// failed counts a failed connection attempt, which starts an outage if there
+// isn't one already
+func (r *retryReporter) failed(reason string, delay time.Duration) {
+	r.report(reason, delay)
+	r.attempts++
+}
+
+func (r *retryReporter) report(reason string, delay time.Duration) {
+	now := r.now()
+	switch {
+	case !r.retrying:
+		r.retrying, r.start = true, now
+		if delay == 0 {
+			r.logger.Printf("%s, retrying\n", reason)
+		} else {
+			r.logger.Printf("%s, retrying in %s\n", reason, delay)
+		}
+	case delay != r.delay || now.Sub(r.reported) >= RetryReportInterval:
+		r.logger.Printf("Still retrying, %s elapsed, next attempt in %s\n",
+			now.Sub(r.start).Round(time.Second), delay)
+	default:
+		return
+	}
+	r.delay, r.reported = delay, now
+}
+
+// connected ends the outage, if there's one, with how long it took to get
+// back and in how many attempts, this one included
+func (r *retryReporter) connected() {
+	if !r.retrying {
+		return
+	}
+	attempts := "attempts"
+	if r.attempts == 0 {
+		attempts = "attempt"
+	}
+	r.logger.Printf("Reconnected after %s, %d %s\n",
+		r.now().Sub(r.start).Round(time.Second), r.attempts+1, attempts)
+	*r = retryReporter{logger: r.logger, now: r.now}
+}
+
+// gaveUp ends the outage after a last failed attempt, past the reconnect limit
+func (r *retryReporter) gaveUp() {
+	if !r.retrying {
+		// the limit was used up by earlier sessions
+		r.start = r.now()
+	}
+	r.logger.Printf("Gave up after %s, %d attempts\n",
+		r.now().Sub(r.start).Round(time.Second), r.attempts+1)
+	*r = retryReporter{logger: r.logger, now: r.now}
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRetryReporter has a ten minute outage with an attempt every 5 seconds,
+// then a shorter one whose delay grows
+func TestRetryReporter(t *testing.T) {
+	var out bytes.Buffer
+	retries := newRetryReporter(log.New(&out, "", 0))
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	retries.now = func() time.Time { return now }
+
+	retries.lost("Server closed", 5*time.Second)
+	for i := 0; i < 119; i++ {
+		now = now.Add(5 * time.Second)
+		retries.failed("Connection refused", 5*time.Second)
+	}
+	now = now.Add(5 * time.Second)
+	retries.connected()
+	expected := []string{"Server closed, retrying in 5s"}
+	for minute := 1; minute < 10; minute++ {
+		expected = append(expected,
+			fmt.Sprintf("Still retrying, %dm0s elapsed, next attempt in 5s", minute))
+	}
+	expected = append(expected, "Reconnected after 10m0s, 120 attempts")
+
+	retries.failed("Connection refused", 5*time.Second)
+	now = now.Add(5 * time.Second)
+	retries.failed("Connection refused", 40*time.Second)
+	now = now.Add(40 * time.Second)
+	retries.failed("Connection refused", 40*time.Second)
+	now = now.Add(40 * time.Second)
+	retries.connected()
+	// connecting without an outage says nothing
+	retries.connected()
+	expected = append(expected,
+		"Connection refused, retrying in 5s",
+		"Still retrying, 5s elapsed, next attempt in 40s",
+		"Reconnected after 1m25s, 4 attempts")
+
+	if want := strings.Join(expected, "\n") + "\n"; out.String() != want {
+		t.Fatalf("expected:\n%sgot:\n%s", want, out.String())
+	}
+}
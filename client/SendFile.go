@@ -0,0 +1,138 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	. "util"
+)
+
+// MaxInFlight bounds the messages SendFile has sent and not had acked yet, so
+// a big file is sent as fast as the server acks it rather than all at once
+const MaxInFlight = 16
+
+// SendFileResult counts what became of the messages SendFile sent
+type SendFileResult struct {
+	Sent, Acked int
+	// Failed were answered with something other than ResponseOk, TimedOut
+	// weren't answered within MsgAckTimeout
+	Failed, TimedOut int
+}
+
+func (r SendFileResult) String() string {
+	return fmt.Sprintf("%d of %d messages acked, %d failed, %d timed out",
+		r.Acked, r.Sent, r.Failed, r.TimedOut)
+}
+
+// SendFile logs in to the server at port as creds, sends each line of in as a
+// message, and logs out once they're all acked or timed out. Empty lines are
+// skipped, and so are commands, since a file of messages shouldn't have the
+// server run them.
+func SendFile(port string, creds UserCredentials, in io.Reader, out io.Writer,
+	options ClientOptions) (SendFileResult, error) {
+	options = options.withDefaults()
+	logger := options.newLogger(out)
+	conn, err := connectToPortWithRetry(port, newRetryReporter(logger), options.ReconnectDelay,
+		&reconnectLimit{max: options.MaxReconnects}, options.Dialer)
+	if err != nil {
+		return SendFileResult{}, err
+	}
+	defer ClosePrintErr(conn)
+	caps := ClientCapabilities().WithFraming(options.Framing).WithVersion(options.Version)
+	if _, err := conn.Write([]byte(caps.Serialize() + "\n")); err != nil {
+		return SendFileResult{}, err
+	}
+	unauthedClient := newUnauthenticatedClient(conn, nil, out, logger, options)
+	defer close(unauthedClient.ended)
+	err, response := unauthedClient.authenticate(ActionLogin, &creds)
+	if err != nil {
+		return SendFileResult{}, err
+	} else if response != ResponseOk {
+		return SendFileResult{}, fmt.Errorf("couldn't log in: %s", response)
+	}
+	client := &Client{UnauthenticatedClient: *unauthedClient, creds: &creds,
+		relog: make(chan struct{}, 1)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.handleResponsesLoop(ctx)
+	// nobody reads the room, but its messages mustn't pile up
+	go func() {
+		for range client.receiveMsg {
+		}
+	}()
+
+	result, err := client.sendLines(in)
+	if err != nil {
+		return result, err
+	}
+	return result, client.sendMsgWithTimeout("", LogoutCmd.Serialize())
+}
+
+// sendLines returns once every message it sent is acked or timed out
+func (client *Client) sendLines(in io.Reader) (SendFileResult, error) {
+	var result SendFileResult
+	var resultLock sync.Mutex
+	var waiting sync.WaitGroup
+	var err error
+	inFlight := make(chan struct{}, MaxInFlight)
+	// stops reading in if we stop early
+	done := make(chan struct{})
+	defer close(done)
+	lines := ReadAsyncIntoChanUntil(bufio.NewScanner(in), done)
+	for n := 1; ; n++ {
+		line := <-lines
+		if line.Err != nil {
+			if !errors.Is(line.Err, io.EOF) {
+				err = line.Err
+			}
+			break
+		}
+		if line.Val == "" {
+			continue
+		} else if IsCmd(line.Val) {
+			client.logger.Printf("Skipping line %d: a command\n", n)
+			continue
+		}
+
+		// waits for a message to be acked, once MaxInFlight are waiting
+		inFlight <- struct{}{}
+		id := client.ids.next()
+		ack := client.insertExpectedResponseId(id)
+		if err = client.sendMsgWithTimeout(id, line.Val); err != nil {
+			client.removeExpectedResponseId(id)
+			break
+		}
+		resultLock.Lock()
+		result.Sent++
+		resultLock.Unlock()
+		waiting.Add(1)
+		go func() {
+			defer waiting.Done()
+			defer func() { <-inFlight }()
+			defer client.removeExpectedResponseId(id)
+			var response Response
+			select {
+			case response = <-ack:
+			case <-time.After(MsgAckTimeout):
+			}
+			resultLock.Lock()
+			defer resultLock.Unlock()
+			switch response {
+			case ResponseOk:
+				result.Acked++
+			case "":
+				result.TimedOut++
+			default:
+				client.logger.Printf("Message %s: %s\n", id, response)
+				result.Failed++
+			}
+		}()
+	}
+	waiting.Wait()
+	return result, err
+}
@@ -0,0 +1,160 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	. "util"
+)
+
+// DropCmd discards the messages typed while disconnected, rather than send
+// them once logged in again
+const DropCmd Cmd = "drop"
+
+// MaxTypedAhead is how many messages typed while disconnected are kept
+const MaxTypedAhead = 100
+
+// typeAhead owns what the user types to a server across its sessions. Online,
+// from connecting on, lines go to whoever reads lines, the prompts and then
+// the logged in client. Offline, from losing the connection until the next
+// one, messages are queued to be sent in order after the next login, only the
+// commands the client runs itself are run, and the rest are refused. Without
+// it, a line typed meanwhile went to whichever loop was still reading, e.g one
+// of a session that was over, or the next login prompt.
+type typeAhead struct {
+	in      <-chan ReadInput
+	lines   chan ReadInput
+	online  chan bool
+	done    chan struct{}
+	out     io.Writer
+	logger  *log.Logger
+	filters *Filters
+
+	// lock guards queued, which the router adds to as the client sends it
+	lock   sync.Mutex
+	queued []string
+}
+
+func newTypeAhead(in <-chan ReadInput, out io.Writer, logger *log.Logger,
+	filters *Filters) *typeAhead {
+	t := &typeAhead{in: in, lines: make(chan ReadInput), online: make(chan bool),
+		done: make(chan struct{}), out: out, logger: logger, filters: filters}
+	go t.route()
+	return t
+}
+
+// route hands lines on while online. A line that no one took by the time the
+// connection is lost, e.g typed as a session ended, counts as typed offline.
+// The end of input waits for the next session, which it ends.
+func (t *typeAhead) route() {
+	online := true
+	var held *ReadInput
+	for {
+		in, lines := t.in, chan ReadInput(nil)
+		var next ReadInput
+		if held != nil {
+			in, next = nil, *held
+			if online {
+				lines = t.lines
+			}
+		}
+		select {
+		case line := <-in:
+			if line.Err == nil && t.runLocalCmd(line.Val) {
+				continue
+			} else if line.Err == nil && !online {
+				t.typedOffline(line.Val)
+				continue
+			}
+			held = &line
+		case lines <- next:
+			held = nil
+		case online = <-t.online:
+			if !online && held != nil && held.Err == nil {
+				t.typedOffline(held.Val)
+				held = nil
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// setOnline is called once connected, and offline once the connection is lost
+func (t *typeAhead) setOnline(online bool) {
+	if t == nil {
+		return
+	}
+	select {
+	case t.online <- online:
+	case <-t.done:
+	}
+}
+
+func (t *typeAhead) stop() {
+	close(t.done)
+}
+
+// runLocalCmd runs DropCmd, whether online or not
+func (t *typeAhead) runLocalCmd(line string) (handled bool) {
+	if !IsCmd(line) {
+		return false
+	}
+	if name, _ := UnserializeStrToCmd(line).Split(); name != DropCmd {
+		return false
+	}
+	t.lock.Lock()
+	dropped := len(t.queued)
+	t.queued = nil
+	t.lock.Unlock()
+	fmt.Fprintf(t.out, "Dropped %d queued messages\n", dropped)
+	return true
+}
+
+// typedOffline queues a message, or runs a command if the client can without
+// a server
+func (t *typeAhead) typedOffline(line string) {
+	if IsCmd(line) {
+		if name, args := UnserializeStrToCmd(line).Split(); name == FilterCmd {
+			runFilterCmd(t.filters, args, t.out, t.logger)
+			return
+		}
+		fmt.Fprintln(t.out, "Not connected — commands need the server, try again once logged in")
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.queued) == MaxTypedAhead {
+		fmt.Fprintf(t.out, "Not connected — already %d messages queued, message dropped\n",
+			MaxTypedAhead)
+		return
+	}
+	t.queued = append(t.queued, line)
+	fmt.Fprintln(t.out, "Not connected — message queued")
+}
+
+// take empties the queue, for sending what's in it
+func (t *typeAhead) take() []string {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	queued := t.queued
+	t.queued = nil
+	return queued
+}
+
+// sendTypedAhead sends the messages typed while reconnecting, in the order
+// they were typed
+func (client *Client) sendTypedAhead() {
+	queued := client.typeAhead.take()
+	if len(queued) == 0 {
+		return
+	}
+	fmt.Fprintf(client.userOutput, "Sending %d queued messages\n", len(queued))
+	for _, msg := range queued {
+		client.sendMsgExpectAsyncResponse(msg)
+	}
+}
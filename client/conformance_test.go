@@ -0,0 +1,50 @@
+package client
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testsupport"
+	. "util"
+)
+
+func TestConformance(t *testing.T) {
+	sessions, err := testsupport.Sessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, framing := range []Framing{FramingV1, FramingV2} {
+		for _, session := range sessions {
+			if !session.RunsAgainst(testsupport.SideClient) {
+				continue
+			}
+			session := session.WithFraming(framing)
+			t.Run(framing.String()+"/"+session.Name, func(t *testing.T) {
+				serverSide, clientSide := net.Pipe()
+				defer serverSide.Close()
+				// userInput is left open, the client treats EOF there as the user
+				// quitting
+				userInput, typed := io.Pipe()
+				shown, userOutput := io.Pipe()
+				defer shown.Close()
+				options := ClientOptions{OnLogin: session.OnLogin, AuthAction: session.AuthAction,
+					Framing: framing}
+				if session.Outbox != nil {
+					options.OutboxPath = filepath.Join(t.TempDir(), "outbox")
+					content := strings.Join(session.Outbox, "\n") + "\n"
+					err := os.WriteFile(options.OutboxPath, []byte(content), 0600)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				go RunSession(clientSide, userInput, userOutput, options)
+				if err := session.ReplayAgainstClient(serverSide, typed, shown); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"server"
+	"testing"
+)
+
+// TestDirectMsgExchange DMs between clients, with broadcasts in between that
+// mustn't change who /r replies to
+func TestDirectMsgExchange(t *testing.T) {
+	addr := listenOnLoopback(server.NewHub(), t)
+	alice, aliceSees := startClient(t, addr, "alice")
+	bob, bobSees := startClient(t, addr, "bob")
+	carol, carolSees := startClient(t, addr, "carol")
+
+	typeLines(t, alice, "/r anyone?")
+	waitForLine(t, aliceSees, "No DM to reply to")
+
+	typeLines(t, bob, "/msg alice hey")
+	waitForLine(t, aliceSees, "[dm] bob: hey")
+	typeLines(t, carol, "hello all")
+	waitForLine(t, aliceSees, "carol: hello all")
+	waitForLine(t, bobSees, "carol: hello all")
+	typeLines(t, alice, "/r hi bob")
+	waitForLine(t, bobSees, "[dm] alice: hi bob")
+
+	typeLines(t, carol, "/msg alice psst")
+	waitForLine(t, aliceSees, "[dm] carol: psst")
+	typeLines(t, bob, "more noise")
+	waitForLine(t, aliceSees, "bob: more noise")
+	typeLines(t, alice, "/r hi carol")
+	waitForLine(t, carolSees, "[dm] alice: hi carol")
+
+	typeLines(t, alice, "/msg")
+	waitForLine(t, aliceSees, "Recent DMs: carol, bob")
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"client"
+	"server"
+	"testing"
+	"time"
+)
+
+// TestDrainRedirect runs the binary with -drain-redirect and has it drain on
+// DrainSignal, which sends its client to the other server
+func TestDrainRedirect(t *testing.T) {
+	newAddr := listenOnLoopback(server.NewHub(), t)
+	port := freePort(t)
+	cmd, logged := startBinary(t, port, "server", "-drain-redirect", newAddr)
+	// it retries until the binary listens
+	typed, output := startClientWithOptions(t, "127.0.0.1:"+port, "alice",
+		client.ClientOptions{ReconnectDelay: 10 * time.Millisecond})
+
+	if err := cmd.Process.Signal(server.DrainSignal); err != nil {
+		t.Fatal(err)
+	}
+	waitForLine(t, output, "Server moved to "+newAddr+", reconnecting")
+	waitForLine(t, output, "Type r to register, l to login")
+	typeLines(t, typed, "r", "alice", "1234", "1234")
+	waitForLine(t, output, "Logged in as alice")
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("expected the server to exit once drained, got %s:\n%s", err, logged)
+		}
+	case <-time.After(lineTimeout):
+		t.Fatalf("the server didn't exit once drained:\n%s", logged)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSingleEntrypoint keeps the root package down to main.go, so the client,
+// server and util packages stay the only implementation of the chat logic
+func TestSingleEntrypoint(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if file != "main.go" && !strings.HasSuffix(file, "_test.go") {
+			t.Errorf("%s: chat logic belongs in the client, server or util packages", file)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"client"
+	"net"
+	"server"
+	"strings"
+	"testing"
+	"testsupport"
+	"time"
+	. "util"
+)
+
+// TestPingAcksTimeOutUnderLatency has the client's pings take longer to get to
+// the server than it waits for their acks, so it gives up on the connection
+func TestPingAcksTimeOutUnderLatency(t *testing.T) {
+	addr := listenOnLoopback(server.NewHub(), t)
+	_, output := startClientWithOptions(t, addr, "alice", client.ClientOptions{
+		Dialer: faultyDialer{testsupport.Faults{Latency: 100 * time.Millisecond}},
+		Quality: client.QualityOptions{PingInterval: 10 * time.Millisecond,
+			PingTimeout: 20 * time.Millisecond}})
+	waitForLine(t, output, "connection lost: last 3 pings unanswered")
+	waitForLine(t, output, "Reconnecting")
+}
+
+// TestReconnectAfterMidMessageDrop drops alice's connection in the middle of a
+// message to her. She mustn't see the half that made it, and gets the next
+// message once she's back.
+func TestReconnectAfterMidMessageDrop(t *testing.T) {
+	hub := server.NewHub()
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan *testsupport.FaultyConn, 2)
+	addr := serveWrapped(hub, listener, func(conn net.Conn) net.Conn {
+		faulty := testsupport.NewFaultyConn(conn, testsupport.Faults{})
+		conns <- faulty
+		return faulty
+	}, t)
+	aliceTyped, aliceSees := startClientWithOptions(t, addr, "alice",
+		client.ClientOptions{ReconnectDelay: time.Millisecond})
+	aliceConn := <-conns
+	bobTyped, _ := startClient(t, addr, "bob")
+
+	aliceConn.SetFaults(testsupport.Faults{DropAfter: len(MsgPrefix + "bob: he")})
+	typeLines(t, bobTyped, "hello alice")
+	for dropped := false; !dropped; {
+		select {
+		case line := <-aliceSees:
+			if line.Err != nil {
+				t.Fatal(line.Err)
+			}
+			if strings.Contains(line.Val, "bob: he") {
+				t.Fatalf("alice was shown the cut message: %q", line.Val)
+			}
+			dropped = strings.HasSuffix(line.Val, "Server closed, retrying in 1ms")
+		case <-time.After(lineTimeout):
+			t.Fatal("alice didn't notice the drop")
+		}
+	}
+	waitForSessionEnd(t, hub, "alice")
+	waitForLine(t, aliceSees, "Type r to register, l to login")
+	typeLines(t, aliceTyped, "l", "alice", "1234")
+	waitForLine(t, aliceSees, "Logged in as alice")
+	typeLines(t, bobTyped, "welcome back")
+	waitForLine(t, aliceSees, "bob: welcome back")
+}
+
+// TestLinesWholeUnderOneByteWrites has both sides of each connection write a
+// byte at a time, so every line is read in pieces
+func TestLinesWholeUnderOneByteWrites(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oneByte := testsupport.Faults{MaxWriteSize: 1}
+	addr := serveWrapped(server.NewHub(), listener, func(conn net.Conn) net.Conn {
+		return testsupport.NewFaultyConn(conn, oneByte)
+	}, t)
+	options := client.ClientOptions{Dialer: faultyDialer{oneByte}}
+	aliceTyped, aliceSees := startClientWithOptions(t, addr, "alice", options)
+	bobTyped, bobSees := startClientWithOptions(t, addr, "bob", options)
+
+	typeLines(t, aliceTyped, "héllo bob 👋")
+	waitForLine(t, bobSees, "alice: héllo bob 👋")
+	typeLines(t, aliceTyped, "/msg bob just you")
+	waitForLine(t, bobSees, "[dm] alice: just you")
+	typeLines(t, bobTyped, "hi alice")
+	waitForLine(t, aliceSees, "bob: hi alice")
+}
+
+// TestTypingDuringOutage has alice type while her connection is down. Her
+// messages wait for her next login, and go out in the order she typed them.
+func TestTypingDuringOutage(t *testing.T) {
+	hub := server.NewHub()
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan net.Conn, 2)
+	addr := serveWrapped(hub, listener, func(conn net.Conn) net.Conn {
+		conns <- conn
+		return conn
+	}, t)
+	aliceTyped, aliceSees := startClientWithOptions(t, addr, "alice",
+		client.ClientOptions{ReconnectDelay: 200 * time.Millisecond})
+	aliceConn := <-conns
+	bobTyped, bobSees := startClient(t, addr, "bob")
+
+	aliceConn.Close()
+	waitForLine(t, aliceSees, "Server closed, retrying in 200ms")
+	typeLines(t, aliceTyped, "oops", "/drop")
+	waitForLine(t, aliceSees, "Dropped 1 queued messages")
+	typeLines(t, aliceTyped, "one", "/who", "two")
+	waitForLine(t, aliceSees, "Not connected — message queued")
+	waitForLine(t, aliceSees, "Not connected — commands need the server, try again once logged in")
+	waitForLine(t, aliceSees, "Not connected — message queued")
+
+	waitForLine(t, aliceSees, "Type r to register, l to login")
+	typeLines(t, aliceTyped, "l", "alice", "1234")
+	waitForLine(t, aliceSees, "Sending 2 queued messages")
+	waitForLine(t, bobSees, "alice: one")
+	waitForLine(t, bobSees, "alice: two")
+	typeLines(t, bobTyped, "welcome back")
+	waitForLine(t, aliceSees, "bob: welcome back")
+}
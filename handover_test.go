@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"server"
+	"testing"
+	"time"
+	. "util"
+)
+
+// TestHandover hands a server's listener over to a second one, as a restart
+// for an upgrade does, and checks its clients end up on the second one
+func TestHandover(t *testing.T) {
+	options := server.ServerOptions{UserDBPath: filepath.Join(t.TempDir(), "users.db")}
+	old, err := server.BuildServer("127.0.0.1:0", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldServed := make(chan error, 1)
+	go func() { oldServed <- old.Serve() }()
+	var addrs []net.Addr
+	for start := time.Now(); len(addrs) == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > lineTimeout {
+			t.Fatal("the server didn't start listening")
+		}
+		addrs = old.Addrs()
+	}
+	addr := addrs[0].String()
+	aliceTypes, aliceSees := startClient(t, addr, "alice")
+	bobTypes, bobSees := startClient(t, addr, "bob")
+
+	files, err := old.HandoverFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// built once alice and bob registered, so it has their accounts
+	upgraded, err := server.BuildServer("127.0.0.1:0", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgradedServed := make(chan error, 1)
+	go func() { upgradedServed <- upgraded.ServeFiles(files) }()
+	go old.Shutdown()
+
+	for _, c := range []struct {
+		name  string
+		types io.Writer
+		sees  <-chan ReadInput
+	}{{"alice", aliceTypes, aliceSees}, {"bob", bobTypes, bobSees}} {
+		waitForLine(t, c.sees, "Server is restarting, reconnecting")
+		waitForLine(t, c.sees, "Type r to register, l to login")
+		typeLines(t, c.types, "l", c.name, "1234")
+		waitForLine(t, c.sees, "Logged in as "+c.name)
+	}
+	select {
+	case err := <-oldServed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(lineTimeout):
+		t.Fatal("the old server didn't drain")
+	}
+	if upgradedAddrs := upgraded.Addrs(); len(upgradedAddrs) != 1 ||
+		upgradedAddrs[0].String() != addr {
+		t.Fatalf("expected the new server to listen at %s, got %v", addr, upgradedAddrs)
+	}
+	typeLines(t, aliceTypes, "made it")
+	waitForLine(t, bobSees, "alice: made it")
+
+	// the clients must keep reading to leave when told to, so the hub drains
+	for _, sees := range []<-chan ReadInput{aliceSees, bobSees} {
+		go func(sees <-chan ReadInput) {
+			for line := range sees {
+				if line.Err != nil {
+					return
+				}
+			}
+		}(sees)
+	}
+	upgraded.Shutdown()
+	select {
+	case err := <-upgradedServed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(lineTimeout):
+		t.Fatal("the new server didn't shut down")
+	}
+}
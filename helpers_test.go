@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"client"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"server"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testsupport"
+	"time"
+	. "util"
+)
+
+// runMainEnv has the test binary run main rather than the tests, see
+// startBinary
+const runMainEnv = "CHATSERVER_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// startBinary runs the chatserver binary with args, as typed after its name,
+// until the test ends. What it logs is in the returned buffer.
+func startBinary(t *testing.T, args ...string) (*exec.Cmd, *lockedBuffer) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	var output lockedBuffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return cmd, &output
+}
+
+// lockedBuffer lets a test read output while it's being written
+type lockedBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// freePort is a TCP port nothing listens on, for a server that only takes a
+// port
+func freePort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// listenOnLoopback serves hub on a free loopback port. Real sockets buffer, so
+// unlike net.Pipe they let acks and messages be in flight while the other side
+// moves on.
+func listenOnLoopback(hub *server.Hub, t *testing.T) string {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveOn(hub, listener, t)
+}
+
+// serveOn serves hub on listener, whatever its transport, until the test ends
+func serveOn(hub *server.Hub, listener net.Listener, t *testing.T) string {
+	return serveWrapped(hub, listener, nil, t)
+}
+
+// serveWrapped is serveOn handing the hub wrap's conn instead of each accepted
+// one, e.g a testsupport.FaultyConn
+func serveWrapped(hub *server.Hub, listener net.Listener, wrap func(net.Conn) net.Conn,
+	t *testing.T) string {
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if wrap != nil {
+				conn = wrap(conn)
+			}
+			go hub.HandleNewConnection(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// faultyDialer connects a client over TCP with faults on its side of the conn
+type faultyDialer struct {
+	faults testsupport.Faults
+}
+
+func (d faultyDialer) Dial(addr string) (net.Conn, error) {
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	return testsupport.NewFaultyConn(conn, d.faults), nil
+}
+
+// waitForSessionEnd waits for the hub to be done with name's session
+func waitForSessionEnd(t *testing.T, hub *server.Hub, name Username) {
+	t.Helper()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		for _, end := range hub.EndedSessions() {
+			if end.User == name {
+				return
+			}
+		}
+		if time.Since(start) > lineTimeout {
+			t.Fatalf("%s's session didn't end", name)
+		}
+	}
+}
+
+// lineTimeout is how long waitForLine waits for its line
+const lineTimeout = 3 * time.Second
+
+// waitForLine reads lines until one ends with expected, skipping the others
+func waitForLine(t *testing.T, lines <-chan ReadInput, expected string) {
+	t.Helper()
+	for {
+		select {
+		case line := <-lines:
+			if line.Err != nil {
+				t.Fatalf("expected %q: %s", expected, line.Err)
+			}
+			if strings.HasSuffix(line.Val, expected) {
+				return
+			}
+		case <-time.After(lineTimeout):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+}
+
+// typeLines writes lines into a client's input as if the user typed them
+func typeLines(t *testing.T, userInput io.Writer, lines ...string) {
+	t.Helper()
+	_, err := userInput.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startClient runs a client against addr and registers name with it, which
+// also starts its log lines. The user types into the returned writer, and sees
+// the returned lines.
+func startClient(t *testing.T, addr string, name string) (io.Writer, <-chan ReadInput) {
+	t.Helper()
+	return startClientWithOptions(t, addr, name, client.ClientOptions{})
+}
+
+func startClientWithOptions(t *testing.T, addr string, name string,
+	options client.ClientOptions) (io.Writer, <-chan ReadInput) {
+	t.Helper()
+	if options.Name == "" {
+		// so the log lines of the test's clients can be told apart
+		options.Name = name
+	}
+	userInput, typed := io.Pipe()
+	shown, userOutput := io.Pipe()
+	t.Cleanup(func() {
+		typed.Close()
+		shown.Close()
+	})
+	go client.RunClientWithOptions(addr, userInput, userOutput, options)
+	output := ReadAsyncIntoChan(bufio.NewScanner(shown))
+	typeLines(t, typed, "r", name, "1234", "1234")
+	waitForLine(t, output, "Logged in as "+name)
+	return typed, output
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"client"
+	"fmt"
+	"server"
+	"testing"
+	"time"
+	. "util"
+)
+
+// TestHooksInOrder relogs and is then logged out for a restart, and checks the
+// hooks fire for each step, in order
+func TestHooksInOrder(t *testing.T) {
+	hub := server.NewHub()
+	addr := listenOnLoopback(hub, t)
+	events := make(chan string, 16)
+	hooks := client.Hooks{
+		Connected: func(addr string) { events <- "connected " + addr },
+		Disconnected: func(addr string, err error) {
+			events <- fmt.Sprintf("disconnected %s, %v", addr, err)
+		},
+		LoggedIn:  func(name Username) { events <- "logged in " + string(name) },
+		LoggedOut: func(name Username) { events <- "logged out " + string(name) },
+	}
+	typed, output := startClientWithOptions(t, addr, "alice",
+		client.ClientOptions{Hooks: hooks, ReconnectDelay: 10 * time.Millisecond})
+
+	typeLines(t, typed, "/quit")
+	waitForLine(t, output, "Type r to register, l to login")
+	typeLines(t, typed, "l", "alice", "1234")
+	waitForLine(t, output, "Logged in as alice")
+	hub.Kick("alice", "a test", LogoutReason{Code: LogoutShutdown, Text: "restarting",
+		RetryAfter: 10 * time.Millisecond})
+	waitForLine(t, output, "Type r to register, l to login")
+	typeLines(t, typed, "l", "alice", "1234")
+	waitForLine(t, output, "Logged in as alice")
+
+	for _, expected := range []string{
+		"connected " + addr,
+		"logged in alice",
+		"logged out alice",
+		"logged in alice",
+		"logged out alice",
+		"disconnected " + addr + ", <nil>",
+		"connected " + addr,
+		"logged in alice",
+	} {
+		select {
+		case event := <-events:
+			if event != expected {
+				t.Fatalf("expected %q, got %q", expected, event)
+			}
+		case <-time.After(lineTimeout):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+}
+
+// TestResponseHook has a script-like embedder follow the server's responses to
+// logging in and to its messages, without reading what's shown
+func TestResponseHook(t *testing.T) {
+	hub := server.NewHub()
+	addr := listenOnLoopback(hub, t)
+	responses := make(chan ServerResponse, 16)
+	hooks := client.Hooks{Response: func(response ServerResponse) { responses <- response }}
+	typed, output := startClientWithOptions(t, addr, "alice", client.ClientOptions{Hooks: hooks,
+		Quality: client.QualityOptions{PingInterval: 10 * time.Millisecond}})
+	expect := func(expected Response) ServerResponse {
+		t.Helper()
+		select {
+		case response := <-responses:
+			if response.Response != expected {
+				t.Fatalf("expected %q, got %+v", expected, response)
+			}
+			return response
+		case <-time.After(lineTimeout):
+			t.Fatalf("timed out waiting for %q", expected)
+			return ServerResponse{}
+		}
+	}
+	if response := expect(ResponseOk); response.Id != AuthResponseID {
+		t.Fatalf("expected the response to logging in, got %+v", response)
+	}
+	typeLines(t, typed, "hi")
+	acked := expect(ResponseOk)
+	typeLines(t, typed, "/nosuchcmd")
+	if refused := expect(ResponseUnknownCmd); refused.Id == acked.Id ||
+		acked.Id == AuthResponseID {
+		t.Fatalf("expected a response per message, got %+v then %+v", acked, refused)
+	}
+	// shown as ever
+	waitForLine(t, output, string(ResponseUnknownCmd))
+	// the client's pings meanwhile are its own
+	select {
+	case response := <-responses:
+		t.Fatalf("expected no more responses, got %+v", response)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"client"
+	"net"
+	"path/filepath"
+	"server"
+	"strings"
+	"testing"
+	"time"
+	. "util"
+)
+
+// TestListenOnSeveralAddrs has clients on a TCP port and on a unix socket chat
+// through one hub, then shuts the server down, which closes both
+func TestListenOnSeveralAddrs(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "chat.sock")
+	s, err := server.BuildServer("127.0.0.1:0", server.ServerOptions{
+		ListenAddrs: []string{server.UnixListenPrefix + socket}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+	var addrs []net.Addr
+	for start := time.Now(); len(addrs) == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > lineTimeout {
+			t.Fatal("the server didn't start listening")
+		}
+		addrs = s.Addrs()
+	}
+	if len(addrs) != 2 || addrs[1].String() != socket {
+		t.Fatalf("expected a TCP address and %s, got %v", socket, addrs)
+	}
+
+	typed, aliceSees := startClient(t, addrs[0].String(), "alice")
+	_, bobSees := startClientWithOptions(t, socket, "bob",
+		client.ClientOptions{Dialer: client.NetDialer{Network: "unix"}})
+	typeLines(t, typed, "hi bob")
+	waitForLine(t, bobSees, "alice: hi bob")
+
+	// the clients must keep reading to leave when told to, so the hub drains
+	for _, sees := range []<-chan ReadInput{aliceSees, bobSees} {
+		go func(sees <-chan ReadInput) {
+			for line := range sees {
+				if line.Err != nil {
+					return
+				}
+			}
+		}(sees)
+	}
+	s.Shutdown()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(lineTimeout):
+		t.Fatal("the server didn't shut down")
+	}
+	for _, addr := range addrs {
+		if conn, err := net.Dial(addr.Network(), addr.String()); err == nil {
+			conn.Close()
+			t.Errorf("%s is still listening", addr)
+		}
+	}
+}
+
+// TestListenAddrTaken fails startup, naming the address that couldn't be bound
+func TestListenAddrTaken(t *testing.T) {
+	taken, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	socket := filepath.Join(t.TempDir(), "chat.sock")
+	s, err := server.BuildServer(server.UnixListenPrefix+socket, server.ServerOptions{
+		ListenAddrs: []string{taken.Addr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Serve()
+	if err == nil || !strings.Contains(err.Error(), taken.Addr().String()) {
+		t.Fatalf("expected an error naming %s, got %v", taken.Addr(), err)
+	}
+	// the socket bound before it isn't left behind
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		t.Error("the unix socket is still listening")
+	}
+}
@@ -0,0 +1,173 @@
+package logfile
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Options say when a RotatingFile is rotated and what's kept of it
+type Options struct {
+	// MaxSize is the size in bytes past which the file is rotated, 10MB by
+	// default. A single write bigger than it gets a file of its own.
+	MaxSize int64
+	// MaxBackups is how many rotated files are kept, 5 by default
+	MaxBackups int
+	// Compress gzips the rotated files, which are then named path.1.gz etc
+	Compress bool
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxSize == 0 {
+		o.MaxSize = 10 << 20
+	}
+	if o.MaxBackups == 0 {
+		o.MaxBackups = 5
+	}
+	return o
+}
+
+// RotatingFile is a log file that's rotated once it grows past MaxSize: path
+// is renamed to path.1, path.1 to path.2 and so on, the oldest past MaxBackups
+// being removed, and a new path is started. Writes are safe from several
+// goroutines, and each goes whole to one file.
+type RotatingFile struct {
+	path    string
+	options Options
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Open appends to the file at path, creating it if needed
+func Open(path string, options Options) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, options: options.withDefaults()}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var rotateErr error
+	if f.size != 0 && f.size+int64(len(p)) > f.options.MaxSize {
+		// failing to rotate, we keep writing to the file as it is
+		rotateErr = f.rotate()
+		if f.file == nil {
+			return 0, rotateErr
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// Reopen starts writing to a new file at path, for after something else like
+// logrotate moved the file away. Until then, writes still go to the moved one.
+func (f *RotatingFile) Reopen() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file != nil {
+		// we're done with it either way
+		f.file.Close()
+	}
+	if err := f.open(); err != nil {
+		f.file = nil
+		return err
+	}
+	return nil
+}
+
+func (f *RotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// backup is the name of the nth rotated file
+func (f *RotatingFile) backup(n int) string {
+	name := f.path + "." + strconv.Itoa(n)
+	if f.options.Compress {
+		name += ".gz"
+	}
+	return name
+}
+
+// rotate shifts the backups along, the oldest one being overwritten, and
+// opens path again, new unless shifting failed. The lock must be held. f.file
+// is nil if it can't be opened.
+func (f *RotatingFile) rotate() error {
+	err := f.file.Close()
+	if err == nil {
+		err = f.shift()
+	}
+	if openErr := f.open(); openErr != nil {
+		f.file = nil
+		return openErr
+	}
+	return err
+}
+
+func (f *RotatingFile) shift() error {
+	for n := f.options.MaxBackups - 1; n >= 1; n-- {
+		err := os.Rename(f.backup(n), f.backup(n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if f.options.Compress {
+		return compress(f.path, f.backup(1))
+	}
+	return os.Rename(f.path, f.backup(1))
+}
+
+// compress moves the file at from into a gzip file at to
+func compress(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zipped := gzip.NewWriter(out)
+	if _, err := io.Copy(zipped, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zipped.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
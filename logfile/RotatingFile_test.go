@@ -0,0 +1,143 @@
+package logfile
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func openInTemp(t *testing.T, options Options) (*RotatingFile, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "server.log")
+	f, err := Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f, path
+}
+
+func write(t *testing.T, f *RotatingFile, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectContent(t *testing.T, path string, expected string) {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != expected {
+		t.Fatalf("expected %s to have %q, got %q", path, expected, content)
+	}
+}
+
+// TestRotatesAtBoundary fills the file to exactly MaxSize, which doesn't
+// rotate it, and checks the next write does, pushing the oldest backup out
+func TestRotatesAtBoundary(t *testing.T) {
+	f, path := openInTemp(t, Options{MaxSize: 10, MaxBackups: 2})
+	write(t, f, "aaaa\n", "bbbb\n")
+	expectContent(t, path, "aaaa\nbbbb\n")
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Fatalf("expected no rotation yet, got %v", err)
+	}
+	write(t, f, "cccc\n", "dddddddddddddddddddd\n", "eeee\n")
+	expectContent(t, path, "eeee\n")
+	expectContent(t, path+".1", "dddddddddddddddddddd\n")
+	expectContent(t, path+".2", "cccc\n")
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 backups, got %v", err)
+	}
+}
+
+func TestRotatesCompressed(t *testing.T) {
+	f, path := openInTemp(t, Options{MaxSize: 5, Compress: true})
+	write(t, f, "aaaa\n", "bbbb\n")
+	expectContent(t, path, "bbbb\n")
+	zipped, err := os.Open(path + ".1.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zipped.Close()
+	unzipped, err := gzip.NewReader(zipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := io.ReadAll(unzipped); err != nil || string(content) != "aaaa\n" {
+		t.Fatalf("expected the first line in the backup, got %q, %v", content, err)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Fatalf("expected the uncompressed backup gone, got %v", err)
+	}
+}
+
+// TestConcurrentWrites checks lines written from several goroutines while the
+// file rotates each end up whole in one of the files
+func TestConcurrentWrites(t *testing.T) {
+	const writers, lines = 8, 100
+	f, path := openInTemp(t, Options{MaxSize: 1000, MaxBackups: 100})
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			line := strings.Repeat(string(rune('a'+i)), 19) + "\n"
+			for j := 0; j < lines; j++ {
+				if _, err := f.Write([]byte(line)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	files, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(content) > 1000 {
+			t.Fatalf("expected %s to be rotated at 1000 bytes, it has %d", file, len(content))
+		}
+		for _, line := range strings.SplitAfter(string(content), "\n") {
+			if line != "" && (len(line) != 20 || strings.Count(line, line[:1]) != 19) {
+				t.Fatalf("expected whole lines, got %q in %s", line, file)
+			}
+		}
+		total += len(content)
+	}
+	if total != writers*lines*20 {
+		t.Fatalf("expected %d bytes in all, got %d", writers*lines*20, total)
+	}
+}
+
+// TestReopenAfterRename moves the file away like logrotate does before
+// signaling the server
+func TestReopenAfterRename(t *testing.T) {
+	f, path := openInTemp(t, Options{})
+	write(t, f, "before\n")
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	write(t, f, "still old\n")
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	write(t, f, "after\n")
+	expectContent(t, path+".old", "before\nstill old\n")
+	expectContent(t, path, "after\n")
+}
@@ -1,26 +1,280 @@
 package main
 
 import (
+	"bufio"
 	"client"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"fmt"
+	"log"
 	"os"
 	"server"
+	"strconv"
+	. "util"
 )
 
+func usage() {
+	fmt.Printf("Usage: %s PORT MODE [flags]\n"+
+		"\tMODE should be either client or server\n"+
+		"Flags:\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
 func main() {
-	if len(os.Args) != 3 {
-		fmt.Printf("Usage: %s PORT MODE\n\tMODE should be either client or server\n",
-			os.Args[0])
+	var options server.ServerOptions
+	validate := flag.Bool("validate", false, "check the server's setup without starting it")
+	createUser := flag.String("create-user", "", "server: add an account `name` to the user DB, "+
+		"with a password read from stdin, without starting the server")
+	createUsers := flag.String("create-users", "", "server: add the accounts in a CSV `file` of "+
+		"username,password lines to the user DB, - for stdin, without starting the server")
+	flag.StringVar(&options.UserDBPath, "userdb", "",
+		"JSON `file` to keep the accounts in, instead of memory only")
+	flag.DurationVar(&options.UserDBPollInterval, "userdb-poll", 0,
+		"how often to check the user DB file for changes made by hand, 0 for never")
+	flag.StringVar(&options.TLSCertFile, "tls-cert", "", "certificate `file` for serving TLS")
+	flag.StringVar(&options.TLSKeyFile, "tls-key", "", "key `file` of the TLS certificate")
+	flag.BoolVar(&options.RequireTLS, "require-tls", false, "refuse plaintext clients")
+	flag.BoolVar(&options.RegistrationClosed, "registration-closed", false,
+		"start with registration closed, which admins open with /set registration on")
+	flag.BoolVar(&options.RegisterThenLogin, "register-then-login", false,
+		"have registering only create the account, which users then log in to")
+	flag.BoolVar(&options.RequireVerification, "require-verification", false,
+		"have new accounts verified with a code before use, logged if nothing sends it")
+	flag.StringVar(&options.MOTD, "motd", "", "the message of the day, shown by /motd")
+	flag.DurationVar(&options.MinMsgInterval, "min-msg-interval", 0,
+		"the least `time` between a user's messages, none when 0")
+	flag.IntVar(&options.MaxLineLen, "max-line-len", 0, "disconnect clients sending a line "+
+		"over `bytes` long, "+strconv.Itoa(server.DefaultMaxLineLen)+" when 0")
+	flag.IntVar(&options.MaxConns, "max-conns", 0,
+		"the most connections served at once, no limit when 0")
+	flag.IntVar(&options.MaxQueued, "max-queued", 0,
+		"how many clients may wait in line past -max-conns, refused at once when 0")
+	flag.IntVar(&options.MaxUsers, "max-users", 0,
+		"the most accounts that can be registered, no limit when 0")
+	flag.DurationVar(&options.ShedSpread, "shed-spread", 0, "how long clients shed by "+
+		"/shed wait before reconnecting at most, "+server.DefaultShedSpread.String()+" when 0")
+	flag.StringVar(&options.DrainRedirect, "drain-redirect", "", "the `addr` clients are told "+
+		"to reconnect to when the server drains on SIGTERM, the same address when empty")
+	flag.DurationVar(&options.LogoutGrace, "logout-grace", 0,
+		"how long a user whose connection dropped stays online for them to reconnect, "+
+			"logged out at once when 0")
+	flag.StringVar(&options.Blocklist.Path, "blocklist", "",
+		"`file` of the words messages may not have, a word per line")
+	flag.DurationVar(&options.Blocklist.PollInterval, "blocklist-poll", 0,
+		"how often to check the blocklist file for changes made by hand, never when 0")
+	maskBlockedWords := flag.Bool("mask-blocked-words", false,
+		"mask blocked words in messages, instead of refusing the messages")
+	flag.StringVar(&options.MinClientVersion, "min-client-version", "",
+		"refuse clients older than `version`, a semantic version")
+	rejectControlChars := flag.Bool("reject-control-chars", false,
+		"refuse messages with control characters, instead of stripping them")
+	flag.Func("empty-messages", "what to do with empty messages: allow, reject or ignore "+
+		"them, allowed by default", func(s string) (err error) {
+		options.EmptyMessages, err = server.ParseEmptyMessagePolicy(s)
+		return err
+	})
+	flag.StringVar(&options.LogFile, "log-file", "",
+		"`file` to log to instead of stderr, rotated as it grows, reopened on SIGHUP")
+	logMaxMB := flag.Int64("log-max-mb", 10, "size in MB past which the log file is rotated")
+	flag.IntVar(&options.LogRotation.MaxBackups, "log-backups", 5,
+		"how many rotated log files to keep")
+	flag.BoolVar(&options.LogRotation.Compress, "log-compress", false,
+		"gzip the rotated log files")
+	logThrottle := flag.Duration("log-throttle", 0, "how long repeated errors are suppressed "+
+		"for after one is logged, "+DefaultLogThrottleWindow.String()+" when 0, never when negative")
+	flag.Func("listen", "also listen at `addr`, a TCP address or "+server.UnixListenPrefix+
+		"PATH for a unix socket, can be repeated", func(addr string) error {
+		options.ListenAddrs = append(options.ListenAddrs, addr)
+		return nil
+	})
+	flag.Func("welcome", "what users get upon logging in, in order: a comma separated list "+
+		"of motd, dms, mentions and history, or none", func(s string) (err error) {
+		options.Welcome, err = server.ParseWelcome(s)
+		return err
+	})
+	flag.StringVar(&options.WebAddr, "web", "",
+		"serve the web client at `addr`, a TCP address or "+server.UnixListenPrefix+"PATH")
+	clientOptions := client.ClientOptions{ResendOutbox: client.OutboxAsk}
+	useTLS := flag.Bool("tls", false, "client: connect over TLS")
+	tlsCA := flag.String("tls-ca", "",
+		"client: CA certificate `file` to trust the server's with, implies -tls")
+	onLogin := flag.String("onlogin", "",
+		"client: `file` of commands to run after logging in, one per line")
+	flag.DurationVar(&clientOptions.ReconnectDelay, "reconnect-delay", 0,
+		"client: how long to wait before reconnecting, 5s when 0")
+	flag.BoolVar(&clientOptions.ShowAckLatency, "show-latency", false,
+		"client: show how long each message took to be acked")
+	sendFile := flag.String("f", "", "client: send each line of `file` as a message and exit, "+
+		"logging in as -user with the password in $"+passwordEnv)
+	user := flag.String("user", "", "client: the `name` to log in as with -f")
+	quiet := flag.Bool("quiet", false, "client: hide users joining and leaving")
+	flag.BoolVar(&clientOptions.Debug, "debug", false,
+		"client: also log what's only worth knowing while debugging")
+	filtersPath := flag.String("filters", "",
+		"client: `file` keeping the /filter settings")
+	flag.Func("auth", "client: answer the register/login prompt with `action`, "+
+		string(ActionLogin)+" or "+string(ActionRegister)+", without asking", func(action string) error {
+		clientOptions.AuthAction = AuthAction(action)
+		if clientOptions.AuthAction != ActionLogin && clientOptions.AuthAction != ActionRegister {
+			return fmt.Errorf("unknown action %q", action)
+		}
+		return nil
+	})
+	flag.Usage = usage
+	if len(os.Args) < 3 {
+		usage()
+		os.Exit(1)
+	}
+	// the flags come after the positional args
+	if err := flag.CommandLine.Parse(os.Args[3:]); err != nil || flag.NArg() != 0 {
+		usage()
 		os.Exit(1)
 	}
 	port, mode := ":"+os.Args[1], os.Args[2]
-	switch mode {
-	case "client":
-		client.RunClient(port, os.Stdin, os.Stdout)
-	case "server":
-		server.RunServer(port)
+	options.LogRotation.MaxSize = *logMaxMB << 20
+	options.LogThrottleWindow = *logThrottle
+	clientOptions.LogThrottleWindow = *logThrottle
+	if *maskBlockedWords {
+		options.Blocklist.Policy = server.BlocklistMask
+	}
+	if *rejectControlChars {
+		options.ControlChars = server.ControlCharsReject
+	}
+	switch {
+	case mode == "server" && *validate:
+		if !server.ValidateReport(os.Stdout, port, options) {
+			os.Exit(1)
+		}
+	case mode == "server" && (*createUser != "" || *createUsers != ""):
+		runCreateUsers(options, *createUser, *createUsers)
+	case mode == "server":
+		server.RunServerWithOptions(port, options)
+	case mode == "client":
+		if *useTLS || *tlsCA != "" {
+			clientOptions.TLS = loadClientTLS(*tlsCA)
+		}
+		clientOptions.Filters = loadFilters(*filtersPath, *quiet)
+		if *sendFile != "" {
+			runSendFile(port, *sendFile, *user, clientOptions)
+		} else {
+			runClient(port, *onLogin, clientOptions)
+		}
 	default:
 		fmt.Printf("MODE should be client or server, instead got %s\n", os.Args[2])
 		os.Exit(1)
 	}
 }
+
+func runClient(port string, onLoginPath string, options client.ClientOptions) {
+	if onLoginPath != "" {
+		var err error
+		options.OnLogin, err = client.ReadOnLoginFile(onLoginPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	err := client.RunClientWithOptions(port, os.Stdin, os.Stdout, options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// loadFilters loads the client's filters from path, if it's set. quiet hides
+// joins on top of them.
+func loadFilters(path string, quiet bool) *client.Filters {
+	filters := client.NewFilters()
+	if path != "" {
+		var err error
+		filters, err = client.LoadFilters(path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if quiet {
+		filters.Hide(client.LineJoins)
+	}
+	return filters
+}
+
+// runCreateUsers adds the account name, or those in the CSV at csvPath, to
+// the user DB file, and prints the report. A server using the file picks them
+// up if it polls it, see -userdb-poll, otherwise they're for before it starts.
+func runCreateUsers(options server.ServerOptions, name string, csvPath string) {
+	if options.UserDBPath == "" {
+		log.Fatalln("creating users needs -userdb")
+	} else if name != "" && csvPath != "" {
+		log.Fatalln("-create-user and -create-users can't be used together")
+	}
+	hub := server.NewHubWithOptions(options)
+	if err := hub.LoadUserDB(); err != nil {
+		log.Fatalln(err)
+	}
+	var report server.CreateUsersReport
+	var err error
+	if name != "" {
+		fmt.Printf("Password for %s: ", name)
+		lines := bufio.NewScanner(os.Stdin)
+		if !lines.Scan() {
+			log.Fatalln("no password given")
+		}
+		creds := UserCredentials{Name: Username(name), Password: Password(lines.Text())}
+		report, err = hub.CreateUsers([]server.NewUser{{Creds: creds}})
+	} else {
+		file := os.Stdin
+		if csvPath != "-" {
+			if file, err = os.Open(csvPath); err != nil {
+				log.Fatalln(err)
+			}
+			defer file.Close()
+		}
+		report, err = hub.ImportUsersCSV(file)
+	}
+	fmt.Print(report)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(report.Refused) != 0 {
+		os.Exit(1)
+	}
+}
+
+// passwordEnv has the password for -f, so it isn't on the command line
+const passwordEnv = "CHAT_PASSWORD"
+
+func runSendFile(port string, path string, user string, options client.ClientOptions) {
+	if user == "" {
+		log.Fatalln("-f needs -user")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer file.Close()
+	creds := UserCredentials{Name: Username(user), Password: Password(os.Getenv(passwordEnv))}
+	result, err := client.SendFile(port, creds, file, os.Stdout, options)
+	fmt.Println(result)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if result.Acked != result.Sent {
+		os.Exit(1)
+	}
+}
+
+// loadClientTLS trusts the system's CAs, or only the one in caPath if set
+func loadClientTLS(caPath string) *tls.Config {
+	config := &tls.Config{}
+	if caPath == "" {
+		return config
+	}
+	pem, err := os.ReadFile(caPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		log.Fatalf("no certificates in %s\n", caPath)
+	}
+	return config
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"client"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"server"
+	"strings"
+	"testing"
+	. "util"
+)
+
+// TestMultipleServers has one client logged in to two servers, sending to each
+// in turn and telling their messages apart. The first server is named after
+// its address.
+func TestMultipleServers(t *testing.T) {
+	addrA := listenOnLoopback(server.NewHub(), t)
+	addrB := listenOnLoopback(server.NewHub(), t)
+	dialAs := func(addr, name string) <-chan ReadInput {
+		t.Helper()
+		conn, err := net.Dial("tcp4", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		_, err = conn.Write([]byte("r\n" + name + "\n1234\nm1;hi from " + name + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ReadAsyncIntoChan(bufio.NewScanner(conn))
+	}
+
+	userInput, typed := io.Pipe()
+	shown, userOutput := io.Pipe()
+	defer shown.Close()
+	defer typed.Close()
+	outbox := filepath.Join(t.TempDir(), "outbox")
+	options := client.ClientOptions{OutboxPath: outbox}
+	go client.RunClientWithOptions(addrA, userInput, userOutput, options)
+	output := ReadAsyncIntoChan(bufio.NewScanner(shown))
+	typeLines(t, typed, "r", "alice", "1234", "1234")
+	waitForLine(t, output, "Logged in as alice")
+	typeLines(t, typed, "/connect b "+addrB, "r", "alice", "1234", "1234")
+	waitForLine(t, output, "[b] Logged in as alice")
+
+	bob := dialAs(addrA, "bob")
+	waitForLine(t, output, "["+addrA+"] bob: hi from bob")
+	carol := dialAs(addrB, "carol")
+	waitForLine(t, output, "[b] carol: hi from carol")
+
+	typeLines(t, typed, "to b")
+	waitForLine(t, carol, "malice: to b")
+	typeLines(t, typed, "/switch "+addrA, "to a")
+	waitForLine(t, output, "Switched to "+addrA)
+	waitForLine(t, bob, "malice: to a")
+
+	// each server has its outbox, named by address rather than the order
+	// they were connected in
+	for _, addr := range []string{addrA, addrB} {
+		path := outbox + "-" + strings.ReplaceAll(addr, ":", "_")
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected an outbox for %s: %s", addr, err)
+		}
+	}
+
+	typeLines(t, typed, "/switch c")
+	waitForLine(t, output, client.ErrNoSuchServer.Error())
+}
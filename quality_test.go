@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"client"
+	"io"
+	"net"
+	"server"
+	"sync/atomic"
+	"testing"
+	"time"
+	. "util"
+)
+
+// delayedConn holds up every read by the current delay, like a slow network
+// between the client and the server
+type delayedConn struct {
+	net.Conn
+	delay int64
+}
+
+func (c *delayedConn) setDelay(d time.Duration) {
+	atomic.StoreInt64(&c.delay, int64(d))
+}
+
+func (c *delayedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	time.Sleep(time.Duration(atomic.LoadInt64(&c.delay)))
+	return n, err
+}
+
+func TestConnectionQuality(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	go server.NewHub().HandleNewConnection(serverSide)
+	conn := &delayedConn{Conn: clientSide}
+
+	userInput, typed := io.Pipe()
+	shown, userOutput := io.Pipe()
+	defer shown.Close()
+	options := client.ClientOptions{Quality: client.QualityOptions{
+		PingInterval: 10 * time.Millisecond,
+		SlowPing:     30 * time.Millisecond,
+		PingTimeout:  200 * time.Millisecond,
+	}}
+	reconnected := make(chan bool, 1)
+	go func() { reconnected <- client.RunSession(conn, userInput, userOutput, options) }()
+	output := ReadAsyncIntoChan(bufio.NewScanner(shown))
+	typeLines(t, typed, "r", "alice", "1234", "1234")
+	waitForLine(t, output, "Logged in as alice")
+	conn.setDelay(60 * time.Millisecond)
+	waitForLine(t, output, "connection degraded: last 3 pings >30ms")
+	conn.setDelay(0)
+	waitForLine(t, output, "connection good again")
+	conn.setDelay(time.Second)
+	waitForLine(t, output, "connection lost: last 3 pings unanswered")
+	// the client keeps printing while on its way out
+	go func() {
+		for range output {
+		}
+	}()
+	select {
+	case shouldReconnect := <-reconnected:
+		if !shouldReconnect {
+			t.Error("expected the client to reconnect")
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("timed out waiting for the client to reconnect")
+	}
+}
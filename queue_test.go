@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"client"
+	"errors"
+	"io"
+	"net"
+	"server"
+	"strings"
+	"testing"
+	"time"
+	. "util"
+)
+
+// TestServerFullQueue has a client wait in line for a full server, and get in
+// once the client it's waiting for leaves
+func TestServerFullQueue(t *testing.T) {
+	hub := server.NewHubWithOptions(server.ServerOptions{MaxConns: 1, MaxQueued: 1})
+	addr := listenOnLoopback(hub, t)
+	alice, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	aliceSees := ReadAsyncIntoChan(bufio.NewScanner(alice))
+	typeLines(t, alice, string(ActionRegister), "alice", "1234")
+	waitForLine(t, aliceSees, ServerResponsePrefix+string(AuthResponseID)+IdSeparator+
+		string(ResponseOk))
+	bobTypes, bobSees := startUnauthedClient(t, addr)
+	waitForLine(t, bobSees, "The server is full, waiting in line: number 1")
+
+	// there's no room in line for carol
+	done := make(chan error)
+	go func() {
+		done <- client.RunClientWithOptions(addr, strings.NewReader("l\ncarol\n1234\n"),
+			io.Discard, client.ClientOptions{ReconnectDelay: time.Millisecond})
+	}()
+	select {
+	case err := <-done:
+		var refused *client.RefusedError
+		if !errors.As(err, &refused) || refused.Reason != ReasonServerFull {
+			t.Fatalf("expected carol to be refused, got %v", err)
+		}
+	case <-time.After(lineTimeout):
+		t.Fatal("carol didn't give up")
+	}
+
+	alice.Close()
+	waitForLine(t, bobSees, "The server has room for us now")
+	typeLines(t, bobTypes, "r", "bob", "1234", "1234")
+	waitForLine(t, bobSees, "Logged in as bob")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"client"
+	"fmt"
+	"io"
+	"net"
+	"server"
+	"strings"
+	"testing"
+	"time"
+	. "util"
+)
+
+// TestSpamAroundRelogin quits and logs back in while messages are in flight in
+// both directions, and checks the server never drops the session over it
+func TestSpamAroundRelogin(t *testing.T) {
+	addr := listenOnLoopback(server.NewHub(), t)
+
+	// bob keeps broadcasting to alice, whatever state she's in
+	bob, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	go io.Copy(io.Discard, bob)
+	_, err = bob.Write([]byte("r\nbob\n1234\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopSpam := make(chan struct{})
+	defer close(stopSpam)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stopSpam:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			_, err := bob.Write([]byte(fmt.Sprintf("m%d;spam %d\n", i, i)))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	userInput, typed := io.Pipe()
+	shown, userOutput := io.Pipe()
+	defer shown.Close()
+	go client.RunSession(conn, userInput, userOutput, client.ClientOptions{})
+	output := ReadAsyncIntoChan(bufio.NewScanner(shown))
+
+	waitForLogin := func(round int) {
+		t.Helper()
+		for {
+			select {
+			case line := <-output:
+				if line.Err != nil {
+					t.Fatalf("round %d: %s", round, line.Err)
+				}
+				if strings.Contains(line.Val, "Server closed") ||
+					strings.Contains(line.Val, "odd output") {
+					t.Fatalf("round %d: session dropped: %s", round, line.Val)
+				}
+				if line.Val == "Logged in as alice" {
+					return
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("round %d: timed out waiting to log in", round)
+			}
+		}
+	}
+	typeLines(t, typed, "r", "alice", "1234", "1234")
+	waitForLogin(0)
+	for round := 1; round <= 100; round++ {
+		for i := 0; i < 5; i++ {
+			typeLines(t, typed, fmt.Sprintf("round %d msg %d", round, i))
+		}
+		// lines typed right after /quit are answers to the login prompt, and
+		// must never make it to the server as messages
+		typeLines(t, typed, "/quit", "late msg", "l", "alice", "1234")
+		waitForLogin(round)
+	}
+}
+
+// TestMessageRacingQuit has bob send a message just as alice quits, and checks
+// she sees it before she's logged out or not at all, rather than after
+func TestMessageRacingQuit(t *testing.T) {
+	addr := listenOnLoopback(server.NewHub(), t)
+	aliceTypes, aliceSees := startClient(t, addr, "alice")
+	bobTypes, _ := startClient(t, addr, "bob")
+	for round := 0; round < 20; round++ {
+		msg := fmt.Sprintf("race %d", round)
+		typeLines(t, bobTypes, msg)
+		typeLines(t, aliceTypes, "/quit")
+		loggedOut := false
+		for prompted := false; !prompted; {
+			select {
+			case line := <-aliceSees:
+				if line.Err != nil {
+					t.Fatal(line.Err)
+				}
+				switch {
+				case strings.HasSuffix(line.Val, "Logged out"):
+					loggedOut = true
+				case strings.HasSuffix(line.Val, "bob: "+msg) && loggedOut:
+					t.Fatalf("round %d: alice saw bob's message after logging out", round)
+				case line.Val == "Type r to register, l to login":
+					prompted = true
+				}
+			case <-time.After(lineTimeout):
+				t.Fatalf("round %d: alice wasn't logged out", round)
+			}
+		}
+		typeLines(t, aliceTypes, "l", "alice", "1234")
+		// nor once she's logged in again
+		marker := fmt.Sprintf("after %d", round)
+		waitForLine(t, aliceSees, "Logged in as alice")
+		typeLines(t, bobTypes, marker)
+		for seen := false; !seen; {
+			select {
+			case line := <-aliceSees:
+				if line.Err != nil {
+					t.Fatal(line.Err)
+				}
+				if strings.HasSuffix(line.Val, "bob: "+msg) {
+					t.Fatalf("round %d: alice saw bob's message after logging in again", round)
+				}
+				seen = strings.HasSuffix(line.Val, "bob: "+marker)
+			case <-time.After(lineTimeout):
+				t.Fatalf("round %d: alice didn't get bob's next message", round)
+			}
+		}
+	}
+}
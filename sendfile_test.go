@@ -0,0 +1,104 @@
+package main
+
+import (
+	"client"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"server"
+	"strings"
+	"testing"
+	"time"
+	. "util"
+)
+
+func TestSendFile(t *testing.T) {
+	usersPath := filepath.Join(t.TempDir(), "users.json")
+	err := os.WriteFile(usersPath, []byte(`{"alice": {"password": "1234"}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := server.NewHubWithOptions(server.ServerOptions{UserDBPath: usersPath})
+	if err := hub.LoadUserDB(); err != nil {
+		t.Fatal(err)
+	}
+	addr := listenOnLoopback(hub, t)
+	_, bob := startClient(t, addr, "bob")
+
+	// the empty line and the command aren't sent
+	file := strings.NewReader("first\n\n/who\nsecond\nthird\n")
+	result, err := client.SendFile(addr, UserCredentials{Name: "alice", Password: "1234"},
+		file, io.Discard, client.ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (client.SendFileResult{Sent: 3, Acked: 3}); result != expected {
+		t.Fatalf("expected %s, got %s", expected, result)
+	}
+	for _, msg := range []string{"first", "second", "third"} {
+		waitForLine(t, bob, "alice: "+msg)
+	}
+
+	_, err = client.SendFile(addr, UserCredentials{Name: "alice", Password: "wrong"},
+		strings.NewReader("hi\n"), io.Discard, client.ClientOptions{})
+	if err == nil || !strings.Contains(err.Error(), string(ResponseInvalidCredentials)) {
+		t.Fatalf("expected the login to fail, got %v", err)
+	}
+}
+
+// TestConcurrentClients sends from two clients in the same process at once,
+// then from another one of alice's. Had they shared ids, the server would take
+// some messages for resends of others and drop them.
+func TestConcurrentClients(t *testing.T) {
+	hub := server.NewHub()
+	addr := listenOnLoopback(hub, t)
+	_, carol := startClient(t, addr, "carol")
+	alice, _ := startClient(t, addr, "alice")
+	bob, _ := startClient(t, addr, "bob")
+
+	const lines = 100
+	file := func(name string, round int) string {
+		var file strings.Builder
+		for i := 1; i <= lines; i++ {
+			fmt.Fprintf(&file, "%s %d.%d\n", name, round, i)
+		}
+		return file.String()
+	}
+	typed := make(chan error, 2)
+	for name, user := range map[string]io.Writer{"alice": alice, "bob": bob} {
+		name, user := name, user
+		go func() {
+			_, err := io.WriteString(user, file(name, 1))
+			typed <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-typed; err != nil {
+			t.Fatal(err)
+		}
+	}
+	typeLines(t, alice, "/quit")
+	waitForSessionEnd(t, hub, "alice")
+	result, err := client.SendFile(addr, UserCredentials{Name: "alice", Password: "1234"},
+		strings.NewReader(file("alice", 2)), io.Discard, client.ClientOptions{})
+	if expected := (client.SendFileResult{Sent: lines, Acked: lines}); err != nil ||
+		result != expected {
+		t.Fatalf("expected %s, got %s, %v", expected, result, err)
+	}
+
+	seen := make(map[string]bool)
+	for len(seen) < 3*lines {
+		select {
+		case line := <-carol:
+			if line.Err != nil {
+				t.Fatal(line.Err)
+			}
+			if _, msg, ok := strings.Cut(line.Val, ": "); ok {
+				seen[msg] = true
+			}
+		case <-time.After(lineTimeout):
+			t.Fatalf("expected every message to be broadcast, got %d of %d", len(seen), 3*lines)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"time"
+	. "util"
+)
+
+// AdminsTag marks the messages sent with AdminsCmd, e.g "[admins] alice: the
+// deploy is done"
+const AdminsTag = "[admins]"
+
+// BroadcastToAdmins sends content from the admin sender to the other admins
+// online. It's not kept in the history, since everyone can replay that.
+func (hub *Hub) BroadcastToAdmins(content string, sender Username, ctx context.Context) Response {
+	if !hub.isAdmin(sender) {
+		return ResponseNotAdmin
+	}
+	hub.activeUsersLock.RLock()
+	if hub.shuttingDown {
+		hub.activeUsersLock.RUnlock()
+		return ResponseServerShuttingDown
+	}
+	senderName := DisplayName(sender)
+	if senderClient, isActive := hub.activeUsers[sender]; isActive {
+		senderName = senderClient.DisplayName()
+	}
+	var recipients []*ClientHandler
+	for name, client := range hub.activeUsers {
+		if name != sender && hub.isAdmin(name) {
+			recipients = append(recipients, client)
+		}
+	}
+	if len(recipients) == 0 {
+		hub.activeUsersLock.RUnlock()
+		return ResponseOk
+	}
+	ctx, cancel := hub.deliveryContext(ctx, time.Time{})
+	defer cancel()
+	msgs := enqueueForAll(recipients, func() *ChatMessage {
+		msg := NewChatMessage(senderName, content, ctx)
+		msg.toAdmins = true
+		return msg
+	})
+	hub.activeUsersLock.RUnlock()
+	return hub.waitForAll(recipients, msgs, ctx).Response()
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+	. "util"
+)
+
+// TestBroadcastToAdmins has admins alice and bob, and carol who isn't one
+func TestBroadcastToAdmins(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	carol := connectToHub(hub, t)
+	carol.register("carol")
+	hub.userDBLock.Lock()
+	hub.userDB["alice"].Admin = true
+	hub.userDB["bob"].Admin = true
+	hub.userDBLock.Unlock()
+
+	alice.send(MsgPrefix + "1;/admins restarting at noon")
+	bob.expect(MsgPrefix + AdminsTag + " alice: restarting at noon")
+	alice.expect("r1;" + string(ResponseOk))
+	alice.send(MsgPrefix + "2;/admins")
+	alice.expect("r2;" + string(ResponseInvalidArgument))
+
+	carol.send(MsgPrefix + "3;/admins let me in")
+	carol.expect("r3;" + string(ResponseNotAdmin))
+	// carol's next message is the next broadcast, not the admins' one
+	bob.send(MsgPrefix + "4;hi all")
+	carol.expect(MsgPrefix + "bob: hi all")
+	alice.expect(MsgPrefix + "bob: hi all")
+	bob.expect("r4;" + string(ResponseOk))
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	. "util"
+)
+
+// ServerBroadcastRetry is how long ServerBroadcast tries each user for by
+// default
+const ServerBroadcastRetry = 10 * time.Second
+
+// announceRetryInterval is how long ServerBroadcast waits to try a user again
+// after failing to, e.g while they reconnect
+const announceRetryInterval = 50 * time.Millisecond
+
+type ServerBroadcastOptions struct {
+	// RetryFor is how long each user is tried for, across their reconnects,
+	// ServerBroadcastRetry when 0
+	RetryFor time.Duration
+}
+
+// DeliveryReport tells who a ServerBroadcast reached, by name
+type DeliveryReport struct {
+	Delivered []Username
+	Unreached []Username
+}
+
+// ServerBroadcast sends content from the server itself to everyone online, as
+// an announcement. Unlike users' messages it's written ahead of their queues,
+// see writeSystemLine, and each user is tried again until RetryFor passes,
+// whatever their session does meanwhile. Draining doesn't stop it, so it can
+// warn of a shutdown.
+func (hub *Hub) ServerBroadcast(content string, opts ServerBroadcastOptions) DeliveryReport {
+	if opts.RetryFor == 0 {
+		opts.RetryFor = ServerBroadcastRetry
+	}
+	deadline := time.Now().Add(opts.RetryFor)
+	hub.activeUsersLock.RLock()
+	names := make([]Username, 0, len(hub.activeUsers))
+	for name := range hub.activeUsers {
+		names = append(names, name)
+	}
+	hub.activeUsersLock.RUnlock()
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+
+	line := SerializeAnnouncement(content)
+	reached := make([]bool, len(names))
+	var tries sync.WaitGroup
+	for i, name := range names {
+		tries.Add(1)
+		go func(i int, name Username) {
+			defer tries.Done()
+			reached[i] = hub.announceTo(name, line, deadline)
+		}(i, name)
+	}
+	tries.Wait()
+
+	var report DeliveryReport
+	for i, name := range names {
+		if reached[i] {
+			report.Delivered = append(report.Delivered, name)
+		} else {
+			report.Unreached = append(report.Unreached, name)
+		}
+	}
+	hub.logger.Printf("Server broadcast reached %d users, %d unreached\n", len(report.Delivered),
+		len(report.Unreached))
+	return report
+}
+
+// announceTo writes line to name's session, trying again until deadline. A
+// session that fails the write is ended, and name's next one tried.
+func (hub *Hub) announceTo(name Username, line string, deadline time.Time) bool {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	for {
+		hub.activeUsersLock.RLock()
+		handler, isActive := hub.activeUsers[name]
+		// a lingering session has no connection to write to, but its user
+		// may reconnect before the deadline
+		isActive = isActive && hub.lingering[name] == nil
+		hub.activeUsersLock.RUnlock()
+		if isActive {
+			err := handler.writeSystemLine(line, false, ctx)
+			if err == nil {
+				return true
+			} else if !errors.Is(err, errRecipientGone) && !errors.Is(err, ctx.Err()) {
+				handler.writeFailed(err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(announceRetryInterval):
+		}
+	}
+}
+
+// Announce is ServerBroadcast on behalf of the admin name
+func (hub *Hub) Announce(name Username, content string) (DeliveryReport, Response) {
+	if !hub.isAdmin(name) {
+		return DeliveryReport{}, ResponseNotAdmin
+	}
+	hub.logger.Printf("%s announced: %s\n", name, content)
+	return hub.ServerBroadcast(content, ServerBroadcastOptions{}), ResponseOk
+}
+
+// announce runs AnnounceCmd, listing who it didn't reach
+func (handler *ClientHandler) announce(content string) (Response, error) {
+	if content == "" {
+		return ResponseInvalidArgument, nil
+	}
+	report, response := handler.broadcaster.Announce(handler.Creds.Name, content)
+	if response != ResponseOk || len(report.Unreached) == 0 {
+		return response, nil
+	}
+	unreached := make([]string, len(report.Unreached))
+	for i, name := range report.Unreached {
+		unreached[i] = string(name)
+	}
+	if err := handler.forwardNoticeToUser("Unreached: " + strings.Join(unreached, ", ")); err != nil {
+		return ResponseIoErrorOccurred, err
+	}
+	if len(report.Delivered) == 0 {
+		return ResponseMsgFailedForAll, nil
+	}
+	return ResponseMsgFailedForSome, nil
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	. "util"
+)
+
+// TestServerBroadcastReport stalls bob, and checks the report names him while
+// everyone else got the announcement
+func TestServerBroadcastReport(t *testing.T) {
+	defer func(timeout time.Duration) { ClientWriteTimeout = timeout }(ClientWriteTimeout)
+	ClientWriteTimeout = 200 * time.Millisecond
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	carol := connectToHub(hub, t)
+	carol.register("carol")
+
+	reports := make(chan DeliveryReport)
+	go func() {
+		reports <- hub.ServerBroadcast("restarting in 5 minutes",
+			ServerBroadcastOptions{RetryFor: time.Second})
+	}()
+	announcement := SerializeAnnouncement("restarting in 5 minutes")
+	alice.expect(announcement)
+	carol.expect(announcement)
+	report := <-reports
+	if !reflect.DeepEqual(report, DeliveryReport{Delivered: []Username{"alice", "carol"},
+		Unreached: []Username{"bob"}}) {
+		t.Fatalf("expected only bob unreached, got %+v", report)
+	}
+	expectEnded(t, hub, "bob", EndWriteTimeout)
+}
+
+func TestAnnounceCmd(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	hub.userDBLock.Lock()
+	hub.userDB["alice"].Admin = true
+	hub.userDBLock.Unlock()
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+
+	bob.send(MsgPrefix + "1;/announce hi")
+	bob.expect("r1;" + string(ResponseNotAdmin))
+	alice.send(MsgPrefix + "1;/announce")
+	alice.expect("r1;" + string(ResponseInvalidArgument))
+	alice.send(MsgPrefix + "2;/announce maintenance at 5")
+	bob.expect(SerializeAnnouncement("maintenance at 5"))
+	alice.expect(SerializeAnnouncement("maintenance at 5"))
+	alice.expect("r2;" + string(ResponseOk))
+}
@@ -0,0 +1,17 @@
+package server
+
+import . "util"
+
+// BlockDMs has SendDirectMsg refuse the DMs to name for the rest of their
+// session, or take them again. Only the session's DMs are refused: when name
+// is offline, DMs to them are kept as usual.
+func (hub *Hub) BlockDMs(name Username, block bool) Response {
+	hub.activeUsersLock.Lock()
+	defer hub.activeUsersLock.Unlock()
+	client, isActive := hub.activeUsers[name]
+	if !isActive {
+		return ResponseInvalidCredentials
+	}
+	client.blocksDMs = block
+	return ResponseOk
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"testing"
+	"time"
+	. "util"
+)
+
+func TestBlockDMs(t *testing.T) {
+	hub := NewHub()
+	hub.offlineMsgs.now = func() time.Time { return time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC) }
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+
+	bob.send(MsgPrefix + "1;/block-dms")
+	bob.expect("r1;" + string(ResponseOk))
+	alice.send(MsgPrefix + "2;/msg bob hi bob")
+	alice.expect("r2;" + string(ResponseDMsBlocked))
+	// the room still gets through
+	alice.send(MsgPrefix + "3;hi all")
+	bob.expect(MsgPrefix + "alice: hi all")
+	alice.expect("r3;" + string(ResponseOk))
+	// bob can still send them
+	bob.send(MsgPrefix + "4;/msg alice hi alice")
+	alice.expect(MsgPrefix + "(DM) bob: hi alice")
+	bob.expect("r4;" + string(ResponseOk))
+
+	bob.send(MsgPrefix + "5;/allow-dms")
+	bob.expect("r5;" + string(ResponseOk))
+	alice.send(MsgPrefix + "6;/msg bob hi again")
+	bob.expect(MsgPrefix + "(DM) alice: hi again")
+	alice.expect("r6;" + string(ResponseOk))
+
+	// the block only lasts the session
+	bob.send(MsgPrefix + "7;/block-dms")
+	bob.expect("r7;" + string(ResponseOk))
+	bob.conn.Close()
+	waitForLogout(t, hub, "bob")
+	alice.send(MsgPrefix + "8;/msg bob later")
+	alice.expect("r8;" + string(ResponseQueuedForOffline))
+	bob = connectToHub(hub, t)
+	bob.login("bob")
+	bob.expect(MsgPrefix + "(DM 2020-01-01T12:00:00Z) alice: later")
+}
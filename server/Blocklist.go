@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+	. "util"
+)
+
+// BlocklistOptions set up the blocked words, which admins change with
+// BlockWordCmd and UnblockWordCmd
+type BlocklistOptions struct {
+	// Path, when set, is the file the blocked words are kept in, a word per
+	// line. It may be edited by hand while the server runs, see PollInterval.
+	Path string
+	// PollInterval, when set, is how often the file is checked for changes
+	// made by hand
+	PollInterval time.Duration
+	// Policy is what happens to messages with blocked words, until an admin
+	// changes it, see BlocklistPolicySetting
+	Policy BlocklistPolicy
+}
+
+type BlocklistPolicy int
+
+const (
+	// BlocklistReject answers messages with blocked words with
+	// ResponseBlockedContent
+	BlocklistReject BlocklistPolicy = iota
+	// BlocklistMask sends them with the blocked words masked, e.g "f***"
+	BlocklistMask
+)
+
+// BlocklistPolicySetting is the blocklist's policy, "reject" or "mask", e.g
+// "set blockpolicy mask". There's a single room, so it's the whole server's.
+const BlocklistPolicySetting = "blockpolicy"
+
+var blocklistPolicies = map[string]BlocklistPolicy{
+	"reject": BlocklistReject,
+	"mask":   BlocklistMask,
+}
+
+func (p BlocklistPolicy) String() string {
+	for name, policy := range blocklistPolicies {
+		if policy == p {
+			return name
+		}
+	}
+	return fmt.Sprintf("BlocklistPolicy(%d)", int(p))
+}
+
+// MaxBlockedWordLen bounds a blocked word, in bytes
+const MaxBlockedWordLen = 64
+
+// isWordRune tells whether r is part of a word. Marks are, since they combine
+// with the letter before them.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+func validBlockedWord(word string) bool {
+	if word == "" || len(word) > MaxBlockedWordLen || !utf8.ValidString(word) {
+		return false
+	}
+	return strings.IndexFunc(word, func(r rune) bool { return !isWordRune(r) }) < 0
+}
+
+// foldWord is the same for all the ways to case word, e.g "Σοφός" and
+// "ΣΟΦΌΣ", by unicode's simple case folding
+func foldWord(word string) string {
+	return strings.Map(func(r rune) rune {
+		folded := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < folded {
+				folded = f
+			}
+		}
+		return folded
+	}, word)
+}
+
+// maskWord keeps word's first letter, e.g "f***"
+func maskWord(word string) string {
+	_, size := utf8.DecodeRuneInString(word)
+	return word[:size] + strings.Repeat("*", utf8.RuneCountInString(word[size:]))
+}
+
+// wordMatcher finds the blocked words in messages. It's never changed but
+// replaced, see Hub.blocklist, so messages are matched without locking.
+type wordMatcher struct {
+	// folded are the words, see foldWord
+	folded map[string]bool
+	// words are as they were blocked, sorted, as they're saved
+	words []string
+}
+
+func newWordMatcher(words []string) *wordMatcher {
+	m := &wordMatcher{folded: make(map[string]bool, len(words))}
+	for _, word := range words {
+		if !m.folded[foldWord(word)] {
+			m.folded[foldWord(word)] = true
+			m.words = append(m.words, word)
+		}
+	}
+	sort.Strings(m.words)
+	return m
+}
+
+func (m *wordMatcher) blocks(word string) bool {
+	return m.folded[foldWord(word)]
+}
+
+// with is the matcher with word blocked or not
+func (m *wordMatcher) with(word string, block bool) *wordMatcher {
+	var words []string
+	for _, w := range m.words {
+		if foldWord(w) != foldWord(word) {
+			words = append(words, w)
+		}
+	}
+	if block {
+		words = append(words, word)
+	}
+	return newWordMatcher(words)
+}
+
+// filter returns msg with its blocked words masked, and whether it had any.
+// Only whole words match, so "ass" doesn't block "class".
+func (m *wordMatcher) filter(msg string) (masked string, found bool) {
+	if len(m.folded) == 0 {
+		return msg, false
+	}
+	var b strings.Builder
+	// copied is how much of msg is in b
+	copied := 0
+	for i := 0; i < len(msg); {
+		start := i
+		for i < len(msg) {
+			r, size := utf8.DecodeRuneInString(msg[i:])
+			if !isWordRune(r) {
+				break
+			}
+			i += size
+		}
+		if i == start {
+			_, size := utf8.DecodeRuneInString(msg[i:])
+			i += size
+			continue
+		}
+		if word := msg[start:i]; m.blocks(word) {
+			found = true
+			b.WriteString(msg[copied:start])
+			b.WriteString(maskWord(word))
+			copied = i
+		}
+	}
+	if !found {
+		return msg, false
+	}
+	b.WriteString(msg[copied:])
+	return b.String(), true
+}
+
+// FilterBlockedWords checks msg for blocked words. It's refused with
+// ResponseBlockedContent, or has them masked, as the blocklist's policy says.
+func (hub *Hub) FilterBlockedWords(msg string) (string, Response) {
+	masked, found := hub.blocklist.Load().filter(msg)
+	switch {
+	case !found:
+		return msg, ResponseOk
+	case BlocklistPolicy(hub.blocklistPolicy.Load()) == BlocklistMask:
+		return masked, ResponseOk
+	default:
+		return msg, ResponseBlockedContent
+	}
+}
+
+// BlockWord blocks word, or unblocks it, on behalf of the admin name. The
+// blocklist is saved to its file, if it has one, before this returns.
+func (hub *Hub) BlockWord(name Username, word string, block bool) Response {
+	if !hub.isAdmin(name) {
+		return ResponseNotAdmin
+	}
+	if !validBlockedWord(word) {
+		return ResponseInvalidArgument
+	}
+	hub.blocklistLock.Lock()
+	defer hub.blocklistLock.Unlock()
+	current := hub.blocklist.Load()
+	if current.blocks(word) == block {
+		return ResponseOk
+	}
+	updated := current.with(word, block)
+	hub.blocklist.Store(updated)
+	if block {
+		hub.logger.Printf("%s blocked the word %q\n", name, word)
+	} else {
+		hub.logger.Printf("%s unblocked the word %q\n", name, word)
+	}
+	if err := hub.saveBlocklist(updated.words); err != nil {
+		hub.logger.Printf("Error saving the blocklist: %s\n", err)
+	}
+	return ResponseOk
+}
+
+// readBlocklist reads a blocklist file, skipping empty lines and "#" comments
+func readBlocklist(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var words []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		if !validBlockedWord(word) {
+			return nil, fmt.Errorf("%s:%d: %q isn't a single word", path, line, word)
+		}
+		words = append(words, word)
+	}
+	return words, scanner.Err()
+}
+
+// saveBlocklist writes the words to the blocklist file, if there's one. The
+// blocklist lock must be held.
+func (hub *Hub) saveBlocklist(words []string) error {
+	path := hub.options.Blocklist.Path
+	if path == "" {
+		return nil
+	}
+	var data []byte
+	for _, word := range words {
+		data = append(append(data, word...), '\n')
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	version, err := statFile(path)
+	if err != nil {
+		return err
+	}
+	// so the watcher doesn't reload our own write
+	hub.blocklistVersion = version
+	return nil
+}
+
+// LoadBlocklist reads the blocked words from BlocklistOptions.Path, if set,
+// unless the file didn't change since it was last read or written. A missing
+// file is an empty list, created when a word is first blocked.
+func (hub *Hub) LoadBlocklist() error {
+	path := hub.options.Blocklist.Path
+	if path == "" {
+		return nil
+	}
+	hub.blocklistLock.Lock()
+	defer hub.blocklistLock.Unlock()
+	version, err := statFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		version, err = fileVersion{}, nil
+	}
+	if err != nil || version == hub.blocklistVersion {
+		return err
+	}
+	var words []string
+	if version != (fileVersion{}) {
+		if words, err = readBlocklist(path); err != nil {
+			return err
+		}
+	}
+	hub.blocklist.Store(newWordMatcher(words))
+	hub.blocklistVersion = version
+	hub.logger.Printf("Loaded %d blocked words\n", len(words))
+	return nil
+}
+
+// watchBlocklist reloads the blocklist whenever it changed on a tick, until
+// ticks is closed. A file caught mid-edit fails to parse and is retried on the
+// next tick.
+func (hub *Hub) watchBlocklist(ticks <-chan time.Time) {
+	for range ticks {
+		if err := hub.LoadBlocklist(); err != nil {
+			hub.logger.Printf("Error reloading the blocklist, will retry: %s\n", err)
+		}
+	}
+}
+
+func checkBlocklist(addr string, options ServerOptions) error {
+	blocklist := options.Blocklist
+	switch {
+	case blocklist.Policy < BlocklistReject || blocklist.Policy > BlocklistMask:
+		return fmt.Errorf("unknown blocklist policy %d", blocklist.Policy)
+	case blocklist.PollInterval < 0:
+		return errors.New("the blocklist poll interval can't be negative")
+	case blocklist.PollInterval != 0 && blocklist.Path == "":
+		return errors.New("polling the blocklist needs a blocklist path")
+	case blocklist.Path == "":
+		return ErrNothingToCheck
+	}
+	_, err := readBlocklist(blocklist.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
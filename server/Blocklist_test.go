@@ -0,0 +1,133 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	. "util"
+)
+
+func TestWordMatcher(t *testing.T) {
+	m := newWordMatcher([]string{"ass", "ΣΟΦΟΣ", "kilo"})
+	for _, test := range []struct {
+		msg, masked string
+	}{
+		// only whole words
+		{"a class act", ""},
+		{"assume nothing", ""},
+		{"bass4ss ass1", ""},
+		{"you ass!", "you a**!"},
+		{"the ass's bray", "the a**'s bray"},
+		{"(ass)ass", "(a**)a**"},
+		// folding case, in any script
+		{"ASS", "A**"},
+		{"ο σοφος", "ο σ****"},
+		// the final sigma folds to sigma, and the Kelvin sign to K, but a latin
+		// o is another letter
+		{"σοφος σοφoς σοφος", "σ**** σοφoς σ****"},
+		{"Kilo", "K***"},
+	} {
+		masked, found := m.filter(test.msg)
+		if !found && test.masked != "" || found && masked != test.masked {
+			t.Errorf("%q: expected %q, got %q (found %t)", test.msg, test.masked, masked, found)
+		}
+	}
+	if m.with("Ass", false).blocks("ass") || !m.with("class", true).blocks("CLASS") {
+		t.Fatal("expected blocking and unblocking to fold case too")
+	}
+}
+
+func TestBlockWordPolicies(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	hub.userDBLock.Lock()
+	hub.userDB["alice"].Admin = true
+	hub.userDBLock.Unlock()
+
+	bob.send(MsgPrefix + "1;/blockword darn")
+	bob.expect("r1;" + string(ResponseNotAdmin))
+	alice.send(MsgPrefix + "2;/blockword two words")
+	alice.expect("r2;" + string(ResponseInvalidArgument))
+	alice.send(MsgPrefix + "3;/blockword Darn")
+	alice.expect("r3;" + string(ResponseOk))
+
+	// rejected by default, DMs included
+	bob.send(MsgPrefix + "4;DARN it")
+	bob.expect("r4;" + string(ResponseBlockedContent))
+	bob.send(MsgPrefix + "5;/msg alice darn")
+	bob.expect("r5;" + string(ResponseBlockedContent))
+	bob.send(MsgPrefix + "6;darning socks")
+	alice.expect(MsgPrefix + "bob: darning socks")
+	bob.expect("r6;" + string(ResponseOk))
+
+	alice.send(MsgPrefix + "7;/set blockpolicy censor")
+	alice.expect("r7;" + string(ResponseInvalidArgument))
+	alice.send(MsgPrefix + "8;/set blockpolicy mask")
+	alice.expect(MsgPrefix + "Blocklist policy set to mask, from reject")
+	alice.expect("r8;" + string(ResponseOk))
+	bob.send(MsgPrefix + "9;DARN it")
+	alice.expect(MsgPrefix + "bob: D*** it")
+	bob.expect("r9;" + string(ResponseOk))
+
+	alice.send(MsgPrefix + "10;/unblockword darn")
+	alice.expect("r10;" + string(ResponseOk))
+	bob.send(MsgPrefix + "11;darn")
+	alice.expect(MsgPrefix + "bob: darn")
+	bob.expect("r11;" + string(ResponseOk))
+}
+
+func TestBlocklistFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist")
+	options := ServerOptions{Blocklist: BlocklistOptions{Path: path}}
+	hub := NewHubWithOptions(options)
+	if err := hub.LoadBlocklist(); err != nil {
+		t.Fatal(err)
+	}
+	hub.userDB["admin"] = &UserRecord{Password: "1234", Admin: true}
+	for _, word := range []string{"darn", "heck"} {
+		if r := hub.BlockWord("admin", word, true); r != ResponseOk {
+			t.Fatalf("expected blocking %s to work, got %q", word, r)
+		}
+	}
+
+	// a restarted server picks the words up
+	restarted := NewHubWithOptions(options)
+	if err := restarted.LoadBlocklist(); err != nil {
+		t.Fatal(err)
+	}
+	if _, r := restarted.FilterBlockedWords("heck"); r != ResponseBlockedContent {
+		t.Fatalf("expected the saved words to be blocked, got %q", r)
+	}
+
+	// and so does a running one, once the file is edited by hand
+	// of another size, for the change to show within the same mtime tick
+	edited := "# edited by hand\ngosh\n"
+	if err := os.WriteFile(path, []byte(edited), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ticks := make(chan time.Time)
+	go hub.watchBlocklist(ticks)
+	defer close(ticks)
+	ticks <- time.Now()
+	ticks <- time.Now()
+	if _, r := hub.FilterBlockedWords("gosh darn"); r != ResponseBlockedContent {
+		t.Fatalf("expected the edited list to be blocked, got %q", r)
+	}
+	if _, r := hub.FilterBlockedWords("darn"); r != ResponseOk {
+		t.Fatalf("expected the words edited out to be allowed, got %q", r)
+	}
+
+	if err := os.WriteFile(path, []byte("not one word\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.LoadBlocklist(); err == nil {
+		t.Fatal("expected a file with more than a word per line to fail to load")
+	}
+	if _, r := hub.FilterBlockedWords("gosh"); r != ResponseBlockedContent {
+		t.Fatalf("expected the last good list to be kept, got %q", r)
+	}
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	. "util"
+)
+
+// Bot is a user run in-process, e.g an automated responder, rather than by a
+// client on a connection. Its session is like anyone else's: it's among the
+// active users, gets the broadcasts, DMs and notices, and logs out the same.
+// It talks to the server like a legacy client, without capabilities.
+type Bot struct {
+	Name Username
+	// Lines has the lines the server writes to the bot other than the
+	// responses to Send, e.g "malice: hi". The bot should keep reading them
+	// like a client would, or its session ends for a write timeout.
+	Lines <-chan string
+
+	input chan ReadInput
+	out   *botOutput
+	ids   atomic.Int64
+	// ended is closed once the session is over, with why in cause
+	ended chan struct{}
+	cause EndCause
+}
+
+// botLinesBuffer is how many lines wait for a bot to read them before the
+// server's writes to it block
+const botLinesBuffer = 128
+
+// StartBot logs the bot name in, registering it first if there's no such
+// account yet, and runs its session until it logs out or the server shuts
+// down. The response is why it couldn't log in otherwise.
+func (hub *Hub) StartBot(name Username, password Password) (*Bot, Response) {
+	out := &botOutput{name: name, lines: make(chan string, botLinesBuffer),
+		closed: make(chan struct{}), responses: make(map[MsgID]chan Response)}
+	input := make(chan ReadInput)
+	request := &AuthRequest{ActionLogin, out, input,
+		&UserCredentials{Name: name, Password: password}, Capabilities{},
+		out.RemoteAddr().String()}
+	response, handler := hub.TryToAuthenticate(request)
+	if response == ResponseInvalidCredentials {
+		request.authType = ActionRegister
+		if response, handler = hub.TryToAuthenticate(request); response == ResponseUsernameExists {
+			// so it's the password that's wrong
+			response = ResponseInvalidCredentials
+		}
+	}
+	if response != ResponseOk {
+		return nil, response
+	}
+
+	bot := &Bot{Name: name, Lines: out.lines, input: input, out: out,
+		ended: make(chan struct{})}
+	go func() {
+		select {
+		case <-hub.shutDown:
+			handler.end(EndShutdown, nil)
+		case <-bot.ended:
+		}
+	}()
+	go func() {
+		bot.cause = hub.runSession(handler)
+		close(out.closed)
+		close(bot.ended)
+	}()
+	return bot, ResponseOk
+}
+
+// Send sends content as the bot, a message or a command like "/msg alice hi",
+// and returns the response to it. It's ResponseNotAuthenticated once the
+// session is over.
+func (b *Bot) Send(content string) Response {
+	id := MsgID(strconv.FormatInt(b.ids.Add(1), 10))
+	response := b.out.expect(id)
+	defer b.out.forget(id)
+	select {
+	case b.input <- ReadInput{Val: MsgPrefix + string(id) + IdSeparator + content}:
+	case <-b.ended:
+		return ResponseNotAuthenticated
+	}
+	select {
+	case r := <-response:
+		return r
+	case <-b.ended:
+		return ResponseNotAuthenticated
+	}
+}
+
+// Logout logs the bot out, and waits for its session to end
+func (b *Bot) Logout() {
+	select {
+	case b.input <- ReadInput{Val: MsgPrefix + IdSeparator + LogoutCmd.Serialize()}:
+	case <-b.ended:
+	}
+	<-b.ended
+}
+
+// Ended is closed once the bot's session is over, see EndCause
+func (b *Bot) Ended() <-chan struct{} {
+	return b.ended
+}
+
+// EndCause is why the bot's session ended, once Ended is closed
+func (b *Bot) EndCause() EndCause {
+	<-b.ended
+	return b.cause
+}
+
+// botOutput is a bot's side of its session, which the server writes to as it
+// would to a client's conn
+type botOutput struct {
+	name  Username
+	lines chan string
+	// closed is closed once the session is over, failing the writes after it
+	closed chan struct{}
+
+	lock     sync.Mutex
+	deadline time.Time
+	// responses are for the responses Send waits for, by id
+	responses map[MsgID]chan Response
+}
+
+func (o *botOutput) expect(id MsgID) <-chan Response {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	response := make(chan Response, 1)
+	o.responses[id] = response
+	return response
+}
+
+func (o *botOutput) forget(id MsgID) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	delete(o.responses, id)
+}
+
+// answer hands r to the Send waiting for it, if any
+func (o *botOutput) answer(r ServerResponse) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	response, waiting := o.responses[r.Id]
+	if waiting {
+		response <- r.Response
+		delete(o.responses, r.Id)
+	}
+	return waiting
+}
+
+// SetWriteDeadline bounds the writes like a conn's, see ClientWriteTimeout
+func (o *botOutput) SetWriteDeadline(t time.Time) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.deadline = t
+	return nil
+}
+
+func (o *botOutput) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		if r, ok := ParseServerResponse(line); ok && o.answer(r) {
+			continue
+		}
+		if err := o.writeLine(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (o *botOutput) writeLine(line string) error {
+	o.lock.Lock()
+	deadline := o.deadline
+	o.lock.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case o.lines <- line:
+		return nil
+	case <-o.closed:
+		return io.ErrClosedPipe
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// botAddr is where a bot's session shows it's from, e.g in SessionsCmd
+type botAddr Username
+
+func (a botAddr) Network() string { return "bot" }
+func (a botAddr) String() string  { return "bot:" + string(a) }
+
+func (o *botOutput) RemoteAddr() net.Addr {
+	return botAddr(o.name)
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	. "util"
+)
+
+// runEchoBot sends back every message the bot gets from someone else
+func runEchoBot(bot *Bot) {
+	for {
+		select {
+		case line := <-bot.Lines:
+			if _, isDM := ParseDirectMsg(line); isDM || !strings.HasPrefix(line, MsgPrefix) {
+				continue
+			}
+			if sender, content, ok := strings.Cut(line[len(MsgPrefix):], ": "); ok &&
+				Username(sender) != bot.Name {
+				bot.Send(content)
+			}
+		case <-bot.Ended():
+			return
+		}
+	}
+}
+
+func TestEchoBot(t *testing.T) {
+	hub := NewHub()
+	bot, r := hub.StartBot("echo", "1234")
+	if r != ResponseOk {
+		t.Fatalf("expected the bot to start, got %q", r)
+	}
+	go runEchoBot(bot)
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	if users := hub.ActiveUsers(); len(users) != 2 {
+		t.Fatalf("expected the bot to be online with alice, got %v", users)
+	}
+
+	alice.send(MsgPrefix + "1;hello")
+	// the echo may come before the response
+	var lines []string
+	for i := 0; i < 2; i++ {
+		err := alice.conn.SetReadDeadline(time.Now().Add(time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := ScanLine(alice.scanner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	if lines[0] != MsgPrefix+"echo: hello" || lines[1] != "r1;"+string(ResponseOk) {
+		t.Fatalf("expected the bot's echo and the response, got %q", lines)
+	}
+
+	bot.Logout()
+	if cause := bot.EndCause(); cause != EndLoggedOut {
+		t.Fatalf("expected the bot to log out, got %q", cause)
+	}
+	waitForLogout(t, hub, "echo")
+	if r := bot.Send("anyone there?"); r != ResponseNotAuthenticated {
+		t.Fatalf("expected sending after logout to be refused, got %q", r)
+	}
+
+	// the account stays, so the bot logs in with it again
+	bot, r = hub.StartBot("echo", "1234")
+	if r != ResponseOk {
+		t.Fatalf("expected the bot to log in again, got %q", r)
+	}
+	defer bot.Logout()
+	if _, r := hub.StartBot("echo", "1234"); r != ResponseUserAlreadyOnline {
+		t.Fatalf("expected a second bot of the same name to be refused, got %q", r)
+	}
+	select {
+	case line := <-bot.Lines:
+		if !strings.Contains(line, "A login to your account was attempted from bot") {
+			t.Fatalf("expected the bot to be warned of the other login, got %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the bot to be warned of the other login")
+	}
+	if _, r := hub.StartBot("alice", "wrong"); r != ResponseInvalidCredentials {
+		t.Fatalf("expected a wrong password to be refused, got %q", r)
+	}
+}
+
+// TestBotNotReading checks a bot that stops reading its lines is dropped like
+// a client that does
+func TestBotNotReading(t *testing.T) {
+	defer func(timeout time.Duration) { ClientWriteTimeout = timeout }(ClientWriteTimeout)
+	ClientWriteTimeout = 10 * time.Millisecond
+	hub := NewHub()
+	bot, r := hub.StartBot("idle", "1234")
+	if r != ResponseOk {
+		t.Fatalf("expected the bot to start, got %q", r)
+	}
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	for i := 0; i <= botLinesBuffer; i++ {
+		hub.BroadcastMessage("hi", "alice", time.Time{}, context.Background())
+	}
+	if cause := bot.EndCause(); cause != EndWriteTimeout {
+		t.Fatalf("expected the bot's session to time out, got %q", cause)
+	}
+	waitForLogout(t, hub, "idle")
+	// before ClientWriteTimeout is put back
+	alice.conn.Close()
+	waitForLogout(t, hub, "alice")
+}
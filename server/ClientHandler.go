@@ -1,28 +1,104 @@
 package server
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	. "util"
 )
 
 type Broadcaster interface {
-	BroadcastMessage(content string, sender Username, ctx context.Context) Response
+	BroadcastMessage(content string, sender Username, expires time.Time, ctx context.Context) Response
+	BroadcastMessageOnce(id MsgID, content string, sender Username, ctx context.Context) Response
+	SendDirectMsg(content string, sender Username, to Username, expires time.Time,
+		ctx context.Context) Response
+	BroadcastToAdmins(content string, sender Username, ctx context.Context) Response
+	Announce(name Username, content string) (DeliveryReport, Response)
+}
+
+type UserDirectory interface {
+	SetDisplayName(name Username, displayName DisplayName) Response
+	ActiveUsers() []string
+	SubscribeToPresence(name Username, subscribe bool) Response
+	Sessions() []string
+	History(n int) []HistoryEntry
+	Export(name Username) []HistoryEntry
+	React(id uint64, name Username, emoji string) (tally string, r Response)
+	Set(name Username, setting string, value string) (notice string, r Response)
+	Version() string
+	RegistrationOpen() bool
+	MOTD() string
+	EndedSessionsFor(name Username) ([]string, Response)
+	ClientVersionsFor(name Username) (string, Response)
+	BlockDMs(name Username, block bool) Response
+	Verify(name Username, code string) Response
+	Shed(name Username, percent int, addr string) ([]Username, Response)
+	BlockWord(name Username, word string, block bool) Response
+	FilterBlockedWords(msg string) (string, Response)
 }
 
 type ClientHandler struct {
-	SendMsg     chan *ChatMessage
-	errs        chan error
-	relog       chan struct{}
+	SendMsg  chan *ChatMessage
+	presence chan PresenceEvent
+	// notices are lines from the server, e.g reaction tallies, which aren't
+	// answers to the user's commands
+	notices chan queuedNotice
+	// system has the lines written ahead of everything queued, see
+	// writeSystemLine
+	system chan systemLine
+	// ends has why the session ended, see end
+	ends  chan sessionEnded
+	relog chan struct{}
+	// ended is closed once the session is over, so no one waits on it anymore
+	ended       chan struct{}
 	Creds       *UserCredentials
+	loggedIn    time.Time
 	clientIn    io.Writer
 	clientOut   <-chan ReadInput
 	broadcaster Broadcaster
+	users       UserDirectory
+	options     *ServerOptions
+	caps        Capabilities
+	// framing is the one caps ask for, which every line to the client is in
+	framing Framing
+	// displayName is guarded by the hub's activeUsersLock
+	displayName DisplayName
+	// blocksDMs is set by BlockDMsCmd, guarded by the hub's activeUsersLock
+	blocksDMs bool
+	// unverified is set until the user verifies their new account, see
+	// ServerOptions.RequireVerification. Only used by the goroutine reading
+	// their input.
+	unverified bool
+	// welcome are the lines written before anything else, see Hub.welcome.
+	// Only used by the goroutine writing to the client.
+	welcome []string
+	// lastMsgSent is when the user last sent a message, for MinMsgInterval.
+	// Only used by the goroutine reading their input.
+	lastMsgSent time.Time
+	// quitID is the id of the LogoutCmd that ended the session, answered once
+	// the session's last lines are written, see runSession. It's empty when
+	// the client doesn't wait for the answer. Set by the goroutine reading
+	// their input before it signals relog.
+	quitID MsgID
+	// lastActive is when the user last sent a message, or logged in, in Unix
+	// nanoseconds, for ShedCmd to tell the idle users
+	lastActive atomic.Int64
+	// logger is the hub's
+	logger *log.Logger
+
+	// broadcasts queues the messages to broadcast, and operations has those
+	// not done yet by id
+	broadcasts     chan *operation
+	operations     map[MsgID]*operation
+	operationsLock sync.Mutex
 }
 
 type AuthRequest struct {
@@ -30,6 +106,10 @@ type AuthRequest struct {
 	clientIn  io.Writer
 	clientOut <-chan ReadInput
 	creds     *UserCredentials
+	caps      Capabilities
+	// remoteAddr is the client's, which the user is told of when it tries to
+	// log in as them while they're online
+	remoteAddr string
 }
 
 func strToAuthAction(str string) (AuthAction, error) {
@@ -39,14 +119,40 @@ func strToAuthAction(str string) (AuthAction, error) {
 	case ActionIOErr: // happens when the client quits without choosing
 		return ActionIOErr, ErrClientHasQuit
 	default:
-		return ActionIOErr, fmt.Errorf("weird output from clientConn: %s", str)
+		return ActionIOErr, &OddOutputError{Line: str}
 	}
 }
 
-func acceptAuthRequest(clientIn io.Writer, clientOut <-chan ReadInput) (*AuthRequest, error) {
-	choice := <-clientOut
-	if choice.Err != nil {
-		return nil, choice.Err
+var ErrMsgBeforeAuth = errors.New("client sent a message before authenticating")
+
+// acceptAuthRequest reads the next auth attempt. afterLogout is set when the
+// client already logged out on this connection, in which case messages it sent
+// before noticing it's logged out are skipped, and logged to logger. framing
+// is what to answer them in.
+func acceptAuthRequest(clientIn io.Writer, clientOut <-chan ReadInput, framing Framing,
+	afterLogout bool, logger *log.Logger) (*AuthRequest, error) {
+	var choice ReadInput
+	for {
+		choice = <-clientOut
+		if choice.Err != nil {
+			return nil, choice.Err
+		}
+		id, _, isMsg := parseInputMsg(choice.Val)
+		if !isMsg {
+			break
+		}
+		if afterLogout {
+			logger.Printf("Skipping message sent after logout: %s\n", choice.Val)
+			continue
+		}
+		// e.g a client that reconnected and thinks it's still logged in
+		if id.IsValid() {
+			err := forwardResponseToUser(clientIn, framing, id, ResponseNotAuthenticated)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, ErrMsgBeforeAuth
 	}
 	action, err := strToAuthAction(choice.Val)
 	if err != nil {
@@ -65,167 +171,658 @@ func acceptAuthRequest(clientIn io.Writer, clientOut <-chan ReadInput) (*AuthReq
 
 	return &AuthRequest{action, clientIn, clientOut,
 		&UserCredentials{Name: Username(username.Val),
-			Password: Password(password.Val)}}, nil
+			Password: Password(password.Val)}, nil, ""}, nil
 }
-func newClientHandler(r *AuthRequest, broadcaster Broadcaster) *ClientHandler {
-	errs := make(chan error, 128)
+func newClientHandler(r *AuthRequest, hub *Hub) *ClientHandler {
 	relog := make(chan struct{}, 1)
-	sendMsg := make(chan *ChatMessage, 128)
-	return &ClientHandler{sendMsg, errs, relog,
-		r.creds, r.clientIn, r.clientOut, broadcaster}
+	sendMsg := make(chan *ChatMessage, MaxQueuedMsgs)
+	presence := make(chan PresenceEvent, 128)
+	handler := &ClientHandler{SendMsg: sendMsg, presence: presence,
+		notices: make(chan queuedNotice, maxQueuedNotices), system: make(chan systemLine),
+		ends: make(chan sessionEnded, 1), relog: relog, ended: make(chan struct{}),
+		Creds: r.creds, loggedIn: time.Now(),
+		clientIn: r.clientIn, clientOut: r.clientOut, broadcaster: hub,
+		users: hub, options: &hub.options, caps: r.caps, framing: FramingOf(r.caps),
+		logger: hub.logger, broadcasts: make(chan *operation, 128),
+		operations: make(map[MsgID]*operation)}
+	handler.lastActive.Store(handler.loggedIn.UnixNano())
+	return handler
+}
+
+// DisplayName is the name other users see. Should be called with the hub's
+// activeUsersLock held.
+func (handler *ClientHandler) DisplayName() DisplayName {
+	if handler.displayName == "" {
+		return DisplayName(handler.Creds.Name)
+	}
+	return handler.displayName
+}
+
+// byteCounter is implemented by CountingConn
+type byteCounter interface {
+	BytesRead() int64
+	BytesWritten() int64
+}
+
+// byteCounts returns the bytes the client sent and received on its connection
+// so far, or ok=false if the connection isn't counted
+func (handler *ClientHandler) byteCounts() (in, out int64, ok bool) {
+	counter, ok := handler.clientIn.(byteCounter)
+	if !ok {
+		return 0, 0, false
+	}
+	return counter.BytesRead(), counter.BytesWritten(), true
 }
+
+// isClosedConnErr tells whether err is from using a conn closed while the
+// session was still writing to it. io.ErrClosedPipe is net.Pipe's.
+func isClosedConnErr(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
+}
+
+// MaxQueuedMsgs is how many messages can wait to be written to a client. One
+// more and the client is disconnected, since it stopped reading and holding
+// its messages would only hold memory.
+const MaxQueuedMsgs = 128
+
+// maxQueuedNotices is how many notices a session holds before dropping them
+const maxQueuedNotices = 128
+
+// enqueueMsg queues msg for the session to write, without blocking
+func (handler *ClientHandler) enqueueMsg(msg *ChatMessage) {
+	select {
+	case handler.SendMsg <- msg:
+	default:
+		msg.Finish(errRecipientQueueFull)
+		handler.end(EndTooSlow, errClientTooSlow)
+	}
+}
+
+// Close doesn't close SendMsg, since broadcasts that started before Logout may
+// still send to it. Its receive loop stops with the session's context instead.
 func (handler *ClientHandler) Close() error {
-	close(handler.SendMsg)
 	return nil
 }
 
+// kick tells the user why they're being logged out, then logs them out by
+// failing the reads of their connection, which ends their session like any
+// disconnect. The conn is left for HandleNewConnection to close, so it's
+// closed once. by is who kicked them, for the record.
+func (handler *ClientHandler) kick(by string, reason LogoutReason) {
+	err := handler.writeSystemLine(reason.Cmd().Serialize(), true, context.Background())
+	if err != nil && !isClosedConnErr(err) && !errors.Is(err, errRecipientGone) {
+		handler.logger.Printf("Error telling %s why they're kicked: %s\n", handler.Creds.Name, err)
+	}
+	// before the reads fail, which would end it as a read error
+	handler.end(EndKicked, fmt.Errorf("by %s: %s", by, reason))
+	if conn, ok := handler.clientIn.(interface{ SetReadDeadline(time.Time) error }); ok {
+		err := conn.SetReadDeadline(time.Now())
+		if err != nil {
+			handler.logger.Println(err)
+		}
+	}
+}
+
+// HandleNewConnection serves conn until the client leaves, and closes it
 func (hub *Hub) HandleNewConnection(conn net.Conn) {
-	defer ClosePrintErr(conn)
-	defer log.Printf("Disconnected: %s\n", conn.RemoteAddr())
+	// Drain may close it first, everything else leaves it to this
+	conn = &closeOnceConn{Conn: conn}
+	defer hub.closeLogErr(conn)
+	// counting outermost keeps the counts reachable from the handler's clientIn
+	counted := NewCountingConn(hub.traceConn(conn))
+	defer func() {
+		hub.logger.Printf("Disconnected: %s (%d bytes in, %d bytes out)\n",
+			counted.RemoteAddr(), counted.BytesRead(), counted.BytesWritten())
+	}()
+
+	conn = counted
+	if !hub.trackConn(conn) {
+		// we're draining, so the client is only told where to go instead
+		sendReconnectNotice(conn, hub.options.DrainRedirect, hub.logger)
+		return
+	}
+	defer hub.untrackConn(conn)
+
+	// stops the goroutines reading the conn, once it's closed too
+	done := make(chan struct{})
+	defer close(done)
+	maxLineLen := hub.options.MaxLineLen
+	if maxLineLen <= 0 {
+		maxLineLen = DefaultMaxLineLen
+	}
+	caps, clientIn := readCapabilities(
+		ReadAsyncIntoChanUntil(NewProtocolScannerMax(conn, maxLineLen), done), done)
+	hub.setConnCapabilities(conn, caps)
+	clientIn, admitted := hub.admit(conn, caps, clientIn, done)
+	if !admitted {
+		return
+	}
+	defer hub.releaseConn()
+	hub.exchangeVersions(conn, caps)
+	afterLogout := false
+	for hub.handleUntilLoggedOut(conn, clientIn, caps, afterLogout) {
+		afterLogout = true
+	}
+}
 
-	clientIn := ReadAsyncIntoChan(bufio.NewScanner(conn))
-	shouldRelog := true
-	for shouldRelog {
-		shouldRelog = hub.handleUntilLoggedOut(conn, clientIn)
+// readCapabilities reads the capabilities line a client sends first. A legacy
+// client's first line is something else, which is put back for the auth to
+// read.
+func readCapabilities(clientIn <-chan ReadInput, done <-chan struct{}) (
+	Capabilities, <-chan ReadInput) {
+	first := <-clientIn
+	if first.Err == nil {
+		if caps, ok := ParseCapabilities(first.Val); ok {
+			return caps, clientIn
+		}
 	}
+	return Capabilities{}, putBack([]ReadInput{first}, clientIn, done)
 }
 
-func (hub *Hub) handleUntilLoggedOut(clientOut io.Writer, clientIn <-chan ReadInput) (expectedToRelog bool) {
-	handler, err := hub.acceptAuthRetry(clientOut, clientIn)
-	if err != nil {
-		if err == ErrClientHasQuit {
-			return false
+// putBack is clientIn with held, read from it already, read first again
+func putBack(held []ReadInput, clientIn <-chan ReadInput, done <-chan struct{}) <-chan ReadInput {
+	withHeld := make(chan ReadInput)
+	go func() {
+		for {
+			next := held[0]
+			select {
+			case withHeld <- next:
+			case <-done:
+				return
+			}
+			if next.Err != nil {
+				return
+			}
+			if held = held[1:]; len(held) != 0 {
+				continue
+			}
+			select {
+			case input := <-clientIn:
+				held = append(held, input)
+			case <-done:
+				return
+			}
 		}
+	}()
+	return withHeld
+}
+
+func (hub *Hub) handleUntilLoggedOut(conn net.Conn, clientIn <-chan ReadInput,
+	caps Capabilities, afterLogout bool) (expectedToRelog bool) {
+	handler, err := hub.acceptAuthRetry(conn, clientIn, caps, afterLogout)
+	if errors.Is(err, ErrLineTooLong) {
+		hub.logger.Printf("Disconnecting %s, which sent a line too long\n", conn.RemoteAddr())
+	}
+	if err != nil {
 		return false
 	}
-	defer hub.Logout(handler.Creds.Name)
+	return hub.runSession(handler) == EndLoggedOut
+}
 
+// runSession runs a logged in user's session until it ends, and returns why
+func (hub *Hub) runSession(handler *ClientHandler) EndCause {
 	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 	go handler.sendMsgsLoop(ctx)
-	go handler.receivePendingMsgsLoop(ctx)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		handler.receivePendingMsgsLoop(ctx)
+	}()
+	var ended sessionEnded
 	select {
 	case <-handler.relog:
-		return true
-	case err := <-handler.errs:
-		if err == ErrClientHasQuit {
-			return false
-		} else if err != nil {
-			fmt.Println(err)
-			return false
-		} else {
-			panic("unreachable")
+		ended = sessionEnded{cause: EndLoggedOut}
+	case ended = <-handler.ends:
+	}
+	cancel()
+	cause := hub.recordSessionEnd(handler, ended)
+	hub.endSession(handler, cause)
+	if cause == EndLoggedOut && handler.quitID != "" {
+		// the answer is the session's last line, so the client has seen all
+		// it's getting by then. What was still queued is given up on.
+		<-written
+		if err := handler.forwardResponseToUser(handler.quitID, ResponseOk); err != nil &&
+			!isClosedConnErr(err) {
+			handler.logger.Printf("Error answering %s's logout: %s\n", handler.Creds.Name, err)
 		}
 	}
+	return cause
 }
 
-func (hub *Hub) acceptAuthRetry(clientIn io.Writer, clientOut <-chan ReadInput) (*ClientHandler, error) {
+func (hub *Hub) acceptAuthRetry(clientIn net.Conn, clientOut <-chan ReadInput,
+	caps Capabilities, afterLogout bool) (*ClientHandler, error) {
 	for {
-		request, err := acceptAuthRequest(clientIn, clientOut)
+		request, err := acceptAuthRequest(clientIn, clientOut, FramingOf(caps), afterLogout,
+			hub.logger)
 		if err != nil {
 			return nil, err
 		}
+		request.caps = caps
+		request.remoteAddr = clientIn.RemoteAddr().String()
 
 		response, handler := hub.TryToAuthenticate(request)
 		if response == ResponseOk {
-			return handler, handler.forwardResponseToUser("", ResponseOk)
+			return handler, handler.forwardResponseToUser(AuthResponseID, ResponseOk)
 		}
 
 		// try to communicate that we're retrying
-		err = forwardResponseToUser(clientIn, "", response)
+		err = forwardResponseToUser(clientIn, FramingOf(caps), AuthResponseID, response)
 		if err != nil {
-			log.Printf("Error with %s: %s\n", handler.Creds.Name, err)
+			hub.logger.Printf("Error with %s: %s\n", request.creds.Name, err)
 			return nil, err
 		}
 	}
 }
 
-func forwardResponseToUser(clientIn io.Writer, id MsgID, r Response) error {
-	_, err := clientIn.Write([]byte(ServerResponsePrefix + string(id) +
-		IdSeparator + string(r) + "\n"))
+// ClientWriteTimeout bounds each write to a client, so a client that stopped
+// reading can't hold up the goroutines writing to it forever
+var ClientWriteTimeout = time.Second * 10
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// writeLine writes a protocol line to the client, within ClientWriteTimeout if
+// the conn supports deadlines
+func writeLine(clientIn io.Writer, line string) error {
+	if conn, ok := clientIn.(writeDeadliner); ok {
+		err := conn.SetWriteDeadline(time.Now().Add(ClientWriteTimeout))
+		if err != nil {
+			return err
+		}
+	}
+	_, err := clientIn.Write([]byte(line + "\n"))
 	return err
 }
+
+// writeLine writes a protocol line to the client in the session's framing
+func (handler *ClientHandler) writeLine(line string) error {
+	return writeLine(handler.clientIn, handler.framing.Frame(line))
+}
+
+func forwardResponseToUser(clientIn io.Writer, framing Framing, id MsgID, r Response) error {
+	return writeLine(clientIn,
+		framing.Frame(ServerResponse{Response: r, Id: id}.Serialize()))
+}
 func (handler *ClientHandler) forwardResponseToUser(id MsgID, r Response) error {
-	return forwardResponseToUser(handler.clientIn, id, r)
+	return handler.writeLine(ServerResponse{Response: r, Id: id}.Serialize())
+}
+
+// systemLine is a line about the session itself, like the logout command,
+// which mustn't wait behind a backlog of chat
+type systemLine struct {
+	line string
+	// final is the last line written to the session, e.g as it's ending
+	final   bool
+	written chan error
+}
+
+// writeSystemLine has line written next, ahead of the queued messages and
+// notices, and waits for it to be written. Unlike the messages, it's never
+// dropped for a full queue. Failing to write it doesn't end the session, which
+// is the caller's to do. ctx only bounds waiting for the line being written
+// before it.
+func (handler *ClientHandler) writeSystemLine(line string, final bool,
+	ctx context.Context) error {
+	written := make(chan error, 1)
+	select {
+	case handler.system <- systemLine{line, final, written}:
+	case <-handler.ended:
+		return errRecipientGone
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-written
+}
+
+// forwardSystemLine writes line, and tells whether to keep writing afterwards
+func (handler *ClientHandler) forwardSystemLine(line systemLine) bool {
+	err := handler.writeLine(line.line)
+	line.written <- err
+	return err == nil && !line.final
 }
 
 func (handler *ClientHandler) receivePendingMsgsLoop(ctx context.Context) {
+	for _, line := range handler.welcome {
+		if err := handler.writeLine(line); err != nil {
+			handler.writeFailed(err)
+			return
+		}
+	}
+	handler.welcome = nil
 	for {
+		// the system lines go first, whatever else is queued
+		select {
+		case line := <-handler.system:
+			if !handler.forwardSystemLine(line) {
+				return
+			}
+			continue
+		default:
+		}
 		select {
 		case <-ctx.Done():
 			return
+		case line := <-handler.system:
+			if !handler.forwardSystemLine(line) {
+				return
+			}
 		case msg := <-handler.SendMsg:
 			handler.forwardMsgToUser(msg)
+		case event := <-handler.presence:
+			handler.forwardPresenceToUser(event)
+		case notice := <-handler.notices:
+			if err := handler.forwardQueuedNotice(notice); err != nil {
+				handler.writeFailed(err)
+			}
 		}
 	}
 }
 
 func (handler *ClientHandler) sendMsgsLoop(ctx context.Context) {
+	broadcastsFinished := make(chan struct{})
+	go handler.broadcastLoop(ctx, broadcastsFinished)
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case input := <-handler.clientOut:
 			if input.Err != nil {
-				handler.errs <- input.Err
+				handler.readFailed(input.Err)
 				return
 			}
 			err := handler.dispatchUserInput(input.Val, ctx)
-			if err != nil {
-				handler.errs <- err
+			if errors.Is(err, errLoggedOut) {
+				// stop reading here, the next lines are the client's next auth
+				// attempt. The messages before the logout still go out.
+				close(handler.broadcasts)
+				<-broadcastsFinished
+				handler.relog <- struct{}{}
+				return
+			} else if err != nil {
+				handler.writeFailed(err)
 				return
 			}
 		}
 	}
 }
 
+// parseInputMsg parses a message line in either framing
 func parseInputMsg(input string) (id MsgID, msg string, ok bool) {
+	input = Unframe(input)
 	if !strings.HasPrefix(input, MsgPrefix) {
 		return "", "", false
 	}
-	input = input[len(MsgPrefix):]
-	parts := strings.Split(input, IdSeparator)
-	if len(parts) < 2 {
-		return "", "", false
+	return SplitIDLine(input[len(MsgPrefix):])
+}
+
+// validMsgID reports whether id can be echoed back in msg's response. Only
+// /quit may have no id, for clients that don't wait for its response.
+func validMsgID(id MsgID, msg string) bool {
+	if id == "" && IsCmd(msg) {
+		name, _ := UnserializeStrToCmd(msg).Split()
+		return name == LogoutCmd
 	}
-	id = MsgID(parts[0])
-	msg = input[len(id)+len(IdSeparator):]
-	return id, msg, true
+	return id.IsValid()
 }
 
 func (handler *ClientHandler) dispatchUserInput(input string, ctx context.Context) error {
 	id, msg, ok := parseInputMsg(input)
-	if !ok {
-		return ErrOddOutput
+	if !ok || !validMsgID(id, msg) {
+		return &OddOutputError{Line: input}
+	}
+	if handler.unverified && !allowedUnverified(msg) {
+		return handler.forwardResponseToUser(id, ResponseNotVerified)
+	}
+	if hasControlChars(msg) {
+		if handler.options.ControlChars == ControlCharsReject {
+			return handler.forwardResponseToUser(id, ResponseControlChars)
+		}
+		msg = stripControlChars(msg)
+	}
+	if sendsMessage(msg) {
+		var response Response
+		if msg, response = handler.users.FilterBlockedWords(msg); response != ResponseOk {
+			return handler.forwardResponseToUser(id, response)
+		}
+	}
+	if handler.throttled(msg, time.Now()) {
+		return handler.forwardResponseToUser(id, ResponseSlowDown)
+	}
+	if sendsMessage(msg) {
+		handler.lastActive.Store(time.Now().UnixNano())
 	}
 
+	var response Response
 	if IsCmd(msg) {
-		return handler.dispatchCmd(UnserializeStrToCmd(msg))
+		var err error
+		response, err = handler.runUserCommand(UnserializeStrToCmd(msg), ctx)
+		if errors.Is(err, errLoggedOut) {
+			handler.quitID = id
+		}
+		if err != nil {
+			return err
+		}
+	} else if strings.TrimSpace(msg) == "" &&
+		handler.options.EmptyMessages != EmptyMessagesAllow {
+		if handler.options.EmptyMessages == EmptyMessagesReject {
+			response = ResponseEmptyMessage
+		} else {
+			response = ResponseOk
+		}
 	} else {
-		response := handler.broadcaster.BroadcastMessage(msg, handler.Creds.Name, ctx)
-		return handler.forwardResponseToUser(id, response)
+		response = handler.startBroadcast(id, msg, ctx)
 	}
+	if response == noResponse {
+		return nil
+	}
+	return handler.forwardResponseToUser(id, response)
 }
 
-func (handler *ClientHandler) dispatchCmd(cmd Cmd) error {
-	switch cmd {
+var errLoggedOut = errors.New("user logged out")
+
+// noResponse is returned by commands after which the client doesn't wait for a
+// response
+const noResponse Response = ""
+
+// runUserCommand returns the command's result, which is the response to send
+// for the command's id. The error is reserved for failing to talk to the user.
+func (handler *ClientHandler) runUserCommand(cmd Cmd, ctx context.Context) (Response, error) {
+	name, args := cmd.Split()
+	switch name {
 	case LogoutCmd:
-		handler.relog <- struct{}{}
-		return nil
+		// a response here could be mistaken by the client for the response to
+		// its next auth attempt, or come before the session's last lines, so
+		// it's left to runSession
+		return noResponse, errLoggedOut
+	case DisplayNameCmd:
+		return handler.users.SetDisplayName(handler.Creds.Name, DisplayName(args)), nil
+	case SubscribeCmd, UnsubscribeCmd:
+		if args != PresenceTopic {
+			return ResponseUnknownTopic, nil
+		}
+		if name == SubscribeCmd && !handler.caps.Supports(CapPresence) {
+			return ResponseUnsupportedByClient, nil
+		}
+		return handler.users.SubscribeToPresence(handler.Creds.Name, name == SubscribeCmd), nil
+	case PingCmd:
+		return ResponseOk, nil
+	case WhoCmd:
+		err := handler.forwardNoticeToUser("Online: " +
+			strings.Join(handler.users.ActiveUsers(), ", "))
+		if err != nil {
+			return ResponseIoErrorOccurred, err
+		}
+		return ResponseOk, nil
+	case PendingCmd:
+		err := handler.forwardNoticeToUser("Pending: " +
+			strings.Join(handler.pendingOperations(), ", "))
+		if err != nil {
+			return ResponseIoErrorOccurred, err
+		}
+		return ResponseOk, nil
+	case CancelCmd:
+		return handler.cancelOperation(MsgID(args), ctx)
+	case HistoryCmd:
+		n := 0
+		if args != "" {
+			var err error
+			n, err = strconv.Atoi(args)
+			if err != nil || n < 0 {
+				return ResponseInvalidArgument, nil
+			}
+		}
+		for _, entry := range handler.users.History(n) {
+			err := handler.forwardNoticeToUser(HistoryNoticePrefix + entry.String())
+			if err != nil {
+				return ResponseIoErrorOccurred, err
+			}
+		}
+		return ResponseOk, nil
+	case ExportCmd:
+		for _, entry := range handler.users.Export(handler.Creds.Name) {
+			exported := ExportedMsg{ID: entry.ID, Time: entry.Time, Content: entry.Content}
+			if err := handler.forwardNoticeToUser(exported.Serialize()); err != nil {
+				return ResponseIoErrorOccurred, err
+			}
+		}
+		return ResponseOk, nil
+	case VerifyCmd:
+		response := handler.users.Verify(handler.Creds.Name, args)
+		if response == ResponseOk {
+			handler.unverified = false
+		}
+		return response, nil
+	case BlockDMsCmd, AllowDMsCmd:
+		return handler.users.BlockDMs(handler.Creds.Name, name == BlockDMsCmd), nil
+	case BlockWordCmd, UnblockWordCmd:
+		return handler.users.BlockWord(handler.Creds.Name, args, name == BlockWordCmd), nil
+	case DirectMsgCmd:
+		to, content, ok := splitDirectMsgArgs(args)
+		if !ok {
+			return ResponseInvalidArgument, nil
+		}
+		return handler.broadcaster.SendDirectMsg(content, handler.Creds.Name, to, time.Time{},
+			ctx), nil
+	case TTLCmd:
+		return handler.sendExpiring(args, ctx), nil
+	case AdminsCmd:
+		if args == "" {
+			return ResponseInvalidArgument, nil
+		}
+		return handler.broadcaster.BroadcastToAdmins(args, handler.Creds.Name, ctx), nil
+	case AnnounceCmd:
+		return handler.announce(args)
+	case ShedCmd:
+		return handler.shed(args)
+	case ReactCmd:
+		idStr, emoji, _ := strings.Cut(args, " ")
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil || !isValidReaction(emoji) {
+			return ResponseInvalidArgument, nil
+		}
+		tally, response := handler.users.React(id, handler.Creds.Name, emoji)
+		if response != ResponseOk {
+			return response, nil
+		}
+		if err := handler.forwardNoticeToUser(tally); err != nil {
+			return ResponseIoErrorOccurred, err
+		}
+		return ResponseOk, nil
+	case TimeCmd:
+		return SerializeServerTime(time.Now()), nil
+	case SetCmd:
+		setting, value, _ := strings.Cut(args, " ")
+		notice, response := handler.users.Set(handler.Creds.Name, setting, value)
+		if response != ResponseOk {
+			return response, nil
+		}
+		if err := handler.forwardNoticeToUser(notice); err != nil {
+			return ResponseIoErrorOccurred, err
+		}
+		return ResponseOk, nil
+	case VersionCmd:
+		return handler.showVersion(args)
+	case MOTDCmd:
+		return handler.showMOTD()
+	case SessionsCmd:
+		if args == EndedSessionsArg {
+			return handler.showEndedSessions()
+		}
+		err := handler.forwardNoticeToUser("Sessions: " +
+			strings.Join(handler.users.Sessions(), ", "))
+		if err != nil {
+			return ResponseIoErrorOccurred, err
+		}
+		return ResponseOk, nil
 	default:
-		// TODO print err
-		return nil
+		return ResponseUnknownCmd, nil
 	}
 }
 
-func (handler *ClientHandler) forwardMsgToUser(msg *ChatMessage) {
-	_, err := handler.clientIn.Write([]byte(MsgPrefix + string(msg.sender) + ": " +
-		msg.content + "\n"))
+// showMOTD sends the message of the day a line at a time, since a notice is a
+// line
+func (handler *ClientHandler) showMOTD() (Response, error) {
+	motd := strings.TrimRight(handler.users.MOTD(), "\n")
+	if motd == "" {
+		motd = "No message of the day"
+	}
+	for _, line := range strings.Split(motd, "\n") {
+		if err := handler.forwardNoticeToUser(line); err != nil {
+			return ResponseIoErrorOccurred, err
+		}
+	}
+	return ResponseOk, nil
+}
+
+// forwardNoticeToUser sends a line from the server itself, i.e with no sender
+func (handler *ClientHandler) forwardNoticeToUser(notice string) error {
+	return handler.writeLine(MsgPrefix + notice)
+}
+
+// queuedNotice is a notice waiting in a session's notices
+type queuedNotice struct {
+	text string
+	// toRoom marks a notice everyone gets, rather than one about the user
+	toRoom bool
+}
+
+// forwardQueuedNotice writes a room notice as such to clients that tell them
+// apart, see CapRoomNotices, and as a message to the others
+func (handler *ClientHandler) forwardQueuedNotice(notice queuedNotice) error {
+	if notice.toRoom && handler.caps.Supports(CapRoomNotices) {
+		return handler.writeLine(SerializeRoomNotice(notice.text))
+	}
+	return handler.forwardNoticeToUser(notice.text)
+}
 
+func (handler *ClientHandler) forwardPresenceToUser(event PresenceEvent) {
+	err := handler.writeLine(event.Serialize())
 	if err != nil {
-		handler.errs <- err
+		handler.writeFailed(err)
+	}
+}
+
+// forwardMsgToUser writes msg to the client, and finishes it with how that
+// went, see ChatMessage.Finish
+func (handler *ClientHandler) forwardMsgToUser(msg *ChatMessage) {
+	// it waited in the queue for too long to be worth writing
+	if msg.expired(time.Now()) {
+		msg.Finish(errMsgExpired)
+		return
+	}
+	// the broadcast gave up on it while it was queued, e.g it was cancelled
+	if err := msg.ctx.Err(); err != nil {
+		msg.Finish(err)
 		return
 	}
-	msg.Finish()
-	return
+	err := handler.writeLine(msg.line())
+	if isClosedConnErr(err) {
+		msg.Finish(errRecipientGone)
+	} else {
+		msg.Finish(err)
+	}
+	if err != nil {
+		handler.writeFailed(err)
+	}
 }
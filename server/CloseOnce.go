@@ -0,0 +1,21 @@
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+// closeOnceConn is a conn that's closed once, however many times it's closed.
+// HandleNewConnection owns a client's conn and closes it when it's done with
+// it, but Drain closes it earlier for a client to reconnect, and the second
+// close of e.g a TCP conn fails, which only adds noise to the log.
+type closeOnceConn struct {
+	net.Conn
+	once sync.Once
+}
+
+// Close closes the conn the first time, and is a no-op after that
+func (c *closeOnceConn) Close() (err error) {
+	c.once.Do(func() { err = c.Conn.Close() })
+	return err
+}
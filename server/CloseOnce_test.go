@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	. "util"
+)
+
+// tcpLikeConn fails to close twice like a TCP conn, where net.Pipe doesn't
+type tcpLikeConn struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+func (c *tcpLikeConn) Close() error {
+	if c.closed.Swap(true) {
+		return &net.OpError{Op: "close", Net: "tcp", Err: net.ErrClosed}
+	}
+	return c.Conn.Close()
+}
+
+// TestTeardownClosesOnce ends alice's session every way it can end, and checks
+// her conn is closed once each time, with nothing logged about closing it
+func TestTeardownClosesOnce(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		end  func(hub *Hub, alice *testConn, conn *failingConn)
+	}{
+		{"quit", func(hub *Hub, alice *testConn, conn *failingConn) {
+			alice.send(MsgPrefix + IdSeparator + LogoutCmd.Serialize())
+			alice.conn.Close()
+		}},
+		{"kick", func(hub *Hub, alice *testConn, conn *failingConn) {
+			hub.Kick("alice", "an admin", LogoutReason{Code: LogoutKicked, Text: "spamming"})
+		}},
+		{"read error", func(hub *Hub, alice *testConn, conn *failingConn) {
+			alice.conn.Close()
+		}},
+		{"write error", func(hub *Hub, alice *testConn, conn *failingConn) {
+			conn.failWrites.Store(true)
+			hub.BroadcastMessage("hi", "bob", time.Time{}, context.Background())
+		}},
+		{"shutdown", func(hub *Hub, alice *testConn, conn *failingConn) {
+			// a client that can't reconnect is disconnected by Drain itself
+			if !hub.Drain(time.Second) {
+				t.Error("drain timed out")
+			}
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			logged := &lockedBuffer{}
+			hub := NewHubWithOptions(ServerOptions{Logger: log.New(logged, "", 0)})
+			serverSide, clientSide := net.Pipe()
+			conn := &failingConn{Conn: &tcpLikeConn{Conn: serverSide}}
+			handled := make(chan struct{})
+			go func() {
+				defer close(handled)
+				hub.HandleNewConnection(conn)
+			}()
+			alice := &testConn{clientSide, bufio.NewScanner(clientSide), t}
+			t.Cleanup(func() { clientSide.Close() })
+			alice.register("alice")
+			go io.Copy(io.Discard, clientSide)
+
+			c.end(hub, alice, conn)
+			select {
+			case <-handled:
+			case <-time.After(time.Second):
+				t.Fatal("the session didn't end")
+			}
+			if strings.Contains(logged.String(), net.ErrClosed.Error()) {
+				t.Fatalf("expected the conn to be closed once, got:\n%s", logged)
+			}
+		})
+	}
+}
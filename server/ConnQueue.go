@@ -0,0 +1,186 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+	. "util"
+)
+
+// QueueUpdateInterval is how often a client waiting in line is told its place
+// again, besides whenever it changes, which also finds those that left
+var QueueUpdateInterval = 10 * time.Second
+
+// connQueue caps the connections served at once, see ServerOptions.MaxConns
+type connQueue struct {
+	lock sync.Mutex
+	// served is how many connections are being served
+	served  int
+	waiting []*queuedConn
+	stopped bool
+}
+
+// queuedConn is a connection waiting in line for its turn
+type queuedConn struct {
+	// turn is closed once it's served
+	turn chan struct{}
+	// moved is signaled when its place in line changes
+	moved chan struct{}
+}
+
+// maxHeldWhileQueued is how many lines a client waiting in line may send, e.g
+// to log in, which are read once it's its turn. Past them, its lines wait to
+// be read, which finds a client that left only when it's next told its place.
+const maxHeldWhileQueued = 16
+
+// admit has conn wait for its turn to be served, past MaxConns, and reports
+// whether it came. A client that can't wait, or that there's no room in line
+// for, is refused with ReasonServerFull instead. The lines a waiting client
+// sends are returned along with the rest it sends. An admitted connection's
+// place is freed with releaseConn.
+func (hub *Hub) admit(conn net.Conn, caps Capabilities, clientIn <-chan ReadInput,
+	done <-chan struct{}) (<-chan ReadInput, bool) {
+	max := hub.options.MaxConns
+	if max <= 0 {
+		return clientIn, true
+	}
+	queue := &hub.queue
+	queue.lock.Lock()
+	if queue.stopped || queue.served < max && len(queue.waiting) == 0 {
+		queue.served++
+		queue.lock.Unlock()
+		return clientIn, true
+	}
+	if !caps.Supports(CapQueue) || len(queue.waiting) >= hub.options.MaxQueued {
+		queue.lock.Unlock()
+		hub.logger.Printf("Refusing %s, the server is full\n", conn.RemoteAddr())
+		if err := writeLine(conn, SerializeRefusal(ReasonServerFull)); err != nil {
+			hub.logger.Printf("Error refusing %s: %s\n", conn.RemoteAddr(), err)
+		}
+		return nil, false
+	}
+	waiter := &queuedConn{turn: make(chan struct{}), moved: make(chan struct{}, 1)}
+	queue.waiting = append(queue.waiting, waiter)
+	queue.lock.Unlock()
+	hub.logger.Printf("Queued %s, the server is full\n", conn.RemoteAddr())
+
+	updates := time.NewTicker(QueueUpdateInterval)
+	defer updates.Stop()
+	var held []ReadInput
+	// told is the place the client was last told, 0 before it's told any
+	told := 0
+	for {
+		position, waiting := queue.position(waiter)
+		if !waiting {
+			// writing on fails the same, if the client is gone
+			writeLine(conn, SerializeQueuePosition(0))
+			hub.logger.Printf("Admitted %s\n", conn.RemoteAddr())
+			if len(held) == 0 {
+				return clientIn, true
+			}
+			return putBack(held, clientIn, done), true
+		}
+		if position != told {
+			if err := writeLine(conn, SerializeQueuePosition(position)); err != nil {
+				queue.quit(waiter)
+				return nil, false
+			}
+			told = position
+		}
+		select {
+		case <-waiter.turn:
+		case <-waiter.moved:
+		case <-updates.C:
+			told = 0
+		case input := <-holdable(clientIn, held):
+			if input.Err != nil {
+				queue.quit(waiter)
+				return nil, false
+			}
+			held = append(held, input)
+		}
+	}
+}
+
+// holdable is clientIn, unless maxHeldWhileQueued lines are held already
+func holdable(clientIn <-chan ReadInput, held []ReadInput) <-chan ReadInput {
+	if len(held) >= maxHeldWhileQueued {
+		return nil
+	}
+	return clientIn
+}
+
+// releaseConn frees an admitted connection's place, for the next in line
+func (hub *Hub) releaseConn() {
+	if hub.options.MaxConns > 0 {
+		hub.queue.release()
+	}
+}
+
+// position is waiter's place in line, 1 being next, if it's still waiting
+func (queue *connQueue) position(waiter *queuedConn) (int, bool) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for i, other := range queue.waiting {
+		if other == waiter {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// release hands a served connection's place to the next in line
+func (queue *connQueue) release() {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.releaseLocked()
+}
+
+func (queue *connQueue) releaseLocked() {
+	if len(queue.waiting) == 0 {
+		queue.served--
+		return
+	}
+	close(queue.waiting[0].turn)
+	queue.waiting = queue.waiting[1:]
+	queue.moved(0)
+}
+
+// quit takes waiter out of line, e.g once its client left. If its turn came
+// meanwhile, the place goes to the next in line.
+func (queue *connQueue) quit(waiter *queuedConn) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for i, other := range queue.waiting {
+		if other == waiter {
+			queue.waiting = append(queue.waiting[:i], queue.waiting[i+1:]...)
+			queue.moved(i)
+			return
+		}
+	}
+	queue.releaseLocked()
+}
+
+// moved tells those waiting from index i on that they moved up. Should be
+// called with the lock held.
+func (queue *connQueue) moved(i int) {
+	for _, waiter := range queue.waiting[i:] {
+		select {
+		case waiter.moved <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// stop admits every connection from now on, those waiting included, for
+// Drain to tell them where to go like the rest
+func (queue *connQueue) stop() {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.stopped = true
+	for _, waiter := range queue.waiting {
+		close(waiter.turn)
+	}
+	queue.served += len(queue.waiting)
+	queue.waiting = nil
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"testing"
+	. "util"
+)
+
+// connectWithCaps connects a client that sends its capabilities first, as
+// this package's client does
+func connectWithCaps(hub *Hub, t *testing.T) *testConn {
+	c := connectToHub(hub, t)
+	c.send(ClientCapabilities().Serialize())
+	return c
+}
+
+func TestConnQueue(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{MaxConns: 2, MaxQueued: 2})
+	alice := connectWithCaps(hub, t)
+	alice.register("alice")
+	bob := connectWithCaps(hub, t)
+	bob.register("bob")
+
+	carol := connectWithCaps(hub, t)
+	carol.expect(SerializeQueuePosition(1))
+	dave := connectWithCaps(hub, t)
+	dave.expect(SerializeQueuePosition(2))
+	// the line is full, and a legacy client can't wait in it anyway
+	for _, refused := range []*testConn{connectWithCaps(hub, t), connectToHub(hub, t)} {
+		refused.send(string(ActionRegister))
+		refused.expect(SerializeRefusal(ReasonServerFull))
+		refused.expectClosed()
+	}
+
+	// carol gives up, so dave moves up, and gets in once alice leaves
+	carol.conn.Close()
+	dave.expect(SerializeQueuePosition(1))
+	// what dave sends meanwhile is read once he's in
+	dave.send(string(ActionRegister), "dave", "1234")
+	alice.conn.Close()
+	dave.expect(SerializeQueuePosition(0))
+	dave.expect(ServerResponsePrefix + string(AuthResponseID) + IdSeparator + string(ResponseOk))
+	dave.send(MsgPrefix + "1;hi")
+	bob.expect(MsgPrefix + "dave: hi")
+	dave.expect("r1;" + string(ResponseOk))
+}
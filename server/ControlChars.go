@@ -0,0 +1,39 @@
+package server
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ControlCharPolicy decides what happens to messages with control characters,
+// e.g ANSI escape sequences or null bytes, which could mess up the terminals
+// of the users they're shown to. Tabs are allowed.
+type ControlCharPolicy int
+
+const (
+	// ControlCharsStrip removes them, and sends what's left
+	ControlCharsStrip ControlCharPolicy = iota
+	// ControlCharsReject answers the message with ResponseControlChars
+	ControlCharsReject
+)
+
+// isUnsafeRune tells whether r shouldn't reach other users' terminals. Bytes
+// that aren't UTF-8 are read as utf8.RuneError, which is unsafe too, since a
+// terminal may not read them as UTF-8 either.
+func isUnsafeRune(r rune) bool {
+	return r != '\t' && (unicode.IsControl(r) || r == utf8.RuneError)
+}
+
+func hasControlChars(msg string) bool {
+	return strings.IndexFunc(msg, isUnsafeRune) >= 0
+}
+
+func stripControlChars(msg string) string {
+	return strings.Map(func(r rune) rune {
+		if isUnsafeRune(r) {
+			return -1
+		}
+		return r
+	}, msg)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// CountingConn counts the bytes read from and written to a connection, to help
+// tell a flooding client or a slow link. It embeds the conn so deadlines and
+// the rest of net.Conn keep working through it.
+type CountingConn struct {
+	net.Conn
+	bytesRead    int64
+	bytesWritten int64
+}
+
+func NewCountingConn(conn net.Conn) *CountingConn {
+	return &CountingConn{Conn: conn}
+}
+
+func (c *CountingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.bytesRead, int64(n))
+	return n, err
+}
+
+// Write counts before writing, so the count is up to date by the time the peer
+// has the bytes, and takes back what didn't make it
+func (c *CountingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.bytesWritten, int64(len(b)))
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.bytesWritten, int64(n-len(b)))
+	return n, err
+}
+
+func (c *CountingConn) BytesRead() int64 {
+	return atomic.LoadInt64(&c.bytesRead)
+}
+
+func (c *CountingConn) BytesWritten() int64 {
+	return atomic.LoadInt64(&c.bytesWritten)
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	. "util"
+)
+
+// NewUser is an account for CreateUsers to create
+type NewUser struct {
+	Creds UserCredentials
+	// Line is the CSV line it was read from, 0 if it wasn't
+	Line int
+}
+
+// RefusedUser is an account CreateUsers didn't create, and why
+type RefusedUser struct {
+	// Line is the CSV line it was read from, 0 if it wasn't
+	Line int
+	// Name is empty when the line had none
+	Name   Username
+	Reason string
+}
+
+func (refused RefusedUser) String() string {
+	var s string
+	if refused.Line != 0 {
+		s = fmt.Sprintf("line %d: ", refused.Line)
+	}
+	if strings.ContainsAny(string(refused.Name), "\r\n") {
+		// a line per refused account
+		s += strconv.Quote(string(refused.Name)) + ": "
+	} else if refused.Name != "" {
+		s += string(refused.Name) + ": "
+	}
+	return s + refused.Reason
+}
+
+// CreateUsersReport sums up creating accounts in bulk
+type CreateUsersReport struct {
+	Created []Username
+	Refused []RefusedUser
+}
+
+func (report CreateUsersReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Created %d users", len(report.Created))
+	if len(report.Created) != 0 {
+		names := make([]string, len(report.Created))
+		for i, name := range report.Created {
+			names[i] = string(name)
+		}
+		fmt.Fprintf(&b, ": %s", strings.Join(names, ", "))
+	}
+	fmt.Fprintf(&b, "\nRefused %d\n", len(report.Refused))
+	for _, refused := range report.Refused {
+		fmt.Fprintln(&b, refused)
+	}
+	return b.String()
+}
+
+// checkNewAccount tells whether name can be registered, as registering online
+// and CreateUsers both check. Should be called with both activeUsersLock and
+// userDBLock held.
+func (hub *Hub) checkNewAccount(name Username) Response {
+	if _, exists := hub.userDB[name]; exists {
+		return ResponseUsernameExists
+	} else if hub.nameShownByOther(name) {
+		// the new account's messages would look like the other user's
+		return ResponseUsernameShownByOther
+	} else if max := hub.options.MaxUsers; max != 0 && len(hub.userDB) >= max {
+		return ResponseRegistrationFull
+	}
+	return ResponseOk
+}
+
+// addAccount puts creds' account in the user DB. Should be called with
+// userDBLock held, once checkNewAccount allowed it.
+func (hub *Hub) addAccount(creds *UserCredentials) *UserRecord {
+	record := &UserRecord{Password: creds.Password}
+	hub.userDB[creds.Name] = record
+	return record
+}
+
+// CreateUsers registers the accounts, e.g ahead of an event, checked like
+// registering online, though whether registration is open doesn't matter, and
+// by credsProblem. An account that would need verifying is verified already.
+// The error is for saving the user DB, the accounts are created either way.
+func (hub *Hub) CreateUsers(users []NewUser) (CreateUsersReport, error) {
+	var report CreateUsersReport
+	var snapshot *userDBSnapshot
+	hub.activeUsersLock.Lock()
+	hub.userDBLock.Lock()
+	for _, user := range users {
+		creds := user.Creds
+		if problem := credsProblem(creds); problem != "" {
+			report.Refused = append(report.Refused, RefusedUser{user.Line, creds.Name, problem})
+			continue
+		}
+		if response := hub.checkNewAccount(creds.Name); response != ResponseOk {
+			report.Refused = append(report.Refused,
+				RefusedUser{user.Line, creds.Name, string(response)})
+			continue
+		}
+		hub.addAccount(&creds)
+		report.Created = append(report.Created, creds.Name)
+	}
+	if len(report.Created) != 0 {
+		snapshot = hub.snapshotUserDB()
+	}
+	hub.userDBLock.Unlock()
+	hub.activeUsersLock.Unlock()
+	return report, hub.writeUserDBSnapshot(snapshot)
+}
+
+// ReadUsersCSV reads the accounts in r, a username and a password per line,
+// optionally under a "username,password" header. The lines with another
+// number of fields are refused.
+func ReadUsersCSV(r io.Reader) ([]NewUser, []RefusedUser, error) {
+	reader := csv.NewReader(r)
+	// checked below, so one bad line doesn't refuse the whole file
+	reader.FieldsPerRecord = -1
+	var users []NewUser
+	var refused []RefusedUser
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return users, refused, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if line == 1 && len(record) == 2 &&
+			strings.EqualFold(record[0], "username") && strings.EqualFold(record[1], "password") {
+			continue
+		}
+		if len(record) != 2 {
+			refused = append(refused, RefusedUser{Line: line,
+				Reason: fmt.Sprintf("expected a username and a password, got %d fields", len(record))})
+			continue
+		}
+		users = append(users, NewUser{UserCredentials{Name: Username(record[0]),
+			Password: Password(record[1])}, line})
+	}
+}
+
+// credsProblem is what's wrong with the credentials of an account to create,
+// empty if nothing is. They must be typeable in a client.
+func credsProblem(creds UserCredentials) string {
+	switch {
+	case creds.Name == "":
+		return "missing username"
+	case strings.ContainsAny(string(creds.Name), "\r\n"):
+		return "username has a line break"
+	case creds.Password == "":
+		return "missing password"
+	case strings.ContainsAny(string(creds.Password), "\r\n"):
+		return "password has a line break"
+	}
+	return ""
+}
+
+// ImportUsersCSV creates the accounts ReadUsersCSV reads from r. The report
+// has the lines it refused too, in order. The error is for reading r, when
+// nothing was created, or for saving the user DB, see CreateUsers.
+func (hub *Hub) ImportUsersCSV(r io.Reader) (CreateUsersReport, error) {
+	users, malformed, err := ReadUsersCSV(r)
+	if err != nil {
+		return CreateUsersReport{}, err
+	}
+	report, err := hub.CreateUsers(users)
+	report.Refused = append(malformed, report.Refused...)
+	sort.SliceStable(report.Refused, func(i, j int) bool {
+		return report.Refused[i].Line < report.Refused[j].Line
+	})
+	return report, err
+}
+
+// CreateUsersPath is where WebHandler has admins, logged in with HTTP basic
+// auth, POST a CSV of accounts to create, see ImportUsersCSV. The response is
+// the report. The CSV must be sent as text/csv, which a form on another site
+// can't send, and over HTTPS when the server has TLS set up.
+const CreateUsersPath = "/admin/users"
+
+// MaxCreateUsersSize bounds the CSV POSTed to CreateUsersPath, in bytes
+const MaxCreateUsersSize = 1 << 20
+
+func (hub *Hub) serveCreateUsers(w http.ResponseWriter, r *http.Request) {
+	if hub.options.TLSCertFile != "" && r.TLS == nil {
+		hub.logger.Printf("Refused plaintext request to create users from %s\n", r.RemoteAddr)
+		http.Error(w, "use HTTPS", http.StatusForbidden)
+		return
+	}
+	name, password, ok := r.BasicAuth()
+	if !ok || !hub.checkAdminLogin(Username(name), Password(password)) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chatserver admin"`)
+		http.Error(w, "admins only", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST a CSV of username,password lines", http.StatusMethodNotAllowed)
+		return
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil ||
+		mediaType != "text/csv" {
+		http.Error(w, "the CSV must be sent as text/csv", http.StatusUnsupportedMediaType)
+		return
+	}
+	report, err := hub.ImportUsersCSV(http.MaxBytesReader(w, r.Body, MaxCreateUsersSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("the CSV is over %d bytes", MaxCreateUsersSize),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	// saving fails only once some were created
+	if err != nil && len(report.Created) == 0 {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		hub.logger.Printf("Error saving the users %s created: %s\n", name, err)
+		http.Error(w, report.String()+"Error saving the user DB", http.StatusInternalServerError)
+		return
+	}
+	hub.logger.Printf("%s created %d users, %d refused\n", name, len(report.Created),
+		len(report.Refused))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, report)
+}
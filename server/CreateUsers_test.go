@@ -0,0 +1,168 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	. "util"
+)
+
+const usersCSV = `username,password
+bob,1234
+alice,5678
+bob,9999
+dave,
+erin
+boss,1234
+"carol
+c",1234
+frank,1234,extra
+carol,1234
+`
+
+const usersCSVReport = `Created 2 users: bob, carol
+Refused 7
+line 3: alice: Username already exists
+line 4: bob: Username already exists
+line 5: dave: missing password
+line 6: expected a username and a password, got 1 fields
+line 7: boss: Username is in use as someone's display name
+line 8: "carol\nc": username has a line break
+line 10: expected a username and a password, got 3 fields
+`
+
+func TestImportUsersCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	// created the same while registration is closed
+	hub := NewHubWithOptions(ServerOptions{UserDBPath: path, RegistrationClosed: true})
+	hub.userDB["alice"] = &UserRecord{Password: "1234", DisplayName: "Boss"}
+	report, err := hub.ImportUsersCSV(strings.NewReader(usersCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.String() != usersCSVReport {
+		t.Fatalf("expected the report\n%s\ngot\n%s", usersCSVReport, report)
+	}
+	db, err := readUserDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db) != 3 || db["bob"].Password != "1234" || db["alice"].Password != "1234" {
+		t.Fatalf("expected bob and carol saved next to alice, got %v", db)
+	}
+
+	// a bad file creates no one
+	if _, err := hub.ImportUsersCSV(strings.NewReader("gina,\"12\"34\n")); err == nil {
+		t.Fatal("expected a malformed CSV to be refused")
+	}
+	for _, name := range []string{"bob", "carol"} {
+		c := connectToHub(hub, t)
+		c.login(name)
+	}
+}
+
+// postUsers sends body to the server at url's CreateUsersPath as name, with
+// the password "1234" unless name is empty
+func postUsers(t *testing.T, client *http.Client, url, method, name, contentType,
+	body string) (*http.Response, string) {
+	t.Helper()
+	request, err := http.NewRequest(method, url+CreateUsersPath, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "" {
+		request.SetBasicAuth(name, "1234")
+	}
+	request.Header.Set("Content-Type", contentType)
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, string(data)
+}
+
+func TestCreateUsersOverHTTP(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{MaxUsers: 3})
+	hub.userDB["root"] = &UserRecord{Password: "1234", Admin: true}
+	hub.userDB["alice"] = &UserRecord{Password: "1234"}
+	server := httptest.NewServer(hub.WebHandler())
+	defer server.Close()
+	do := func(method, name, contentType, body string) (*http.Response, string) {
+		t.Helper()
+		return postUsers(t, http.DefaultClient, server.URL, method, name, contentType, body)
+	}
+
+	for _, name := range []string{"", "alice"} {
+		if response, _ := do(http.MethodPost, name, "text/csv", "bob,1234\n"); response.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected %q to be unauthorized, got %s", name, response.Status)
+		}
+	}
+	if response, _ := do(http.MethodGet, "root", "", ""); response.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected a GET to be refused, got %s", response.Status)
+	}
+	// what a form on another site can send
+	if response, _ := do(http.MethodPost, "root", "text/plain", "bob,1234\n"); response.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected a text/plain POST to be refused, got %s", response.Status)
+	}
+	response, body := do(http.MethodPost, "root", "text/csv; charset=utf-8",
+		"bob,1234\ncarol,1234\n")
+	expected := "Created 1 users: bob\nRefused 1\nline 2: carol: " +
+		string(ResponseRegistrationFull) + "\n"
+	if response.StatusCode != http.StatusOK || body != expected {
+		t.Fatalf("expected the report\n%s\ngot %s\n%s", expected, response.Status, body)
+	}
+	bob := connectToHub(hub, t)
+	bob.login("bob")
+}
+
+// TestCreateUsersTooLarge refuses a CSV over MaxCreateUsersSize. net/http
+// waits half a second before closing a connection whose request it didn't read
+// all of, so this runs in parallel, after the tests it would hold up.
+func TestCreateUsersTooLarge(t *testing.T) {
+	t.Parallel()
+	hub := NewHub()
+	hub.userDB["root"] = &UserRecord{Password: "1234", Admin: true}
+	server := httptest.NewServer(hub.WebHandler())
+	defer server.Close()
+	huge := "bob,1234\n" + strings.Repeat("x", MaxCreateUsersSize)
+	response, _ := postUsers(t, server.Client(), server.URL, http.MethodPost, "root", "text/csv",
+		huge)
+	if response.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected a CSV over %d bytes to be refused, got %s", MaxCreateUsersSize,
+			response.Status)
+	}
+	hub.userDBLock.RLock()
+	defer hub.userDBLock.RUnlock()
+	if _, exists := hub.userDB["bob"]; exists {
+		t.Fatal("expected no one created from a CSV that's too large")
+	}
+}
+
+// TestCreateUsersNeedsTLS has a server with TLS set up refuse plaintext
+// requests, like RequireTLS has it refuse plaintext clients
+func TestCreateUsersNeedsTLS(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"})
+	hub.userDB["root"] = &UserRecord{Password: "1234", Admin: true}
+	plain := httptest.NewServer(hub.WebHandler())
+	defer plain.Close()
+	response, _ := postUsers(t, plain.Client(), plain.URL, http.MethodPost, "root", "text/csv",
+		"bob,1234\n")
+	if response.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a plaintext request to be refused, got %s", response.Status)
+	}
+	secure := httptest.NewTLSServer(hub.WebHandler())
+	defer secure.Close()
+	response, body := postUsers(t, secure.Client(), secure.URL, http.MethodPost, "root",
+		"text/csv", "bob,1234\n")
+	if response.StatusCode != http.StatusOK || body != "Created 1 users: bob\nRefused 0\n" {
+		t.Fatalf("expected bob created over HTTPS, got %s\n%s", response.Status, body)
+	}
+}
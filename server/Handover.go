@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// UpgradeSignal has a running server hand its listeners over to a new process
+// of its binary, e.g after it was replaced by a newer one, see Handover
+const UpgradeSignal = syscall.SIGUSR2
+
+// InheritedListenersEnv is set for the process Handover starts, to how many
+// listeners it inherits. They're its files from fd 3 on, in the order of its
+// listen specs, the web client's last if WebAddr is set.
+const InheritedListenersEnv = "CHATSERVER_INHERITED_LISTENERS"
+
+// firstInheritedFD is the first of ExtraFiles in the started process, after
+// stdin, stdout and stderr
+const firstInheritedFD = 3
+
+// inheritedListenerFiles are the listeners' files the process was started
+// with, nil if it wasn't started by Handover
+func inheritedListenerFiles() ([]*os.File, error) {
+	value, inherited := os.LookupEnv(InheritedListenersEnv)
+	if !inherited {
+		return nil, nil
+	}
+	// not for the processes we start
+	os.Unsetenv(InheritedListenersEnv)
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("bad %s %q", InheritedListenersEnv, value)
+	}
+	files := make([]*os.File, n)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(firstInheritedFD+i), "inherited listener "+strconv.Itoa(i))
+	}
+	return files, nil
+}
+
+// HandoverFiles are copies of the listeners' files, for another server to
+// serve them with ServeFiles, in the order ServeFiles takes them. They're the
+// caller's to close.
+func (server *Server) HandoverFiles() ([]*os.File, error) {
+	server.listenersLock.Lock()
+	listeners := server.listeners
+	if server.webBound != nil {
+		listeners = append(append([]net.Listener(nil), listeners...), server.webBound)
+	}
+	server.listenersLock.Unlock()
+	var files []*os.File
+	for _, listener := range listeners {
+		withFile, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			closeFiles(files)
+			return nil, fmt.Errorf("can't hand %s over", listener.Addr())
+		}
+		file, err := withFile.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, fmt.Errorf("handing %s over: %w", listener.Addr(), err)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// ServeFiles is Serve on the listeners another server handed over, see
+// HandoverFiles. There's one for each listen spec, and one more for the web
+// client if WebAddr is set. The files are closed once the listeners are made.
+func (server *Server) ServeFiles(files []*os.File) error {
+	defer closeFiles(files)
+	expected := len(server.addrs)
+	if server.options.WebAddr != "" {
+		expected++
+	}
+	if len(files) != expected {
+		return fmt.Errorf("handed %d listeners over, expected %d", len(files), expected)
+	}
+	listeners := make([]net.Listener, len(files))
+	for i, file := range files {
+		listener, err := net.FileListener(file)
+		if err != nil {
+			for _, listener := range listeners[:i] {
+				server.Hub.closeLogErr(listener)
+			}
+			return fmt.Errorf("serving %s: %w", file.Name(), err)
+		}
+		listeners[i] = listener
+	}
+	if server.options.WebAddr != "" {
+		return server.serve(listeners[:len(server.addrs)], listeners[len(server.addrs)])
+	}
+	return server.serve(listeners, nil)
+}
+
+// Handover starts the server's binary again with the same arguments, passing
+// it the listeners, then shuts down. The new process accepts the clients from
+// then on, and those connected here are told to reconnect, which lands them
+// there, see Hub.Drain. If the new process can't be started, the server goes
+// on serving.
+func (server *Server) Handover() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	files, err := server.HandoverFiles()
+	if err != nil {
+		return err
+	}
+	defer closeFiles(files)
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), InheritedListenersEnv+"="+strconv.Itoa(len(files)))
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting %s: %w", executable, err)
+	}
+	server.Hub.logger.Printf("Handed the listeners over to process %d, draining\n",
+		cmd.Process.Pid)
+	server.keepSocketFiles()
+	go server.Shutdown()
+	return nil
+}
+
+// keepSocketFiles keeps the unix sockets' files once their listeners close,
+// since another process serves them now
+func (server *Server) keepSocketFiles() {
+	server.listenersLock.Lock()
+	defer server.listenersLock.Unlock()
+	for _, listener := range append(server.allListeners(), server.webBound) {
+		if unix, ok := listener.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+	}
+}
+
+// handOverOn hands the listeners over on the first signal it can, until the
+// server drained
+func (server *Server) handOverOn(signals <-chan os.Signal) {
+	for {
+		select {
+		case <-signals:
+			if err := server.Handover(); err != nil {
+				server.Hub.logger.Printf("Error handing the listeners over: %s\n", err)
+				continue
+			}
+			return
+		case <-server.drained:
+			return
+		}
+	}
+}
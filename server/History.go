@@ -0,0 +1,247 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	. "util"
+)
+
+// HistoryRetention bounds how much of the room's history the server keeps. A
+// message is forgotten once it's beyond either bound, whichever comes first.
+type HistoryRetention struct {
+	// MaxMessages is how many of the last messages are kept, DefaultHistoryMessages
+	// when 0
+	MaxMessages int
+	// MaxAge is how long messages are kept, DefaultHistoryAge when 0
+	MaxAge time.Duration
+}
+
+const (
+	DefaultHistoryMessages = 500
+	DefaultHistoryAge      = time.Hour
+)
+
+func (r HistoryRetention) withDefaults() HistoryRetention {
+	if r.MaxMessages == 0 {
+		r.MaxMessages = DefaultHistoryMessages
+	}
+	if r.MaxAge == 0 {
+		r.MaxAge = DefaultHistoryAge
+	}
+	return r
+}
+
+// RoomHistoryOptions are a room's own history settings
+type RoomHistoryOptions struct {
+	// Retention bounds the room's history, like ServerOptions.History does
+	// when it's zero
+	Retention HistoryRetention
+	// SinceJoin only replays the messages sent after the user joined, so e.g
+	// someone just let into a private room doesn't see what was said before
+	SinceJoin bool
+}
+
+// GlobalRoom is the channel everyone is in, whose history HistoryCmd shows
+const GlobalRoom = ""
+
+type HistoryEntry struct {
+	// ID numbers the room's messages from 1, for referring to them, e.g with
+	// ReactCmd
+	ID     uint64
+	Time   time.Time
+	Sender DisplayName
+	// Account is the sender's account name, which unlike Sender can't be
+	// taken by someone else, see ExportCmd
+	Account Username
+	Content string
+}
+
+// String has the time in RFC3339, for clients to show in their own time zone
+func (entry HistoryEntry) String() string {
+	return entry.Time.UTC().Format(time.RFC3339) + " #" + strconv.FormatUint(entry.ID, 10) +
+		" " + string(entry.Sender) + ": " + entry.Content
+}
+
+// reaction is a user's emoji on a message
+type reaction struct {
+	user  Username
+	emoji string
+}
+
+// history is the room's last messages, oldest first. Expired messages are
+// dropped lazily, whenever it's added to or read.
+type history struct {
+	retention HistoryRetention
+	// now is the clock messages are timed and expired by, replaceable for tests
+	now func() time.Time
+
+	lock    sync.Mutex
+	entries []HistoryEntry
+	lastID  uint64
+	// reactions are by message ID, in the order they were made. They're
+	// forgotten along with their message.
+	reactions map[uint64][]reaction
+}
+
+func newHistory(retention HistoryRetention) *history {
+	return &history{retention: retention.withDefaults(), now: time.Now,
+		reactions: make(map[uint64][]reaction)}
+}
+
+func (h *history) add(account Username, sender DisplayName, content string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.lastID++
+	h.entries = append(h.entries, HistoryEntry{h.lastID, h.now(), sender, account, content})
+	h.expire()
+}
+
+// react adds user's emoji to the message id, returning the message's tally of
+// reactions, e.g "Reactions to #3 (bob: hi): 👍 2, 🎉 1". A user can only
+// react with each emoji once per message.
+func (h *history) react(id uint64, user Username, emoji string) (tally string, r Response) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.expire()
+	// entries are sorted by ID
+	i := sort.Search(len(h.entries), func(i int) bool { return h.entries[i].ID >= id })
+	if i == len(h.entries) || h.entries[i].ID != id {
+		return "", ResponseUnknownMessage
+	}
+	entry := h.entries[i]
+	for _, existing := range h.reactions[id] {
+		if existing.user == user && existing.emoji == emoji {
+			return "", ResponseAlreadyReacted
+		}
+	}
+	h.reactions[id] = append(h.reactions[id], reaction{user, emoji})
+
+	var emojis []string
+	counts := make(map[string]int)
+	for _, existing := range h.reactions[id] {
+		if counts[existing.emoji] == 0 {
+			emojis = append(emojis, existing.emoji)
+		}
+		counts[existing.emoji]++
+	}
+	for i, emoji := range emojis {
+		emojis[i] = emoji + " " + strconv.Itoa(counts[emoji])
+	}
+	return fmt.Sprintf("Reactions to #%d (%s: %s): %s", id, entry.Sender, entry.Content,
+		strings.Join(emojis, ", ")), ResponseOk
+}
+
+// last returns up to n of the last messages, all of them when n is 0
+func (h *history) last(n int) []HistoryEntry {
+	return h.lastSince(n, time.Time{})
+}
+
+// lastSince is last for only the messages sent at since or after
+func (h *history) lastSince(n int, since time.Time) []HistoryEntry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.expire()
+	first := sort.Search(len(h.entries), func(i int) bool {
+		return !h.entries[i].Time.Before(since)
+	})
+	if n == 0 || n > len(h.entries)-first {
+		n = len(h.entries) - first
+	}
+	return append([]HistoryEntry(nil), h.entries[len(h.entries)-n:]...)
+}
+
+// lastBy is last for only the messages account sent
+func (h *history) lastBy(account Username, n int) []HistoryEntry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.expire()
+	var entries []HistoryEntry
+	for i := len(h.entries) - 1; i >= 0 && (n == 0 || len(entries) < n); i-- {
+		if h.entries[i].Account == account {
+			entries = append(entries, h.entries[i])
+		}
+	}
+	// back to oldest first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
+
+// expire must be called with the lock held
+func (h *history) expire() {
+	first := 0
+	if len(h.entries) > h.retention.MaxMessages {
+		first = len(h.entries) - h.retention.MaxMessages
+	}
+	oldestKept := h.now().Add(-h.retention.MaxAge)
+	for first < len(h.entries) && h.entries[first].Time.Before(oldestKept) {
+		first++
+	}
+	for _, entry := range h.entries[:first] {
+		delete(h.reactions, entry.ID)
+	}
+	if first != 0 {
+		// copied so the dropped entries' backing array can be freed
+		h.entries = append([]HistoryEntry(nil), h.entries[first:]...)
+	}
+}
+
+// historyStore keeps each room's history apart, so replaying one never shows
+// another's messages. A room's history is made on its first message. The
+// histories are only kept in memory, so they're gone once the server exits.
+type historyStore struct {
+	retention HistoryRetention
+	rooms     map[string]RoomHistoryOptions
+	// now is the clock of all the rooms' histories, replaceable for tests
+	now func() time.Time
+
+	lock      sync.Mutex
+	histories map[string]*history
+}
+
+func newHistoryStore(retention HistoryRetention,
+	rooms map[string]RoomHistoryOptions) *historyStore {
+	return &historyStore{retention: retention, rooms: rooms, now: time.Now,
+		histories: make(map[string]*history)}
+}
+
+func (s *historyStore) room(name string) *history {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	h, exists := s.histories[name]
+	if !exists {
+		retention := s.rooms[name].Retention
+		if retention == (HistoryRetention{}) {
+			retention = s.retention
+		}
+		h = newHistory(retention)
+		h.now = func() time.Time { return s.now() }
+		s.histories[name] = h
+	}
+	return h
+}
+
+func (s *historyStore) add(room string, account Username, sender DisplayName,
+	content string) {
+	s.room(room).add(account, sender, content)
+}
+
+// replay returns up to n of room's last messages for a user who joined it at
+// joined, all of them when n is 0. Unless the room is SinceJoin, that's
+// regardless of when they joined.
+func (s *historyStore) replay(room string, n int, joined time.Time) []HistoryEntry {
+	if !s.rooms[room].SinceJoin {
+		joined = time.Time{}
+	}
+	return s.room(room).lastSince(n, joined)
+}
+
+func (s *historyStore) react(room string, id uint64, user Username, emoji string) (
+	tally string, r Response) {
+	return s.room(room).react(id, user, emoji)
+}
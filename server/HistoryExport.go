@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+	. "util"
+)
+
+// HistoryFilter picks the messages ExportHistory writes
+type HistoryFilter struct {
+	// Room is the room whose history is exported, GlobalRoom by default
+	Room string
+	// Since and Until, when set, bound the messages' times, Since included
+	// and Until not
+	Since, Until time.Time
+}
+
+func (f HistoryFilter) matches(entry HistoryEntry) bool {
+	return !entry.Time.Before(f.Since) && (f.Until.IsZero() || entry.Time.Before(f.Until))
+}
+
+type ExportFormat int
+
+const (
+	// ExportText is a line per message, like HistoryCmd's but with the
+	// sender's account name too
+	ExportText ExportFormat = iota
+	// ExportJSONLines is a JSON object per line, see exportedEntry
+	ExportJSONLines
+)
+
+var exportFormats = map[string]ExportFormat{
+	"text":  ExportText,
+	"jsonl": ExportJSONLines,
+}
+
+// exportedEntry is a message as ExportJSONLines writes it
+type exportedEntry struct {
+	Room    string      `json:"room"`
+	ID      uint64      `json:"id"`
+	Time    time.Time   `json:"time"`
+	Sender  DisplayName `json:"sender"`
+	Account Username    `json:"account"`
+	Content string      `json:"content"`
+}
+
+func formatEntry(format ExportFormat, room string, entry HistoryEntry) ([]byte, error) {
+	if format == ExportJSONLines {
+		line, err := json.Marshal(exportedEntry{room, entry.ID, entry.Time.UTC(), entry.Sender,
+			entry.Account, entry.Content})
+		return append(line, '\n'), err
+	}
+	sender := string(entry.Sender)
+	if string(entry.Account) != sender {
+		sender += " (" + string(entry.Account) + ")"
+	}
+	return []byte(fmt.Sprintf("%s #%d %s: %s\n", entry.Time.UTC().Format(time.RFC3339),
+		entry.ID, sender, entry.Content)), nil
+}
+
+// snapshot is the history's messages as of now, oldest first. They're never
+// changed, since adding a message appends past them and expiring copies the
+// rest, so they're read without the lock while messages are added.
+func (h *history) snapshot() []HistoryEntry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.expire()
+	return h.entries[:len(h.entries):len(h.entries)]
+}
+
+// existing is the room's history, nil if it has none
+func (s *historyStore) existing(room string) *history {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.histories[room]
+}
+
+// ExportHistory writes the messages filter picks to w, oldest first, as format
+// says. It writes from a snapshot of the history, so messages are added
+// meanwhile however slow w is, and stops early once ctx is done.
+func (hub *Hub) ExportHistory(ctx context.Context, w io.Writer, filter HistoryFilter,
+	format ExportFormat) (exported int, err error) {
+	h := hub.history.existing(filter.Room)
+	if h == nil {
+		return 0, nil
+	}
+	for _, entry := range h.snapshot() {
+		if !filter.matches(entry) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return exported, err
+		}
+		line, err := formatEntry(format, filter.Room, entry)
+		if err != nil {
+			return exported, err
+		}
+		if _, err := w.Write(line); err != nil {
+			return exported, err
+		}
+		exported++
+	}
+	return exported, nil
+}
+
+// HistoryExportPath is where WebHandler serves ExportHistory to admins, who
+// log in with HTTP basic auth. The query picks the messages: room, since and
+// until as dates or RFC3339 times, and format, "text" or "jsonl", e.g
+// "/admin/export?room=gophers&since=2024-01-01&format=jsonl".
+const HistoryExportPath = "/admin/export"
+
+// checkAdminLogin tells whether name and password are an admin's
+func (hub *Hub) checkAdminLogin(name Username, password Password) bool {
+	hub.userDBLock.RLock()
+	defer hub.userDBLock.RUnlock()
+	record, exists := hub.userDB[name]
+	return exists && record.Password == password && record.Admin
+}
+
+// parseExportTime takes a date, e.g "2024-01-01", or an RFC3339 time
+func parseExportTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func parseExportQuery(r *http.Request) (HistoryFilter, ExportFormat, error) {
+	query := r.URL.Query()
+	filter := HistoryFilter{Room: query.Get("room")}
+	var err error
+	if filter.Since, err = parseExportTime(query.Get("since")); err != nil {
+		return filter, 0, fmt.Errorf("bad since: %w", err)
+	}
+	if filter.Until, err = parseExportTime(query.Get("until")); err != nil {
+		return filter, 0, fmt.Errorf("bad until: %w", err)
+	}
+	format := ExportText
+	if name := query.Get("format"); name != "" {
+		var known bool
+		if format, known = exportFormats[name]; !known {
+			return filter, 0, fmt.Errorf("unknown format %q", name)
+		}
+	}
+	return filter, format, nil
+}
+
+// serveHistoryExport streams the export, in chunks as the response's buffer
+// fills up, so a slow client only holds up its own export
+func (hub *Hub) serveHistoryExport(w http.ResponseWriter, r *http.Request) {
+	name, password, ok := r.BasicAuth()
+	if !ok || !hub.checkAdminLogin(Username(name), Password(password)) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chatserver admin"`)
+		http.Error(w, "admins only", http.StatusUnauthorized)
+		return
+	}
+	filter, format, err := parseExportQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if format == ExportJSONLines {
+		w.Header().Set("Content-Type", "application/jsonl; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	exported, err := hub.ExportHistory(r.Context(), w, filter, format)
+	if err != nil {
+		hub.logger.Printf("Error exporting history to %s, after %d messages: %s\n", name,
+			exported, err)
+		return
+	}
+	hub.logger.Printf("%s exported %d messages of room %q\n", name, exported, filter.Room)
+}
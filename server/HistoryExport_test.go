@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newExportHub has the given number of messages in gophers, a minute apart
+// from 2024-01-01, and a message in the global room
+func newExportHub(t *testing.T, messages int) *Hub {
+	t.Helper()
+	hub := NewHubWithOptions(ServerOptions{History: HistoryRetention{
+		MaxMessages: 10 * messages, MaxAge: 100 * 365 * 24 * time.Hour}})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	hub.history.now = func() time.Time { return now }
+	for i := 1; i <= messages; i++ {
+		hub.history.add("gophers", "alice", "Alice", fmt.Sprintf("message %d", i))
+		now = now.Add(time.Minute)
+	}
+	hub.history.add(GlobalRoom, "bob", "bob", "elsewhere")
+	return hub
+}
+
+func TestExportHistoryFilters(t *testing.T) {
+	hub := newExportHub(t, 3000)
+	since := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	filter := HistoryFilter{Room: "gophers", Since: since, Until: since.Add(time.Hour)}
+	var out strings.Builder
+	exported, err := hub.ExportHistory(context.Background(), &out, filter, ExportJSONLines)
+	if err != nil || exported != 60 {
+		t.Fatalf("expected the hour's 60 messages exported, got %d, %v", exported, err)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(out.String()))
+	for id := uint64(601); scanner.Scan(); id++ {
+		var entry exportedEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.ID != id || entry.Room != "gophers" || entry.Account != "alice" ||
+			entry.Content != fmt.Sprintf("message %d", id) || entry.Time.Before(filter.Since) ||
+			!entry.Time.Before(filter.Until) {
+			t.Fatalf("expected message %d in the hour, got %+v", id, entry)
+		}
+	}
+
+	out.Reset()
+	exported, err = hub.ExportHistory(context.Background(), &out,
+		HistoryFilter{Room: "gophers", Since: time.Date(2024, 1, 3, 1, 58, 0, 0, time.UTC)},
+		ExportText)
+	expected := "2024-01-03T01:58:00Z #2999 Alice (alice): message 2999\n" +
+		"2024-01-03T01:59:00Z #3000 Alice (alice): message 3000\n"
+	if err != nil || exported != 2 || out.String() != expected {
+		t.Fatalf("expected the last two messages, got %q, %v", out.String(), err)
+	}
+
+	// rooms are apart, and one without messages isn't made by asking
+	exported, err = hub.ExportHistory(context.Background(), io.Discard, HistoryFilter{}, ExportText)
+	if err != nil || exported != 1 {
+		t.Fatalf("expected the global room's message, got %d, %v", exported, err)
+	}
+	exported, err = hub.ExportHistory(context.Background(), io.Discard,
+		HistoryFilter{Room: "rust"}, ExportText)
+	if err != nil || exported != 0 || hub.history.existing("rust") != nil {
+		t.Fatalf("expected nothing from a room without messages, got %d, %v", exported, err)
+	}
+}
+
+// blockingWriter blocks its first write until unblocked
+type blockingWriter struct {
+	writing   chan struct{}
+	unblocked chan struct{}
+	written   int
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	if w.written == 0 {
+		close(w.writing)
+		<-w.unblocked
+	}
+	w.written++
+	return len(p), nil
+}
+
+func TestExportDoesntBlockAppends(t *testing.T) {
+	hub := newExportHub(t, 2000)
+	w := &blockingWriter{writing: make(chan struct{}), unblocked: make(chan struct{})}
+	type result struct {
+		exported int
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		exported, err := hub.ExportHistory(context.Background(), w,
+			HistoryFilter{Room: "gophers"}, ExportText)
+		done <- result{exported, err}
+	}()
+	<-w.writing
+
+	appended := make(chan struct{})
+	go func() {
+		defer close(appended)
+		for i := 0; i < 1000; i++ {
+			hub.history.add("gophers", "bob", "bob", "meanwhile")
+		}
+	}()
+	select {
+	case <-appended:
+	case <-time.After(time.Second):
+		t.Fatal("expected messages to be added while the export is stuck writing")
+	}
+	close(w.unblocked)
+	// the messages added meanwhile aren't part of the export
+	if r := <-done; r.err != nil || r.exported != 2000 || w.written != 2000 {
+		t.Fatalf("expected the 2000 messages there were exported, got %d, %v", r.exported, r.err)
+	}
+}
+
+func TestHistoryExportOverHTTP(t *testing.T) {
+	hub := newExportHub(t, 100)
+	hub.userDB["root"] = &UserRecord{Password: "1234", Admin: true}
+	hub.userDB["alice"] = &UserRecord{Password: "1234"}
+	server := httptest.NewServer(hub.WebHandler())
+	defer server.Close()
+
+	get := func(name, query string) (*http.Response, string) {
+		t.Helper()
+		request, err := http.NewRequest(http.MethodGet, server.URL+HistoryExportPath+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "" {
+			request.SetBasicAuth(name, "1234")
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response, string(body)
+	}
+	for _, name := range []string{"", "alice"} {
+		if response, _ := get(name, "?room=gophers"); response.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected %q to be unauthorized, got %s", name, response.Status)
+		}
+	}
+	if response, _ := get("root", "?since=yesterday"); response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a bad since to be refused, got %s", response.Status)
+	}
+	response, body := get("root", "?room=gophers&since=2024-01-01T01:30:00Z&format=jsonl")
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	if response.StatusCode != http.StatusOK || len(lines) != 10 ||
+		!strings.Contains(lines[0], `"content":"message 91"`) {
+		t.Fatalf("expected the last 10 messages, got %s: %q", response.Status, lines)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+	. "util"
+)
+
+func contents(entries []HistoryEntry) []string {
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Content)
+	}
+	return got
+}
+
+func expectContents(t *testing.T, entries []HistoryEntry, expected ...string) {
+	t.Helper()
+	got := contents(entries)
+	if len(got) != len(expected) {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %q, got %q", expected, got)
+		}
+	}
+}
+
+func TestRoomHistoriesAreApart(t *testing.T) {
+	store := newHistoryStore(HistoryRetention{MaxMessages: 2}, map[string]RoomHistoryOptions{
+		"gophers": {Retention: HistoryRetention{MaxMessages: 3}},
+	})
+	for _, content := range []string{"g1", "g2", "g3", "g4"} {
+		store.add("gophers", "alice", "alice", content)
+	}
+	store.add(GlobalRoom, "bob", "bob", "hi")
+	store.add("rust", "carol", "carol", "r1")
+	store.add("rust", "carol", "carol", "r2")
+	store.add("rust", "carol", "carol", "r3")
+
+	expectContents(t, store.replay("gophers", 0, time.Time{}), "g2", "g3", "g4")
+	expectContents(t, store.replay("gophers", 2, time.Time{}), "g3", "g4")
+	expectContents(t, store.replay(GlobalRoom, 0, time.Time{}), "hi")
+	// rooms without settings keep the global retention
+	expectContents(t, store.replay("rust", 0, time.Time{}), "r2", "r3")
+	expectContents(t, store.replay("empty", 0, time.Time{}))
+
+	// ids and reactions are per room
+	if _, r := store.react("rust", 3, "alice", "👍"); r != ResponseOk {
+		t.Fatalf("expected %q, got %q", ResponseOk, r)
+	}
+	if _, r := store.react(GlobalRoom, 3, "alice", "👍"); r != ResponseUnknownMessage {
+		t.Fatalf("expected %q, got %q", ResponseUnknownMessage, r)
+	}
+}
+
+func TestRoomHistorySinceJoin(t *testing.T) {
+	store := newHistoryStore(HistoryRetention{}, map[string]RoomHistoryOptions{
+		"private": {SinceJoin: true},
+	})
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	for _, room := range []string{"private", "public"} {
+		store.add(room, "alice", "alice", "before")
+	}
+	now = now.Add(time.Minute)
+	joined := now
+	for _, room := range []string{"private", "public"} {
+		store.add(room, "alice", "alice", "after 1")
+		store.add(room, "alice", "alice", "after 2")
+	}
+
+	expectContents(t, store.replay("private", 0, joined), "after 1", "after 2")
+	expectContents(t, store.replay("private", 1, joined), "after 2")
+	expectContents(t, store.replay("private", 0, joined.Add(time.Hour)))
+	expectContents(t, store.replay("public", 0, joined), "before", "after 1", "after 2")
+}
+
+func TestHistoryLastBy(t *testing.T) {
+	h := newHistory(HistoryRetention{})
+	h.add("alice", "alice", "a1")
+	h.add("bob", "alice", "b1")
+	h.add("alice", "alice", "a2")
+	h.add("alice", "alice", "a3")
+	expectContents(t, h.lastBy("alice", 0), "a1", "a2", "a3")
+	expectContents(t, h.lastBy("alice", 2), "a2", "a3")
+	expectContents(t, h.lastBy("bob", 0), "b1")
+	expectContents(t, h.lastBy("carol", 0))
+}
+
+// expectExport sends ExportCmd as c and checks it gets back exactly expected
+func expectExport(t *testing.T, c *testConn, id string, expected ...string) {
+	t.Helper()
+	c.send(MsgPrefix + id + ";/export")
+	for _, content := range expected {
+		if err := c.conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		line, err := ScanLine(c.scanner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, ok := ParseExportedMsg(strings.TrimPrefix(line, MsgPrefix))
+		if !ok || msg.Content != content {
+			t.Fatalf("expected %q exported, got %q", content, line)
+		}
+	}
+	c.expect("r" + id + ";" + string(ResponseOk))
+}
+
+// TestExportOnlyOwnMessages has bob send as alice's old display name, which
+// mustn't make his message part of her export
+func TestExportOnlyOwnMessages(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+
+	alice.send(MsgPrefix + "1;/displayname Al")
+	alice.expect("r1;" + string(ResponseOk))
+	alice.send(MsgPrefix + "2;one")
+	bob.expect(MsgPrefix + "Al: one")
+	alice.expect("r2;" + string(ResponseOk))
+	alice.send(MsgPrefix + "3;/displayname")
+	alice.expect("r3;" + string(ResponseOk))
+
+	bob.send(MsgPrefix + "1;/displayname Al")
+	bob.expect("r1;" + string(ResponseOk))
+	bob.send(MsgPrefix + "2;not alice")
+	alice.expect(MsgPrefix + "Al: not alice")
+	bob.expect("r2;" + string(ResponseOk))
+	alice.send(MsgPrefix + "4;two")
+	bob.expect(MsgPrefix + "alice: two")
+	alice.expect("r4;" + string(ResponseOk))
+
+	expectExport(t, alice, "5", "one", "two")
+	expectExport(t, bob, "3", "not alice")
+}
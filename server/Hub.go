@@ -1,170 +1,1206 @@
 package server
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"logfile"
 	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 	. "util"
 )
 
+// serverCapabilities are the ones the server supports
+var serverCapabilities = Capabilities{CapPresence: true, CapReconnect: true,
+	CapRoomNotices: true, CapQueue: true}
+
+type ServerOptions struct {
+	// TraceWriter, when set, gets every protocol line of every connection, with
+	// passwords redacted
+	TraceWriter io.Writer
+	// EmptyMessages decides what happens to empty or whitespace-only messages
+	EmptyMessages EmptyMessagePolicy
+	// ControlChars decides what happens to messages and commands with control
+	// characters, which are stripped by default
+	ControlChars ControlCharPolicy
+	// RegistrationClosed starts the server refusing new accounts, see
+	// Hub.SetRegistrationOpen and RegistrationSetting
+	RegistrationClosed bool
+	// RegisterThenLogin has registering only create the account, answered
+	// with ResponseRegisteredPleaseLogin, rather than log in to it too. Its
+	// first session is a login then, which with RequireVerification is where
+	// the code is sent. Clients before it was added don't know the response,
+	// see MinClientVersion.
+	RegisterThenLogin bool
+	// DrainRedirect is the address clients are told to reconnect to when the
+	// server drains. Empty means the same address, e.g for a restart.
+	DrainRedirect string
+	// ShedSpread is how long the clients shed by ShedCmd wait before
+	// reconnecting at most, each a random part of it so they don't all come
+	// back at once. DefaultShedSpread when 0.
+	ShedSpread time.Duration
+	// History bounds the messages kept for HistoryCmd, and for the rooms that
+	// don't set their own retention in RoomHistory
+	History HistoryRetention
+	// RoomHistory has the history settings of the rooms that have their own,
+	// by room
+	RoomHistory map[string]RoomHistoryOptions
+	// TLSCertFile and TLSKeyFile, when set, let clients connect over TLS
+	TLSCertFile string
+	TLSKeyFile  string
+	// RequireTLS refuses plaintext clients, which are told why with a refusal
+	// line before the connection is closed
+	RequireTLS bool
+	// MsgSendTimeout is how long a message is tried to be delivered for,
+	// util's MsgSendTimeout when 0. Admins can change it live, see SetCmd.
+	MsgSendTimeout time.Duration
+	// OfflineMsgs bounds the direct messages kept for users who are offline
+	OfflineMsgs OfflineMsgOptions
+	// Mentions bounds the mentions kept for users who are offline, e.g
+	// "@dave can you check the deploy"
+	Mentions MentionOptions
+	// UserDBPath, when set, is the file the accounts are kept in, see
+	// Hub.LoadUserDB
+	UserDBPath string
+	// UserDBPollInterval, when set, is how often the user DB file is checked
+	// for changes made by hand. Removed users are logged out.
+	UserDBPollInterval time.Duration
+	// ListenAddrs are more addresses to listen at besides the server's main
+	// one, e.g "unix:/run/chat.sock", see ParseListenSpec
+	ListenAddrs []string
+	// Version is the version VersionCmd shows, BinaryVersion() when empty, see
+	// util.BuildVersion for setting it at build time
+	Version string
+	// MOTD is the message of the day, which users read with MOTDCmd. It may
+	// have several lines.
+	MOTD string
+	// Welcome is what users get right after the response to their login, in
+	// order, DefaultWelcome when nil. A step left out is skipped, e.g the
+	// offline DMs are kept for the user then, and an empty list sends nothing.
+	Welcome []WelcomeStep
+	// MinMsgInterval, when set, is the least time between each user's
+	// messages, to keep the conversation readable. Messages sent sooner are
+	// refused with ResponseSlowDown.
+	MinMsgInterval time.Duration
+	// RequireVerification has new accounts verified before they're used: the
+	// session that registers one can only send VerifyCmd with the code
+	// VerificationCodeSink got, and logging in to it is refused with
+	// ResponseNotVerified until then. Registering it again with the same
+	// password sends a new code.
+	RequireVerification bool
+	// VerificationCodeSink delivers the codes, e.g by email. The codes are
+	// logged when it's nil, e.g while developing.
+	VerificationCodeSink func(name Username, code string)
+	// MaxLineLen bounds each protocol line a client sends, auth lines
+	// included, in bytes. A client sending a longer one is disconnected
+	// before the line is read whole, so it can't have the server buffer an
+	// endless line. DefaultMaxLineLen when 0. It guards the server rather
+	// than limiting what users say, so it's meant to be well over any
+	// message's length.
+	MaxLineLen int
+	// MaxConns, when set, caps the connections served at once, logged in or
+	// not. Past it, clients are refused with ReasonServerFull, unless
+	// MaxQueued lets them wait in line for a connection to end.
+	MaxConns int
+	// MaxQueued is how many clients past MaxConns may wait in line, told
+	// their place as it changes. Clients without CapQueue are refused rather
+	// than queued. None wait when 0.
+	MaxQueued int
+	// MaxUsers, when set, caps the registered accounts. Registering more is
+	// refused with ResponseRegistrationFull, while logging in still works.
+	MaxUsers int
+	// Logger is where the server logs, log's standard logger by default
+	Logger *log.Logger
+	// LogFile, when set, is a file the server logs to instead of Logger,
+	// rotated as LogRotation says. Only startup and fatal errors are still
+	// logged to the standard logger. See BuildServer.
+	LogFile     string
+	LogRotation logfile.Options
+	// LogThrottleWindow is how long repeated errors, e.g failing to send to a
+	// flapping connection, are suppressed for after one is logged, before
+	// they're summed up. DefaultLogThrottleWindow when 0, and every one is
+	// logged when negative. See LogThrottle.
+	LogThrottleWindow time.Duration
+	// LogoutGrace, when set, is how long users whose connection dropped stay
+	// online, their messages queued, before they're logged out. Logging in
+	// again by then picks their session up instead, see lingeringSession.
+	LogoutGrace time.Duration
+	// Blocklist sets up the words messages may not have
+	Blocklist BlocklistOptions
+	// MinClientVersion, when set, is the oldest client version that may log
+	// in, a semantic version. Older clients are refused with
+	// ResponseClientTooOld, while those whose version isn't a semantic one, or
+	// that don't report it, are let in. Admins can change it live, see
+	// MinClientVersionSetting.
+	MinClientVersion string
+	// WebAddr, when set, is where the web client is served, over HTTP or, when
+	// TLS is set up, HTTPS only. It's a listen spec, see ParseListenSpec, and
+	// Hub.WebHandler.
+	WebAddr string
+}
+
+type EmptyMessagePolicy int
+
+const (
+	// EmptyMessagesAllow broadcasts them like any other message
+	EmptyMessagesAllow EmptyMessagePolicy = iota
+	// EmptyMessagesReject answers them with ResponseEmptyMessage
+	EmptyMessagesReject
+	// EmptyMessagesIgnore acks them without broadcasting
+	EmptyMessagesIgnore
+)
+
+// ParseEmptyMessagePolicy parses allow, reject or ignore, for
+// EmptyMessagesAllow, EmptyMessagesReject and EmptyMessagesIgnore
+func ParseEmptyMessagePolicy(s string) (EmptyMessagePolicy, error) {
+	switch s {
+	case "allow":
+		return EmptyMessagesAllow, nil
+	case "reject":
+		return EmptyMessagesReject, nil
+	case "ignore":
+		return EmptyMessagesIgnore, nil
+	}
+	return 0, fmt.Errorf("unknown empty message policy %q", s)
+}
+
 func RunServer(port string) {
-	listener, err := net.Listen("tcp4", port)
+	RunServerWithOptions(port, ServerOptions{})
+}
+
+// DrainSignal makes a running server drain, see Hub.Drain, and exit
+const DrainSignal = syscall.SIGTERM
+
+// DrainTimeout is how long a draining server waits for its clients to leave
+const DrainTimeout = time.Second * 30
+
+// DefaultMaxLineLen is ServerOptions.MaxLineLen's default, the longest line
+// bufio.Scanner reads by default
+const DefaultMaxLineLen = bufio.MaxScanTokenSize - 2
+
+func RunServerWithOptions(port string, options ServerOptions) {
+	server, err := BuildServer(port, options)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	log.Printf("Listening at %s\n", listener.Addr())
-	defer ClosePrintErr(listener)
-	hub := NewHub()
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Fatalln(err)
-		}
-		log.Printf("Connected: %s\n", conn.RemoteAddr())
-		go hub.HandleNewConnection(conn)
+	err = server.Serve()
+	if err != nil {
+		log.Fatalln(err)
 	}
 }
 
 type Hub struct {
 	activeUsers     map[Username]*ClientHandler
 	activeUsersLock sync.RWMutex
+	// presenceWatchers are notified when users log in or out. Guarded by
+	// activeUsersLock.
+	presenceWatchers map[Username]*ClientHandler
+	// lingering are the sessions of the active users whose connection dropped,
+	// see ServerOptions.LogoutGrace. Guarded by activeUsersLock.
+	lingering map[Username]*lingeringSession
 
-	userDB     map[Username]Password
+	userDB     map[Username]*UserRecord
 	userDBLock sync.RWMutex
+	// userDBVersion is the user DB file's as of its last read or write.
+	// userDBGen counts the changes to userDB, and userDBSavedGen is the last
+	// change written to the file. All guarded by userDBLock.
+	userDBVersion  fileVersion
+	userDBGen      uint64
+	userDBSavedGen uint64
+	// userDBSaveLock serializes writing the file
+	userDBSaveLock sync.Mutex
+
+	options ServerOptions
+	// sentMsgs remembers the users' last messages, see BroadcastMessageOnce
+	sentMsgs     map[Username]*sentMsgLog
+	sentMsgsLock sync.Mutex
+	// registrationClosed is atomic so it can be toggled live, and checked
+	// without taking the locks
+	registrationClosed atomic.Bool
+	// lastConnID numbers the connections for tracing
+	lastConnID int64
+
+	// conns are all the open connections, logged in or not, along with the
+	// capabilities their client advertised
+	conns     map[net.Conn]Capabilities
+	connsLock sync.Mutex
+	// draining is set by Drain, after which drained is closed once the last
+	// connection closes. Guarded by connsLock.
+	draining bool
+	drained  chan struct{}
+	// queue admits the tracked connections, see ServerOptions.MaxConns
+	queue connQueue
+	// shuttingDown is set by Drain, after which messages are refused. Guarded
+	// by activeUsersLock, so setting it waits for the messages already being
+	// queued.
+	shuttingDown bool
+	// shutDown is closed once Drain is done waiting, which gives up on the
+	// messages still waiting for their recipients
+	shutDown     chan struct{}
+	shutDownOnce sync.Once
+
+	// endedSessions are the last sessions to end, and why
+	endedSessions endedSessions
+
+	history *historyStore
+	// offlineMsgs are DMs to users who were offline. Adding to them and taking
+	// them at login are done with activeUsersLock held, so a DM is either
+	// queued here or sent to the user's session.
+	offlineMsgs *offlineMsgs
+	// msgSendTimeout is ServerOptions.MsgSendTimeout, atomic since admins
+	// change it while messages are sent
+	msgSendTimeout atomic.Int64
+	// offlineMentions are mentions of users who were offline, added and taken
+	// with activeUsersLock held like offlineMsgs
+	offlineMentions *offlineMentions
+	// logger is ServerOptions.Logger
+	logger *log.Logger
+
+	// blocklist is swapped for a new matcher on each change, so messages are
+	// matched without locking. blocklistLock serializes the changes and
+	// guards blocklistVersion, the blocklist file's as of its last read or
+	// write.
+	blocklist        atomic.Pointer[wordMatcher]
+	blocklistLock    sync.Mutex
+	blocklistVersion fileVersion
+	// blocklistPolicy is a BlocklistPolicy, atomic since admins change it
+	// while messages are filtered
+	blocklistPolicy atomic.Int64
+	// minClientVersion is ServerOptions.MinClientVersion, a string, atomic
+	// since admins change it while clients log in
+	minClientVersion atomic.Value
+	// loginAttemptNotices throttles warnOfLoginAttempt
+	loginAttemptNotices *loginAttemptNotices
+	// errLog logs the errors that come in bursts, see
+	// ServerOptions.LogThrottleWindow
+	errLog *LogThrottle
+}
+
+type UserRecord struct {
+	Password Password `json:"password"`
+	// DisplayName is optional, the account name is shown when it's empty
+	DisplayName DisplayName `json:"display_name,omitempty"`
+	// Admin lets the user change server settings with SetCmd. Only set by
+	// editing the user DB.
+	Admin bool `json:"admin,omitempty"`
+	// VerificationCode is set while the account waits to be verified, see
+	// ServerOptions.RequireVerification
+	VerificationCode string `json:"verification_code,omitempty"`
 }
 
 func NewHub() *Hub {
-	return &Hub{
-		activeUsers: make(map[Username]*ClientHandler),
-		userDB:      make(map[Username]Password),
+	return NewHubWithOptions(ServerOptions{})
+}
+
+func NewHubWithOptions(options ServerOptions) *Hub {
+	hub := &Hub{
+		activeUsers:      make(map[Username]*ClientHandler),
+		presenceWatchers: make(map[Username]*ClientHandler),
+		lingering:        make(map[Username]*lingeringSession),
+		userDB:           make(map[Username]*UserRecord),
+		options:          options,
+		sentMsgs:         make(map[Username]*sentMsgLog),
+		conns:            make(map[net.Conn]Capabilities),
+		drained:          make(chan struct{}),
+		shutDown:         make(chan struct{}),
+		history:          newHistoryStore(options.History, options.RoomHistory),
+		offlineMsgs:      newOfflineMsgs(options.OfflineMsgs),
+		offlineMentions:  newOfflineMentions(options.Mentions),
+		logger:           options.Logger,
+
+		loginAttemptNotices: newLoginAttemptNotices(),
+	}
+	if hub.logger == nil {
+		hub.logger = log.Default()
 	}
+	hub.errLog = NewLogThrottle(hub.logger, options.LogThrottleWindow)
+	hub.registrationClosed.Store(options.RegistrationClosed)
+	hub.blocklist.Store(newWordMatcher(nil))
+	hub.blocklistPolicy.Store(int64(options.Blocklist.Policy))
+	if hub.options.Version == "" {
+		hub.options.Version = BinaryVersion()
+	}
+	hub.minClientVersion.Store(options.MinClientVersion)
+	if options.MsgSendTimeout == 0 {
+		options.MsgSendTimeout = MsgSendTimeout
+	}
+	hub.msgSendTimeout.Store(int64(options.MsgSendTimeout))
+	return hub
 }
 
-func (hub *Hub) TryToAuthenticate(request *AuthRequest) (Response, *ClientHandler) {
-	response := hub.testAuth(request)
-	if response != ResponseOk {
-		return response, nil
+// closeLogErr is ClosePrintErr, logging to the server's logger
+func (hub *Hub) closeLogErr(c io.Closer) {
+	if err := c.Close(); err != nil {
+		hub.logger.Println(err)
 	}
-	return response, hub.logClientIn(request)
 }
-func (hub *Hub) testAuth(request *AuthRequest) Response {
+
+// SetRegistrationOpen allows or refuses registering new accounts from now on.
+// Logging in isn't affected.
+func (hub *Hub) SetRegistrationOpen(open bool) {
+	hub.registrationClosed.Store(!open)
+	hub.logger.Printf("Registration open: %t\n", open)
+}
+
+// RegistrationOpen tells whether new accounts can be registered, see
+// SetRegistrationOpen
+func (hub *Hub) RegistrationOpen() bool {
+	return !hub.registrationClosed.Load()
+}
+
+// trackConn adds conn to the open connections, unless we're draining
+func (hub *Hub) trackConn(conn net.Conn) bool {
+	hub.connsLock.Lock()
+	defer hub.connsLock.Unlock()
+	if hub.draining {
+		return false
+	}
+	hub.conns[conn] = nil
+	return true
+}
+
+func (hub *Hub) setConnCapabilities(conn net.Conn, caps Capabilities) {
+	hub.connsLock.Lock()
+	defer hub.connsLock.Unlock()
+	hub.conns[conn] = caps
+}
+
+func (hub *Hub) untrackConn(conn net.Conn) {
+	hub.connsLock.Lock()
+	defer hub.connsLock.Unlock()
+	delete(hub.conns, conn)
+	if hub.draining && len(hub.conns) == 0 {
+		close(hub.drained)
+	}
+}
+
+// Drain tells every connected client, logged in or not, to reconnect to the
+// DrainRedirect option's address, and waits up to timeout for them to
+// disconnect. Legacy clients, which don't know the notice, are disconnected
+// instead. Connections made meanwhile only get the same notice. Returns
+// false if clients were still connected at the timeout.
+//
+// Messages are refused with ResponseServerShuttingDown from the start, and
+// those still being delivered at the end are given up on.
+func (hub *Hub) Drain(timeout time.Duration) bool {
+	// the errors suppressed so far are summed up before the server exits
+	defer hub.errLog.Flush()
+	hub.stopSending()
+	defer hub.shutDownOnce.Do(func() { close(hub.shutDown) })
+	hub.connsLock.Lock()
+	if !hub.draining {
+		hub.draining = true
+		hub.queue.stop()
+		hub.logger.Printf("Draining %d connections\n", len(hub.conns))
+		for conn, caps := range hub.conns {
+			if !caps.Supports(CapReconnect) {
+				// it reconnects on its own once the connection closes
+				hub.closeLogErr(conn)
+				continue
+			}
+			// a client that isn't reading mustn't hold up the others
+			go sendReconnectNotice(conn, hub.options.DrainRedirect, hub.logger)
+		}
+		if len(hub.conns) == 0 {
+			close(hub.drained)
+		}
+	}
+	hub.connsLock.Unlock()
+
+	select {
+	case <-hub.drained:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// stopSending refuses the messages sent from here on. It waits for those
+// already being queued, since they hold activeUsersLock.
+func (hub *Hub) stopSending() {
 	hub.activeUsersLock.Lock()
 	defer hub.activeUsersLock.Unlock()
+	hub.shuttingDown = true
+}
+
+func sendReconnectNotice(conn net.Conn, redirect string, logger *log.Logger) {
+	err := writeLine(conn, SerializeReconnectNotice(redirect))
+	if err != nil {
+		logger.Printf("Error sending reconnect notice to %s: %s\n", conn.RemoteAddr(), err)
+	}
+}
+
+// traceConn wraps conn so its lines are traced, if tracing is on
+func (hub *Hub) traceConn(conn net.Conn) net.Conn {
+	if hub.options.TraceWriter == nil {
+		return conn
+	}
+	id := strconv.FormatInt(atomic.AddInt64(&hub.lastConnID, 1), 10)
+	return NewTracedConn(conn, hub.options.TraceWriter, id, RedactPasswords(TraceIn))
+}
 
+func (hub *Hub) TryToAuthenticate(request *AuthRequest) (Response, *ClientHandler) {
+	if !VersionAtLeast(request.caps.Version(), hub.minClientVersion.Load().(string)) {
+		return ResponseClientTooOld, nil
+	}
+	if request.authType == ActionRegister && !hub.RegistrationOpen() {
+		return ResponseRegistrationClosed, nil
+	}
+	var code string
+	if request.authType == ActionRegister && hub.options.RequireVerification {
+		var err error
+		if code, err = newVerificationCode(); err != nil {
+			hub.logger.Printf("Error making a verification code: %s\n", err)
+			return ResponseIoErrorOccurred, nil
+		}
+	}
+	var snapshot *userDBSnapshot
+	// saved once the locks are released
+	defer func() { hub.saveUserDB(snapshot) }()
+	// sent once the locks are released too, if the account waits for it
+	var pending bool
+	defer func() {
+		if pending {
+			hub.sendVerificationCode(request.creds.Name, code)
+		}
+	}()
+	// online is the session of a user someone else tried to log in as,
+	// warned once the locks are released too
+	var online *ClientHandler
+	defer func() {
+		if online != nil {
+			go hub.warnOfLoginAttempt(online, request.remoteAddr)
+		}
+	}()
+	// checking and logging in under the same locks, so two clients can't both
+	// take the same name, or the last account MaxUsers allows
+	hub.activeUsersLock.Lock()
+	defer hub.activeUsersLock.Unlock()
 	hub.userDBLock.Lock()
 	defer hub.userDBLock.Unlock()
 
+	response := hub.testAuth(request)
+	if response == ResponseUserAlreadyOnline {
+		online = hub.activeUsers[request.creds.Name]
+	}
+	if response != ResponseOk {
+		return response, nil
+	}
+	if request.authType == ActionRegister && hub.options.RegisterThenLogin {
+		snapshot = hub.registerOnly(request.creds, code)
+		pending = code != ""
+		return ResponseRegisteredPleaseLogin, nil
+	}
+	var client *ClientHandler
+	client, snapshot = hub.logClientIn(request, code)
+	pending = client.unverified && code != ""
+	return response, client
+}
+
+// testAuth should be called with activeUsersLock and userDBLock held
+func (hub *Hub) testAuth(request *AuthRequest) Response {
 	switch request.authType {
 	case ActionLogin:
-		pass, exists := hub.userDB[request.creds.Name]
-		if !exists || pass != request.creds.Password {
+		record, exists := hub.userDB[request.creds.Name]
+		if !exists || record.Password != request.creds.Password {
 			return ResponseInvalidCredentials
-		} else if _, isActive := hub.activeUsers[request.creds.Name]; isActive {
+		} else if record.VerificationCode != "" && !hub.options.RegisterThenLogin {
+			// there's a session to verify in when registering
+			return ResponseNotVerified
+		} else if _, isActive := hub.activeUsers[request.creds.Name]; isActive &&
+			hub.lingering[request.creds.Name] == nil {
+			// a lingering session is picked up instead
 			return ResponseUserAlreadyOnline
 		}
 		return ResponseOk
 	case ActionRegister:
-		if _, exists := hub.userDB[request.creds.Name]; exists {
-			return ResponseUsernameExists
+		if record, exists := hub.userDB[request.creds.Name]; exists {
+			if record.VerificationCode == "" || record.Password != request.creds.Password {
+				return ResponseUsernameExists
+			} else if _, isActive := hub.activeUsers[request.creds.Name]; isActive {
+				return ResponseUserAlreadyOnline
+			}
+			// registering again for a new verification code
+			return ResponseOk
 		}
-		return ResponseOk
+		return hub.checkNewAccount(request.creds.Name)
 	default:
 		panic("unreachable")
 	}
 }
-func (hub *Hub) logClientIn(request *AuthRequest) *ClientHandler {
+
+// logClientIn should be called with activeUsersLock and userDBLock held. The
+// snapshot of the user DB, if it changed, is for saving once they're
+// released. A registration's account waits for code to be verified, if it's
+// set.
+func (hub *Hub) logClientIn(request *AuthRequest, code string) (*ClientHandler, *userDBSnapshot) {
+	var snapshot *userDBSnapshot
+	client := newClientHandler(request, hub)
+	record, exists := hub.userDB[client.Creds.Name]
+	if !exists {
+		record = hub.addAccount(client.Creds)
+	}
+	if code != "" {
+		record.VerificationCode = code
+	}
+	if !exists || code != "" {
+		snapshot = hub.snapshotUserDB()
+	}
+	if record.VerificationCode != "" {
+		client.unverified = true
+		// the notice queue is still empty
+		client.notices <- queuedNotice{verificationNotice, false}
+	}
+	// someone might have taken our display name while we were offline
+	if record.DisplayName != "" && !hub.displayNameTaken(client.Creds.Name, record.DisplayName) {
+		client.displayName = record.DisplayName
+	}
+	if hub.resumeLingering(client) {
+		return client, snapshot
+	}
+	client.welcome = hub.welcome(client.Creds.Name)
+	hub.activeUsers[client.Creds.Name] = client
+	hub.notifyPresenceWatchers(PresenceEvent{Name: client.Creds.Name, Online: true})
+	hub.logger.Printf("Logged in: %s\n", client.Creds.Name)
+	return client, snapshot
+}
+
+// registerOnly creates creds' account, for RegisterThenLogin, waiting for code
+// to be verified if it's set, and returns the snapshot of the user DB to save.
+// Should be called with activeUsersLock and userDBLock held.
+func (hub *Hub) registerOnly(creds *UserCredentials, code string) *userDBSnapshot {
+	record, exists := hub.userDB[creds.Name]
+	if !exists {
+		record = hub.addAccount(creds)
+	}
+	if code != "" {
+		record.VerificationCode = code
+	}
+	hub.logger.Printf("Registered: %s\n", creds.Name)
+	return hub.snapshotUserDB()
+}
+
+// displayNameTaken reports whether displayName would let name pass as someone
+// else: another active user already shows it, or it's someone else's account
+// name. Should be called with both activeUsersLock and userDBLock held.
+func (hub *Hub) displayNameTaken(name Username, displayName DisplayName) bool {
+	for other := range hub.userDB {
+		if other != name && strings.EqualFold(string(other), string(displayName)) {
+			return true
+		}
+	}
+	for other, client := range hub.activeUsers {
+		if other != name && strings.EqualFold(string(client.displayName), string(displayName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// nameShownByOther reports whether another user has a display name that looks
+// like name. Should be called with both activeUsersLock and userDBLock held.
+func (hub *Hub) nameShownByOther(name Username) bool {
+	for other, record := range hub.userDB {
+		if other != name && strings.EqualFold(string(record.DisplayName), string(name)) {
+			return true
+		}
+	}
+	for other, client := range hub.activeUsers {
+		if other != name && strings.EqualFold(string(client.displayName), string(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetDisplayName changes the name the user's messages are shown under. An empty
+// displayName resets it to the account name.
+func (hub *Hub) SetDisplayName(name Username, displayName DisplayName) Response {
+	if displayName != "" && !displayName.IsValid() {
+		return ResponseInvalidDisplayName
+	}
+	var snapshot *userDBSnapshot
+	// saved once the locks are released
+	defer func() { hub.saveUserDB(snapshot) }()
+	// the write lock makes checking and setting atomic, so two users can't race
+	// into the same name
 	hub.activeUsersLock.Lock()
 	defer hub.activeUsersLock.Unlock()
 
 	hub.userDBLock.Lock()
 	defer hub.userDBLock.Unlock()
 
-	client := newClientHandler(request, hub)
-	hub.userDB[client.Creds.Name] = client.Creds.Password
-	hub.activeUsers[client.Creds.Name] = client
-	log.Printf("Logged in: %s\n", client.Creds.Name)
-	return client
+	client, isActive := hub.activeUsers[name]
+	// the account may have been removed from the user DB file meanwhile
+	record, exists := hub.userDB[name]
+	if !isActive || !exists {
+		return ResponseInvalidCredentials
+	}
+	if displayName != "" && hub.displayNameTaken(name, displayName) {
+		return ResponseDisplayNameTaken
+	}
+	record.DisplayName = displayName
+	client.displayName = displayName
+	snapshot = hub.snapshotUserDB()
+	hub.logger.Printf("Display name of %s: %q\n", name, displayName)
+	return ResponseOk
+}
+
+// ActiveUsers lists the online users by account name, followed by their display
+// name if they set one
+func (hub *Hub) ActiveUsers() []string {
+	hub.activeUsersLock.RLock()
+	defer hub.activeUsersLock.RUnlock()
+
+	users := make([]string, 0, len(hub.activeUsers))
+	for name, client := range hub.activeUsers {
+		if client.displayName == "" {
+			users = append(users, string(name))
+		} else {
+			users = append(users, string(name)+" ("+string(client.displayName)+")")
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Version is the server's version, see ServerOptions.Version
+func (hub *Hub) Version() string {
+	return hub.options.Version
+}
+
+// MOTD is the message of the day, see ServerOptions.MOTD
+func (hub *Hub) MOTD() string {
+	return hub.options.MOTD
 }
+
+// Sessions lists the online users along with the bytes they sent and received
+// on their connection, and their client's capabilities
+func (hub *Hub) Sessions() []string {
+	hub.activeUsersLock.RLock()
+	defer hub.activeUsersLock.RUnlock()
+
+	sessions := make([]string, 0, len(hub.activeUsers))
+	for name, client := range hub.activeUsers {
+		details := []string{}
+		if in, out, ok := client.byteCounts(); ok {
+			details = append(details, fmt.Sprintf("%dB in, %dB out", in, out))
+		}
+		if len(client.caps) != 0 {
+			details = append(details, "caps: "+client.caps.String())
+		}
+		if len(details) == 0 {
+			sessions = append(sessions, string(name))
+			continue
+		}
+		sessions = append(sessions, string(name)+" ("+strings.Join(details, ", ")+")")
+	}
+	sort.Strings(sessions)
+	return sessions
+}
+
+// History returns up to n of the room's last messages that are still retained,
+// oldest first, or all of them when n is 0
+func (hub *Hub) History(n int) []HistoryEntry {
+	return hub.history.replay(GlobalRoom, n, time.Time{})
+}
+
+// MaxExportedMsgs bounds how many messages ExportCmd sends, the last ones
+const MaxExportedMsgs = 1000
+
+// Export is name's own last messages in the room's history, oldest first, up
+// to MaxExportedMsgs of them
+func (hub *Hub) Export(name Username) []HistoryEntry {
+	return hub.history.room(GlobalRoom).lastBy(name, MaxExportedMsgs)
+}
+
+// MaxReactionLen bounds a reaction's length in bytes, which fits any emoji
+// sequence in use
+const MaxReactionLen = 32
+
+func isValidReaction(emoji string) bool {
+	return emoji != "" && len(emoji) <= MaxReactionLen && utf8.ValidString(emoji) &&
+		strings.IndexFunc(emoji, unicode.IsSpace) == -1
+}
+
+// React adds name's emoji to the message id in the history, and tells the
+// others online the message's new tally of reactions, which it returns for
+// name. The tally is dropped for users whose queue is full, like presence
+// events.
+func (hub *Hub) React(id uint64, name Username, emoji string) (tally string, r Response) {
+	tally, r = hub.history.react(GlobalRoom, id, name, emoji)
+	if r != ResponseOk {
+		return "", r
+	}
+	hub.activeUsersLock.RLock()
+	defer hub.activeUsersLock.RUnlock()
+	for user, client := range hub.activeUsers {
+		if user == name {
+			continue
+		}
+		select {
+		case client.notices <- queuedNotice{tally, true}:
+		default:
+			hub.logger.Printf("Reaction tally dropped for %s\n", user)
+		}
+	}
+	return tally, ResponseOk
+}
+
 func (hub *Hub) Logout(name Username) {
 	hub.activeUsersLock.Lock()
 	defer hub.activeUsersLock.Unlock()
+	hub.logoutLocked(name)
+}
 
-	ClosePrintErr(hub.activeUsers[name])
+// logoutLocked is Logout with activeUsersLock held
+func (hub *Hub) logoutLocked(name Username) {
+	hub.closeLogErr(hub.activeUsers[name])
 	delete(hub.activeUsers, name)
-	log.Printf("Logged out: %s\n", name)
+	delete(hub.presenceWatchers, name)
+	hub.notifyPresenceWatchers(PresenceEvent{Name: name, Online: false})
+	hub.logger.Printf("Logged out: %s\n", name)
+}
+
+// Kick logs name out, telling them why. by is who kicked them, for the record.
+// Returns false if they aren't online.
+func (hub *Hub) Kick(name Username, by string, reason LogoutReason) bool {
+	hub.activeUsersLock.RLock()
+	handler, isActive := hub.activeUsers[name]
+	lingering := hub.lingering[name]
+	hub.activeUsersLock.RUnlock()
+	if !isActive {
+		return false
+	}
+	hub.logger.Printf("Kicking %s: %s\n", name, reason)
+	if lingering != nil {
+		// there's no connection to tell them on
+		hub.endLingering(name, lingering)
+		return true
+	}
+	handler.kick(by, reason)
+	return true
+}
+
+// MaxPresenceWatchers bounds the fan-out every login and logout causes
+const MaxPresenceWatchers = 256
+
+// SubscribeToPresence adds or removes name from the users that get presence
+// events
+func (hub *Hub) SubscribeToPresence(name Username, subscribe bool) Response {
+	hub.activeUsersLock.Lock()
+	defer hub.activeUsersLock.Unlock()
+
+	client, isActive := hub.activeUsers[name]
+	if !isActive {
+		return ResponseInvalidCredentials
+	}
+	if !subscribe {
+		delete(hub.presenceWatchers, name)
+		return ResponseOk
+	}
+	if _, isWatching := hub.presenceWatchers[name]; !isWatching &&
+		len(hub.presenceWatchers) >= MaxPresenceWatchers {
+		return ResponseTooManySubscribers
+	}
+	hub.presenceWatchers[name] = client
+	return ResponseOk
+}
+
+// notifyPresenceWatchers doesn't block, a watcher whose queue is full misses the
+// event. Should be called with activeUsersLock held.
+func (hub *Hub) notifyPresenceWatchers(event PresenceEvent) {
+	for name, watcher := range hub.presenceWatchers {
+		if name == event.Name {
+			continue
+		}
+		select {
+		case watcher.presence <- event:
+		default:
+			hub.logger.Printf("Presence event dropped for %s\n", name)
+		}
+	}
 }
 
 type ChatMessage struct {
-	finished chan struct{}
-	sender   Username
+	// finished gets nil once the message is delivered, or why it wasn't, see
+	// Finish
+	finished chan error
+	sender   DisplayName
 	content  string
+	// ctx is the broadcast's, once it's done the message isn't worth sending
+	ctx context.Context
+	// direct is set for a direct message, which is marked as one
+	direct *DirectMsg
+	// toAdmins marks a message sent to the admins only, see AdminsCmd
+	toAdmins bool
+	// expires, when set, is when the message is dropped rather than written,
+	// see TTLCmd
+	expires time.Time
+}
+
+func NewChatMessage(sender DisplayName, content string, ctx context.Context) *ChatMessage {
+	return &ChatMessage{make(chan error, 1), sender, content, ctx, nil, false, time.Time{}}
+}
+
+func newDirectChatMessage(dm DirectMsg, ctx context.Context) *ChatMessage {
+	return &ChatMessage{make(chan error, 1), DisplayName(dm.Sender), dm.Content, ctx, &dm,
+		false, dm.Expires}
 }
 
-func NewChatMessage(sender Username, content string) *ChatMessage {
-	return &ChatMessage{make(chan struct{}, 1), sender, content}
+// line is the protocol line the message is sent as
+func (m *ChatMessage) line() string {
+	if m.direct != nil {
+		return m.direct.Serialize()
+	} else if m.toAdmins {
+		return MsgPrefix + AdminsTag + " " + string(m.sender) + ": " + m.content
+	}
+	return MsgPrefix + string(m.sender) + ": " + m.content
 }
 
-func (m *ChatMessage) Finish() {
+// Finish tells the sender how the message's delivery went: nil once its line
+// was written to the recipient's conn without error within
+// ClientWriteTimeout, which is all a delivery means, since whether they read
+// it isn't known. Otherwise err is why it wasn't, e.g the write failing or
+// timing out, or the recipient's session ending first. It's called once per
+// message.
+func (m *ChatMessage) Finish(err error) {
 	// shouldn't block, since the channel has size 1
-	m.finished <- struct{}{}
+	m.finished <- err
 }
 
-func (m *ChatMessage) WaitForFinish() {
-	<-m.finished
+// BroadcastMessage sends content to everyone else online. It's dropped rather
+// than delivered after expires, if it's set.
+func (hub *Hub) BroadcastMessage(content string, sender Username, expires time.Time,
+	ctx context.Context) Response {
+	return hub.BroadcastMessageWithResult(content, sender, expires, ctx).Response()
 }
 
-func (hub *Hub) BroadcastMessage(content string, sender Username, ctx context.Context) Response {
+// BroadcastMessageWithResult is BroadcastMessage, telling how the delivery to
+// each recipient went rather than just the response
+func (hub *Hub) BroadcastMessageWithResult(content string, sender Username, expires time.Time,
+	ctx context.Context) DeliveryResult {
 	hub.activeUsersLock.RLock()
-	totalToSendTo := len(hub.activeUsers) - 1
-	if totalToSendTo == 0 {
+	if hub.shuttingDown {
 		hub.activeUsersLock.RUnlock()
-		return ResponseOk
+		return DeliveryResult{refusal: ResponseServerShuttingDown}
 	}
-	errs := make(chan error, totalToSendTo)
-	ctx, cancel := context.WithTimeout(ctx, MsgSendTimeout)
-	defer cancel()
+	senderName := DisplayName(sender)
+	if senderClient, isActive := hub.activeUsers[sender]; isActive {
+		senderName = senderClient.DisplayName()
+	}
+	hub.history.add(GlobalRoom, sender, senderName, content)
+	hub.keepOfflineMentions(content, sender, senderName, expires)
 
+	// counted rather than taken as everyone but the sender, who may have
+	// logged out meanwhile
+	recipients := make([]*ClientHandler, 0, len(hub.activeUsers))
 	for _, client := range hub.activeUsers {
-		if client.Creds.Name == sender {
-			continue
+		if client.Creds.Name != sender {
+			recipients = append(recipients, client)
 		}
-		go func(handler *ClientHandler) {
-			errs <- sendMessageToClient(handler, content, sender, ctx)
-		}(client)
 	}
+	if len(recipients) == 0 {
+		hub.activeUsersLock.RUnlock()
+		return DeliveryResult{}
+	}
+	ctx, cancel := hub.deliveryContext(ctx, expires)
+	defer cancel()
+	msgs := enqueueForAll(recipients, func() *ChatMessage {
+		msg := NewChatMessage(senderName, content, ctx)
+		msg.expires = expires
+		return msg
+	})
 	hub.activeUsersLock.RUnlock()
-	succeeded := 0
-	// a range on errs would cause a hang here since we don't close the channel
-	for i := 0; i < totalToSendTo; i++ {
-		if err := <-errs; err != nil {
-			log.Printf("Error sending msg: %s\n", err)
-		} else {
-			succeeded++
+	return hub.waitForAll(recipients, msgs, ctx)
+}
+
+// DeliveryResult is how a broadcast's delivery to each recipient went
+type DeliveryResult struct {
+	// Recipients is how many it was sent to, the sender and Departed aside
+	Recipients int
+	// Succeeded is how many got it
+	Succeeded int
+	// Expired is how many it was dropped for since its TTL ran out first
+	Expired int
+	// Departed is how many logged out or disconnected before it was written
+	// to them. They're no longer recipients, so it's no failure.
+	Departed int
+	// Failed is how many it couldn't be delivered to otherwise, e.g since
+	// writing to them failed
+	Failed int
+	// TimedOut is how many of Failed weren't written to in time, since they
+	// weren't reading, rather than the write failing
+	TimedOut int
+	// FailedUsers are the recipients counted in Failed
+	FailedUsers []Username
+
+	// refusal is the response when it wasn't sent at all, e.g
+	// ResponseServerShuttingDown
+	refusal Response
+}
+
+// Response is what the sender is told of the broadcast
+func (r DeliveryResult) Response() Response {
+	switch {
+	case r.refusal != "":
+		return r.refusal
+	case r.Failed == 0 && r.Expired == 0:
+		return ResponseOk
+	case r.Failed == 0 && r.Succeeded == 0:
+		return ResponseMsgExpiredForAll
+	case r.Failed == 0:
+		return ResponseMsgExpiredForSome
+	case r.TimedOut == r.Failed && r.Succeeded == 0:
+		return ResponseMsgTimedOutForAll
+	case r.TimedOut == r.Failed:
+		return ResponseMsgTimedOutForSome
+	case r.Succeeded == 0:
+		return ResponseMsgFailedForAll
+	default:
+		return ResponseMsgFailedForSome
+	}
+}
+
+// enqueueForAll queues a message made by newMsg for each recipient. Each
+// recipient's queue is drained in order by its own session, so broadcasts to a
+// slow recipient wait in line rather than in goroutines.
+func enqueueForAll(recipients []*ClientHandler, newMsg func() *ChatMessage) []*ChatMessage {
+	msgs := make([]*ChatMessage, len(recipients))
+	for i, client := range recipients {
+		msgs[i] = newMsg()
+		client.enqueueMsg(msgs[i])
+	}
+	return msgs
+}
+
+// deliveryOutcome is how a message went for one of its recipients
+type deliveryOutcome int
+
+const (
+	outcomeDelivered deliveryOutcome = iota
+	outcomeExpired
+	// outcomeDeparted is the recipient's session ending before the message
+	// was written, e.g since they logged out, which is normal churn
+	outcomeDeparted
+	outcomeTimedOut
+	outcomeFailed
+)
+
+// outcomeOf tells the outcome of msg from the error waitForDelivery returned
+func outcomeOf(msg *ChatMessage, err error) deliveryOutcome {
+	switch {
+	case err == nil:
+		return outcomeDelivered
+	case msg.expiredBy(err):
+		return outcomeExpired
+	case errors.Is(err, errRecipientGone):
+		return outcomeDeparted
+	case timedOut(err):
+		return outcomeTimedOut
+	default:
+		return outcomeFailed
+	}
+}
+
+// add counts recipient's outcome
+func (r *DeliveryResult) add(recipient Username, outcome deliveryOutcome) {
+	switch outcome {
+	case outcomeDelivered:
+		r.Succeeded++
+	case outcomeExpired:
+		r.Expired++
+	case outcomeDeparted:
+		r.Recipients--
+		r.Departed++
+	default:
+		if outcome == outcomeTimedOut {
+			r.TimedOut++
+		}
+		r.Failed++
+		r.FailedUsers = append(r.FailedUsers, recipient)
+	}
+}
+
+// waitForAll returns how the broadcast of msgs went, once each is delivered to
+// its recipient or given up on
+func (hub *Hub) waitForAll(recipients []*ClientHandler, msgs []*ChatMessage,
+	ctx context.Context) DeliveryResult {
+	result := DeliveryResult{Recipients: len(msgs)}
+	for i, msg := range msgs {
+		err := hub.waitForDelivery(recipients[i], msg, ctx)
+		outcome := outcomeOf(msg, err)
+		if outcome == outcomeFailed {
+			hub.errLog.Printf("Error sending msg", "Error sending msg: %s\n", err)
 		}
+		result.add(recipients[i].Creds.Name, outcome)
 	}
+	return result
+}
 
-	if succeeded == 0 {
+// keepOfflineMentions keeps the mentions in content of registered users who
+// are offline, for when they log in. Should be called with activeUsersLock
+// held.
+func (hub *Hub) keepOfflineMentions(content string, sender Username, senderName DisplayName,
+	expires time.Time) {
+	for _, name := range parseMentions(content) {
+		if _, isActive := hub.activeUsers[name]; isActive || name == sender {
+			continue
+		}
+		hub.userDBLock.RLock()
+		_, exists := hub.userDB[name]
+		hub.userDBLock.RUnlock()
+		if exists {
+			hub.offlineMentions.add(name, senderName, content, expires)
+		}
+	}
+}
+
+// SendDirectMsg sends content to the user to alone. If they're offline, it's
+// kept for when they log in and ResponseQueuedForOffline is returned. Only
+// registered users can get DMs, unless they block them. It's dropped rather
+// than delivered after expires, if it's set.
+func (hub *Hub) SendDirectMsg(content string, sender Username, to Username,
+	expires time.Time, ctx context.Context) Response {
+	hub.activeUsersLock.RLock()
+	if hub.shuttingDown {
+		hub.activeUsersLock.RUnlock()
+		return ResponseServerShuttingDown
+	}
+	// the account name rather than the display name, so the recipient can
+	// reply to it
+	dm := DirectMsg{Sender: sender, Content: content, Expires: expires}
+	recipient, isActive := hub.activeUsers[to]
+	if !isActive {
+		defer hub.activeUsersLock.RUnlock()
+		hub.userDBLock.RLock()
+		_, exists := hub.userDB[to]
+		hub.userDBLock.RUnlock()
+		if !exists {
+			return ResponseNoSuchUser
+		}
+		return hub.offlineMsgs.add(to, dm)
+	}
+	if recipient.blocksDMs {
+		hub.activeUsersLock.RUnlock()
+		return ResponseDMsBlocked
+	}
+	ctx, cancel := hub.deliveryContext(ctx, expires)
+	defer cancel()
+	msg := newDirectChatMessage(dm, ctx)
+	recipient.enqueueMsg(msg)
+	hub.activeUsersLock.RUnlock()
+	if err := hub.waitForDelivery(recipient, msg, ctx); err != nil {
+		if msg.expiredBy(err) {
+			return ResponseMsgExpiredForAll
+		} else if timedOut(err) {
+			return ResponseMsgTimedOutForAll
+		} else if !errors.Is(err, errRecipientGone) {
+			hub.logger.Printf("Error sending DM: %s\n", err)
+		}
 		return ResponseMsgFailedForAll
-	} else if succeeded < totalToSendTo {
-		return ResponseMsgFailedForSome
-	} else {
-		return ResponseOk
 	}
+	return ResponseOk
+}
+
+// MaxRememberedMsgs is how many of each user's last messages are remembered to
+// spot resends
+const MaxRememberedMsgs = 1024
+
+// sentMsgLog is the responses to a user's last messages, by id
+type sentMsgLog struct {
+	responses map[MsgID]Response
+	// order is oldest first, for forgetting
+	order []MsgID
 }
 
-func sendMessageToClient(recipient *ClientHandler, content string,
-	sender Username, ctx context.Context) error {
-	msg := NewChatMessage(sender, content)
+// BroadcastMessageOnce is BroadcastMessage for a message the client may be
+// resending, e.g after a crash between sending it and getting the ack. A
+// message with an id the sender already used gets the same response again,
+// without being broadcast twice. Client ids are unique across restarts for
+// this.
+func (hub *Hub) BroadcastMessageOnce(id MsgID, content string, sender Username,
+	ctx context.Context) Response {
+	hub.sentMsgsLock.Lock()
+	sent, exists := hub.sentMsgs[sender]
+	if !exists {
+		sent = &sentMsgLog{responses: make(map[MsgID]Response)}
+		hub.sentMsgs[sender] = sent
+	}
+	response, isResend := sent.responses[id]
+	hub.sentMsgsLock.Unlock()
+	if isResend {
+		return response
+	}
+
+	response = hub.BroadcastMessage(content, sender, time.Time{}, ctx)
+	if response == ResponseMsgFailedForAll || response == ResponseMsgTimedOutForAll ||
+		response == ResponseServerShuttingDown {
+		// nobody got it, so a resend should go through
+		return response
+	}
+	hub.sentMsgsLock.Lock()
+	defer hub.sentMsgsLock.Unlock()
+	sent.responses[id] = response
+	sent.order = append(sent.order, id)
+	if len(sent.order) > MaxRememberedMsgs {
+		delete(sent.responses, sent.order[0])
+		sent.order = sent.order[1:]
+	}
+	return response
+}
+
+var (
+	errRecipientGone      = errors.New("the recipient's session ended")
+	errRecipientQueueFull = errors.New("the recipient has too many messages queued")
+	errClientTooSlow      = errors.New("too many messages queued, the client isn't reading")
+	errServerShutDown     = errors.New("the server shut down before the message was delivered")
+)
+
+// timedOut tells whether err, why a message wasn't delivered, is its write not
+// being done in time, the broadcast's MsgSendTimeout or the recipient's
+// ClientWriteTimeout, rather than it failing
+func timedOut(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// waitForDelivery waits for msg to be delivered to recipient, or given up on,
+// which the server shutting down does too, see Drain
+func (hub *Hub) waitForDelivery(recipient *ClientHandler, msg *ChatMessage,
+	ctx context.Context) error {
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
-	case recipient.SendMsg <- msg:
+		return finishedOr(msg, ctx.Err())
+	case <-hub.shutDown:
+		return finishedOr(msg, errServerShutDown)
+	case <-recipient.ended:
+		// the session may have ended for failing to write msg, which says more
+		return finishedOr(msg, errRecipientGone)
+	case err := <-msg.finished:
+		return err
 	}
+}
+
+// finishedOr is how msg was finished if it was, and err otherwise. The
+// recipients are waited for in turn, so one may have gotten it while we waited
+// for another.
+func finishedOr(msg *ChatMessage, err error) error {
 	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-msg.finished:
+	case err := <-msg.finished:
+		return err
+	default:
+		return err
 	}
-	return nil
 }
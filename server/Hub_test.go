@@ -0,0 +1,1657 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	. "util"
+)
+
+type testConn struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+	t       *testing.T
+}
+
+func connectToHub(hub *Hub, t *testing.T) *testConn {
+	serverSide, clientSide := net.Pipe()
+	go hub.HandleNewConnection(serverSide)
+	c := &testConn{clientSide, bufio.NewScanner(clientSide), t}
+	t.Cleanup(func() { clientSide.Close() })
+	return c
+}
+
+func (c *testConn) send(lines ...string) {
+	c.t.Helper()
+	err := c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	_, err = c.conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testConn) expect(expected string) {
+	c.t.Helper()
+	err := c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line, err := ScanLine(c.scanner)
+	if err != nil {
+		c.t.Fatalf("expected %q, got error %s", expected, err)
+	}
+	if line != expected {
+		c.t.Fatalf("expected %q, got %q", expected, line)
+	}
+}
+
+func (c *testConn) expectClosed() {
+	c.t.Helper()
+	err := c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err == io.ErrClosedPipe {
+		// net.Pipe refuses deadlines once the other side is closed
+		return
+	} else if err != nil {
+		c.t.Fatal(err)
+	}
+	line, err := ScanLine(c.scanner)
+	if err != io.EOF {
+		c.t.Fatalf("expected the connection to close, got %q, %v", line, err)
+	}
+}
+
+func (c *testConn) login(name string) {
+	c.t.Helper()
+	c.send(string(ActionLogin), name, "1234")
+	c.expect(ServerResponsePrefix + string(AuthResponseID) + IdSeparator + string(ResponseOk))
+}
+
+func (c *testConn) register(name string) {
+	c.t.Helper()
+	c.send(string(ActionRegister), name, "1234")
+	c.expect(ServerResponsePrefix + string(AuthResponseID) + IdSeparator + string(ResponseOk))
+}
+
+func TestDisplayNameCollision(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+
+	alice.send(MsgPrefix + "1;/displayname Al (work)")
+	alice.expect("r1;" + string(ResponseOk))
+
+	bob.send(MsgPrefix + "2;/displayname al (WORK)")
+	bob.expect("r2;" + string(ResponseDisplayNameTaken))
+	bob.send(MsgPrefix + "3;/displayname Alice")
+	bob.expect("r3;" + string(ResponseDisplayNameTaken))
+	bob.send(MsgPrefix + "4;/displayname Bob: hi")
+	bob.expect("r4;" + string(ResponseInvalidDisplayName))
+	// a lookalike of alice's account name, with a Cyrillic A
+	bob.send(MsgPrefix + "6;/displayname Аlice")
+	bob.expect("r6;" + string(ResponseInvalidDisplayName))
+
+	bob.send(MsgPrefix + "5;/who")
+	bob.expect(MsgPrefix + "Online: alice (Al (work)), bob")
+	bob.expect("r5;" + string(ResponseOk))
+}
+
+// TestRegisterDisplayedName checks a new account can't take a name someone
+// already shows as their display name
+func TestRegisterDisplayedName(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	alice.send(MsgPrefix + "1;/displayname Bob")
+	alice.expect("r1;" + string(ResponseOk))
+
+	bob := connectToHub(hub, t)
+	bob.send(string(ActionRegister), "bob", "1234")
+	bob.expect(ServerResponsePrefix + string(AuthResponseID) + IdSeparator +
+		string(ResponseUsernameShownByOther))
+	bob.register("robert")
+}
+
+func TestDisplayNameUsedAsSender(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+
+	alice.send(MsgPrefix + "1;/displayname Al")
+	alice.expect("r1;" + string(ResponseOk))
+	alice.send(MsgPrefix + "2;hi")
+	bob.expect(MsgPrefix + "Al: hi")
+	alice.expect("r2;" + string(ResponseOk))
+
+	alice.send(MsgPrefix + "3;/displayname")
+	alice.expect("r3;" + string(ResponseOk))
+	alice.send(MsgPrefix + "4;hi again")
+	bob.expect(MsgPrefix + "alice: hi again")
+	alice.expect("r4;" + string(ResponseOk))
+}
+
+func TestFailingCommandResponse(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+
+	alice.send(MsgPrefix + "1;/nosuchcmd arg")
+	alice.expect("r1;" + string(ResponseUnknownCmd))
+	alice.send(MsgPrefix + "2;/displayname :(")
+	alice.expect("r2;" + string(ResponseInvalidDisplayName))
+	// the id isn't tied up by the failures
+	alice.send(MsgPrefix + "3;/displayname Al")
+	alice.expect("r3;" + string(ResponseOk))
+}
+
+func TestSessionsByteCounts(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+
+	// alice's count includes the command itself, but not its output yet
+	alice.send(MsgPrefix + "1;/sessions")
+	alice.expect(MsgPrefix + "Sessions: alice (26B in, 9B out), bob (11B in, 9B out)")
+	alice.expect("r1;" + string(ResponseOk))
+}
+
+func TestVersion(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{Version: "v1.2.3"})
+	alice := connectToHub(hub, t)
+	// an unknown capability isn't part of the protocol the session uses
+	alice.send(ClientCapabilities().Serialize() + ",teleport")
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+
+	alice.send(MsgPrefix + "1;/version")
+	alice.expect(MsgPrefix + "Version: server v1.2.3, protocol presence queue reconnect roomnotices, registration open")
+	alice.expect("r1;" + string(ResponseOk))
+	bob.send(MsgPrefix + "2;/version")
+	bob.expect(MsgPrefix + "Version: server v1.2.3, protocol legacy, registration open")
+	bob.expect("r2;" + string(ResponseOk))
+}
+
+func TestClientVersions(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{Version: "v1.2.3"})
+	alice := connectToHub(hub, t)
+	alice.send(ClientCapabilities().WithVersion("1.1.0").Serialize())
+	// answered with the server's version
+	alice.expect(Capabilities{}.WithVersion("v1.2.3").Serialize())
+	alice.register("alice")
+	hub.userDBLock.Lock()
+	hub.userDB["alice"].Admin = true
+	hub.userDBLock.Unlock()
+	for _, name := range []string{"bob", "carol"} {
+		c := connectToHub(hub, t)
+		c.send(ClientCapabilities().WithVersion(DevelVersion).Serialize())
+		c.expect(Capabilities{}.WithVersion("v1.2.3").Serialize())
+		c.register(name)
+	}
+	dave := connectToHub(hub, t)
+	dave.register("dave")
+
+	alice.send(MsgPrefix + "1;/version")
+	alice.expect(MsgPrefix + "Version: server v1.2.3, client 1.1.0, protocol presence queue reconnect roomnotices, registration open")
+	alice.expect("r1;" + string(ResponseOk))
+	alice.send(MsgPrefix + "2;/version clients")
+	alice.expect(MsgPrefix + "Client versions: devel x2, 1.1.0 x1, unknown x1")
+	alice.expect("r2;" + string(ResponseOk))
+	dave.send(MsgPrefix + "3;/version clients")
+	dave.expect("r3;" + string(ResponseNotAdmin))
+
+	dave.send(LogoutCmd.Serialize())
+	waitForLogout(t, hub, "dave")
+	alice.send(MsgPrefix + "4;/version clients")
+	alice.expect(MsgPrefix + "Client versions: devel x2, 1.1.0 x1")
+	alice.expect("r4;" + string(ResponseOk))
+}
+
+func TestMinClientVersion(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{MinClientVersion: "1.0.0"})
+	alice := connectToHub(hub, t)
+	alice.send(ClientCapabilities().WithVersion("1.0.0").Serialize())
+	alice.expect(Capabilities{}.WithVersion(hub.options.Version).Serialize())
+	alice.register("alice")
+	hub.userDBLock.Lock()
+	hub.userDB["alice"].Admin = true
+	hub.userDBLock.Unlock()
+
+	alice.send(MsgPrefix + "1;/set minclientversion newest")
+	alice.expect("r1;" + string(ResponseInvalidArgument))
+	alice.send(MsgPrefix + "2;/set minclientversion 2.0.0-rc.1")
+	alice.expect(MsgPrefix + "Minimum client version set to 2.0.0-rc.1, from 1.0.0")
+	alice.expect("r2;" + string(ResponseOk))
+
+	bob := connectToHub(hub, t)
+	bob.send(ClientCapabilities().WithVersion("1.9.0").Serialize())
+	bob.expect(Capabilities{}.WithVersion(hub.options.Version).Serialize())
+	bob.send(string(ActionRegister), "bob", "1234")
+	bob.expect(ServerResponsePrefix + string(AuthResponseID) + IdSeparator +
+		string(ResponseClientTooOld))
+	// a newer client, and one that can't tell, get in
+	carol := connectToHub(hub, t)
+	carol.send(ClientCapabilities().WithVersion("2.0.0").Serialize())
+	carol.expect(Capabilities{}.WithVersion(hub.options.Version).Serialize())
+	carol.register("carol")
+	dave := connectToHub(hub, t)
+	dave.register("dave")
+}
+
+func TestLoginAttemptNotice(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	mallory := connectToHub(hub, t)
+	mallory.send(string(ActionLogin), "alice", "1234")
+	mallory.expect("rauth;" + string(ResponseUserAlreadyOnline))
+	alice.expect(SerializeAnnouncement(
+		"A login to your account was attempted from pipe and was rejected"))
+
+	// within the interval, so alice isn't told
+	mallory.send(string(ActionLogin), "alice", "1234")
+	mallory.expect("rauth;" + string(ResponseUserAlreadyOnline))
+	alice.send(MsgPrefix + "1;/motd")
+	alice.expect(MsgPrefix + "No message of the day")
+	alice.expect("r1;" + string(ResponseOk))
+
+	// a wrong password isn't worth telling about
+	hub.loginAttemptNotices.lastSent = map[Username]time.Time{}
+	mallory.send(string(ActionLogin), "alice", "wrong")
+	mallory.expect("rauth;" + string(ResponseInvalidCredentials))
+	alice.send(MsgPrefix + "2;/motd")
+	alice.expect(MsgPrefix + "No message of the day")
+	alice.expect("r2;" + string(ResponseOk))
+}
+
+func TestLoginAttemptNoticesExpire(t *testing.T) {
+	notices := newLoginAttemptNotices()
+	start := time.Now()
+	if !notices.shouldSend("alice", start) || !notices.shouldSend("bob", start) {
+		t.Fatal("expected the first notices to be sent")
+	}
+	if notices.shouldSend("alice", start.Add(LoginAttemptNoticeInterval-time.Second)) {
+		t.Fatal("expected a notice within the interval not to be sent")
+	}
+	if !notices.shouldSend("alice", start.Add(LoginAttemptNoticeInterval)) {
+		t.Fatal("expected a notice after the interval to be sent")
+	}
+	if _, kept := notices.lastSent["bob"]; kept {
+		t.Fatal("expected bob's expired notice to be forgotten")
+	}
+}
+
+func TestMOTD(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{MOTD: "Welcome!\nBe nice.\n"})
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	alice.send(MsgPrefix + "1;/motd")
+	alice.expect(MsgPrefix + "Welcome!")
+	alice.expect(MsgPrefix + "Be nice.")
+	alice.expect("r1;" + string(ResponseOk))
+
+	bob := connectToHub(NewHub(), t)
+	bob.register("bob")
+	bob.send(MsgPrefix + "2;/motd")
+	bob.expect(MsgPrefix + "No message of the day")
+	bob.expect("r2;" + string(ResponseOk))
+}
+
+func TestRegistrationClosed(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	alice.send(MsgPrefix + IdSeparator + LogoutCmd.Serialize())
+
+	hub.SetRegistrationOpen(false)
+	bob := connectToHub(hub, t)
+	bob.send(string(ActionRegister), "bob", "1234")
+	bob.expect(ServerResponsePrefix + string(AuthResponseID) + IdSeparator +
+		string(ResponseRegistrationClosed))
+	// existing users can still log in
+	alice.login("alice")
+
+	hub.SetRegistrationOpen(true)
+	bob.register("bob")
+
+	// admins close it with /set, and see it in /version
+	hub.userDBLock.Lock()
+	hub.userDB["alice"].Admin = true
+	hub.userDBLock.Unlock()
+	bob.send(MsgPrefix + "1;/set registration off")
+	bob.expect("r1;" + string(ResponseNotAdmin))
+	alice.send(MsgPrefix + "2;/set registration closed")
+	alice.expect("r2;" + string(ResponseInvalidArgument))
+	alice.send(MsgPrefix + "3;/set registration off")
+	alice.expect(MsgPrefix + "Registration set off, from on")
+	alice.expect("r3;" + string(ResponseOk))
+	alice.send(MsgPrefix + "4;/version")
+	alice.expect(MsgPrefix + "Version: server " + BinaryVersion() +
+		", protocol legacy, registration closed")
+	alice.expect("r4;" + string(ResponseOk))
+	carol := connectToHub(hub, t)
+	carol.send(string(ActionRegister), "carol", "1234")
+	carol.expect(ServerResponsePrefix + string(AuthResponseID) + IdSeparator +
+		string(ResponseRegistrationClosed))
+	alice.send(MsgPrefix + "5;/set registration on")
+	alice.expect(MsgPrefix + "Registration set on, from off")
+	alice.expect("r5;" + string(ResponseOk))
+	carol.register("carol")
+}
+
+// TestLegacyAndModernClients has a client that advertises all capabilities
+// and a legacy one that advertises none in the same room
+func TestRegistrationFull(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{MaxUsers: 3})
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	alice.send(MsgPrefix + IdSeparator + LogoutCmd.Serialize())
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+
+	// only one of them gets the last account
+	const racing = 8
+	responses := make(chan string, racing)
+	for i := 0; i < racing; i++ {
+		c := connectToHub(hub, t)
+		go func(name string) {
+			c.conn.Write([]byte(string(ActionRegister) + "\n" + name + "\n1234\n"))
+			c.conn.SetReadDeadline(time.Now().Add(time.Second))
+			line, _ := ScanLine(c.scanner)
+			responses <- line
+		}("user" + strconv.Itoa(i))
+	}
+	registered := 0
+	for i := 0; i < racing; i++ {
+		switch response := <-responses; response {
+		case ServerResponsePrefix + string(AuthResponseID) + IdSeparator + string(ResponseOk):
+			registered++
+		case ServerResponsePrefix + string(AuthResponseID) + IdSeparator +
+			string(ResponseRegistrationFull):
+		default:
+			t.Fatalf("unexpected response %q", response)
+		}
+	}
+	if registered != 1 {
+		t.Fatalf("expected one more account, got %d", registered)
+	}
+	// existing users can still log in
+	alice.login("alice")
+}
+
+// TestSendToEndedSession ends bob's session while a DM to him is stuck being
+// written, since he isn't reading. alice hears it failed right away, not once
+// MsgSendTimeout is up.
+func TestSendToEndedSession(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{MsgSendTimeout: time.Minute})
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+
+	alice.send(MsgPrefix + "1;/msg bob you there?")
+	// for the DM to be on its way to bob, rather than kept for him offline
+	time.Sleep(50 * time.Millisecond)
+	// a line longer than the server reads fails bob's reads
+	go bob.conn.Write([]byte(strings.Repeat("x", 1<<17) + "\n"))
+	expectEnded(t, hub, "bob", EndReadError)
+	alice.expect("r1;" + string(ResponseMsgFailedForAll))
+}
+
+// TestBroadcastResultPartialFailure broadcasts to bob, who reads, and carol,
+// who doesn't, so her delivery times out
+func TestBroadcastResultPartialFailure(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{MsgSendTimeout: 100 * time.Millisecond})
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	go io.Copy(io.Discard, bob.conn)
+	carol := connectToHub(hub, t)
+	carol.register("carol")
+
+	result := hub.BroadcastMessageWithResult("hi", "alice", time.Time{}, context.Background())
+	if result.Recipients != 2 || result.Succeeded != 1 || result.Failed != 1 ||
+		result.TimedOut != 1 || result.Expired != 0 {
+		t.Fatalf("expected 1 of 2 recipients to time out, got %+v", result)
+	}
+	if len(result.FailedUsers) != 1 || result.FailedUsers[0] != "carol" {
+		t.Fatalf("expected carol to be the one failed, got %v", result.FailedUsers)
+	}
+	if r := result.Response(); r != ResponseMsgTimedOutForSome {
+		t.Fatalf("expected %q, got %q", ResponseMsgTimedOutForSome, r)
+	}
+}
+
+// failingConn is a conn whose writes fail once failWrites is set
+type failingConn struct {
+	net.Conn
+	failWrites atomic.Bool
+}
+
+var errTestWrite = errors.New("test write error")
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	if c.failWrites.Load() {
+		return 0, errTestWrite
+	}
+	return c.Conn.Write(b)
+}
+
+// TestBroadcastWriteError has the write to carol fail, which alice hears as a
+// failure rather than a timeout, while bob still gets the message
+func TestBroadcastWriteError(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	serverSide, clientSide := net.Pipe()
+	carolConn := &failingConn{Conn: serverSide}
+	go hub.HandleNewConnection(carolConn)
+	carol := &testConn{clientSide, bufio.NewScanner(clientSide), t}
+	t.Cleanup(func() { clientSide.Close() })
+	carol.register("carol")
+
+	go io.Copy(io.Discard, bob.conn)
+	carolConn.failWrites.Store(true)
+	result := hub.BroadcastMessageWithResult("hi", "alice", time.Time{}, context.Background())
+	if result.Recipients != 2 || result.Succeeded != 1 || result.Failed != 1 ||
+		result.TimedOut != 0 {
+		t.Fatalf("expected the write to carol to fail, got %+v", result)
+	}
+	if len(result.FailedUsers) != 1 || result.FailedUsers[0] != "carol" {
+		t.Fatalf("expected carol to be the one failed, got %v", result.FailedUsers)
+	}
+	if r := result.Response(); r != ResponseMsgFailedForSome {
+		t.Fatalf("expected %q, got %q", ResponseMsgFailedForSome, r)
+	}
+	expectEnded(t, hub, "carol", EndWriteError)
+}
+
+// TestBroadcastFromOfflineSender broadcasts as alice after she logged out, so
+// bob is the only recipient rather than none
+func TestBroadcastFromOfflineSender(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	alice.conn.Close()
+	waitForLogout(t, hub, "alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+
+	done := make(chan DeliveryResult, 1)
+	go func() {
+		done <- hub.BroadcastMessageWithResult("still here?", "alice", time.Time{},
+			context.Background())
+	}()
+	bob.expect(MsgPrefix + "alice: still here?")
+	if result := <-done; result.Recipients != 1 || result.Succeeded != 1 {
+		t.Fatalf("expected bob to get it, got %+v", result)
+	}
+
+	// and with nobody else online, nobody is counted
+	bob.conn.Close()
+	waitForLogout(t, hub, "bob")
+	result := hub.BroadcastMessageWithResult("anyone?", "alice", time.Time{}, context.Background())
+	if result.Recipients != 0 || result.Response() != ResponseOk {
+		t.Fatalf("expected no recipients, got %+v", result)
+	}
+}
+
+// TestBroadcastDuringChurn has users come and go while alice sends a burst of
+// messages, and checks none of her messages count as failed for it
+func TestBroadcastDuringChurn(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	go io.Copy(io.Discard, bob.conn)
+
+	const burst = 200
+	responses := make(chan string, burst)
+	go func() {
+		for {
+			line, err := ScanLine(alice.scanner)
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, ServerResponsePrefix) {
+				responses <- line
+			}
+		}
+	}()
+	sent := make(chan error, 1)
+	go func() {
+		var lines []string
+		for i := 0; i < burst; i++ {
+			lines = append(lines, MsgPrefix+strconv.Itoa(i)+IdSeparator+"burst")
+		}
+		_, err := alice.conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+		sent <- err
+	}()
+	for i := 0; i < 20; i++ {
+		name := "churn" + strconv.Itoa(i)
+		churner := connectToHub(hub, t)
+		churner.register(name)
+		go io.Copy(io.Discard, churner.conn)
+		time.Sleep(time.Millisecond)
+		churner.conn.Close()
+		waitForLogout(t, hub, name)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < burst; i++ {
+		select {
+		case line := <-responses:
+			if !strings.HasSuffix(line, IdSeparator+string(ResponseOk)) {
+				t.Fatalf("expected every message to go through, got %q", line)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %d of the %d responses", i, burst)
+		}
+	}
+}
+
+func TestBroadcastResultResponses(t *testing.T) {
+	for _, test := range []struct {
+		result   DeliveryResult
+		expected Response
+	}{
+		{DeliveryResult{}, ResponseOk},
+		{DeliveryResult{Recipients: 2, Succeeded: 2}, ResponseOk},
+		{DeliveryResult{Recipients: 1, Succeeded: 1, Departed: 1}, ResponseOk},
+		{DeliveryResult{Departed: 2}, ResponseOk},
+		{DeliveryResult{Recipients: 2, Expired: 2}, ResponseMsgExpiredForAll},
+		{DeliveryResult{Recipients: 2, Succeeded: 1, Expired: 1}, ResponseMsgExpiredForSome},
+		{DeliveryResult{Recipients: 2, Expired: 1, Failed: 1}, ResponseMsgFailedForAll},
+		{DeliveryResult{Recipients: 3, Succeeded: 1, Expired: 1, Failed: 1},
+			ResponseMsgFailedForSome},
+		{DeliveryResult{Recipients: 2, Failed: 2, TimedOut: 2}, ResponseMsgTimedOutForAll},
+		{DeliveryResult{Recipients: 2, Failed: 2, TimedOut: 1}, ResponseMsgFailedForAll},
+		{DeliveryResult{Recipients: 2, Succeeded: 1, Failed: 1, TimedOut: 1},
+			ResponseMsgTimedOutForSome},
+		{DeliveryResult{refusal: ResponseServerShuttingDown}, ResponseServerShuttingDown},
+	} {
+		if r := test.result.Response(); r != test.expected {
+			t.Errorf("expected %+v to be %q, got %q", test.result, test.expected, r)
+		}
+	}
+}
+
+// TestLogFile checks the server logs to its LogFile rather than the standard
+// logger
+func TestLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	server, err := BuildServer(":0", ServerOptions{LogFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.logFile.Close()
+	alice := connectToHub(server.Hub, t)
+	alice.register("alice")
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "Logged in: alice\n") {
+		t.Fatalf("expected alice's login in the log file, got %q", content)
+	}
+}
+
+func TestLegacyAndModernClients(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.send(ClientCapabilities().Serialize())
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+
+	alice.send(MsgPrefix + "1;/subscribe presence")
+	alice.expect("r1;" + string(ResponseOk))
+	bob.send(MsgPrefix + "2;/subscribe presence")
+	bob.expect("r2;" + string(ResponseUnsupportedByClient))
+	// both still chat as usual
+	bob.send(MsgPrefix + "3;hi")
+	alice.expect(MsgPrefix + "bob: hi")
+	bob.expect("r3;" + string(ResponseOk))
+
+	bob.send(MsgPrefix + "4;/sessions")
+	bob.expect(MsgPrefix + "Sessions: alice (74B in, 24B out, caps: presence queue reconnect roomnotices), " +
+		"bob (53B in, 51B out)")
+	bob.expect("r4;" + string(ResponseOk))
+
+	alice.send(MsgPrefix + "5;/unsubscribe presence")
+	alice.expect("r5;" + string(ResponseOk))
+	// the legacy client doesn't know reconnect notices, so it's disconnected
+	go hub.Drain(time.Second)
+	alice.expect(SerializeReconnectNotice(""))
+	bob.expectClosed()
+}
+
+func TestResentMessageBroadcastOnce(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+
+	alice.send(MsgPrefix + "7;hi")
+	bob.expect(MsgPrefix + "alice: hi")
+	alice.expect("r7;" + string(ResponseOk))
+	// e.g from a client that crashed before getting the ack, after a relogin
+	alice.send(MsgPrefix + IdSeparator + LogoutCmd.Serialize())
+	alice.login("alice")
+	alice.send(MsgPrefix + "7;hi")
+	alice.expect("r7;" + string(ResponseOk))
+	// bob's next message isn't the resent one
+	alice.send(MsgPrefix + "8;next")
+	bob.expect(MsgPrefix + "alice: next")
+	alice.expect("r8;" + string(ResponseOk))
+}
+
+func TestCancelMidFanOut(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	// carol never reads, so fanning out to her is stuck
+	carol := connectToHub(hub, t)
+	carol.register("carol")
+
+	alice.send(MsgPrefix + "1;hello")
+	bob.expect(MsgPrefix + "alice: hello")
+	alice.send(MsgPrefix + "2;/pending")
+	alice.expect(MsgPrefix + "Pending: 1")
+	alice.expect("r2;" + string(ResponseOk))
+
+	// queued behind the stuck message, so cancelled without waiting for it
+	alice.send(MsgPrefix + "6;queued")
+	alice.send(MsgPrefix + "6;same id")
+	alice.expect("r6;" + string(ResponseMsgIDInProgress))
+	alice.send(MsgPrefix + "7;/cancel 6")
+	alice.expect("r6;" + string(ResponseCancelled))
+	alice.expect("r7;" + string(ResponseOk))
+
+	alice.send(MsgPrefix + "3;/cancel 1")
+	alice.expect("r1;" + string(ResponseCancelled))
+	alice.expect("r3;" + string(ResponseOk))
+	alice.send(MsgPrefix + "4;/cancel 1")
+	alice.expect("r4;" + string(ResponseUnknownOperation))
+	alice.send(MsgPrefix + "5;/pending")
+	alice.expect(MsgPrefix + "Pending: ")
+	alice.expect("r5;" + string(ResponseOk))
+}
+
+// TestSlowRecipientStress has many users broadcasting at once while one
+// recipient reads slowly. Their messages should line up in the slow user's
+// queue, in order, instead of each broadcast waiting on it in a goroutine.
+func TestSlowRecipientStress(t *testing.T) {
+	// the slow user's queue fits all the messages
+	const senders, msgsEach = 12, 10
+	hub := NewHub()
+	slow := connectToHub(hub, t)
+	slow.register("slow")
+	users := make([]*testConn, senders)
+	for i := range users {
+		users[i] = connectToHub(hub, t)
+		users[i].register("user" + strconv.Itoa(i))
+		// a round trip, so the session's goroutines are all running
+		users[i].send(MsgPrefix + "ping;/ping")
+		users[i].expect("rping;" + string(ResponseOk))
+	}
+	baseline := runtime.NumGoroutine()
+
+	errs := make(chan error, senders+1)
+	var readers sync.WaitGroup
+	// read checks each sender's messages come in the order they were sent
+	read := func(c *testConn, name string, lines int, delay time.Duration) {
+		defer readers.Done()
+		next := make(map[string]int)
+		for i := 0; i < lines; i++ {
+			c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			line, err := ScanLine(c.scanner)
+			if err != nil {
+				errs <- fmt.Errorf("%s: %w after %d lines", name, err, i)
+				return
+			}
+			if strings.HasPrefix(line, ServerResponsePrefix) {
+				if !strings.HasSuffix(line, IdSeparator+string(ResponseOk)) {
+					errs <- fmt.Errorf("%s: expected %s, got %q", name, ResponseOk, line)
+					return
+				}
+				continue
+			}
+			sender, content, _ := strings.Cut(strings.TrimPrefix(line, MsgPrefix), ": ")
+			if expected := "msg " + strconv.Itoa(next[sender]); content != expected {
+				errs <- fmt.Errorf("%s: expected %q from %s, got %q", name, expected, sender, line)
+				return
+			}
+			next[sender]++
+			time.Sleep(delay)
+		}
+	}
+	readers.Add(senders + 1)
+	go read(slow, "slow", senders*msgsEach, 2*time.Millisecond)
+	for i, c := range users {
+		// the others' messages, and the responses to ours
+		go read(c, "user"+strconv.Itoa(i), senders*msgsEach, 0)
+	}
+
+	peak := baseline
+	sampled := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			if n := runtime.NumGoroutine(); n > peak {
+				peak = n
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	for _, c := range users {
+		for i := 0; i < msgsEach; i++ {
+			id := strconv.Itoa(i)
+			c.send(MsgPrefix + id + IdSeparator + "msg " + id)
+		}
+	}
+	readers.Wait()
+	close(done)
+	<-sampled
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	// the readers and the sampler, plus some slack
+	if limit := baseline + senders + 1 + 1 + 8; peak > limit {
+		t.Errorf("%d goroutines at the peak, expected at most %d", peak, limit)
+	}
+}
+
+// lockedBuffer lets the test read the trace while the hub is writing to it
+type lockedBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+var traceTimestamp = regexp.MustCompile(`(?m)^\d\d:\d\d:\d\d\.\d+ `)
+
+func TestTraceMatchesGolden(t *testing.T) {
+	trace := &lockedBuffer{}
+	hub := NewHubWithOptions(ServerOptions{TraceWriter: trace})
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	alice.send(MsgPrefix + "1;/who")
+	alice.expect(MsgPrefix + "Online: alice")
+	alice.expect("r1;" + string(ResponseOk))
+	alice.send(MsgPrefix + "2;hello")
+	alice.expect("r2;" + string(ResponseOk))
+
+	golden, err := os.ReadFile("testdata/trace.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := traceTimestamp.ReplaceAllString(trace.String(), "")
+	if got != string(golden) {
+		t.Errorf("trace doesn't match testdata/trace.golden, got:\n%s", got)
+	}
+	if strings.Contains(got, "1234") {
+		t.Error("password wasn't redacted")
+	}
+}
+
+func TestPresenceSubscription(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.send(ClientCapabilities().Serialize())
+	alice.register("alice")
+	alice.send(MsgPrefix + "1;/subscribe presence")
+	alice.expect("r1;" + string(ResponseOk))
+	alice.send(MsgPrefix + "2;/subscribe weather")
+	alice.expect("r2;" + string(ResponseUnknownTopic))
+
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	alice.expect(PresenceEvent{Name: "bob", Online: true}.Serialize())
+	bob.conn.Close()
+	alice.expect(PresenceEvent{Name: "bob", Online: false}.Serialize())
+
+	alice.send(MsgPrefix + "3;/unsubscribe presence")
+	alice.expect("r3;" + string(ResponseOk))
+	carol := connectToHub(hub, t)
+	carol.register("carol")
+	// no event for carol comes before the /who output
+	alice.send(MsgPrefix + "4;/who")
+	alice.expect(MsgPrefix + "Online: alice, carol")
+	alice.expect("r4;" + string(ResponseOk))
+}
+
+func TestEmptyMessages(t *testing.T) {
+	if _, err := ParseEmptyMessagePolicy("drop"); err == nil {
+		t.Fatal("expected an unknown policy to be refused")
+	}
+	for _, name := range []string{"allow", "reject", "ignore"} {
+		policy, err := ParseEmptyMessagePolicy(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hub := NewHubWithOptions(ServerOptions{EmptyMessages: policy})
+		alice := connectToHub(hub, t)
+		alice.register("alice")
+		bob := connectToHub(hub, t)
+		bob.register("bob")
+
+		alice.send(MsgPrefix + "1;  ")
+		switch policy {
+		case EmptyMessagesAllow:
+			bob.expect(MsgPrefix + "alice:   ")
+			alice.expect("r1;" + string(ResponseOk))
+		case EmptyMessagesReject:
+			alice.expect("r1;" + string(ResponseEmptyMessage))
+		case EmptyMessagesIgnore:
+			alice.expect("r1;" + string(ResponseOk))
+		}
+		// commands aren't affected, and bob got nothing else before the next
+		// message
+		alice.send(MsgPrefix + "2;/who")
+		alice.expect(MsgPrefix + "Online: alice, bob")
+		alice.expect("r2;" + string(ResponseOk))
+		alice.send(MsgPrefix + "3;hi")
+		bob.expect(MsgPrefix + "alice: hi")
+		alice.expect("r3;" + string(ResponseOk))
+	}
+}
+
+// TestCRLFClient plays a client that ends its lines with CRLF, e.g netcat on
+// Windows. The \r is no part of what it sends, and the server's lines never
+// have one.
+// TestLineTooLong sends multi-megabyte lines, which have the connection
+// closed before the server read them whole, logged in or not
+func TestLineTooLong(t *testing.T) {
+	logged := &lockedBuffer{}
+	hub := NewHubWithOptions(ServerOptions{MaxLineLen: 100, Logger: log.New(logged, "", 0)})
+	huge := strings.Repeat("a", 4<<20)
+	sendHuge := func(c *testConn) <-chan error {
+		sent := make(chan error, 1)
+		go func() {
+			_, err := io.WriteString(c.conn, huge+"\n")
+			sent <- err
+		}()
+		return sent
+	}
+	expectCutOff := func(sent <-chan error) {
+		t.Helper()
+		select {
+		case err := <-sent:
+			if err == nil {
+				t.Fatal("expected the server to stop reading the line")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected the line's write to fail")
+		}
+	}
+
+	alice := connectToHub(hub, t)
+	alice.send(string(ActionLogin))
+	sent := sendHuge(alice)
+	alice.expectClosed()
+	expectCutOff(sent)
+	if !strings.Contains(logged.String(), "line too long") {
+		t.Fatalf("expected the disconnection to be logged, got %q", logged)
+	}
+
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	prefix := MsgPrefix + "1;"
+	bob.send(prefix + strings.Repeat("b", 100-len(prefix)))
+	bob.expect("r1;" + string(ResponseOk))
+	sent = sendHuge(bob)
+	bob.expectClosed()
+	expectCutOff(sent)
+	waitForLogout(t, hub, "bob")
+}
+
+func TestCRLFClient(t *testing.T) {
+	hub := NewHub()
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	serverSide, alice := net.Pipe()
+	go hub.HandleNewConnection(serverSide)
+	t.Cleanup(func() { alice.Close() })
+	alice.SetDeadline(time.Now().Add(time.Second))
+	lines := bufio.NewReader(alice)
+	expect := func(expected string) {
+		t.Helper()
+		line, err := lines.ReadString('\n')
+		if err != nil || line != expected+"\n" {
+			t.Fatalf("expected %q, got %q, %v", expected+"\n", line, err)
+		}
+	}
+	send := func(line string) {
+		t.Helper()
+		if _, err := io.WriteString(alice, line+"\r\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(ClientCapabilities().Serialize())
+	send(string(ActionRegister))
+	send("alice")
+	send("1234")
+	expect("rauth;" + string(ResponseOk))
+	send(MsgPrefix + "1;hi")
+	bob.expect(MsgPrefix + "alice: hi")
+	expect("r1;" + string(ResponseOk))
+	// a \r inside the line is content, which control characters are stripped of
+	send(MsgPrefix + "2;one\rtwo")
+	bob.expect(MsgPrefix + "alice: onetwo")
+	expect("r2;" + string(ResponseOk))
+	bob.send(MsgPrefix + "3;hi alice")
+	expect(MsgPrefix + "bob: hi alice")
+	bob.expect("r3;" + string(ResponseOk))
+
+	// the password was taken without the \r
+	send(MsgPrefix + "4;/quit")
+	expect("r4;" + string(ResponseOk))
+	waitForLogout(t, hub, "alice")
+	relog := connectToHub(hub, t)
+	relog.login("alice")
+}
+
+func TestControlChars(t *testing.T) {
+	for _, policy := range []ControlCharPolicy{ControlCharsStrip, ControlCharsReject} {
+		hub := NewHubWithOptions(ServerOptions{ControlChars: policy})
+		alice := connectToHub(hub, t)
+		alice.register("alice")
+		bob := connectToHub(hub, t)
+		bob.register("bob")
+
+		// an ANSI escape clearing the screen, a null byte, a C1 control and a
+		// byte that isn't UTF-8, around a tab which is fine
+		alice.send(MsgPrefix + "1;\x1b[2Jred\x1b[31m\x00\tcsi\u009b\xffok")
+		if policy == ControlCharsStrip {
+			bob.expect(MsgPrefix + "alice: [2Jred[31m\tcsiok")
+			alice.expect("r1;" + string(ResponseOk))
+		} else {
+			alice.expect("r1;" + string(ResponseControlChars))
+		}
+		// commands are sanitized too, e.g a title-setting escape in a DM
+		alice.send(MsgPrefix + "2;/msg bob \x1b]0;pwned\x07hi")
+		if policy == ControlCharsStrip {
+			bob.expect(MsgPrefix + "(DM) alice: ]0;pwnedhi")
+			alice.expect("r2;" + string(ResponseOk))
+		} else {
+			alice.expect("r2;" + string(ResponseControlChars))
+		}
+		alice.send(MsgPrefix + "3;hi")
+		bob.expect(MsgPrefix + "alice: hi")
+		alice.expect("r3;" + string(ResponseOk))
+	}
+}
+
+func TestDrain(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{DrainRedirect: "127.0.0.1:7001"})
+	notice := SerializeReconnectNotice("127.0.0.1:7001")
+	alice := connectToHub(hub, t)
+	alice.send(ClientCapabilities().Serialize())
+	alice.register("alice")
+	// bob is told too, even though he hasn't logged in. His failed login makes
+	// sure his capabilities were read.
+	bob := connectToHub(hub, t)
+	bob.send(ClientCapabilities().Serialize(), string(ActionLogin), "bob", "1234")
+	bob.expect(ServerResponsePrefix + string(AuthResponseID) + IdSeparator +
+		string(ResponseInvalidCredentials))
+
+	drained := make(chan bool)
+	go func() { drained <- hub.Drain(2 * time.Second) }()
+	alice.expect(notice)
+	bob.expect(notice)
+	carol := connectToHub(hub, t)
+	carol.expect(notice)
+	carol.expectClosed()
+
+	alice.conn.Close()
+	select {
+	case <-drained:
+		t.Fatal("drain finished while bob was still connected")
+	case <-time.After(50 * time.Millisecond):
+	}
+	bob.conn.Close()
+	if !<-drained {
+		t.Fatal("drain timed out")
+	}
+}
+
+// TestDrainDuringBroadcasts drains while messages are sent to bob, who isn't
+// reading, and checks they're given up on when it times out rather than waiting
+// for MsgSendTimeout, and that none are sent afterwards
+func TestDrainDuringBroadcasts(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{MsgSendTimeout: 5 * time.Second})
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.send(ClientCapabilities().Serialize())
+	bob.register("bob")
+	carol := connectToHub(hub, t)
+	carol.register("carol")
+	go io.Copy(io.Discard, carol.conn)
+
+	const senders = 4
+	responses := make(chan Response, senders)
+	for i := 0; i < senders; i++ {
+		go func() {
+			var response Response
+			for response != ResponseServerShuttingDown {
+				response = hub.BroadcastMessage("hi", "alice", time.Time{}, context.Background())
+				if response == ResponseOk {
+					response = "bob got a message he isn't reading"
+					break
+				}
+			}
+			responses <- response
+		}()
+	}
+	// bob's notice can't be written, so he's still connected at the timeout
+	time.Sleep(50 * time.Millisecond)
+	if hub.Drain(100 * time.Millisecond) {
+		t.Fatal("expected the drain to time out")
+	}
+	for i := 0; i < senders; i++ {
+		select {
+		case response := <-responses:
+			if response != ResponseServerShuttingDown {
+				t.Fatalf("expected the messages to be refused after draining, got %q", response)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected the messages in progress to be given up on")
+		}
+	}
+	r := hub.SendDirectMsg("hi", "alice", "carol", time.Time{}, context.Background())
+	if r != ResponseServerShuttingDown {
+		t.Fatalf("expected DMs to be refused too, got %q", r)
+	}
+}
+
+func TestHistoryKeepsLastMessages(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{History: HistoryRetention{MaxMessages: 2}})
+	hub.history.now = func() time.Time { return time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC) }
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+
+	for _, id := range []string{"1", "2", "3"} {
+		alice.send(MsgPrefix + id + IdSeparator + "msg " + id)
+		alice.expect(ServerResponsePrefix + id + IdSeparator + string(ResponseOk))
+	}
+	alice.send(MsgPrefix + "4;/history")
+	alice.expect(MsgPrefix + "History: 2020-01-01T12:00:00Z #2 alice: msg 2")
+	alice.expect(MsgPrefix + "History: 2020-01-01T12:00:00Z #3 alice: msg 3")
+	alice.expect("r4;" + string(ResponseOk))
+	alice.send(MsgPrefix + "5;/history 1")
+	alice.expect(MsgPrefix + "History: 2020-01-01T12:00:00Z #3 alice: msg 3")
+	alice.expect("r5;" + string(ResponseOk))
+	alice.send(MsgPrefix + "6;/history -1")
+	alice.expect("r6;" + string(ResponseInvalidArgument))
+}
+
+func TestHistoryExpiresOldMessages(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{History: HistoryRetention{MaxAge: time.Minute}})
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	hub.history.now = func() time.Time { return now }
+
+	hub.BroadcastMessage("old", "alice", time.Time{}, context.Background())
+	now = now.Add(50 * time.Second)
+	hub.BroadcastMessage("new", "alice", time.Time{}, context.Background())
+	if got := hub.History(0); len(got) != 2 {
+		t.Fatalf("expected both messages, got %v", got)
+	}
+	// expired lazily, on the next read
+	now = now.Add(20 * time.Second)
+	got := hub.History(0)
+	if len(got) != 1 || got[0].Content != "new" {
+		t.Fatalf("expected only the new message, got %v", got)
+	}
+}
+
+func TestReactions(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+
+	alice.send(MsgPrefix + "1;hi")
+	bob.expect(MsgPrefix + "alice: hi")
+	alice.expect("r1;" + string(ResponseOk))
+
+	tally := MsgPrefix + "Reactions to #1 (alice: hi): "
+	bob.send(MsgPrefix + "2;/react 1 👍")
+	bob.expect(tally + "👍 1")
+	bob.expect("r2;" + string(ResponseOk))
+	alice.expect(tally + "👍 1")
+
+	// each user can react with each emoji once
+	bob.send(MsgPrefix + "3;/react 1 👍")
+	bob.expect("r3;" + string(ResponseAlreadyReacted))
+	bob.send(MsgPrefix + "4;/react 1 🎉")
+	bob.expect(tally + "👍 1, 🎉 1")
+	bob.expect("r4;" + string(ResponseOk))
+	alice.expect(tally + "👍 1, 🎉 1")
+	alice.send(MsgPrefix + "5;/react 1 👍")
+	alice.expect(tally + "👍 2, 🎉 1")
+	alice.expect("r5;" + string(ResponseOk))
+	bob.expect(tally + "👍 2, 🎉 1")
+
+	alice.send(MsgPrefix + "6;/react 2 👍")
+	alice.expect("r6;" + string(ResponseUnknownMessage))
+	for i, args := range []string{"", "1", "x 👍", "1 two words", "1 " + strings.Repeat("👍", 9)} {
+		id := strconv.Itoa(7 + i)
+		alice.send(MsgPrefix + id + ";/react " + args)
+		alice.expect("r" + id + ";" + string(ResponseInvalidArgument))
+	}
+
+	// a client that tells room notices apart gets them as such, but not the
+	// tally answering its own reaction
+	carol := connectToHub(hub, t)
+	carol.send(ClientCapabilities().Serialize())
+	carol.register("carol")
+	bob.send(MsgPrefix + "12;/react 1 🚀")
+	bob.expect(tally + "👍 2, 🎉 1, 🚀 1")
+	bob.expect("r12;" + string(ResponseOk))
+	alice.expect(tally + "👍 2, 🎉 1, 🚀 1")
+	carol.expect(SerializeRoomNotice("Reactions to #1 (alice: hi): 👍 2, 🎉 1, 🚀 1"))
+	carol.send(MsgPrefix + "1;/react 1 🚀")
+	carol.expect(tally + "👍 2, 🎉 1, 🚀 2")
+	carol.expect("r1;" + string(ResponseOk))
+}
+
+func TestReactionsExpireWithMessage(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{History: HistoryRetention{MaxMessages: 1}})
+	hub.BroadcastMessage("old", "alice", time.Time{}, context.Background())
+	if _, r := hub.React(1, "bob", "👍"); r != ResponseOk {
+		t.Fatalf("expected %q, got %q", ResponseOk, r)
+	}
+	hub.BroadcastMessage("new", "alice", time.Time{}, context.Background())
+	if _, r := hub.React(1, "carol", "👍"); r != ResponseUnknownMessage {
+		t.Fatalf("expected %q, got %q", ResponseUnknownMessage, r)
+	}
+	if len(hub.history.room(GlobalRoom).reactions) != 0 {
+		t.Fatalf("expected the old message's reactions to be forgotten, got %v",
+			hub.history.room(GlobalRoom).reactions)
+	}
+}
+
+// waitForLogout waits until the hub has logged name out, after its connection
+// closed
+func waitForLogout(t *testing.T, hub *Hub, name string) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); ; {
+		online := false
+		for _, user := range hub.ActiveUsers() {
+			online = online || user == name
+		}
+		if !online {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("%s is still logged in", name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDirectMsgs(t *testing.T) {
+	hub := NewHub()
+	hub.offlineMsgs.now = func() time.Time { return time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC) }
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	carol := connectToHub(hub, t)
+	carol.register("carol")
+	carol.conn.Close()
+	waitForLogout(t, hub, "carol")
+
+	alice.send(MsgPrefix + "1;/msg bob hi bob")
+	bob.expect(MsgPrefix + "(DM) alice: hi bob")
+	alice.expect("r1;" + string(ResponseOk))
+	alice.send(MsgPrefix + "2;/msg nobody hi")
+	alice.expect("r2;" + string(ResponseNoSuchUser))
+	alice.send(MsgPrefix + "3;/msg bob")
+	alice.expect("r3;" + string(ResponseInvalidArgument))
+
+	alice.send(MsgPrefix + "4;/msg carol first")
+	alice.expect("r4;" + string(ResponseQueuedForOffline))
+	bob.send(MsgPrefix + "5;/msg carol second")
+	bob.expect("r5;" + string(ResponseQueuedForOffline))
+
+	// delivered in order right after logging in, before anything live
+	carol = connectToHub(hub, t)
+	carol.login("carol")
+	carol.expect(MsgPrefix + "(DM 2020-01-01T12:00:00Z) alice: first")
+	carol.expect(MsgPrefix + "(DM 2020-01-01T12:00:00Z) bob: second")
+	alice.send(MsgPrefix + "6;live")
+	carol.expect(MsgPrefix + "alice: live")
+	bob.expect(MsgPrefix + "alice: live")
+	alice.expect("r6;" + string(ResponseOk))
+
+	// only once
+	carol.conn.Close()
+	waitForLogout(t, hub, "carol")
+	carol = connectToHub(hub, t)
+	carol.login("carol")
+	alice.send(MsgPrefix + "7;/msg carol again")
+	carol.expect(MsgPrefix + "(DM) alice: again")
+	alice.expect("r7;" + string(ResponseOk))
+}
+
+func TestOfflineMsgsCapAndExpiry(t *testing.T) {
+	msgs := newOfflineMsgs(OfflineMsgOptions{MaxPerUser: 2, TTL: time.Minute})
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	msgs.now = func() time.Time { return now }
+
+	for i, expected := range []Response{ResponseQueuedForOffline, ResponseQueuedForOffline,
+		ResponseOfflineQueueFull} {
+		if r := msgs.add("carol", DirectMsg{Sender: "alice", Content: strconv.Itoa(i)}); r != expected {
+			t.Fatalf("message %d: expected %q, got %q", i, expected, r)
+		}
+		now = now.Add(20 * time.Second)
+	}
+	// the cap is per user
+	if r := msgs.add("dave", DirectMsg{Sender: "alice"}); r != ResponseQueuedForOffline {
+		t.Fatalf("expected %q, got %q", ResponseQueuedForOffline, r)
+	}
+	// the first is a minute old now, so it's expired and makes room
+	now = now.Add(time.Second)
+	if r := msgs.add("carol", DirectMsg{Sender: "alice", Content: "3"}); r != ResponseQueuedForOffline {
+		t.Fatalf("expected %q, got %q", ResponseQueuedForOffline, r)
+	}
+	var got []string
+	for _, msg := range msgs.take("carol") {
+		got = append(got, msg.Content)
+	}
+	if strings.Join(got, ",") != "1,3" {
+		t.Fatalf("expected messages 1 and 3, got %v", got)
+	}
+	if len(msgs.take("carol")) != 0 {
+		t.Fatal("expected the messages to be taken only once")
+	}
+	now = now.Add(time.Hour)
+	if len(msgs.take("dave")) != 0 {
+		t.Fatal("expected dave's message to expire")
+	}
+}
+
+func TestOfflineMentionDigest(t *testing.T) {
+	hub := NewHub()
+	hub.offlineMentions.now = func() time.Time { return time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC) }
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	dave := connectToHub(hub, t)
+	dave.register("dave")
+	dave.conn.Close()
+	waitForLogout(t, hub, "dave")
+
+	alice.send(MsgPrefix + "1;@dave can you check the deploy")
+	bob.expect(MsgPrefix + "alice: @dave can you check the deploy")
+	alice.expect("r1;" + string(ResponseOk))
+	// online users and unknown names are only broadcast to
+	bob.send(MsgPrefix + "2;@alice @nobody thanks, @dave!")
+	alice.expect(MsgPrefix + "bob: @alice @nobody thanks, @dave!")
+	bob.expect("r2;" + string(ResponseOk))
+
+	dave = connectToHub(hub, t)
+	dave.login("dave")
+	dave.expect(MsgPrefix + "You were mentioned 2 times while away")
+	dave.expect(MsgPrefix + "2020-01-01T12:00:00Z alice: @dave can you check the deploy")
+	dave.expect(MsgPrefix + "2020-01-01T12:00:00Z bob: @alice @nobody thanks, @dave!")
+	if _, exists := hub.offlineMentions.byUser["alice"]; exists {
+		t.Fatal("expected no mentions kept for alice, who was online")
+	}
+	if digest := hub.offlineMentions.take("dave"); digest != nil {
+		t.Fatalf("expected the digest to be shown once, got %q", digest)
+	}
+}
+
+func TestOfflineMentionsCapAndExpiry(t *testing.T) {
+	mentions := newOfflineMentions(MentionOptions{TTL: time.Minute})
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	mentions.now = func() time.Time { return now }
+
+	for i := 0; i <= DefaultMentionsPerUser; i++ {
+		mentions.add("dave", "alice", "@dave "+strconv.Itoa(i), time.Time{})
+	}
+	digest := mentions.take("dave")
+	if len(digest) != DefaultMentionsPerUser+2 {
+		t.Fatalf("expected a heading, %d mentions and a note, got %d lines",
+			DefaultMentionsPerUser, len(digest))
+	}
+	if digest[0] != "You were mentioned 101 times while away" {
+		t.Fatalf("unexpected heading %q", digest[0])
+	}
+	// the oldest is the one dropped
+	if !strings.HasSuffix(digest[1], "alice: @dave 1") {
+		t.Fatalf("expected the first shown to be mention 1, got %q", digest[1])
+	}
+	if note := digest[len(digest)-1]; note != "(1 older not shown)" {
+		t.Fatalf("unexpected truncation note %q", note)
+	}
+
+	mentions.add("dave", "alice", "@dave old", time.Time{})
+	now = now.Add(time.Minute + time.Second)
+	if digest := mentions.take("dave"); digest != nil {
+		t.Fatalf("expected the mention to expire, got %q", digest)
+	}
+}
+
+func TestUserDBEditedByHand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeFile := func(content string, modTime time.Time) {
+		t.Helper()
+		err := os.WriteFile(path, []byte(content), 0o600)
+		if err == nil {
+			// set explicitly, since writes can land within the fs's mtime resolution
+			err = os.Chtimes(path, modTime, modTime)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	writeFile(`{"alice": {"password": "1234"}, "bob": {"password": "1234"}}`, start)
+	hub := NewHubWithOptions(ServerOptions{UserDBPath: path})
+	if err := hub.LoadUserDB(); err != nil {
+		t.Fatal(err)
+	}
+	ticks := make(chan time.Time)
+	defer close(ticks)
+	go hub.watchUserDB(ticks)
+
+	bob := connectToHub(hub, t)
+	bob.login("bob")
+	// caught mid-write, so nothing changes until the next tick
+	writeFile(`{"alice": {"pass`, start.Add(time.Second))
+	ticks <- time.Now()
+	bob.send(MsgPrefix + "1;/ping")
+	bob.expect("r1;" + string(ResponseOk))
+
+	writeFile(`{"alice": {"password": "1234"}}`, start.Add(2*time.Second))
+	ticks <- time.Now()
+	bob.expect(LogoutReason{Code: LogoutKicked, Text: "your account was removed"}.Cmd().Serialize())
+	bob.expectClosed()
+	bob = connectToHub(hub, t)
+	bob.send(string(ActionLogin), "bob", "1234")
+	bob.expect(ServerResponsePrefix + string(AuthResponseID) + IdSeparator +
+		string(ResponseInvalidCredentials))
+	alice := connectToHub(hub, t)
+	alice.login("alice")
+}
+
+func TestServerTime(t *testing.T) {
+	alice := connectToHub(NewHub(), t)
+	alice.register("alice")
+	before := time.Now()
+	alice.send(MsgPrefix + "1;/time")
+	line, err := ScanLine(alice.scanner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTime, err := ParseServerTime(Response(strings.TrimPrefix(line, "r1;")))
+	if !strings.HasPrefix(line, "r1;") || err != nil {
+		t.Fatalf("expected the server's time, got %q", line)
+	}
+	if serverTime.Before(before.Add(-time.Second)) || serverTime.After(time.Now().Add(time.Second)) {
+		t.Fatalf("server time %s is off", serverTime)
+	}
+}
+
+// TestUserDBReloadKeepsRegistrations checks a reload never swaps in a file
+// that misses registrations the hub made
+func TestUserDBReloadKeepsRegistrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	hub := NewHubWithOptions(ServerOptions{UserDBPath: path})
+	staleVersion := fileVersion{}
+	stale := map[Username]*UserRecord{}
+
+	dave := connectToHub(hub, t)
+	dave.register("dave")
+	db, err := readUserDB(path)
+	if err != nil || db["dave"] == nil {
+		t.Fatalf("expected dave to be saved, got %v, %v", db, err)
+	}
+	// e.g read before dave's registration was saved
+	if swapped, err := hub.swapUserDB(stale, staleVersion); swapped || err != nil {
+		t.Fatalf("expected a stale read not to be swapped in, got %v, %v", swapped, err)
+	}
+
+	// a change not saved yet would be lost too
+	hub.userDBLock.Lock()
+	hub.userDBGen++
+	hub.userDBLock.Unlock()
+	if err := os.WriteFile(path, []byte(`{}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.reloadUserDB(); !errors.Is(err, errUnsavedUserDB) {
+		t.Fatalf("expected %v, got %v", errUnsavedUserDB, err)
+	}
+	dave.send(MsgPrefix + IdSeparator + LogoutCmd.Serialize())
+	dave.login("dave")
+}
+
+// TestSlowClientDisconnected has bob never read, so the message being written
+// to him blocks and the rest queue up behind it until he's disconnected
+func TestSlowClientDisconnected(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{MsgSendTimeout: 10 * time.Millisecond})
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	for i := 0; i < MaxQueuedMsgs+2; i++ {
+		id := strconv.Itoa(i)
+		alice.send(MsgPrefix + id + IdSeparator + "hi")
+		alice.conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := ScanLine(alice.scanner)
+		if err != nil || !strings.HasPrefix(line, ServerResponsePrefix+id+IdSeparator) {
+			t.Fatalf("expected a response to %s, got %q, %v", id, line, err)
+		}
+	}
+	expectEnded(t, hub, "bob", EndTooSlow)
+}
+
+// TestHangUpMidForward has bob hang up while a message is being written to
+// him, which is a normal disconnect and not logged as an error
+// TestKickAheadOfBacklog kicks bob while he has a backlog of messages, and
+// checks the logout command is written right after the one being written
+func TestKickAheadOfBacklog(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	hub.activeUsersLock.RLock()
+	bobsHandler := hub.activeUsers["bob"]
+	hub.activeUsersLock.RUnlock()
+
+	const backlog = 50
+	for i := 0; i < backlog; i++ {
+		go hub.BroadcastMessage("msg "+strconv.Itoa(i), "alice", time.Time{}, context.Background())
+	}
+	// one's being written, and the rest wait for it
+	for deadline := time.Now().Add(time.Second); len(bobsHandler.SendMsg) != backlog-1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d messages queued, got %d", backlog-1, len(bobsHandler.SendMsg))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	reason := LogoutReason{Code: LogoutKicked, Text: "spamming"}
+	kicked := make(chan struct{})
+	go func() {
+		hub.Kick("bob", "an admin", reason)
+		close(kicked)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	bob.conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := ScanLine(bob.scanner)
+	if err != nil || !strings.HasPrefix(line, MsgPrefix+"alice: msg ") {
+		t.Fatalf("expected the message being written, got %q, %v", line, err)
+	}
+	bob.expect(reason.Cmd().Serialize())
+	bob.expectClosed()
+	<-kicked
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Fatalf("expected the connection to close right away, it took %s", took)
+	}
+}
+
+// TestQuitAnsweredLast has bob send alice a message just as she quits, and
+// checks it's either written before her /quit is answered or not at all
+func TestQuitAnsweredLast(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	for i := 0; i < 20; i++ {
+		id := strconv.Itoa(i)
+		bob.send(MsgPrefix + id + IdSeparator + "race " + id)
+		alice.send(MsgPrefix + "q" + id + IdSeparator + LogoutCmd.Serialize())
+		for answered := false; !answered; {
+			if err := alice.conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			line, err := ScanLine(alice.scanner)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch line {
+			case "rq" + id + IdSeparator + string(ResponseOk):
+				answered = true
+			case MsgPrefix + "bob: race " + id:
+			default:
+				t.Fatalf("expected bob's message or the answer to the logout, got %q", line)
+			}
+		}
+		// nothing's written after the answer, until she logs in again
+		alice.login("alice")
+		bob.expect("r" + id + IdSeparator + string(ResponseOk))
+	}
+}
+
+func TestHangUpMidForward(t *testing.T) {
+	logged := &lockedBuffer{}
+	log.SetOutput(logged)
+	defer log.SetOutput(os.Stderr)
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+
+	alice.send(MsgPrefix + "1;hi")
+	// bob isn't reading, so the write to him is blocked by now
+	time.Sleep(10 * time.Millisecond)
+	bob.conn.Close()
+	// bob left rather than failed to get it
+	alice.expect("r1;" + string(ResponseOk))
+	waitForLogout(t, hub, "bob")
+	if strings.Contains(logged.String(), "Error") ||
+		strings.Contains(logged.String(), "closed") {
+		t.Fatalf("expected a quiet disconnect, got:\n%s", logged)
+	}
+}
+
+// TestNoGoroutineLeaks churns short-lived connections through every way a
+// session can end, and checks the hub's goroutines all end with them
+func TestNoGoroutineLeaks(t *testing.T) {
+	defer func(timeout time.Duration) { ClientWriteTimeout = timeout }(ClientWriteTimeout)
+	ClientWriteTimeout = 10 * time.Millisecond
+	hub := NewHub()
+	// alice stays, messaging the others so they have writes in flight
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	// a round trip, so alice's session goroutines are all running
+	alice.send(MsgPrefix + "ping;/ping")
+	alice.expect("rping;" + string(ResponseOk))
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 1000; i++ {
+		serverSide, clientSide := net.Pipe()
+		go hub.HandleNewConnection(serverSide)
+		c := &testConn{clientSide, bufio.NewScanner(clientSide), t}
+		name := fmt.Sprintf("user%d", i)
+		switch i % 4 {
+		case 0:
+			// hangs up before authenticating
+		case 1:
+			// hangs up while logged in
+			c.register(name)
+		case 2:
+			c.register(name)
+			c.send(MsgPrefix + IdSeparator + LogoutCmd.Serialize())
+		case 3:
+			// never reads the message, so writing it times out
+			c.register(name)
+			id := strconv.Itoa(i)
+			alice.send(MsgPrefix + id + IdSeparator + "hi")
+			alice.conn.SetReadDeadline(time.Now().Add(time.Second))
+			line, err := ScanLine(alice.scanner)
+			if err != nil || !strings.HasPrefix(line, ServerResponsePrefix+id+IdSeparator) {
+				t.Fatalf("expected a response to %s, got %q, %v", id, line, err)
+			}
+		}
+		clientSide.Close()
+	}
+
+	var now int
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if now = runtime.NumGoroutine(); now <= baseline {
+			return
+		}
+	}
+	buf := make([]byte, 1<<20)
+	t.Fatalf("%d goroutines, up from %d:\n%s", now, baseline, buf[:runtime.Stack(buf, true)])
+}
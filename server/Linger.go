@@ -0,0 +1,93 @@
+package server
+
+import (
+	"time"
+	. "util"
+)
+
+// lingeringSession is the session of a user whose connection dropped, kept
+// online for ServerOptions.LogoutGrace so a quick reconnect doesn't show
+// them leaving and joining again. Messages to them are queued meanwhile, and
+// go to the session that picks it up, see Hub.resumeLingering.
+type lingeringSession struct {
+	handler *ClientHandler
+	timer   *time.Timer
+}
+
+// lingers tells whether a session that ended for cause is kept for its user
+// to reconnect. Only the connection dropping is, not them logging out or
+// being made to.
+func lingers(cause EndCause) bool {
+	switch cause {
+	case EndQuit, EndReadError, EndWriteError, EndWriteTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// endSession logs handler's user out once their session ended for cause, or
+// once LogoutGrace passed if it lingers
+func (hub *Hub) endSession(handler *ClientHandler, cause EndCause) {
+	name := handler.Creds.Name
+	if hub.options.LogoutGrace <= 0 || !lingers(cause) {
+		close(handler.ended)
+		hub.Logout(name)
+		return
+	}
+	hub.activeUsersLock.Lock()
+	defer hub.activeUsersLock.Unlock()
+	lingering := &lingeringSession{handler: handler}
+	lingering.timer = time.AfterFunc(hub.options.LogoutGrace, func() {
+		if hub.endLingering(name, lingering) {
+			hub.logger.Printf("%s didn't reconnect within %s\n", name,
+				hub.options.LogoutGrace)
+		}
+	})
+	hub.lingering[name] = lingering
+	hub.logger.Printf("Keeping %s online for %s for them to reconnect\n", name,
+		hub.options.LogoutGrace)
+}
+
+// endLingering logs name out, if their session is still lingering, and
+// tells whether it was
+func (hub *Hub) endLingering(name Username, lingering *lingeringSession) bool {
+	hub.activeUsersLock.Lock()
+	if hub.lingering[name] != lingering {
+		// they reconnected, or were logged out already
+		hub.activeUsersLock.Unlock()
+		return false
+	}
+	lingering.timer.Stop()
+	delete(hub.lingering, name)
+	hub.logoutLocked(name)
+	hub.activeUsersLock.Unlock()
+	// the messages still queued are given up on
+	close(lingering.handler.ended)
+	return true
+}
+
+// resumeLingering has client pick up its user's lingering session, if they
+// have one, taking over its queues so what was sent to them meanwhile is
+// written to the new connection. Nobody's told they left and came back.
+// Should be called with activeUsersLock held.
+func (hub *Hub) resumeLingering(client *ClientHandler) bool {
+	name := client.Creds.Name
+	lingering, isLingering := hub.lingering[name]
+	if !isLingering {
+		return false
+	}
+	lingering.timer.Stop()
+	delete(hub.lingering, name)
+	old := lingering.handler
+	// ended too, so whoever waits for the queued messages waits for this
+	// session to write them
+	client.SendMsg, client.notices, client.ended = old.SendMsg, old.notices, old.ended
+	client.blocksDMs = old.blocksDMs
+	if _, isWatching := hub.presenceWatchers[name]; isWatching {
+		hub.presenceWatchers[name] = client
+	}
+	hub.activeUsers[name] = client
+	hub.logger.Printf("Reconnected: %s\n", name)
+	return true
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"testing"
+	"time"
+	. "util"
+)
+
+func TestReconnectWithinLogoutGrace(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{LogoutGrace: time.Minute})
+	alice := connectToHub(hub, t)
+	alice.send(ClientCapabilities().Serialize())
+	alice.register("alice")
+	alice.send(MsgPrefix + "1;/subscribe presence")
+	alice.expect("r1;" + string(ResponseOk))
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	alice.expect(PresenceEvent{Name: "bob", Online: true}.Serialize())
+
+	bob.conn.Close()
+	expectEnded(t, hub, "bob", EndQuit)
+	// bob's still online, so what's sent to him meanwhile waits for him
+	alice.send(MsgPrefix + "2;while you were away")
+	bob = connectToHub(hub, t)
+	bob.login("bob")
+	bob.expect(MsgPrefix + "alice: while you were away")
+	alice.expect("r2;" + string(ResponseOk))
+
+	// alice never saw bob leave and come back
+	alice.send(MsgPrefix + "3;/who")
+	alice.expect(MsgPrefix + "Online: alice, bob")
+	alice.expect("r3;" + string(ResponseOk))
+}
+
+func TestLogoutAfterGrace(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{LogoutGrace: 50 * time.Millisecond})
+	alice := connectToHub(hub, t)
+	alice.send(ClientCapabilities().Serialize())
+	alice.register("alice")
+	alice.send(MsgPrefix + "1;/subscribe presence")
+	alice.expect("r1;" + string(ResponseOk))
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	alice.expect(PresenceEvent{Name: "bob", Online: true}.Serialize())
+
+	start := time.Now()
+	bob.conn.Close()
+	alice.expect(PresenceEvent{Name: "bob", Online: false}.Serialize())
+	if took := time.Since(start); took < 50*time.Millisecond {
+		t.Fatalf("expected bob to be logged out after the grace period, took %s", took)
+	}
+	bob = connectToHub(hub, t)
+	bob.login("bob")
+	alice.expect(PresenceEvent{Name: "bob", Online: true}.Serialize())
+
+	// logging out isn't a dropped connection, so there's no grace for it
+	bob.send(MsgPrefix + IdSeparator + LogoutCmd.Serialize())
+	alice.expect(PresenceEvent{Name: "bob", Online: false}.Serialize())
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+	. "util"
+)
+
+// LoginAttemptNoticeInterval is how often at most a user is told of attempts
+// to log into their account while they're online, so it can't be used to
+// flood them
+const LoginAttemptNoticeInterval = time.Minute
+
+// loginAttemptNotices is when each account was last told of a login attempt
+type loginAttemptNotices struct {
+	lastSent map[Username]time.Time
+	lock     sync.Mutex
+}
+
+func newLoginAttemptNotices() *loginAttemptNotices {
+	return &loginAttemptNotices{lastSent: make(map[Username]time.Time)}
+}
+
+// shouldSend tells whether name may be told of a login attempt now, and if so
+// counts it as told. The accounts told longer than
+// LoginAttemptNoticeInterval ago are forgotten.
+func (n *loginAttemptNotices) shouldSend(name Username, now time.Time) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for other, sent := range n.lastSent {
+		if now.Sub(sent) >= LoginAttemptNoticeInterval {
+			delete(n.lastSent, other)
+		}
+	}
+	if _, sent := n.lastSent[name]; sent {
+		return false
+	}
+	n.lastSent[name] = now
+	return true
+}
+
+// hostOf is addr without its port, if it has one
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// warnOfLoginAttempt tells the user of online that a login to their account
+// from addr was refused since they're online, unless they were told of another
+// one lately. The notice goes ahead of the queued messages, see
+// writeSystemLine.
+func (hub *Hub) warnOfLoginAttempt(online *ClientHandler, addr string) {
+	name := online.Creds.Name
+	if !hub.loginAttemptNotices.shouldSend(name, time.Now()) {
+		return
+	}
+	hub.logger.Printf("Refused a login as %s from %s, who's online\n", name, addr)
+	notice := SerializeAnnouncement("A login to your account was attempted from " +
+		hostOf(addr) + " and was rejected")
+	err := online.writeSystemLine(notice, false, context.Background())
+	if err != nil && !errors.Is(err, errRecipientGone) {
+		online.writeFailed(err)
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	. "util"
+)
+
+// MentionOptions bound the mentions kept for users who are offline, which
+// they're shown a digest of when they log in
+type MentionOptions struct {
+	// MaxPerUser is how many are kept for each user, DefaultMentionsPerUser
+	// when 0. Past it the oldest are dropped, and only counted.
+	MaxPerUser int
+	// TTL is how long each is kept, DefaultMentionTTL when 0
+	TTL time.Duration
+}
+
+const (
+	DefaultMentionsPerUser = 100
+	DefaultMentionTTL      = time.Hour * 24 * 7
+)
+
+// MaxMentionsPerUser leaves room in a new session's notice queue for the
+// digest's heading and truncation note
+const MaxMentionsPerUser = maxQueuedNotices - 2
+
+func (o MentionOptions) withDefaults() MentionOptions {
+	if o.MaxPerUser == 0 {
+		o.MaxPerUser = DefaultMentionsPerUser
+	}
+	if o.TTL == 0 {
+		o.TTL = DefaultMentionTTL
+	}
+	return o
+}
+
+// MentionPrefix marks a user's name in a message, e.g "@dave can you check"
+const MentionPrefix = "@"
+
+// parseMentions returns the users content mentions, each once. Punctuation
+// right after a name, as in "@dave, hi", isn't part of it.
+func parseMentions(content string) []Username {
+	var names []Username
+	seen := make(map[Username]bool)
+	for _, word := range strings.Fields(content) {
+		if !strings.HasPrefix(word, MentionPrefix) {
+			continue
+		}
+		name := Username(strings.TrimRight(word[len(MentionPrefix):], ".,;:!?'\")"))
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// mention is a message that mentioned a user while they were offline
+type mention struct {
+	sender  DisplayName
+	content string
+	sent    time.Time
+	// expires is the message's, see TTLCmd
+	expires time.Time
+}
+
+type userMentions struct {
+	// kept are oldest first
+	kept []mention
+	// dropped counts the ones dropped for MaxPerUser
+	dropped int
+}
+
+// offlineMentions are the mentions waiting for their users to log in. Expired
+// ones are dropped lazily, like offlineMsgs.
+type offlineMentions struct {
+	options MentionOptions
+	// now is the clock the mentions are timed and expired by, replaceable for
+	// tests
+	now func() time.Time
+
+	lock   sync.Mutex
+	byUser map[Username]*userMentions
+}
+
+func newOfflineMentions(options MentionOptions) *offlineMentions {
+	return &offlineMentions{options: options.withDefaults(), now: time.Now,
+		byUser: make(map[Username]*userMentions)}
+}
+
+// add keeps a mention of user, dropping their oldest past MaxPerUser. It's
+// dropped after expires too, if it's set.
+func (o *offlineMentions) add(user Username, sender DisplayName, content string,
+	expires time.Time) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.expire(user)
+	mentions, exists := o.byUser[user]
+	if !exists {
+		mentions = &userMentions{}
+		o.byUser[user] = mentions
+	}
+	if len(mentions.kept) >= o.options.MaxPerUser {
+		mentions.kept = mentions.kept[1:]
+		mentions.dropped++
+	}
+	mentions.kept = append(mentions.kept, mention{sender, content, o.now(), expires})
+}
+
+// take returns the digest of the mentions of user, who no longer needs them
+// kept, or nil if there are none
+func (o *offlineMentions) take(user Username) []string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.expire(user)
+	mentions, exists := o.byUser[user]
+	if !exists {
+		return nil
+	}
+	delete(o.byUser, user)
+	return mentions.digest()
+}
+
+// expire must be called with the lock held. Once all of a user's mentions
+// expire, so does the count of the dropped ones.
+func (o *offlineMentions) expire(user Username) {
+	mentions, exists := o.byUser[user]
+	if !exists {
+		return
+	}
+	now := o.now()
+	oldestKept := now.Add(-o.options.TTL)
+	first := 0
+	for first < len(mentions.kept) && mentions.kept[first].sent.Before(oldestKept) {
+		first++
+	}
+	var kept []mention
+	for _, m := range mentions.kept[first:] {
+		if m.expires.IsZero() || now.Before(m.expires) {
+			kept = append(kept, m)
+		}
+	}
+	if len(kept) == 0 {
+		delete(o.byUser, user)
+	} else if len(kept) != len(mentions.kept) {
+		mentions.kept = kept
+	}
+}
+
+// digest is the notices the user is shown at login: how many times they were
+// mentioned, then the messages, with the server time each was sent at
+func (m *userMentions) digest() []string {
+	total := len(m.kept) + m.dropped
+	times := "times"
+	if total == 1 {
+		times = "time"
+	}
+	lines := []string{fmt.Sprintf("You were mentioned %d %s while away", total, times)}
+	for _, mention := range m.kept {
+		lines = append(lines, mention.sent.UTC().Format(time.RFC3339)+" "+
+			string(mention.sender)+": "+mention.content)
+	}
+	if m.dropped != 0 {
+		lines = append(lines, fmt.Sprintf("(%d older not shown)", m.dropped))
+	}
+	return lines
+}
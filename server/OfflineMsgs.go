@@ -0,0 +1,95 @@
+package server
+
+import (
+	"sync"
+	"time"
+	. "util"
+)
+
+// OfflineMsgOptions bound the direct messages kept for users who are offline,
+// until they log in
+type OfflineMsgOptions struct {
+	// MaxPerUser is how many are kept for each user, DefaultOfflineMsgsPerUser
+	// when 0. More are refused with ResponseOfflineQueueFull.
+	MaxPerUser int
+	// TTL is how long each is kept, DefaultOfflineMsgTTL when 0
+	TTL time.Duration
+}
+
+const (
+	DefaultOfflineMsgsPerUser = 50
+	DefaultOfflineMsgTTL      = time.Hour * 24 * 7
+)
+
+func (o OfflineMsgOptions) withDefaults() OfflineMsgOptions {
+	if o.MaxPerUser == 0 {
+		o.MaxPerUser = DefaultOfflineMsgsPerUser
+	}
+	if o.TTL == 0 {
+		o.TTL = DefaultOfflineMsgTTL
+	}
+	return o
+}
+
+// offlineMsgs are the direct messages waiting for their recipients to log in,
+// oldest first. Expired ones are dropped lazily, like history.
+type offlineMsgs struct {
+	options OfflineMsgOptions
+	// now is the clock the messages are timed and expired by, replaceable for
+	// tests
+	now func() time.Time
+
+	lock   sync.Mutex
+	byUser map[Username][]DirectMsg
+}
+
+func newOfflineMsgs(options OfflineMsgOptions) *offlineMsgs {
+	return &offlineMsgs{options: options.withDefaults(), now: time.Now,
+		byUser: make(map[Username][]DirectMsg)}
+}
+
+// add keeps msg for to, stamped with the time it was sent
+func (o *offlineMsgs) add(to Username, msg DirectMsg) Response {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.expire(to)
+	if len(o.byUser[to]) >= o.options.MaxPerUser {
+		return ResponseOfflineQueueFull
+	}
+	msg.Sent = o.now()
+	o.byUser[to] = append(o.byUser[to], msg)
+	return ResponseQueuedForOffline
+}
+
+// take returns the messages waiting for user, who no longer needs them kept
+func (o *offlineMsgs) take(user Username) []DirectMsg {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.expire(user)
+	msgs := o.byUser[user]
+	delete(o.byUser, user)
+	return msgs
+}
+
+// expire must be called with the lock held. Besides the TTL they're all kept
+// for, each DM may expire sooner, see DirectMsg.Expires.
+func (o *offlineMsgs) expire(user Username) {
+	msgs := o.byUser[user]
+	now := o.now()
+	oldestKept := now.Add(-o.options.TTL)
+	first := 0
+	for first < len(msgs) && msgs[first].Sent.Before(oldestKept) {
+		first++
+	}
+	var kept []DirectMsg
+	for _, msg := range msgs[first:] {
+		if !dmExpired(msg, now) {
+			kept = append(kept, msg)
+		}
+	}
+	if len(kept) == 0 {
+		delete(o.byUser, user)
+	} else if len(kept) != len(msgs) {
+		o.byUser[user] = kept
+	}
+}
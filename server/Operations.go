@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"sort"
+	. "util"
+)
+
+// operation is a message still being broadcast, which its sender can cancel,
+// e.g when it's stuck on slow recipients
+type operation struct {
+	id      MsgID
+	content string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	// done is closed once the operation is over, cancelled or not
+	done chan struct{}
+	// running is set once broadcastLoop gets to the operation, and answered
+	// once a queued operation was cancelled and responded to. Both are guarded
+	// by the handler's operationsLock.
+	running  bool
+	answered bool
+}
+
+// startBroadcast queues content for broadcasting, which happens in the order
+// the messages came. Meanwhile the user's other input, like /cancel, is
+// handled. The response is noResponse if the broadcast started, since it
+// responds once it's done.
+func (handler *ClientHandler) startBroadcast(id MsgID, content string,
+	ctx context.Context) Response {
+	op := &operation{id: id, content: content, done: make(chan struct{})}
+	op.ctx, op.cancel = context.WithCancel(ctx)
+
+	handler.operationsLock.Lock()
+	if _, exists := handler.operations[id]; exists {
+		handler.operationsLock.Unlock()
+		op.cancel()
+		// its response couldn't be told apart from the other's
+		return ResponseMsgIDInProgress
+	}
+	handler.operations[id] = op
+	handler.operationsLock.Unlock()
+	select {
+	case handler.broadcasts <- op:
+	case <-ctx.Done():
+	}
+	return noResponse
+}
+
+// broadcastLoop runs the queued broadcasts until the queue is closed, and
+// closes finished after the last one
+func (handler *ClientHandler) broadcastLoop(ctx context.Context, finished chan<- struct{}) {
+	defer close(finished)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case op, ok := <-handler.broadcasts:
+			if !ok {
+				return
+			}
+			handler.runBroadcast(op, ctx)
+		}
+	}
+}
+
+func (handler *ClientHandler) runBroadcast(op *operation, ctx context.Context) {
+	defer close(op.done)
+	defer op.cancel()
+	handler.operationsLock.Lock()
+	if op.answered {
+		// cancelled while queued
+		handler.operationsLock.Unlock()
+		return
+	}
+	op.running = true
+	handler.operationsLock.Unlock()
+
+	var response Response
+	if op.ctx.Err() == nil {
+		response = handler.broadcaster.BroadcastMessageOnce(op.id, op.content,
+			handler.Creds.Name, op.ctx)
+	}
+	// forgotten before responding, so the client may reuse the id once it
+	// has the response
+	handler.operationsLock.Lock()
+	delete(handler.operations, op.id)
+	handler.operationsLock.Unlock()
+	if ctx.Err() != nil {
+		// the session is over, there's no one to respond to
+		return
+	} else if op.ctx.Err() != nil {
+		// those who got the message before the cancel keep it
+		response = ResponseCancelled
+	}
+	err := handler.forwardResponseToUser(op.id, response)
+	if err != nil {
+		handler.writeFailed(err)
+	}
+}
+
+// cancelOperation stops the operation of the message with the given id, so it
+// responds with ResponseCancelled before the cancel itself is answered. A
+// queued operation is answered right away, and a running one is waited for,
+// which is quick since its fan-out stops with its context.
+func (handler *ClientHandler) cancelOperation(id MsgID, ctx context.Context) (Response, error) {
+	handler.operationsLock.Lock()
+	op, exists := handler.operations[id]
+	if !exists {
+		handler.operationsLock.Unlock()
+		return ResponseUnknownOperation, nil
+	}
+	op.cancel()
+	queued := !op.running
+	if queued {
+		op.answered = true
+		delete(handler.operations, id)
+	}
+	handler.operationsLock.Unlock()
+
+	if queued {
+		err := handler.forwardResponseToUser(id, ResponseCancelled)
+		if err != nil {
+			return ResponseIoErrorOccurred, err
+		}
+		return ResponseOk, nil
+	}
+	select {
+	case <-op.done:
+	case <-ctx.Done():
+		// the session is over, so is the operation
+	}
+	return ResponseOk, nil
+}
+
+// pendingOperations returns the ids of the messages still being broadcast
+func (handler *ClientHandler) pendingOperations() []string {
+	handler.operationsLock.Lock()
+	defer handler.operationsLock.Unlock()
+	ids := make([]string, 0, len(handler.operations))
+	for id := range handler.operations {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"logfile"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Server is a hub set up from its options, ready to serve without having bound
+// its addresses yet
+type Server struct {
+	// addrs are the listen specs, see ParseListenSpec
+	addrs   []string
+	options ServerOptions
+	Hub     *Hub
+	// tlsConfig is nil unless TLS is set up
+	tlsConfig *tls.Config
+	// logFile is nil unless LogFile is set
+	logFile *logfile.RotatingFile
+
+	// listeners are the ones being served, closed once by Shutdown
+	listenersLock sync.Mutex
+	listeners     []net.Listener
+	// webListener is nil unless WebAddr is set, see Serve. webBound is it
+	// before TLS, for handing it over.
+	webListener net.Listener
+	webBound    net.Listener
+	shutdown    sync.Once
+	drained     chan struct{}
+}
+
+// UnixListenPrefix marks a listen spec as a unix socket's path, e.g
+// "unix:/run/chat.sock". Any other spec is a TCP address.
+const UnixListenPrefix = "unix:"
+
+// ParseListenSpec returns the network and address to listen at for spec
+func ParseListenSpec(spec string) (network, address string) {
+	if strings.HasPrefix(spec, UnixListenPrefix) {
+		return "unix", spec[len(UnixListenPrefix):]
+	}
+	return "tcp4", spec
+}
+
+// BuildServer validates the options, see Validate, and loads the server's
+// state. Nothing is bound until Serve. With LogFile set, the server logs to it
+// from here on, and reopens it on ReopenLogSignal, e.g after logrotate moved
+// it.
+func BuildServer(addr string, options ServerOptions) (*Server, error) {
+	if errs := Validate(addr, options); len(errs) != 0 {
+		return nil, errs
+	}
+	tlsConfig, err := loadTLSConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	var logFile *logfile.RotatingFile
+	if options.LogFile != "" {
+		logFile, err = logfile.Open(options.LogFile, options.LogRotation)
+		if err != nil {
+			return nil, err
+		}
+		options.Logger = log.New(logFile, "", log.LstdFlags)
+		log.Printf("Logging to %s\n", options.LogFile)
+	}
+	hub := NewHubWithOptions(options)
+	err = hub.LoadUserDB()
+	if err == nil {
+		err = hub.LoadBlocklist()
+	}
+	if err != nil {
+		if logFile != nil {
+			logFile.Close()
+		}
+		return nil, err
+	}
+	return &Server{addrs: append([]string{addr}, options.ListenAddrs...), options: options,
+		Hub: hub, tlsConfig: tlsConfig, logFile: logFile, drained: make(chan struct{})}, nil
+}
+
+// ReopenLogSignal has a running server reopen its LogFile
+const ReopenLogSignal = syscall.SIGHUP
+
+// Serve binds every address, and accepts clients on all of them until the
+// server is shut down, serving the web client too if WebAddr is set. If any
+// address can't be bound, none is served.
+func (server *Server) Serve() error {
+	if files, err := inheritedListenerFiles(); err != nil || files != nil {
+		if err != nil {
+			return err
+		}
+		return server.ServeFiles(files)
+	}
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, listener := range listeners {
+			server.Hub.closeLogErr(listener)
+		}
+	}
+	for _, spec := range server.addrs {
+		listener, err := net.Listen(ParseListenSpec(spec))
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("listening at %s: %w", spec, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	var web net.Listener
+	if server.options.WebAddr != "" {
+		var err error
+		web, err = net.Listen(ParseListenSpec(server.options.WebAddr))
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("listening at %s: %w", server.options.WebAddr, err)
+		}
+	}
+	return server.serve(listeners, web)
+}
+
+// serve serves listeners, and the web client at web if it's not nil
+func (server *Server) serve(listeners []net.Listener, web net.Listener) error {
+	if web != nil {
+		server.listenersLock.Lock()
+		server.webBound = web
+		server.webListener = web
+		if server.tlsConfig != nil {
+			server.webListener = tls.NewListener(web, server.tlsConfig)
+		}
+		server.listenersLock.Unlock()
+	}
+	return server.ServeListeners(listeners...)
+}
+
+// ServeListeners is Serve on listeners that are already bound. It returns once
+// they're all closed and the hub is drained, with the first error accepting
+// on any of them, which shuts the server down.
+func (server *Server) ServeListeners(listeners ...net.Listener) error {
+	server.listenersLock.Lock()
+	server.listeners = listeners
+	webListener := server.webListener
+	select {
+	case <-server.drained:
+		// shut down before serving
+		for _, listener := range server.allListeners() {
+			server.Hub.closeLogErr(listener)
+		}
+	default:
+	}
+	server.listenersLock.Unlock()
+	hub := server.Hub
+	if server.options.UserDBPollInterval != 0 {
+		go hub.watchUserDB(time.NewTicker(server.options.UserDBPollInterval).C)
+	}
+	if server.options.Blocklist.PollInterval != 0 {
+		go hub.watchBlocklist(time.NewTicker(server.options.Blocklist.PollInterval).C)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, DrainSignal)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			server.Shutdown()
+		case <-server.drained:
+		}
+	}()
+	upgrades := make(chan os.Signal, 1)
+	signal.Notify(upgrades, UpgradeSignal)
+	defer signal.Stop(upgrades)
+	go server.handOverOn(upgrades)
+	if server.logFile != nil {
+		defer server.logFile.Close()
+		reopens := make(chan os.Signal, 1)
+		signal.Notify(reopens, ReopenLogSignal)
+		defer signal.Stop(reopens)
+		go server.reopenLogOn(reopens)
+	}
+
+	var accepting sync.WaitGroup
+	errs := make(chan error, len(listeners)+1)
+	for _, listener := range listeners {
+		log.Printf("Listening at %s\n", listener.Addr())
+		accepting.Add(1)
+		go func(listener net.Listener) {
+			defer accepting.Done()
+			if err := server.acceptLoop(listener); err != nil {
+				errs <- fmt.Errorf("accepting at %s: %w", listener.Addr(), err)
+				server.Shutdown()
+			}
+		}(listener)
+	}
+	if webListener != nil {
+		log.Printf("Serving the web client at %s\n", webListener.Addr())
+		accepting.Add(1)
+		go func() {
+			defer accepting.Done()
+			err := http.Serve(webListener, server.Hub.WebHandler())
+			if !errors.Is(err, net.ErrClosed) {
+				errs <- fmt.Errorf("serving the web client at %s: %w", webListener.Addr(), err)
+				server.Shutdown()
+			}
+		}()
+	}
+	accepting.Wait()
+	<-server.drained
+	close(errs)
+	return <-errs
+}
+
+// reopenLogOn reopens the log file on each signal, until the server drained
+func (server *Server) reopenLogOn(signals <-chan os.Signal) {
+	for {
+		select {
+		case <-signals:
+			if err := server.logFile.Reopen(); err != nil {
+				// where the log went is gone, so it's for stderr
+				log.Printf("Error reopening %s: %s\n", server.options.LogFile, err)
+			}
+		case <-server.drained:
+			return
+		}
+	}
+}
+
+// acceptLoop returns nil once listener is closed
+func (server *Server) acceptLoop(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		server.Hub.logger.Printf("Connected: %s\n", conn.RemoteAddr())
+		go func(conn net.Conn) {
+			upgraded, ok := server.upgradeConn(conn)
+			if !ok {
+				server.Hub.closeLogErr(conn)
+				return
+			}
+			server.Hub.HandleNewConnection(upgraded)
+		}(conn)
+	}
+}
+
+// Addrs are the addresses the server is listening at
+func (server *Server) Addrs() []net.Addr {
+	server.listenersLock.Lock()
+	defer server.listenersLock.Unlock()
+	addrs := make([]net.Addr, len(server.listeners))
+	for i, listener := range server.listeners {
+		addrs[i] = listener.Addr()
+	}
+	return addrs
+}
+
+// WebAddr is the address the web client is served at, nil unless WebAddr is
+// set and the server is serving
+func (server *Server) WebAddr() net.Addr {
+	server.listenersLock.Lock()
+	defer server.listenersLock.Unlock()
+	if server.webListener == nil {
+		return nil
+	}
+	return server.webListener.Addr()
+}
+
+// allListeners are the listeners and the web's. The listeners lock must be
+// held.
+func (server *Server) allListeners() []net.Listener {
+	if server.webListener == nil {
+		return server.listeners
+	}
+	return append(append([]net.Listener(nil), server.listeners...), server.webListener)
+}
+
+// Shutdown closes every listener, so new clients are refused from here on, and
+// drains the hub, see Hub.Drain. Serve returns once it's done.
+func (server *Server) Shutdown() {
+	server.shutdown.Do(func() {
+		server.listenersLock.Lock()
+		for _, listener := range server.allListeners() {
+			server.Hub.closeLogErr(listener)
+		}
+		server.listenersLock.Unlock()
+		if !server.Hub.Drain(DrainTimeout) {
+			server.Hub.logger.Println("Timed out draining, exiting anyway")
+		}
+		close(server.drained)
+	})
+}
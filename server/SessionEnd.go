@@ -0,0 +1,177 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+	. "util"
+)
+
+// EndCause is why a session ended, recorded where it ended
+type EndCause string
+
+const (
+	// EndQuit is the client closing the connection
+	EndQuit EndCause = "quit"
+	// EndLoggedOut is the user logging out with LogoutCmd, the connection
+	// staying up for their next login
+	EndLoggedOut EndCause = "logged out"
+	EndReadError EndCause = "read error"
+	// EndWriteTimeout is a write taking over ClientWriteTimeout
+	EndWriteTimeout EndCause = "write timeout"
+	EndWriteError   EndCause = "write error"
+	EndKicked       EndCause = "kicked"
+	// EndTooSlow is the client not reading its messages, see MaxQueuedMsgs
+	EndTooSlow EndCause = "too slow"
+	// EndShutdown is the client leaving a draining server, see Hub.Drain
+	EndShutdown EndCause = "shutdown"
+)
+
+// SessionEnd records how a session ended
+type SessionEnd struct {
+	User  Username
+	Addr  string
+	Cause EndCause
+	// Detail is the error, or who kicked the user and why
+	Detail   string
+	Duration time.Duration
+	Ended    time.Time
+}
+
+// String is the record as logged, one structured line
+func (e SessionEnd) String() string {
+	s := fmt.Sprintf("user=%s addr=%s cause=%q duration=%s ended=%s", e.User, e.Addr,
+		e.Cause, e.Duration.Round(time.Millisecond), e.Ended.UTC().Format(time.RFC3339))
+	if e.Detail != "" {
+		s += fmt.Sprintf(" detail=%q", e.Detail)
+	}
+	return s
+}
+
+// sessionEnded is what ends a session, sent once on the handler's ends
+type sessionEnded struct {
+	cause  EndCause
+	detail string
+}
+
+// end ends the session for cause. Only the first cause is read, so it never
+// blocks on the rest.
+func (handler *ClientHandler) end(cause EndCause, err error) {
+	ended := sessionEnded{cause: cause}
+	if err != nil {
+		ended.detail = err.Error()
+	}
+	select {
+	case handler.ends <- ended:
+	default:
+	}
+}
+
+// readFailed ends the session after reading from the client failed
+func (handler *ClientHandler) readFailed(err error) {
+	if errors.Is(err, ErrClientHasQuit) || isClosedConnErr(err) {
+		handler.end(EndQuit, nil)
+		return
+	}
+	handler.end(EndReadError, err)
+}
+
+// writeFailed ends the session after writing to the client failed. A write
+// to a conn that was closed meanwhile, e.g as the session was torn down, ends
+// it as cleanly as the client quitting.
+func (handler *ClientHandler) writeFailed(err error) {
+	switch {
+	case isClosedConnErr(err):
+		handler.end(EndQuit, nil)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		handler.end(EndWriteTimeout, err)
+	default:
+		handler.end(EndWriteError, err)
+	}
+}
+
+// remoteAddr is the client's address, if its conn has one
+func (handler *ClientHandler) remoteAddr() string {
+	if conn, ok := handler.clientIn.(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr().String()
+	}
+	return "unknown"
+}
+
+// MaxEndedSessions is how many of the last sessions to end are kept, for
+// SessionsCmd
+const MaxEndedSessions = 100
+
+// endedSessions are the last sessions to end, oldest first
+type endedSessions struct {
+	lock     sync.Mutex
+	sessions []SessionEnd
+}
+
+func (s *endedSessions) add(end SessionEnd) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.sessions) == MaxEndedSessions {
+		s.sessions = append(s.sessions[:0], s.sessions[1:]...)
+	}
+	s.sessions = append(s.sessions, end)
+}
+
+func (s *endedSessions) all() []SessionEnd {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]SessionEnd(nil), s.sessions...)
+}
+
+// recordSessionEnd logs how handler's session ended, and keeps it for
+// SessionsCmd. A client that left a draining server was shut down, whatever
+// it did to leave. Returns the cause recorded.
+func (hub *Hub) recordSessionEnd(handler *ClientHandler, ended sessionEnded) EndCause {
+	if ended.cause == EndQuit || ended.cause == EndReadError {
+		hub.connsLock.Lock()
+		if hub.draining {
+			ended.cause = EndShutdown
+		}
+		hub.connsLock.Unlock()
+	}
+	now := time.Now()
+	end := SessionEnd{User: handler.Creds.Name, Addr: handler.remoteAddr(),
+		Cause: ended.cause, Detail: ended.detail, Duration: now.Sub(handler.loggedIn),
+		Ended: now}
+	hub.logger.Printf("Session ended: %s\n", end)
+	hub.endedSessions.add(end)
+	return end.Cause
+}
+
+// EndedSessions are the last MaxEndedSessions sessions to end, oldest first
+func (hub *Hub) EndedSessions() []SessionEnd {
+	return hub.endedSessions.all()
+}
+
+// EndedSessionsFor lists the ended sessions to the admin name
+func (hub *Hub) EndedSessionsFor(name Username) ([]string, Response) {
+	if !hub.isAdmin(name) {
+		return nil, ResponseNotAdmin
+	}
+	var lines []string
+	for _, end := range hub.EndedSessions() {
+		lines = append(lines, end.String())
+	}
+	return lines, ResponseOk
+}
+
+func (handler *ClientHandler) showEndedSessions() (Response, error) {
+	lines, response := handler.users.EndedSessionsFor(handler.Creds.Name)
+	if response != ResponseOk {
+		return response, nil
+	}
+	for _, line := range lines {
+		if err := handler.forwardNoticeToUser("Ended: " + line); err != nil {
+			return ResponseIoErrorOccurred, err
+		}
+	}
+	return ResponseOk, nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+	. "util"
+)
+
+// expectEnded waits for name's last session to be recorded as ended for cause
+func expectEnded(t *testing.T, hub *Hub, name Username, cause EndCause) SessionEnd {
+	t.Helper()
+	var last SessionEnd
+	deadline := time.Now().Add(time.Second)
+	for ; time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		for _, end := range hub.EndedSessions() {
+			if end.User == name {
+				last = end
+			}
+		}
+		if last.Cause == cause {
+			return last
+		}
+	}
+	t.Fatalf("expected %s's session to end for %q, got %+v", name, cause, last)
+	return last
+}
+
+func TestSessionEndCauses(t *testing.T) {
+	defer func(timeout time.Duration) { ClientWriteTimeout = timeout }(ClientWriteTimeout)
+	ClientWriteTimeout = 10 * time.Millisecond
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	hub.userDBLock.Lock()
+	hub.userDB["alice"].Admin = true
+	hub.userDBLock.Unlock()
+
+	alice.send(MsgPrefix + IdSeparator + LogoutCmd.Serialize())
+	expectEnded(t, hub, "alice", EndLoggedOut)
+	alice.login("alice")
+
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	bob.conn.Close()
+	expectEnded(t, hub, "bob", EndQuit)
+
+	// a line longer than the server reads
+	carol := connectToHub(hub, t)
+	carol.register("carol")
+	go carol.conn.Write([]byte(strings.Repeat("x", 1<<17) + "\n"))
+	if end := expectEnded(t, hub, "carol", EndReadError); !strings.Contains(end.Detail, "too long") {
+		t.Errorf("expected the read error, got %q", end.Detail)
+	}
+
+	// dave never reads, so the message to him can't be written
+	dave := connectToHub(hub, t)
+	dave.register("dave")
+	alice.send(MsgPrefix + "1;hi")
+	alice.expect("r1;" + string(ResponseMsgTimedOutForAll))
+	expectEnded(t, hub, "dave", EndWriteTimeout)
+
+	erin := connectToHub(hub, t)
+	erin.register("erin")
+	hub.Kick("erin", "an admin", LogoutReason{Code: LogoutKicked, Text: "spamming"})
+	if end := expectEnded(t, hub, "erin", EndKicked); end.Detail != "by an admin: kicked (spamming)" {
+		t.Errorf("expected who kicked erin and why, got %q", end.Detail)
+	}
+
+	alice.send(MsgPrefix + "2;/sessions ended")
+	for _, name := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		if err := alice.conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		line, err := ScanLine(alice.scanner)
+		if err != nil || !strings.HasPrefix(line, MsgPrefix+"Ended: user="+name+" ") {
+			t.Fatalf("expected %s's session, got %q, %v", name, line, err)
+		}
+	}
+	alice.expect("r2;" + string(ResponseOk))
+	frank := connectToHub(hub, t)
+	frank.register("frank")
+	frank.send(MsgPrefix + "3;/sessions ended")
+	frank.expect("r3;" + string(ResponseNotAdmin))
+
+	// a legacy client is disconnected right away by the drain
+	hub.Drain(time.Second)
+	expectEnded(t, hub, "frank", EndShutdown)
+}
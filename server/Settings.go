@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+	. "util"
+)
+
+// MsgTimeoutSetting is the message timeout in milliseconds, e.g "set
+// msgtimeout 500"
+const MsgTimeoutSetting = "msgtimeout"
+
+// MinClientVersionSetting is the oldest client version that may log in, see
+// ServerOptions.MinClientVersion, e.g "set minclientversion 1.2.0". Setting it
+// to 0 lets every client in.
+const MinClientVersionSetting = "minclientversion"
+
+// RegistrationSetting opens or closes registration, see
+// Hub.SetRegistrationOpen, e.g "set registration off"
+const RegistrationSetting = "registration"
+
+// MinMsgSendTimeout and MaxMsgSendTimeout bound the message timeout. Too short
+// and no one gets messages, too long and a dead recipient holds up its
+// senders.
+const (
+	MinMsgSendTimeout = 10 * time.Millisecond
+	MaxMsgSendTimeout = time.Minute
+)
+
+// MsgSendTimeout is how long messages are currently tried to be delivered for
+func (hub *Hub) MsgSendTimeout() time.Duration {
+	return time.Duration(hub.msgSendTimeout.Load())
+}
+
+func (hub *Hub) isAdmin(name Username) bool {
+	hub.userDBLock.RLock()
+	defer hub.userDBLock.RUnlock()
+	record, exists := hub.userDB[name]
+	return exists && record.Admin
+}
+
+// Set changes setting to value on behalf of the admin name. The notice
+// confirms the change to them.
+func (hub *Hub) Set(name Username, setting string, value string) (notice string, r Response) {
+	if !hub.isAdmin(name) {
+		return "", ResponseNotAdmin
+	}
+	switch setting {
+	case MsgTimeoutSetting:
+		ms, err := strconv.ParseInt(value, 10, 64)
+		timeout := time.Duration(ms) * time.Millisecond
+		if err != nil || timeout < MinMsgSendTimeout || timeout > MaxMsgSendTimeout {
+			return "", ResponseInvalidArgument
+		}
+		old := time.Duration(hub.msgSendTimeout.Swap(int64(timeout)))
+		hub.logger.Printf("%s set the message timeout to %s, from %s\n", name, timeout, old)
+		return fmt.Sprintf("Message timeout set to %s, from %s", timeout, old), ResponseOk
+	case BlocklistPolicySetting:
+		policy, ok := blocklistPolicies[value]
+		if !ok {
+			return "", ResponseInvalidArgument
+		}
+		old := BlocklistPolicy(hub.blocklistPolicy.Swap(int64(policy)))
+		hub.logger.Printf("%s set the blocklist policy to %s, from %s\n", name, policy, old)
+		return fmt.Sprintf("Blocklist policy set to %s, from %s", policy, old), ResponseOk
+	case MinClientVersionSetting:
+		if !validSemVer(value) {
+			return "", ResponseInvalidArgument
+		}
+		old := hub.minClientVersion.Swap(value).(string)
+		if old == "" {
+			old = "none"
+		}
+		hub.logger.Printf("%s set the minimum client version to %s, from %s\n", name, value, old)
+		return fmt.Sprintf("Minimum client version set to %s, from %s", value, old), ResponseOk
+	case RegistrationSetting:
+		var open bool
+		switch value {
+		case "on":
+			open = true
+		case "off":
+		default:
+			return "", ResponseInvalidArgument
+		}
+		old := "off"
+		if hub.RegistrationOpen() {
+			old = "on"
+		}
+		hub.logger.Printf("%s set registration %s, from %s\n", name, value, old)
+		hub.SetRegistrationOpen(open)
+		return fmt.Sprintf("Registration set %s, from %s", value, old), ResponseOk
+	default:
+		return "", ResponseUnknownSetting
+	}
+}
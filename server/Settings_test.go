@@ -0,0 +1,40 @@
+package server
+
+import (
+	"testing"
+	. "util"
+)
+
+func TestSetMsgTimeoutLive(t *testing.T) {
+	hub := NewHub()
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	hub.userDBLock.Lock()
+	hub.userDB["alice"].Admin = true
+	hub.userDBLock.Unlock()
+
+	bob.send(MsgPrefix + "1;/set msgtimeout 50")
+	bob.expect("r1;" + string(ResponseNotAdmin))
+	alice.send(MsgPrefix + "2;/set msgtimeout 5")
+	alice.expect("r2;" + string(ResponseInvalidArgument))
+	alice.send(MsgPrefix + "3;/set msgtimeout soon")
+	alice.expect("r3;" + string(ResponseInvalidArgument))
+	alice.send(MsgPrefix + "4;/set nothing 50")
+	alice.expect("r4;" + string(ResponseUnknownSetting))
+	if timeout := hub.MsgSendTimeout(); timeout != MsgSendTimeout {
+		t.Fatalf("expected the timeout to stay %s, got %s", MsgSendTimeout, timeout)
+	}
+
+	alice.send(MsgPrefix + "5;/set msgtimeout 200")
+	alice.expect(MsgPrefix + "Message timeout set to 200ms, from 3s")
+	alice.expect("r5;" + string(ResponseOk))
+	// carol never reads, so the message to her times out, now well before
+	// expect gives up
+	carol := connectToHub(hub, t)
+	carol.register("carol")
+	alice.send(MsgPrefix + "6;hi")
+	bob.expect(MsgPrefix + "alice: hi")
+	alice.expect("r6;" + string(ResponseMsgTimedOutForSome))
+}
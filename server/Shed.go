@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	. "util"
+)
+
+// DefaultShedSpread is ServerOptions.ShedSpread's default
+const DefaultShedSpread = 10 * time.Second
+
+// Shed has percent of the online clients reconnect, to addr if it's set, on
+// behalf of the admin name, and returns who it told. The idlest go first, and
+// each waits a random part of ShedSpread, see ReconnectOrder. Only the clients
+// that can reconnect are counted, which the admin's own isn't.
+func (hub *Hub) Shed(name Username, percent int, addr string) ([]Username, Response) {
+	if !hub.isAdmin(name) {
+		return nil, ResponseNotAdmin
+	}
+	if percent <= 0 || percent > 100 {
+		return nil, ResponseInvalidArgument
+	}
+	hub.activeUsersLock.RLock()
+	var candidates []*ClientHandler
+	for user, handler := range hub.activeUsers {
+		if user != name && hub.lingering[user] == nil &&
+			handler.caps.Supports(CapReconnect) {
+			candidates = append(candidates, handler)
+		}
+	}
+	hub.activeUsersLock.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastActive.Load() < candidates[j].lastActive.Load()
+	})
+	// rounded up, so a share of a few clients still sheds one
+	candidates = candidates[:(len(candidates)*percent+99)/100]
+
+	spread := hub.options.ShedSpread
+	if spread <= 0 {
+		spread = DefaultShedSpread
+	}
+	shed := make([]Username, len(candidates))
+	for i, handler := range candidates {
+		shed[i] = handler.Creds.Name
+		order := ReconnectOrder{Delay: time.Duration(rand.Int63n(int64(spread))), Addr: addr}
+		hub.logger.Printf("Shedding %s: reconnect in %s\n", handler.Creds.Name, order.Delay)
+		// a client that isn't reading mustn't hold up the others
+		go func(handler *ClientHandler) {
+			err := handler.writeSystemLine(order.Cmd().Serialize(), false,
+				context.Background())
+			if err != nil && !errors.Is(err, errRecipientGone) {
+				handler.logger.Printf("Error shedding %s: %s\n", handler.Creds.Name, err)
+			}
+		}(handler)
+	}
+	hub.logger.Printf("%s shed %d%%: %d clients\n", name, percent, len(shed))
+	return shed, ResponseOk
+}
+
+// shed runs ShedCmd, listing who it shed
+func (handler *ClientHandler) shed(args string) (Response, error) {
+	share, addr, _ := strings.Cut(args, " ")
+	percent, err := strconv.Atoi(strings.TrimSuffix(share, "%"))
+	if err != nil || strings.Contains(addr, " ") {
+		return ResponseInvalidArgument, nil
+	}
+	shed, response := handler.users.Shed(handler.Creds.Name, percent, addr)
+	if response != ResponseOk {
+		return response, nil
+	}
+	names := make([]string, len(shed))
+	for i, name := range shed {
+		names[i] = string(name)
+	}
+	if err := handler.forwardNoticeToUser("Shed: " + strings.Join(names, ", ")); err != nil {
+		return ResponseIoErrorOccurred, err
+	}
+	return ResponseOk, nil
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+	. "util"
+)
+
+// TestShed sheds half of the clients that can reconnect, and checks the idle
+// ones are told to, within ShedSpread, while the others are untouched
+func TestShed(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{ShedSpread: 50 * time.Millisecond})
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	hub.userDBLock.Lock()
+	hub.userDB["alice"].Admin = true
+	hub.userDBLock.Unlock()
+	clients := map[string]*testConn{}
+	for _, name := range []string{"bob", "carol", "dave", "erin"} {
+		clients[name] = connectToHub(hub, t)
+		clients[name].send(ClientCapabilities().Serialize())
+		clients[name].register(name)
+	}
+	// frank can't reconnect, so he isn't counted
+	frank := connectToHub(hub, t)
+	frank.register("frank")
+	clients["frank"] = frank
+
+	// carol and erin chat, so bob and dave are the idle ones
+	for i, sender := range []string{"carol", "erin"} {
+		id := MsgID(strconv.Itoa(i + 1))
+		clients[sender].send(MsgPrefix + string(id) + IdSeparator + "hi")
+		alice.expect(MsgPrefix + sender + ": hi")
+		for name, c := range clients {
+			if name != sender {
+				c.expect(MsgPrefix + sender + ": hi")
+			}
+		}
+		clients[sender].expect("r" + string(id) + IdSeparator + string(ResponseOk))
+	}
+
+	bob := clients["bob"]
+	bob.send(MsgPrefix + "1;/shed 50%")
+	bob.expect("r1;" + string(ResponseNotAdmin))
+	for i, args := range []string{"", "half", "0%", "101%", "50% a b"} {
+		id := strconv.Itoa(i + 1)
+		alice.send(MsgPrefix + id + ";/shed " + args)
+		alice.expect("r" + id + IdSeparator + string(ResponseInvalidArgument))
+	}
+	alice.send(MsgPrefix + "9;/shed 50% 127.0.0.1:7001")
+	alice.expect(MsgPrefix + "Shed: bob, dave")
+	alice.expect("r9;" + string(ResponseOk))
+	for _, name := range []string{"bob", "dave"} {
+		c := clients[name]
+		if err := c.conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		line, err := ScanLine(c.scanner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmdName, args := UnserializeStrToCmd(line).Split()
+		order, ok := ParseReconnectOrder(args)
+		if !IsCmd(line) || cmdName != ReconnectCmd || !ok {
+			t.Fatalf("expected %s to be told to reconnect, got %q", name, line)
+		}
+		if order.Delay >= 50*time.Millisecond || order.Addr != "127.0.0.1:7001" {
+			t.Fatalf("expected a delay within the spread, to the address, got %+v", order)
+		}
+	}
+	for _, name := range []string{"carol", "erin", "frank"} {
+		clients[name].send(MsgPrefix + "p;/ping")
+		clients[name].expect("rp;" + string(ResponseOk))
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	. "util"
+)
+
+// recordTypeHandshake is the first byte a TLS client sends, which tells it
+// apart from a plaintext client, whose first byte is a protocol line's
+const recordTypeHandshake = 0x16
+
+// loadTLSConfig returns nil when TLS isn't set up
+func loadTLSConfig(options ServerOptions) (*tls.Config, error) {
+	if options.TLSCertFile == "" && options.TLSKeyFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(options.TLSCertFile, options.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+func checkTLS(addr string, options ServerOptions) error {
+	if options.TLSCertFile == "" && options.TLSKeyFile == "" && !options.RequireTLS {
+		return ErrNothingToCheck
+	}
+	if options.TLSCertFile == "" || options.TLSKeyFile == "" {
+		return errors.New("TLS needs both a certificate and a key file")
+	}
+	_, err := loadTLSConfig(options)
+	return err
+}
+
+// peekedConn is a conn whose first bytes were already read into r
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// upgradeConn wraps conn in TLS if the client started a TLS handshake. A
+// plaintext client is served as is, unless TLS is required, in which case it's
+// refused. Returns false if the conn is done with.
+func (server *Server) upgradeConn(conn net.Conn) (net.Conn, bool) {
+	if server.tlsConfig == nil {
+		return conn, true
+	}
+	r := bufio.NewReader(conn)
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, false
+	}
+	conn = &peekedConn{conn, r}
+	if first[0] == recordTypeHandshake {
+		return tls.Server(conn, server.tlsConfig), true
+	}
+	if !server.options.RequireTLS {
+		return conn, true
+	}
+	server.Hub.logger.Printf("Refused plaintext connection from %s\n", conn.RemoteAddr())
+	err = writeLine(conn, SerializeRefusal(ReasonTLSRequired))
+	if err != nil {
+		server.Hub.logger.Println(err)
+	}
+	return nil, false
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	. "util"
+)
+
+var errMsgExpired = errors.New("the message expired before it could be written")
+
+// deliveryContext bounds waiting for a message to be delivered by the
+// MsgSendTimeout, and by when it expires if that's sooner, since it's dropped
+// by then
+func (hub *Hub) deliveryContext(ctx context.Context, expires time.Time) (
+	context.Context, context.CancelFunc) {
+	deadline := time.Now().Add(hub.MsgSendTimeout())
+	if !expires.IsZero() && expires.Before(deadline) {
+		deadline = expires
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+// expired tells whether the message's TTL ran out by now
+func (m *ChatMessage) expired(now time.Time) bool {
+	return !m.expires.IsZero() && !now.Before(m.expires)
+}
+
+// expiredBy tells whether err, why the message wasn't delivered, is it
+// expiring, rather than its delivery failing
+func (m *ChatMessage) expiredBy(err error) bool {
+	return errors.Is(err, errMsgExpired) ||
+		(errors.Is(err, context.DeadlineExceeded) && m.expired(time.Now()))
+}
+
+// dmExpired tells whether a DM kept for its recipient expired by now
+func dmExpired(dm DirectMsg, now time.Time) bool {
+	return !dm.Expires.IsZero() && !now.Before(dm.Expires)
+}
+
+// parseTTL takes seconds, or a duration like "90s"
+func parseTTL(s string) (time.Duration, bool) {
+	ttl, err := time.ParseDuration(s)
+	if seconds, atoiErr := strconv.Atoi(s); atoiErr == nil {
+		ttl, err = time.Duration(seconds)*time.Second, nil
+	}
+	return ttl, err == nil && ttl > 0
+}
+
+// sendExpiring sends the message or DM args has after its TTL, see TTLCmd. Its
+// expiry is by the server's clock, so the client's doesn't matter.
+func (handler *ClientHandler) sendExpiring(args string, ctx context.Context) Response {
+	ttlArg, content, _ := strings.Cut(args, " ")
+	ttl, ok := parseTTL(ttlArg)
+	if !ok || content == "" {
+		return ResponseInvalidArgument
+	}
+	expires := time.Now().Add(ttl)
+	if !IsCmd(content) {
+		return handler.broadcaster.BroadcastMessage(content, handler.Creds.Name, expires, ctx)
+	}
+	name, args := UnserializeStrToCmd(content).Split()
+	to, content, ok := splitDirectMsgArgs(args)
+	if name != DirectMsgCmd || !ok {
+		return ResponseInvalidArgument
+	}
+	return handler.broadcaster.SendDirectMsg(content, handler.Creds.Name, to, expires, ctx)
+}
+
+// splitDirectMsgArgs splits DirectMsgCmd's arguments into who it's to and the
+// message
+func splitDirectMsgArgs(args string) (to Username, content string, ok bool) {
+	toArg, content, _ := strings.Cut(args, " ")
+	return Username(toArg), content, toArg != "" && content != ""
+}
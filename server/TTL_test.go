@@ -0,0 +1,84 @@
+package server
+
+import (
+	"testing"
+	"time"
+	. "util"
+)
+
+// TestTTLMessageToStalledRecipient queues a message with a TTL behind one bob's
+// not reading, and checks it's dropped once it expired, while one without a
+// TTL queued behind it still arrives
+func TestTTLMessageToStalledRecipient(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{MsgSendTimeout: 5 * time.Second})
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	carol := connectToHub(hub, t)
+	carol.register("carol")
+
+	// bob's not reading, so his writer's stuck on this
+	carol.send(MsgPrefix + "1;first")
+	alice.expect(MsgPrefix + "carol: first")
+
+	alice.send(MsgPrefix + "1;/ttl 50ms deploy starting")
+	carol.expect(MsgPrefix + "alice: deploy starting")
+	alice.expect("r1;" + string(ResponseMsgExpiredForSome))
+	alice.send(MsgPrefix + "2;still on")
+	carol.expect(MsgPrefix + "alice: still on")
+
+	bob.expect(MsgPrefix + "carol: first")
+	carol.expect("r1;" + string(ResponseOk))
+	bob.expect(MsgPrefix + "alice: still on")
+	alice.expect("r2;" + string(ResponseOk))
+
+	alice.send(MsgPrefix + "3;/ttl 0 never")
+	alice.expect("r3;" + string(ResponseInvalidArgument))
+	alice.send(MsgPrefix + "4;/ttl 300 /who")
+	alice.expect("r4;" + string(ResponseInvalidArgument))
+}
+
+// TestTTLOfflineMsgs checks what's kept for a user who's away expires by
+// its TTL, its clock set a minute after it was sent
+func TestTTLOfflineMsgs(t *testing.T) {
+	hub := NewHub()
+	later := time.Now().Add(time.Minute)
+	hub.offlineMsgs.now = func() time.Time { return later }
+	hub.offlineMentions.now = func() time.Time { return later }
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+	bob.conn.Close()
+	waitForLogout(t, hub, "bob")
+
+	alice.send(MsgPrefix + "1;/ttl 30 /msg bob standup in 5")
+	alice.expect("r1;" + string(ResponseQueuedForOffline))
+	alice.send(MsgPrefix + "2;/msg bob call me")
+	alice.expect("r2;" + string(ResponseQueuedForOffline))
+	alice.send(MsgPrefix + "3;/ttl 30 @bob quick question")
+	alice.expect("r3;" + string(ResponseOk))
+	alice.send(MsgPrefix + "4;/ttl 300 @bob lunch?")
+	alice.expect("r4;" + string(ResponseOk))
+
+	bob = connectToHub(hub, t)
+	bob.login("bob")
+	sent := later.UTC().Format(time.RFC3339)
+	// the DM and the digest are queued separately, so either comes first
+	expected := map[string]bool{
+		MsgPrefix + "(DM " + sent + ") alice: call me":     true,
+		MsgPrefix + "You were mentioned 1 time while away": true,
+		MsgPrefix + sent + " alice: @bob lunch?":           true,
+	}
+	for len(expected) != 0 {
+		if err := bob.conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		line, err := ScanLine(bob.scanner)
+		if err != nil || !expected[line] {
+			t.Fatalf("expected one of %v, got %q, %v", expected, line, err)
+		}
+		delete(expected, line)
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"time"
+	. "util"
+)
+
+// throttled tells whether msg, sent at now, is too soon after the user's last
+// message, see MinMsgInterval. Only what's sent to others counts, not the
+// other commands. A message that isn't throttled is the last one from then on.
+func (handler *ClientHandler) throttled(msg string, now time.Time) bool {
+	interval := handler.options.MinMsgInterval
+	if interval == 0 || !sendsMessage(msg) {
+		return false
+	}
+	if !handler.lastMsgSent.IsZero() && now.Sub(handler.lastMsgSent) < interval {
+		return true
+	}
+	handler.lastMsgSent = now
+	return false
+}
+
+// sendsMessage tells whether msg is a message to other users, rather than a
+// command that isn't
+func sendsMessage(msg string) bool {
+	if !IsCmd(msg) {
+		return true
+	}
+	name, _ := UnserializeStrToCmd(msg).Split()
+	switch name {
+	case DirectMsgCmd, AdminsCmd, TTLCmd:
+		return true
+	default:
+		return false
+	}
+}
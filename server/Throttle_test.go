@@ -0,0 +1,60 @@
+package server
+
+import (
+	"testing"
+	"time"
+	. "util"
+)
+
+func TestThrottledInterval(t *testing.T) {
+	handler := &ClientHandler{options: &ServerOptions{MinMsgInterval: time.Second}}
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, step := range []struct {
+		after     time.Duration
+		msg       string
+		throttled bool
+	}{
+		{0, "hi", false},
+		{500 * time.Millisecond, "again", true},
+		// commands that don't send anything aren't
+		{600 * time.Millisecond, "/who", false},
+		{700 * time.Millisecond, "/msg bob hi", true},
+		// a second after the last one that went through
+		{time.Second, "/ttl 30 hi", false},
+		{1900 * time.Millisecond, "/admins hi", true},
+		{2 * time.Second, "hi", false},
+	} {
+		if throttled := handler.throttled(step.msg, start.Add(step.after)); throttled != step.throttled {
+			t.Fatalf("expected %q after %s to be throttled: %t, got %t", step.msg, step.after,
+				step.throttled, throttled)
+		}
+	}
+
+	handler.options.MinMsgInterval = 0
+	if handler.throttled("hi", start.Add(2*time.Second)) {
+		t.Fatal("expected no throttling with no interval")
+	}
+}
+
+func TestMinMsgInterval(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{MinMsgInterval: 100 * time.Millisecond})
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+
+	alice.send(MsgPrefix + "1;first")
+	bob.expect(MsgPrefix + "alice: first")
+	alice.expect("r1;" + string(ResponseOk))
+	alice.send(MsgPrefix + "2;second")
+	alice.expect("r2;" + string(ResponseSlowDown))
+	// other users have their own
+	bob.send(MsgPrefix + "1;hi")
+	alice.expect(MsgPrefix + "bob: hi")
+	bob.expect("r1;" + string(ResponseOk))
+
+	time.Sleep(100 * time.Millisecond)
+	alice.send(MsgPrefix + "3;second")
+	bob.expect(MsgPrefix + "alice: second")
+	alice.expect("r3;" + string(ResponseOk))
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+	. "util"
+)
+
+// The user DB file is a JSON object of the UserRecords by username. It may be
+// edited by hand while the server runs, see ServerOptions.UserDBPollInterval.
+
+func readUserDB(path string) (map[Username]*UserRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db := make(map[Username]*UserRecord)
+	err = json.Unmarshal(data, &db)
+	if err != nil {
+		return nil, err
+	}
+	for name, record := range db {
+		if record == nil {
+			db[name] = &UserRecord{}
+		}
+	}
+	return db, nil
+}
+
+func writeUserDB(path string, db map[Username]*UserRecord) error {
+	data, err := json.MarshalIndent(db, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic replaces the file in one go, so readers never see half of it
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// fileVersion tells whether a file changed since it was last read
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) (fileVersion, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{info.ModTime(), info.Size()}, nil
+}
+
+// LoadUserDB reads the accounts from ServerOptions.UserDBPath, if set. A
+// missing file is an empty DB, created on the first registration.
+func (hub *Hub) LoadUserDB() error {
+	path := hub.options.UserDBPath
+	if path == "" {
+		return nil
+	}
+	version, err := statFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	db, err := readUserDB(path)
+	if err != nil {
+		return err
+	}
+	hub.userDBLock.Lock()
+	defer hub.userDBLock.Unlock()
+	hub.userDB = db
+	hub.userDBVersion = version
+	return nil
+}
+
+// userDBSnapshot is a copy of the user DB, to be saved without holding the
+// hub's locks
+type userDBSnapshot struct {
+	// gen orders the snapshots, see Hub.userDBGen
+	gen uint64
+	db  map[Username]*UserRecord
+}
+
+// snapshotUserDB counts a change to the user DB and copies it for saveUserDB,
+// or returns nil if the DB isn't kept in a file. Should be called with
+// userDBLock held.
+func (hub *Hub) snapshotUserDB() *userDBSnapshot {
+	if hub.options.UserDBPath == "" {
+		return nil
+	}
+	hub.userDBGen++
+	db := make(map[Username]*UserRecord, len(hub.userDB))
+	for name, record := range hub.userDB {
+		copied := *record
+		db[name] = &copied
+	}
+	return &userDBSnapshot{hub.userDBGen, db}
+}
+
+// saveUserDB writes a snapshot, unless a newer one was already written. It's
+// called without the hub's locks, so auth isn't held up by the disk.
+func (hub *Hub) saveUserDB(snapshot *userDBSnapshot) {
+	if err := hub.writeUserDBSnapshot(snapshot); err != nil {
+		hub.logger.Printf("Error saving user DB: %s\n", err)
+	}
+}
+
+// writeUserDBSnapshot is saveUserDB, returning the error for the caller to
+// report
+func (hub *Hub) writeUserDBSnapshot(snapshot *userDBSnapshot) error {
+	if snapshot == nil {
+		return nil
+	}
+	hub.userDBSaveLock.Lock()
+	defer hub.userDBSaveLock.Unlock()
+	hub.userDBLock.RLock()
+	stale := snapshot.gen <= hub.userDBSavedGen
+	hub.userDBLock.RUnlock()
+	if stale {
+		return nil
+	}
+
+	path := hub.options.UserDBPath
+	err := writeUserDB(path, snapshot.db)
+	var version fileVersion
+	if err == nil {
+		version, err = statFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	hub.userDBLock.Lock()
+	hub.userDBSavedGen = snapshot.gen
+	// so the watcher doesn't reload our own write
+	hub.userDBVersion = version
+	hub.userDBLock.Unlock()
+	return nil
+}
+
+// watchUserDB reloads the user DB whenever it changed on a tick, until ticks is
+// closed. A file caught mid-write fails to parse and is retried on the next
+// tick.
+func (hub *Hub) watchUserDB(ticks <-chan time.Time) {
+	for range ticks {
+		err := hub.reloadUserDB()
+		if err != nil {
+			hub.logger.Printf("Error reloading user DB, will retry: %s\n", err)
+		}
+	}
+}
+
+var errUnsavedUserDB = errors.New("changes to the user DB aren't saved yet")
+
+// maxReloadAttempts bounds the retries of a reload that keeps finding the file
+// changed since it was read
+const maxReloadAttempts = 3
+
+func (hub *Hub) reloadUserDB() error {
+	path := hub.options.UserDBPath
+	for attempt := 0; attempt < maxReloadAttempts; attempt++ {
+		version, err := statFile(path)
+		if err != nil {
+			return err
+		}
+		hub.userDBLock.RLock()
+		unchanged := version == hub.userDBVersion
+		hub.userDBLock.RUnlock()
+		if unchanged {
+			return nil
+		}
+		// parsed before taking the locks, so auth isn't held up by the disk
+		db, err := readUserDB(path)
+		if err != nil {
+			return err
+		}
+		swapped, err := hub.swapUserDB(db, version)
+		if swapped || err != nil {
+			return err
+		}
+	}
+	return errors.New("the user DB kept changing while reloading")
+}
+
+// swapUserDB replaces the user DB with db, read from the file at version. It
+// doesn't if the file changed since, since db may miss a registration saved
+// meanwhile, or if the hub has changes not saved yet, which db would lose.
+func (hub *Hub) swapUserDB(db map[Username]*UserRecord, version fileVersion) (
+	swapped bool, err error) {
+	hub.activeUsersLock.Lock()
+	hub.userDBLock.Lock()
+	if hub.userDBGen != hub.userDBSavedGen {
+		hub.userDBLock.Unlock()
+		hub.activeUsersLock.Unlock()
+		return false, errUnsavedUserDB
+	}
+	current, err := statFile(hub.options.UserDBPath)
+	if err != nil || current != version {
+		hub.userDBLock.Unlock()
+		hub.activeUsersLock.Unlock()
+		return false, err
+	}
+
+	added, removed, changed := 0, 0, 0
+	var kicked []*ClientHandler
+	for name, record := range db {
+		old, exists := hub.userDB[name]
+		if !exists {
+			added++
+		} else if old.Password != record.Password {
+			changed++
+		}
+	}
+	for name := range hub.userDB {
+		if _, exists := db[name]; !exists {
+			removed++
+			if handler, isActive := hub.activeUsers[name]; isActive {
+				kicked = append(kicked, handler)
+			}
+		}
+	}
+	hub.userDB = db
+	hub.userDBVersion = version
+	hub.userDBLock.Unlock()
+	hub.activeUsersLock.Unlock()
+
+	hub.logger.Printf("Reloaded user DB: %d added, %d removed, %d passwords changed\n",
+		added, removed, changed)
+	for _, handler := range kicked {
+		hub.Kick(handler.Creds.Name, "the user DB",
+			LogoutReason{Code: LogoutKicked, Text: "your account was removed"})
+	}
+	return true, nil
+}
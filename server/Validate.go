@@ -0,0 +1,209 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConfigCheck is one of the checks a server's setup has to pass before it
+// starts
+type ConfigCheck struct {
+	Name  string
+	Check func(addr string, options ServerOptions) error
+}
+
+var ConfigChecks = []ConfigCheck{
+	{"listen address", checkListenAddr},
+	{"user DB", checkUserDB},
+	{"data directory", checkDataDir},
+	{"TLS", checkTLS},
+	{"limits", checkLimits},
+	{"log file", checkLogFile},
+	{"blocklist", checkBlocklist},
+}
+
+// ErrNothingToCheck is returned by a check that doesn't apply to the options,
+// e.g the user DB checks when there's no user DB file. It isn't a failure.
+var ErrNothingToCheck = errors.New("nothing to check")
+
+// ValidationErrors are the failures of all the checks that failed
+type ValidationErrors []error
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate runs every ConfigCheck, without binding anything, and returns the
+// failures of all of them
+func Validate(addr string, options ServerOptions) ValidationErrors {
+	var errs ValidationErrors
+	for _, check := range ConfigChecks {
+		err := check.Check(addr, options)
+		if err != nil && !errors.Is(err, ErrNothingToCheck) {
+			errs = append(errs, fmt.Errorf("%s: %w", check.Name, err))
+		}
+	}
+	return errs
+}
+
+// ValidateReport writes a line per check, and reports whether none failed
+func ValidateReport(w io.Writer, addr string, options ServerOptions) bool {
+	ok := true
+	for _, check := range ConfigChecks {
+		switch err := check.Check(addr, options); {
+		case err == nil:
+			fmt.Fprintf(w, "ok   %s\n", check.Name)
+		case errors.Is(err, ErrNothingToCheck):
+			fmt.Fprintf(w, "skip %s: nothing to check\n", check.Name)
+		default:
+			fmt.Fprintf(w, "FAIL %s: %s\n", check.Name, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+func checkListenAddr(addr string, options ServerOptions) error {
+	specs := append([]string{addr}, options.ListenAddrs...)
+	if options.WebAddr != "" {
+		specs = append(specs, options.WebAddr)
+	}
+	for _, spec := range specs {
+		if err := checkListenSpec(spec); err != nil {
+			return fmt.Errorf("%s: %w", spec, err)
+		}
+	}
+	return nil
+}
+
+func checkListenSpec(spec string) error {
+	network, address := ParseListenSpec(spec)
+	if network == "unix" {
+		if address == "" {
+			return errors.New("no socket path")
+		}
+		_, err := os.Stat(filepath.Dir(address))
+		return err
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	_, err = net.LookupPort(network, port)
+	return err
+}
+
+// checkUserDB passes when there's no user DB file yet, since it's created on
+// the first registration
+func checkUserDB(addr string, options ServerOptions) error {
+	if options.UserDBPath == "" {
+		return ErrNothingToCheck
+	}
+	db, err := readUserDB(options.UserDBPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for name, record := range db {
+		if name == "" {
+			return errors.New("a user has an empty name")
+		} else if record.Password == "" {
+			return fmt.Errorf("user %s has no password", name)
+		} else if record.DisplayName != "" && !record.DisplayName.IsValid() {
+			return fmt.Errorf("user %s has an invalid display name", name)
+		}
+	}
+	return nil
+}
+
+// checkDataDir makes sure the files the server writes can be written
+func checkDataDir(addr string, options ServerOptions) error {
+	if options.UserDBPath == "" {
+		return ErrNothingToCheck
+	}
+	f, err := os.CreateTemp(filepath.Dir(options.UserDBPath), ".validate")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func checkLimits(addr string, options ServerOptions) error {
+	if err := checkRetention(options.History); err != nil {
+		return err
+	}
+	for room, roomOptions := range options.RoomHistory {
+		if err := checkRetention(roomOptions.Retention); err != nil {
+			return fmt.Errorf("room %q: %w", room, err)
+		}
+	}
+	switch {
+	case options.OfflineMsgs.MaxPerUser < 0 || options.OfflineMsgs.MaxPerUser > MaxQueuedMsgs:
+		return fmt.Errorf("offline messages per user must be between 0 and %d", MaxQueuedMsgs)
+	case options.OfflineMsgs.TTL < 0:
+		return errors.New("offline messages can't be kept for a negative duration")
+	case options.Mentions.MaxPerUser < 0 || options.Mentions.MaxPerUser > MaxMentionsPerUser:
+		return fmt.Errorf("offline mentions per user must be between 0 and %d", MaxMentionsPerUser)
+	case options.MsgSendTimeout != 0 && (options.MsgSendTimeout < MinMsgSendTimeout ||
+		options.MsgSendTimeout > MaxMsgSendTimeout):
+		return fmt.Errorf("the message timeout must be between %s and %s",
+			MinMsgSendTimeout, MaxMsgSendTimeout)
+	case options.Mentions.TTL < 0:
+		return errors.New("offline mentions can't be kept for a negative duration")
+	case options.UserDBPollInterval < 0:
+		return errors.New("the user DB poll interval can't be negative")
+	case options.UserDBPollInterval != 0 && options.UserDBPath == "":
+		return errors.New("polling the user DB needs a user DB path")
+	case options.EmptyMessages < EmptyMessagesAllow || options.EmptyMessages > EmptyMessagesIgnore:
+		return fmt.Errorf("unknown empty message policy %d", options.EmptyMessages)
+	case options.MinClientVersion != "" && !validSemVer(options.MinClientVersion):
+		return fmt.Errorf("the minimum client version %q isn't a semantic version",
+			options.MinClientVersion)
+	case options.ControlChars < ControlCharsStrip || options.ControlChars > ControlCharsReject:
+		return fmt.Errorf("unknown control character policy %d", options.ControlChars)
+	}
+	return nil
+}
+
+// checkLogFile makes sure the log file can be appended to, without creating it
+// if it's not there yet
+func checkLogFile(addr string, options ServerOptions) error {
+	if options.LogFile == "" {
+		return ErrNothingToCheck
+	}
+	switch rotation := options.LogRotation; {
+	case rotation.MaxSize < 0:
+		return errors.New("the log file's max size can't be negative")
+	case rotation.MaxBackups < 0:
+		return errors.New("the log file can't keep a negative number of backups")
+	}
+	f, err := os.OpenFile(options.LogFile, os.O_WRONLY|os.O_APPEND, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return checkDataDir(addr, ServerOptions{UserDBPath: options.LogFile})
+	} else if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func checkRetention(retention HistoryRetention) error {
+	switch {
+	case retention.MaxMessages < 0:
+		return errors.New("history can't keep a negative number of messages")
+	case retention.MaxAge < 0:
+		return errors.New("history can't keep messages for a negative duration")
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"logfile"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testsupport"
+	"time"
+)
+
+func TestCheckListenAddr(t *testing.T) {
+	socket := UnixListenPrefix + filepath.Join(t.TempDir(), "chat.sock")
+	for addr, valid := range map[string]bool{
+		":7000":                       true,
+		"127.0.0.1:7000":              true,
+		"7000":                        false,
+		":http":                       true,
+		":99999":                      false,
+		":notaport":                   false,
+		socket:                        true,
+		"unix:":                       false,
+		"unix:/nonexistent/chat.sock": false,
+	} {
+		if err := checkListenAddr(addr, ServerOptions{}); (err == nil) != valid {
+			t.Errorf("%q: expected valid=%v, got %v", addr, valid, err)
+		}
+	}
+	// a bad extra address is named
+	err := checkListenAddr(":7000", ServerOptions{ListenAddrs: []string{":7001", "7002"}})
+	if err == nil || !strings.HasPrefix(err.Error(), "7002: ") {
+		t.Errorf("expected the bad address named, got %v", err)
+	}
+}
+
+func TestCheckUserDB(t *testing.T) {
+	dir := t.TempDir()
+	for content, valid := range map[string]bool{
+		`{"alice": {"password": "1234", "display_name": "Alice"}}`: true,
+		`{"alice": {"pass`: false,
+		`["alice"]`:        false,
+		`{"alice": {}}`:    false,
+		`{"alice": {"password": "1234", "display_name": "a\nb"}}`: false,
+	} {
+		path := filepath.Join(dir, "users.json")
+		err := os.WriteFile(path, []byte(content), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkUserDB("", ServerOptions{UserDBPath: path}); (err == nil) != valid {
+			t.Errorf("%s: expected valid=%v, got %v", content, valid, err)
+		}
+	}
+	missing := ServerOptions{UserDBPath: filepath.Join(dir, "missing.json")}
+	if err := checkUserDB("", missing); err != nil {
+		t.Errorf("a missing user DB should pass, got %s", err)
+	}
+}
+
+func TestCheckDataDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkDataDir("", ServerOptions{UserDBPath: filepath.Join(dir, "users.json")}); err != nil {
+		t.Error(err)
+	}
+	missingDir := ServerOptions{UserDBPath: filepath.Join(dir, "nope", "users.json")}
+	if err := checkDataDir("", missingDir); err == nil {
+		t.Error("expected a missing directory to fail")
+	}
+}
+
+func TestCheckLogFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.log")
+	if err := checkLogFile("", ServerOptions{LogFile: path}); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the check not to create the file, got %v", err)
+	}
+	negative := ServerOptions{LogFile: path, LogRotation: logfile.Options{MaxBackups: -1}}
+	if err := checkLogFile("", negative); err == nil {
+		t.Error("expected negative backups to fail")
+	}
+	missingDir := ServerOptions{LogFile: filepath.Join(dir, "nope", "server.log")}
+	if err := checkLogFile("", missingDir); err == nil {
+		t.Error("expected a missing directory to fail")
+	}
+}
+
+func TestCheckTLS(t *testing.T) {
+	dir := t.TempDir()
+	cert, key, _, err := testsupport.WriteSelfSignedCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTLS("", ServerOptions{}); !errors.Is(err, ErrNothingToCheck) {
+		t.Errorf("expected nothing to check without TLS, got %v", err)
+	}
+	valid := []ServerOptions{
+		{TLSCertFile: cert, TLSKeyFile: key},
+		{TLSCertFile: cert, TLSKeyFile: key, RequireTLS: true},
+	}
+	invalid := []ServerOptions{
+		{RequireTLS: true},
+		{TLSCertFile: cert},
+		{TLSCertFile: cert, TLSKeyFile: filepath.Join(dir, "missing.pem")},
+		{TLSCertFile: key, TLSKeyFile: cert},
+	}
+	for _, options := range valid {
+		if err := checkTLS("", options); err != nil {
+			t.Errorf("%+v: %s", options, err)
+		}
+	}
+	for _, options := range invalid {
+		if err := checkTLS("", options); err == nil || errors.Is(err, ErrNothingToCheck) {
+			t.Errorf("%+v: expected to fail, got %v", options, err)
+		}
+	}
+}
+
+func TestCheckLimits(t *testing.T) {
+	valid := []ServerOptions{
+		{},
+		{History: HistoryRetention{MaxMessages: 10, MaxAge: time.Minute}},
+		{RoomHistory: map[string]RoomHistoryOptions{
+			"gophers": {Retention: HistoryRetention{MaxMessages: 10}, SinceJoin: true}}},
+		{UserDBPath: "users.json", UserDBPollInterval: time.Second},
+	}
+	invalid := []ServerOptions{
+		{History: HistoryRetention{MaxMessages: -1}},
+		{History: HistoryRetention{MaxAge: -time.Minute}},
+		{RoomHistory: map[string]RoomHistoryOptions{
+			"gophers": {Retention: HistoryRetention{MaxMessages: -1}}}},
+		{UserDBPollInterval: time.Second},
+		{OfflineMsgs: OfflineMsgOptions{MaxPerUser: MaxQueuedMsgs + 1}},
+		{OfflineMsgs: OfflineMsgOptions{TTL: -time.Second}},
+		{Mentions: MentionOptions{MaxPerUser: MaxMentionsPerUser + 1}},
+		{Mentions: MentionOptions{TTL: -time.Second}},
+		{MsgSendTimeout: time.Millisecond},
+		{MsgSendTimeout: time.Hour},
+		{EmptyMessages: EmptyMessagesIgnore + 1},
+		{ControlChars: ControlCharsReject + 1},
+	}
+	for _, options := range valid {
+		if err := checkLimits("", options); err != nil {
+			t.Errorf("%+v: %s", options, err)
+		}
+	}
+	for _, options := range invalid {
+		if err := checkLimits("", options); err == nil {
+			t.Errorf("%+v: expected to fail", options)
+		}
+	}
+}
+
+// TestValidateReportsAllFailures checks failures don't stop the rest of the
+// checks from running
+func TestValidateReportsAllFailures(t *testing.T) {
+	options := ServerOptions{History: HistoryRetention{MaxMessages: -1}}
+	errs := Validate("7000", options)
+	if len(errs) != 2 {
+		t.Fatalf("expected the address and limits to fail, got %v", errs)
+	}
+	var report bytes.Buffer
+	if ValidateReport(&report, "7000", options) {
+		t.Fatal("expected the report to fail")
+	}
+	// without a user DB, TLS, a log file or a blocklist, their checks have
+	// nothing to check
+	if strings.Count(report.String(), "FAIL") != 2 || strings.Count(report.String(), "skip") != 5 {
+		t.Fatalf("unexpected report:\n%s", report.String())
+	}
+	if _, err := BuildServer("7000", options); err == nil {
+		t.Fatal("expected BuildServer to refuse")
+	}
+}
+
+func TestValidateReportWrappedErrors(t *testing.T) {
+	defer func(checks []ConfigCheck) { ConfigChecks = checks }(ConfigChecks)
+	ConfigChecks = []ConfigCheck{
+		{"skipped", func(string, ServerOptions) error {
+			return fmt.Errorf("no file: %w", ErrNothingToCheck)
+		}},
+		{"failed", func(string, ServerOptions) error { return errors.New("bad") }},
+	}
+	var report bytes.Buffer
+	if ValidateReport(&report, "", ServerOptions{}) {
+		t.Error("expected the report to fail")
+	}
+	expected := "skip skipped: nothing to check\nFAIL failed: bad\n"
+	if report.String() != expected {
+		t.Errorf("expected:\n%sgot:\n%s", expected, report.String())
+	}
+	if errs := Validate("", ServerOptions{}); len(errs) != 1 {
+		t.Errorf("expected only the failed check's error, got %v", errs)
+	}
+}
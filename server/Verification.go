@@ -0,0 +1,66 @@
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	. "util"
+)
+
+// verificationCodeDigits is how long verification codes are
+const verificationCodeDigits = 6
+
+// newVerificationCode is a random code of verificationCodeDigits digits
+func newVerificationCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1e6))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", verificationCodeDigits, n), nil
+}
+
+// verificationNotice tells a user who just registered how to verify
+const verificationNotice = "Your account needs verifying: send the code you got with /" +
+	string(VerifyCmd) + " CODE to start chatting"
+
+// sendVerificationCode hands the code to ServerOptions.VerificationCodeSink,
+// or logs it when there's none, e.g while developing
+func (hub *Hub) sendVerificationCode(name Username, code string) {
+	if hub.options.VerificationCodeSink != nil {
+		hub.options.VerificationCodeSink(name, code)
+		return
+	}
+	hub.logger.Printf("Verification code for %s: %s\n", name, code)
+}
+
+// Verify activates name's pending account, if code is the one they were sent.
+// An account that's verified already stays so.
+func (hub *Hub) Verify(name Username, code string) Response {
+	var snapshot *userDBSnapshot
+	// saved once the lock is released
+	defer func() { hub.saveUserDB(snapshot) }()
+	hub.userDBLock.Lock()
+	defer hub.userDBLock.Unlock()
+	record, exists := hub.userDB[name]
+	if !exists {
+		return ResponseNoSuchUser
+	} else if record.VerificationCode == "" {
+		return ResponseOk
+	} else if code != record.VerificationCode {
+		return ResponseWrongVerificationCode
+	}
+	record.VerificationCode = ""
+	snapshot = hub.snapshotUserDB()
+	hub.logger.Printf("Verified: %s\n", name)
+	return ResponseOk
+}
+
+// allowedUnverified tells whether a session whose account isn't verified yet
+// may send msg, which is only for verifying or leaving
+func allowedUnverified(msg string) bool {
+	if !IsCmd(msg) {
+		return false
+	}
+	name, _ := UnserializeStrToCmd(msg).Split()
+	return name == VerifyCmd || name == LogoutCmd
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"testing"
+	"time"
+	. "util"
+)
+
+func expectCode(t *testing.T, codes <-chan string) string {
+	t.Helper()
+	select {
+	case code := <-codes:
+		return code
+	case <-time.After(time.Second):
+		t.Fatal("expected a verification code to be sent")
+		return ""
+	}
+}
+
+func TestVerification(t *testing.T) {
+	codes := make(chan string, 2)
+	hub := NewHubWithOptions(ServerOptions{RequireVerification: true,
+		VerificationCodeSink: func(name Username, code string) {
+			if name == "alice" {
+				codes <- code
+			}
+		}})
+	authResponse := ServerResponsePrefix + string(AuthResponseID) + IdSeparator
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	alice.expect(MsgPrefix + verificationNotice)
+	first := expectCode(t, codes)
+
+	// pending, the session can only verify
+	alice.send(MsgPrefix + "1;hi")
+	alice.expect("r1;" + string(ResponseNotVerified))
+	alice.send(MsgPrefix + "2;/who")
+	alice.expect("r2;" + string(ResponseNotVerified))
+	wrong := "000000"
+	if first == wrong {
+		wrong = "111111"
+	}
+	alice.send(MsgPrefix + "3;/verify " + wrong)
+	alice.expect("r3;" + string(ResponseWrongVerificationCode))
+
+	// nor can logging in
+	alice.send(MsgPrefix + IdSeparator + LogoutCmd.Serialize())
+	alice.send(string(ActionLogin), "alice", "1234")
+	alice.expect(authResponse + string(ResponseNotVerified))
+	// registering again is for the account's owner only, and sends a new code
+	alice.send(string(ActionRegister), "alice", "wrong")
+	alice.expect(authResponse + string(ResponseUsernameExists))
+	alice.register("alice")
+	alice.expect(MsgPrefix + verificationNotice)
+	second := expectCode(t, codes)
+	if second != first {
+		alice.send(MsgPrefix + "4;/verify " + first)
+		alice.expect("r4;" + string(ResponseWrongVerificationCode))
+	}
+
+	alice.send(MsgPrefix + "5;/verify " + second)
+	alice.expect("r5;" + string(ResponseOk))
+	alice.send(MsgPrefix + "6;hi")
+	alice.expect("r6;" + string(ResponseOk))
+	alice.send(MsgPrefix + "7;/verify " + second)
+	alice.expect("r7;" + string(ResponseOk))
+	alice.send(MsgPrefix + IdSeparator + LogoutCmd.Serialize())
+	alice.login("alice")
+	hub.userDBLock.RLock()
+	defer hub.userDBLock.RUnlock()
+	if code := hub.userDB["alice"].VerificationCode; code != "" {
+		t.Fatalf("expected the account to be verified, got code %q", code)
+	}
+}
+
+// TestVerifyAfterRegisterThenLogin verifies in the session of the first login,
+// as registering doesn't start one
+func TestVerifyAfterRegisterThenLogin(t *testing.T) {
+	codes := make(chan string, 1)
+	hub := NewHubWithOptions(ServerOptions{RequireVerification: true, RegisterThenLogin: true,
+		VerificationCodeSink: func(name Username, code string) { codes <- code }})
+	authResponse := ServerResponsePrefix + string(AuthResponseID) + IdSeparator
+	alice := connectToHub(hub, t)
+	alice.send(string(ActionRegister), "alice", "1234")
+	alice.expect(authResponse + string(ResponseRegisteredPleaseLogin))
+	code := expectCode(t, codes)
+	alice.send(string(ActionLogin), "alice", "wrong")
+	alice.expect(authResponse + string(ResponseInvalidCredentials))
+	alice.login("alice")
+	alice.expect(MsgPrefix + verificationNotice)
+	alice.send(MsgPrefix + "1;hi")
+	alice.expect("r1;" + string(ResponseNotVerified))
+	alice.send(MsgPrefix + "2;/verify " + code)
+	alice.expect("r2;" + string(ResponseOk))
+	alice.send(MsgPrefix + "3;hi")
+	alice.expect("r3;" + string(ResponseOk))
+}
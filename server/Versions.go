@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	. "util"
+)
+
+// unknownVersion counts the clients that didn't report their version
+const unknownVersion = "unknown"
+
+// exchangeVersions logs the version the client reported on its capabilities
+// line, and answers a client that reported one with the server's
+func (hub *Hub) exchangeVersions(conn net.Conn, caps Capabilities) {
+	version := caps.Version()
+	if version == "" {
+		hub.logger.Printf("Client version at %s: %s\n", conn.RemoteAddr(), unknownVersion)
+		return
+	}
+	hub.logger.Printf("Client version at %s: %s\n", conn.RemoteAddr(), version)
+	err := writeLine(conn, Capabilities{}.WithVersion(hub.options.Version).Serialize())
+	if err != nil {
+		hub.logger.Printf("Error sending our version to %s: %s\n", conn.RemoteAddr(), err)
+	}
+}
+
+// ClientVersions counts the open connections by the version their client
+// reported
+func (hub *Hub) ClientVersions() map[string]int {
+	hub.connsLock.Lock()
+	defer hub.connsLock.Unlock()
+	versions := make(map[string]int)
+	for _, caps := range hub.conns {
+		version := caps.Version()
+		if version == "" {
+			version = unknownVersion
+		}
+		versions[version]++
+	}
+	return versions
+}
+
+// ClientVersionsFor lists ClientVersions to the admin name, most common
+// first, e.g "1.2.0 x3, devel x1"
+func (hub *Hub) ClientVersionsFor(name Username) (string, Response) {
+	if !hub.isAdmin(name) {
+		return "", ResponseNotAdmin
+	}
+	counts := hub.ClientVersions()
+	versions := make([]string, 0, len(counts))
+	for version := range counts {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		if counts[versions[i]] != counts[versions[j]] {
+			return counts[versions[i]] > counts[versions[j]]
+		}
+		return versions[i] < versions[j]
+	})
+	for i, version := range versions {
+		versions[i] = fmt.Sprintf("%s x%d", version, counts[version])
+	}
+	return strings.Join(versions, ", "), ResponseOk
+}
+
+func (handler *ClientHandler) showVersion(args string) (Response, error) {
+	var notice string
+	if args == ClientVersionsArg {
+		versions, response := handler.users.ClientVersionsFor(handler.Creds.Name)
+		if response != ResponseOk {
+			return response, nil
+		}
+		notice = "Client versions: " + versions
+	} else {
+		protocol := serverCapabilities.Common(handler.caps).String()
+		if protocol == "" {
+			protocol = "legacy"
+		}
+		notice = "Version: server " + handler.users.Version()
+		if client := handler.caps.Version(); client != "" {
+			notice += ", client " + client
+		}
+		notice += ", protocol " + protocol
+		if handler.users.RegistrationOpen() {
+			notice += ", registration open"
+		} else {
+			notice += ", registration closed"
+		}
+	}
+	if err := handler.forwardNoticeToUser(notice); err != nil {
+		return ResponseIoErrorOccurred, err
+	}
+	return ResponseOk, nil
+}
+
+func validSemVer(s string) bool {
+	_, ok := ParseSemVer(s)
+	return ok
+}
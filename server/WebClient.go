@@ -0,0 +1,54 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// webFiles are the web client's page, script and stylesheet
+//
+//go:embed web
+var webFiles embed.FS
+
+// webContentSecurityPolicy lets the page load nothing but its own script and
+// stylesheet, and connect nowhere but back to us
+const webContentSecurityPolicy = "default-src 'none'; script-src 'self'; " +
+	"style-src 'self'; connect-src 'self'; frame-ancestors 'none'; " +
+	"base-uri 'none'; form-action 'none'"
+
+// WebHandler serves the web client at "/", whose page connects back at
+// WebSocketPath to be served like any other client, see
+// ServerOptions.WebAddr. Admins export the history at HistoryExportPath, and
+// create accounts at CreateUsersPath.
+func (hub *Hub) WebHandler() http.Handler {
+	files, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		// the directory is embedded, so it's there
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", withSecurityHeaders(http.FileServer(http.FS(files))))
+	mux.HandleFunc(WebSocketPath, func(w http.ResponseWriter, r *http.Request) {
+		conn, ok := hub.upgradeWebSocket(w, r)
+		if !ok {
+			return
+		}
+		hub.logger.Printf("Connected: %s (WebSocket)\n", conn.RemoteAddr())
+		hub.HandleNewConnection(conn)
+	})
+	mux.Handle(HistoryExportPath, withSecurityHeaders(http.HandlerFunc(hub.serveHistoryExport)))
+	mux.Handle(CreateUsersPath, withSecurityHeaders(http.HandlerFunc(hub.serveCreateUsers)))
+	return mux
+}
+
+func withSecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("Content-Security-Policy", webContentSecurityPolicy)
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Referrer-Policy", "no-referrer")
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	. "util"
+)
+
+// dialWebSocket does the handshake the web client's page does, with origin as
+// its Origin header, none when empty. Returns the response, and the
+// connection if it was upgraded.
+func dialWebSocket(t *testing.T, server *httptest.Server, origin string) (*http.Response,
+	*testConn) {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(time.Second))
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	request := "GET " + WebSocketPath + " HTTP/1.1\r\nHost: " + server.Listener.Addr().String() +
+		"\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n"
+	if origin != "" {
+		request += "Origin: " + origin + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	response, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return response, nil
+	}
+	// RFC 6455's example key and accept
+	accept := response.Header.Get("Sec-WebSocket-Accept")
+	if accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("expected RFC 6455's accept key, got %q", accept)
+	}
+	conn.SetDeadline(time.Time{})
+	ws := newWebSocketConn(conn, r, true)
+	return response, &testConn{ws, bufio.NewScanner(ws), t}
+}
+
+func TestWebClientPage(t *testing.T) {
+	server := httptest.NewServer(NewHub().WebHandler())
+	defer server.Close()
+	for path, expected := range map[string]string{
+		"/":          `<script src="client.js"`,
+		"/client.js": "new WebSocket(",
+	} {
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusOK || !strings.Contains(string(body), expected) {
+			t.Fatalf("expected %s to have %q, got %s: %s", path, expected, response.Status, body)
+		}
+		if csp := response.Header.Get("Content-Security-Policy"); csp != webContentSecurityPolicy {
+			t.Fatalf("expected %s's content security policy, got %q", path, csp)
+		}
+		if nosniff := response.Header.Get("X-Content-Type-Options"); nosniff != "nosniff" {
+			t.Fatalf("expected %s not to be sniffed, got %q", path, nosniff)
+		}
+	}
+}
+
+// TestWebClientChats plays the web client's page, chatting with a TCP client
+func TestWebClientChats(t *testing.T) {
+	hub := NewHub()
+	server := httptest.NewServer(hub.WebHandler())
+	defer server.Close()
+	bob := connectToHub(hub, t)
+	bob.register("bob")
+
+	_, alice := dialWebSocket(t, server, server.URL)
+	alice.send(Capabilities{CapPresence: true}.Serialize())
+	alice.register("alice")
+	alice.send(MsgPrefix + "1;hi from the browser")
+	bob.expect(MsgPrefix + "alice: hi from the browser")
+	alice.expect("r1;" + string(ResponseOk))
+
+	bob.send(MsgPrefix + "2;hi back")
+	alice.expect(MsgPrefix + "bob: hi back")
+	bob.expect("r2;" + string(ResponseOk))
+
+	alice.conn.Close()
+	waitForLogout(t, hub, "alice")
+}
+
+func TestWebSocketRefusesOtherSites(t *testing.T) {
+	server := httptest.NewServer(NewHub().WebHandler())
+	defer server.Close()
+	response, conn := dialWebSocket(t, server, "https://evil.example")
+	if conn != nil || response.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a cross-origin WebSocket to be forbidden, got %s", response.Status)
+	}
+}
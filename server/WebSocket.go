@@ -0,0 +1,339 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocketPath is where browsers connect, see WebHandler. Over a WebSocket,
+// each text message is a protocol line, without its newline.
+const WebSocketPath = "/ws"
+
+// webSocketGUID is what the handshake's accept key is derived with, see RFC
+// 6455
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// maxWebSocketMessage bounds a message as a line is bounded over TCP, by the
+// protocol scanner's buffer
+const maxWebSocketMessage = bufio.MaxScanTokenSize
+
+// wsCloseNormal is a close frame's payload for a connection that's done with
+var wsCloseNormal = []byte{0x03, 0xe8}
+
+// ErrWebSocketProtocol is the peer breaking RFC 6455, which ends the session
+var ErrWebSocketProtocol = errors.New("WebSocket protocol error")
+
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether a comma separated header, e.g Connection,
+// lists token
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether the page that opened the WebSocket is ours.
+// Clients that aren't browsers don't send an origin, and can't be tricked into
+// connecting with the user's cookies anyway.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// upgradeWebSocket answers r's WebSocket handshake, and returns the connection
+// it upgraded to. A request that isn't a handshake, or comes from another
+// site's page, is answered with an HTTP error instead. Returns false if the
+// request is done with.
+func (hub *Hub) upgradeWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, bool) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case r.Method != http.MethodGet || key == "" ||
+		!headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket"):
+		http.Error(w, "Expected a WebSocket handshake", http.StatusBadRequest)
+		return nil, false
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, false
+	case !sameOrigin(r):
+		hub.logger.Printf("Refused WebSocket from %s, opened by %s\n", r.RemoteAddr,
+			r.Header.Get("Origin"))
+		http.Error(w, "Cross-origin WebSocket refused", http.StatusForbidden)
+		return nil, false
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Can't upgrade this connection", http.StatusInternalServerError)
+		return nil, false
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		hub.logger.Println(err)
+		return nil, false
+	}
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		webSocketAccept(key))
+	if err != nil {
+		hub.logger.Println(err)
+		hub.closeLogErr(conn)
+		return nil, false
+	}
+	return newWebSocketConn(conn, rw.Reader, false), true
+}
+
+// webSocketConn reads and writes protocol lines as WebSocket messages, for
+// the hub to serve it like any other conn. Ping frames are answered as
+// they're read.
+type webSocketConn struct {
+	net.Conn
+	r *bufio.Reader
+	// client is whether we're the client, who masks its frames, rather than the
+	// server, who requires them masked
+	client bool
+	// unread is what's left to read of the last message, its newline included
+	unread []byte
+
+	writeLock sync.Mutex
+	// partial is a line written without its newline yet
+	partial   []byte
+	closeOnce sync.Once
+}
+
+func newWebSocketConn(conn net.Conn, r *bufio.Reader, client bool) *webSocketConn {
+	return &webSocketConn{Conn: conn, r: r, client: client}
+}
+
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	for len(c.unread) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.unread = append(msg, '\n')
+	}
+	n := copy(b, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+// readMessage reads the next message, put together from its fragments,
+// answering the control frames sent meanwhile. The peer closing the
+// WebSocket is EOF.
+func (c *webSocketConn) readMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.sendClose(payload)
+			return nil, io.EOF
+		case wsOpText, wsOpBinary:
+			if started {
+				return nil, fmt.Errorf("%w: a message started inside another",
+					ErrWebSocketProtocol)
+			}
+			started = true
+			msg = payload
+		case wsOpContinuation:
+			if !started {
+				return nil, fmt.Errorf("%w: a continuation with no message",
+					ErrWebSocketProtocol)
+			}
+			msg = append(msg, payload...)
+		default:
+			return nil, fmt.Errorf("%w: unknown opcode %#x", ErrWebSocketProtocol, op)
+		}
+		if len(msg) > maxWebSocketMessage {
+			return nil, fmt.Errorf("%w: message over %d bytes", ErrWebSocketProtocol,
+				maxWebSocketMessage)
+		}
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func (c *webSocketConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	op = head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	switch {
+	case head[0]&0x70 != 0:
+		err = fmt.Errorf("%w: reserved bits set", ErrWebSocketProtocol)
+	case masked == c.client:
+		err = fmt.Errorf("%w: frame masked %t", ErrWebSocketProtocol, masked)
+	case op >= wsOpClose && (!fin || length > 125):
+		err = fmt.Errorf("%w: invalid control frame", ErrWebSocketProtocol)
+	case length > maxWebSocketMessage:
+		err = fmt.Errorf("%w: frame over %d bytes", ErrWebSocketProtocol,
+			maxWebSocketMessage)
+	}
+	if err != nil {
+		return
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// Write sends each line written as a text message. A line written in pieces
+// is sent once its newline is.
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.partial = append(c.partial, b...)
+	for {
+		i := bytes.IndexByte(c.partial, '\n')
+		if i < 0 {
+			break
+		}
+		if err := c.writeFrameLocked(wsOpText, c.partial[:i]); err != nil {
+			return 0, err
+		}
+		c.partial = c.partial[i+1:]
+	}
+	if len(c.partial) == 0 {
+		c.partial = nil
+	}
+	return len(b), nil
+}
+
+func (c *webSocketConn) writeFrame(op byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.writeFrameLocked(op, payload)
+}
+
+// writeFrameLocked writes payload as a single frame. The write lock must be
+// held.
+func (c *webSocketConn) writeFrameLocked(op byte, payload []byte) error {
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|op)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, maskBit|126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, maskBit|127), uint64(n))
+	}
+	if !c.client {
+		_, err := c.Conn.Write(append(frame, payload...))
+		return err
+	}
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	start := len(frame)
+	frame = append(frame, payload...)
+	for i := range frame[start:] {
+		frame[start+i] ^= mask[i%4]
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// sendClose sends the close frame, once, whether it starts the closing
+// handshake or answers the peer's
+func (c *webSocketConn) sendClose(payload []byte) {
+	c.closeOnce.Do(func() {
+		// a peer that's gone or stopped reading doesn't hold the close up
+		c.Conn.SetWriteDeadline(time.Now().Add(ClientWriteTimeout))
+		c.writeFrame(wsOpClose, payload)
+	})
+}
+
+// Close sends a close frame first, unless it answered the peer's already
+func (c *webSocketConn) Close() error {
+	c.sendClose(wsCloseNormal)
+	return c.Conn.Close()
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	. "util"
+)
+
+// WelcomeStep is a block of lines users get right after logging in, see
+// ServerOptions.Welcome
+type WelcomeStep string
+
+const (
+	// WelcomeMOTD is the message of the day, if there is one
+	WelcomeMOTD WelcomeStep = "motd"
+	// WelcomeOfflineMsgs are the DMs sent to the user while they were
+	// offline, see OfflineMsgOptions
+	WelcomeOfflineMsgs WelcomeStep = "dms"
+	// WelcomeMentions sums up the mentions of the user while they were
+	// offline, see MentionOptions
+	WelcomeMentions WelcomeStep = "mentions"
+	// WelcomeHistory is the last WelcomeHistoryLen messages, as HistoryCmd
+	// shows them
+	WelcomeHistory WelcomeStep = "history"
+)
+
+// DefaultWelcome is the welcome when ServerOptions.Welcome isn't set
+var DefaultWelcome = []WelcomeStep{WelcomeOfflineMsgs, WelcomeMentions}
+
+// WelcomeHistoryLen is how many messages WelcomeHistory replays
+const WelcomeHistoryLen = 20
+
+// ParseWelcome parses a comma separated list of steps, e.g "motd,dms,history",
+// or "none" for no welcome at all
+func ParseWelcome(s string) ([]WelcomeStep, error) {
+	steps := []WelcomeStep{}
+	if s == "none" {
+		return steps, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		switch step := WelcomeStep(strings.TrimSpace(name)); step {
+		case WelcomeMOTD, WelcomeOfflineMsgs, WelcomeMentions, WelcomeHistory:
+			steps = append(steps, step)
+		default:
+			return nil, fmt.Errorf("unknown welcome step %q", name)
+		}
+	}
+	return steps, nil
+}
+
+// welcome is the lines name gets upon logging in, the steps' in order. It's
+// called with activeUsersLock held, before they're added to activeUsers, so
+// the session writes them ahead of anything sent to the user, see
+// ClientHandler.welcome. Those who are told they joined, see PresenceEvent,
+// are told once the user is there to get their replies.
+func (hub *Hub) welcome(name Username) []string {
+	steps := hub.options.Welcome
+	if steps == nil {
+		steps = DefaultWelcome
+	}
+	var lines []string
+	for _, step := range steps {
+		switch step {
+		case WelcomeMOTD:
+			if motd := strings.TrimRight(hub.options.MOTD, "\n"); motd != "" {
+				for _, line := range strings.Split(motd, "\n") {
+					lines = append(lines, MsgPrefix+line)
+				}
+			}
+		case WelcomeOfflineMsgs:
+			for _, dm := range hub.offlineMsgs.take(name) {
+				lines = append(lines, dm.Serialize())
+			}
+		case WelcomeMentions:
+			for _, notice := range hub.offlineMentions.take(name) {
+				lines = append(lines, MsgPrefix+notice)
+			}
+		case WelcomeHistory:
+			for _, entry := range hub.History(WelcomeHistoryLen) {
+				lines = append(lines, MsgPrefix+HistoryNoticePrefix+entry.String())
+			}
+		}
+	}
+	return lines
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	. "util"
+)
+
+func TestWelcomeOrder(t *testing.T) {
+	hub := NewHubWithOptions(ServerOptions{MOTD: "Welcome!\nBe nice\n",
+		Welcome: []WelcomeStep{WelcomeMOTD, WelcomeMentions, WelcomeOfflineMsgs, WelcomeHistory}})
+	now := func() time.Time { return time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC) }
+	hub.offlineMsgs.now, hub.offlineMentions.now, hub.history.now = now, now, now
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	alice.expect(MsgPrefix + "Welcome!")
+	alice.expect(MsgPrefix + "Be nice")
+	dave := connectToHub(hub, t)
+	dave.register("dave")
+	dave.expect(MsgPrefix + "Welcome!")
+	dave.expect(MsgPrefix + "Be nice")
+	dave.conn.Close()
+	waitForLogout(t, hub, "dave")
+
+	alice.send(MsgPrefix + "1;@dave can you check the deploy")
+	alice.expect("r1;" + string(ResponseOk))
+	alice.send(MsgPrefix + "2;/msg dave it's down")
+	alice.expect("r2;" + string(ResponseQueuedForOffline))
+
+	dave = connectToHub(hub, t)
+	dave.login("dave")
+	dave.expect(MsgPrefix + "Welcome!")
+	dave.expect(MsgPrefix + "Be nice")
+	dave.expect(MsgPrefix + "You were mentioned 1 time while away")
+	dave.expect(MsgPrefix + "2020-01-01T12:00:00Z alice: @dave can you check the deploy")
+	dave.expect(MsgPrefix + "(DM 2020-01-01T12:00:00Z) alice: it's down")
+	dave.expect(MsgPrefix + "History: 2020-01-01T12:00:00Z #1 alice: @dave can you check the deploy")
+	// then the live messages, once the welcome is over
+	alice.send(MsgPrefix + "3;on it")
+	dave.expect(MsgPrefix + "alice: on it")
+	alice.expect("r3;" + string(ResponseOk))
+}
+
+// TestWelcomeNotInterleaved logs dave in while alice keeps broadcasting, and
+// checks the welcome goes out in one piece before her messages
+func TestWelcomeNotInterleaved(t *testing.T) {
+	var motd []string
+	for i := 0; i < 50; i++ {
+		motd = append(motd, "motd "+strconv.Itoa(i))
+	}
+	hub := NewHubWithOptions(ServerOptions{MOTD: strings.Join(motd, "\n"),
+		Welcome: []WelcomeStep{WelcomeMOTD}})
+	alice := connectToHub(hub, t)
+	alice.register("alice")
+	for _, line := range motd {
+		alice.expect(MsgPrefix + line)
+	}
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			hub.BroadcastMessage("flood", "alice", time.Time{}, context.Background())
+		}
+	}()
+	dave := connectToHub(hub, t)
+	dave.register("dave")
+	for _, line := range motd {
+		dave.expect(MsgPrefix + line)
+	}
+	dave.expect(MsgPrefix + "alice: flood")
+	close(stop)
+	dave.conn.Close()
+	<-stopped
+}
+
+func TestParseWelcome(t *testing.T) {
+	steps, err := ParseWelcome("history, motd")
+	if err != nil || len(steps) != 2 || steps[0] != WelcomeHistory || steps[1] != WelcomeMOTD {
+		t.Fatalf("expected history then motd, got %v, %v", steps, err)
+	}
+	if steps, err := ParseWelcome("none"); err != nil || steps == nil || len(steps) != 0 {
+		t.Fatalf("expected no steps, rather than the default, got %v, %v", steps, err)
+	}
+	if _, err := ParseWelcome("motd,news"); err == nil {
+		t.Fatal("expected an unknown step to be refused")
+	}
+}
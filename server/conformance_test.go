@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"testsupport"
+	. "util"
+)
+
+func TestConformance(t *testing.T) {
+	sessions, err := testsupport.Sessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, framing := range []Framing{FramingV1, FramingV2} {
+		for _, session := range sessions {
+			if !session.RunsAgainst(testsupport.SideServer) {
+				continue
+			}
+			session := session.WithFraming(framing)
+			t.Run(framing.String()+"/"+session.Name, func(t *testing.T) {
+				serverSide, clientSide := net.Pipe()
+				defer clientSide.Close()
+				go NewHub().HandleNewConnection(serverSide)
+				if err := session.ReplayAgainstServer(clientSide); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
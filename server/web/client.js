@@ -0,0 +1,104 @@
+"use strict";
+// The web client speaks the chat protocol over a WebSocket, each message a
+// protocol line, see server/WebSocket.go
+
+const log = document.getElementById("log");
+const auth = document.getElementById("auth");
+const chat = document.getElementById("chat");
+const input = document.getElementById("input");
+
+const authResponseID = "auth";
+let socket = null;
+let lastID = 0;
+
+// show adds a line to the log, as text and never as markup
+function show(text, kind) {
+	const line = document.createElement("div");
+	line.className = kind;
+	line.textContent = text;
+	log.append(line);
+	line.scrollIntoView();
+}
+
+function connect() {
+	const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+	socket = new WebSocket(scheme + "//" + location.host + "/ws");
+	socket.onopen = () => {
+		socket.send("cpresence");
+		auth.hidden = false;
+	};
+	socket.onmessage = (event) => receive(event.data);
+	socket.onclose = () => {
+		show("Disconnected", "error");
+		auth.hidden = true;
+		chat.hidden = true;
+	};
+}
+
+// receive handles a line from the server
+function receive(line) {
+	const rest = line.slice(1);
+	switch (line[0]) {
+	case "m":
+		show(rest, "msg");
+		break;
+	case "p":
+		show("* " + rest.slice(1) + (rest[0] === "+" ? " joined" : " left"), "event");
+		break;
+	case "r": {
+		const separator = rest.indexOf(";");
+		const id = rest.slice(0, separator);
+		const response = rest.slice(separator + 1);
+		if (id === authResponseID) {
+			loggedIn(response);
+		} else if (response !== "Ok") {
+			show(response, "error");
+		}
+		break;
+	}
+	case "e":
+		show("Refused: " + rest, "error");
+		break;
+	case "x":
+		show("The server is going away, reload to reconnect", "error");
+		break;
+	}
+}
+
+function loggedIn(response) {
+	if (response !== "Ok") {
+		show(response, "error");
+		auth.hidden = false;
+		return;
+	}
+	show("Logged in as " + document.getElementById("name").value, "response");
+	auth.hidden = true;
+	chat.hidden = false;
+	input.focus();
+}
+
+auth.addEventListener("submit", (event) => {
+	event.preventDefault();
+	const password = document.getElementById("password");
+	socket.send(event.submitter.value);
+	socket.send(document.getElementById("name").value);
+	socket.send(password.value);
+	password.value = "";
+	auth.hidden = true;
+});
+
+chat.addEventListener("submit", (event) => {
+	event.preventDefault();
+	if (input.value === "") {
+		return;
+	}
+	lastID++;
+	socket.send("m" + lastID + ";" + input.value);
+	if (!input.value.startsWith("/")) {
+		show(input.value, "mine");
+	}
+	input.value = "";
+});
+
+auth.hidden = true;
+connect();
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"server"
+	"strings"
+	"testing"
+	"time"
+	. "util"
+)
+
+// TestShed has the server shed the idle one of two clients, and checks it
+// reconnects once the delay it was given is over, while the other stays
+func TestShed(t *testing.T) {
+	usersPath := filepath.Join(t.TempDir(), "users.json")
+	err := os.WriteFile(usersPath, []byte(`{"alice": {"password": "1234", "admin": true}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := server.NewHubWithOptions(server.ServerOptions{UserDBPath: usersPath,
+		ShedSpread: 300 * time.Millisecond})
+	if err := hub.LoadUserDB(); err != nil {
+		t.Fatal(err)
+	}
+	addr := listenOnLoopback(hub, t)
+	bobTypes, bobSees := startClient(t, addr, "bob")
+	carolTypes, carolSees := startClient(t, addr, "carol")
+	typeLines(t, carolTypes, "busy")
+	waitForLine(t, bobSees, "carol: busy")
+
+	start := time.Now()
+	shed, r := hub.Shed("alice", 50, "")
+	if r != ResponseOk || len(shed) != 1 || shed[0] != "bob" {
+		t.Fatalf("expected bob to be shed, got %v, %q", shed, r)
+	}
+	// what bob sends as he's told to go is delivered, before or after
+	typeLines(t, bobTypes, "bye")
+	var delay time.Duration
+	for told := false; !told; {
+		select {
+		case line := <-bobSees:
+			if line.Err != nil {
+				t.Fatal(line.Err)
+			}
+			const notice = "Server is shedding load, reconnecting in "
+			if i := strings.Index(line.Val, notice); i >= 0 {
+				told = true
+				if delay, err = time.ParseDuration(line.Val[i+len(notice):]); err != nil {
+					t.Fatal(err)
+				}
+			}
+		case <-time.After(lineTimeout):
+			t.Fatal("bob wasn't told to reconnect")
+		}
+	}
+	waitForLine(t, bobSees, "Type r to register, l to login")
+	if waited := time.Since(start); waited < delay {
+		t.Fatalf("expected bob to wait %s before reconnecting, he waited %s", delay, waited)
+	}
+	typeLines(t, bobTypes, "l", "bob", "1234")
+	waitForLine(t, bobSees, "Logged in as bob")
+	waitForLine(t, carolSees, "bob: bye")
+	typeLines(t, carolTypes, "welcome back")
+	waitForLine(t, bobSees, "carol: welcome back")
+	for _, end := range hub.EndedSessions() {
+		if end.User == "carol" {
+			t.Fatalf("expected carol to stay, her session ended: %+v", end)
+		}
+	}
+}
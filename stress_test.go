@@ -1,159 +1,76 @@
 package main
 
 import (
-	"bufio"
-	"client"
 	"fmt"
 	"io"
 	"server"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 	. "util"
 )
 
-func TestStress(t *testing.T) {
-	port := ":7000"
-	go server.RunServer(port)
-	time.Sleep(time.Millisecond * 100)
-	client1 := NewClientRun(port)
-	defer client1.Close()
-	// client1.peek(t)
-	client2 := NewClientRun(port)
-	defer client2.Close()
-	client1.RegisterWait(&UserCredentials{Name: "yoav", Password: "1234"}, t)
-	client2.RegisterWait(&UserCredentials{Name: "bob", Password: "0987"}, t)
-
-	// nMessages := 2 << 14
-	// go spamMessages(client1.input, nMessages, t)
-	// msgs := receiveMessages(client2.output, nMessages, t)
-	// if msgs[len(msgs)-1] != client1.user.name+": Hello!" {
-	// 	t.Error("IDK")
-	// }
-}
-
-type ClientRoutineController struct {
-	user   *UserCredentials
-	input  *io.PipeWriter
-	output *io.PipeReader
-}
-
-func NewClientRun(port string) (c ClientRoutineController) {
-	stdin, clientIn := io.Pipe()
-	c.input = clientIn
-	clientOut, stdout := io.Pipe()
-	c.output = clientOut
-	go client.RunClient(port, stdin, stdout)
-	return c
-}
-func (client *ClientRoutineController) peek(t *testing.T) {
-	originalIn := client.input
-	newStdin, newInInterface := io.Pipe()
-	client.input = newInInterface
-
-	go func() {
-		s := bufio.NewScanner(newStdin)
-		i, err := ScanLine(s)
-		for err != nil {
-			t.Logf("%s received: %s", client.user, i)
-			originalIn.Write([]byte(i))
-			i, err = ScanLine(s)
-		}
-	}()
+// stressMsgs is how many messages TestStress sends, and stressBudget how long
+// they may take to arrive, which makes the test a performance regression
+// gate too
+const (
+	stressMsgs   = 1 << 14
+	stressBudget = 30 * time.Second
+)
 
-	originalOut := client.output
-	newOutInterface, newStdout := io.Pipe()
-	client.output = newOutInterface
+// TestStress has a client send stressMsgs messages as fast as they're typed,
+// and checks another client gets each of them once, in order. The messages
+// are numbered, since the lines the clients print about the session can come
+// between them.
+func TestStress(t *testing.T) {
+	addr := listenOnLoopback(server.NewHub(), t)
+	spammer, spammerOutput := startClient(t, addr, "yoav")
+	_, output := startClient(t, addr, "bob")
+	// nothing the spammer prints matters, but it mustn't block on it
+	go drainLines(spammerOutput)
 
-	go func() {
-		s := bufio.NewScanner(originalOut)
-		i, err := ScanLine(s)
-		for err != nil {
-			t.Logf("%s printed: %s", client.user, i)
-			newStdout.Write([]byte(i))
-			i, err = ScanLine(s)
+	start := time.Now()
+	go spamMessages(t, spammer, stressMsgs)
+	deadline := time.After(stressBudget)
+	const prefix = "yoav: #"
+	for next := 0; next < stressMsgs; {
+		select {
+		case line := <-output:
+			if line.Err != nil {
+				t.Fatalf("got %d of %d messages: %s", next, stressMsgs, line.Err)
+			}
+			i := strings.Index(line.Val, prefix)
+			if i < 0 {
+				continue
+			}
+			seq, err := strconv.Atoi(line.Val[i+len(prefix):])
+			if err != nil || seq != next {
+				t.Fatalf("expected message #%d, got %q", next, line.Val)
+			}
+			next++
+		case <-deadline:
+			t.Fatalf("got %d of %d messages in %s", next, stressMsgs, stressBudget)
 		}
-	}()
-}
-
-func (client *ClientRoutineController) Close() {
-	ClosePrintErr(client.output)
-	ClosePrintErr(client.input)
-}
-func (client *ClientRoutineController) RegisterWait(user *UserCredentials, t *testing.T) {
-	client.user = user
-	clientOut := bufio.NewScanner(client.output)
-	fmt.Println("skipping line")
-	if err := skipLine(clientOut); err != nil { // Connected as ...
-		t.Error(err)
-	}
-	expect(clientOut, "Type r to register, l to login", t)
-	_, err := client.input.Write([]byte("r\n"))
-	if err != nil {
-		t.Error(err)
-	}
-	expect(clientOut, "Username:", t)
-	_, err = client.input.Write([]byte(client.user.Name + "\n"))
-	if err != nil {
-		t.Error(err)
-	}
-	expect(clientOut, "Password:", t)
-	_, err = client.input.Write([]byte(client.user.Password + "\n"))
-	if err != nil {
-		t.Error(err)
 	}
-	expect(clientOut, "Logged in as "+string(client.user.Name), t)
-	expect(clientOut, "", t)
+	t.Logf("%d messages took %s", stressMsgs, time.Since(start))
 }
 
-func spamMessages(clientIn io.Writer, n int, t *testing.T) {
-	for i := 0; i <= n; i++ {
-		_, err := clientIn.Write([]byte("Hello!\n"))
-		if err != nil {
-			t.Error(err)
-		}
-		step := 1
-		if i/n == (step*n)/10 {
-			fmt.Printf("Sent %d%% of the messages\n", step)
-			step++
-		}
-	}
-}
-func receiveMessages(clientOut io.Reader, n int, t *testing.T) []string {
-	scanner := bufio.NewScanner(clientOut)
-	res := make([]string, n)
+// spamMessages types n numbered messages into a client
+func spamMessages(t *testing.T, userInput io.Writer, n int) {
 	for i := 0; i < n; i++ {
-		temp, err := ScanLine(scanner)
-		res[i] = temp
-		if err != nil {
-			t.Error(err)
+		if _, err := fmt.Fprintf(userInput, "#%d\n", i); err != nil {
+			t.Errorf("typing message #%d: %s", i, err)
+			return
 		}
 	}
-	return res
-}
-func skipLine(s *bufio.Scanner) error {
-	_, err := ScanLine(s)
-	return err
 }
-func expect(clientOut *bufio.Scanner, expected string, t *testing.T) {
-	s, err := ScanLine(clientOut)
-	if err != nil {
-		t.Error("expect ", err)
-	}
-	if s != expected {
-		t.Error(ErrOddOutput, s)
-	}
 
-}
-func tookTooLong(fn func(), timeout time.Duration) bool {
-	end := make(chan struct{})
-	go func() {
-		fn()
-		end <- struct{}{}
-	}()
-	select {
-	case <-end:
-		return false
-	case <-time.After(timeout):
-		return true
+// drainLines reads lines until they fail
+func drainLines(lines <-chan ReadInput) {
+	for line := range lines {
+		if line.Err != nil {
+			return
+		}
 	}
 }
@@ -0,0 +1,242 @@
+package testsupport
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Faults are how a FaultyConn's writes misbehave, none by default
+type Faults struct {
+	// Latency is how long after it's written the peer can read a write
+	Latency time.Duration
+	// BytesPerSecond caps how fast writes go out, 0 meaning no cap
+	BytesPerSecond int
+	// DropAfter, when set, drops the conn once this many bytes were written
+	// since the faults were set, cutting the write that crosses it. The peer
+	// reads what made it and then EOF, and writing fails once the cut went out.
+	DropAfter int
+	// DropChance is the chance the conn drops once DropAfter bytes were
+	// written, certain when 0
+	DropChance float64
+	// MaxWriteSize splits writes into separate ones of at most this many
+	// bytes, so the peer reads lines in pieces
+	MaxWriteSize int
+	// Rand decides the drops, math/rand's top level functions when nil
+	Rand *rand.Rand
+}
+
+// FaultyConn is a conn whose writes misbehave as its Faults say, to bring
+// about the bugs that only happen over a bad network. Reads go straight
+// through, so wrapping both ends of a connection makes both directions faulty.
+//
+// Like a socket's, writes only queue what's written, which goes out later, in
+// order, and a write fails for one that failed before it. There's no limit to
+// the queue and so no write deadline, for a peer that stops reading.
+type FaultyConn struct {
+	net.Conn
+
+	lock sync.Mutex
+	// changed is signaled whenever what follows does
+	changed *sync.Cond
+	faults  Faults
+	queue   []delivery
+	// written counts the bytes since faults were set, for DropAfter
+	written int
+	paused  bool
+	closing bool
+	// err fails the writes after a delivery failed or the conn dropped
+	err     error
+	dropped bool
+	// pumped is closed once the queue's no longer delivered
+	pumped    chan struct{}
+	closeOnce sync.Once
+}
+
+// delivery is a write, which the peer can read once it's due, faulty as the
+// conn was when it was written
+type delivery struct {
+	data   []byte
+	due    time.Time
+	faults Faults
+	// dropAt is where in data the conn drops, -1 if it doesn't
+	dropAt int
+}
+
+// closeFlushTimeout bounds how long Close waits for the queue to go out
+const closeFlushTimeout = time.Second
+
+func NewFaultyConn(conn net.Conn, faults Faults) *FaultyConn {
+	c := &FaultyConn{Conn: conn, faults: faults, pumped: make(chan struct{})}
+	c.changed = sync.NewCond(&c.lock)
+	go c.pump()
+	return c
+}
+
+// SetFaults replaces the conn's faults for the writes still to come, e.g to
+// drop it only once a test got to the part it's about
+func (c *FaultyConn) SetFaults(faults Faults) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.faults = faults
+	c.written = 0
+}
+
+// Pause holds up what's written until Resume, like a stalled network. What's
+// already going out finishes its current piece, see MaxWriteSize.
+func (c *FaultyConn) Pause() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.paused = true
+}
+
+func (c *FaultyConn) Resume() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.paused = false
+	c.changed.Broadcast()
+}
+
+// Close lets what was written go out first, unless the conn is paused, or the
+// peer doesn't read it within closeFlushTimeout
+func (c *FaultyConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		c.closing = true
+		c.changed.Broadcast()
+		c.lock.Unlock()
+		c.Conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+		<-c.pumped
+	})
+	c.lock.Lock()
+	dropped := c.dropped
+	c.lock.Unlock()
+	if dropped {
+		// it's closed already, which isn't the closer's error
+		return nil
+	}
+	return c.Conn.Close()
+}
+
+func (c *FaultyConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	} else if c.closing {
+		return 0, net.ErrClosed
+	}
+	c.queue = append(c.queue, delivery{append([]byte(nil), p...),
+		time.Now().Add(c.faults.Latency), c.faults, c.dropAt(len(p))})
+	c.changed.Broadcast()
+	return len(p), nil
+}
+
+// SetWriteDeadline does nothing, since writes don't wait
+func (c *FaultyConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *FaultyConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(t)
+}
+
+// pump delivers the queue, until the conn's closed or fails
+func (c *FaultyConn) pump() {
+	defer close(c.pumped)
+	for {
+		next, ok := c.next()
+		if !ok {
+			return
+		}
+		time.Sleep(time.Until(next.due))
+		if err := c.deliver(next); err != nil {
+			c.lock.Lock()
+			if c.err == nil {
+				c.err = err
+			}
+			c.queue = nil
+			c.lock.Unlock()
+			return
+		}
+	}
+}
+
+// next waits for the next delivery. There's none once the conn's closing and
+// has no more to deliver, or is paused.
+func (c *FaultyConn) next() (delivery, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for !c.closing && (len(c.queue) == 0 || c.paused) {
+		c.changed.Wait()
+	}
+	if len(c.queue) == 0 || c.paused {
+		return delivery{}, false
+	}
+	next := c.queue[0]
+	c.queue = c.queue[1:]
+	return next, true
+}
+
+// deliver writes d to the peer, in as many pieces as MaxWriteSize says
+func (c *FaultyConn) deliver(d delivery) error {
+	data := d.data
+	if d.dropAt >= 0 {
+		data = data[:d.dropAt]
+	}
+	for len(data) != 0 {
+		c.lock.Lock()
+		for c.paused && !c.closing {
+			c.changed.Wait()
+		}
+		paused := c.paused
+		c.lock.Unlock()
+		if paused {
+			return net.ErrClosed
+		}
+		piece := data
+		if d.faults.MaxWriteSize != 0 && d.faults.MaxWriteSize < len(piece) {
+			piece = piece[:d.faults.MaxWriteSize]
+		}
+		data = data[len(piece):]
+		if d.faults.BytesPerSecond != 0 {
+			time.Sleep(time.Duration(len(piece)) * time.Second /
+				time.Duration(d.faults.BytesPerSecond))
+		}
+		if _, err := c.Conn.Write(piece); err != nil {
+			return err
+		}
+	}
+	if d.dropAt >= 0 {
+		// the peer reads EOF, and we fail from now on
+		c.lock.Lock()
+		c.err = net.ErrClosed
+		c.dropped = true
+		c.lock.Unlock()
+		c.Conn.Close()
+		return net.ErrClosed
+	}
+	return nil
+}
+
+// dropAt counts n more bytes written, and returns where in them the conn
+// drops, or -1 if it doesn't. The lock must be held.
+func (c *FaultyConn) dropAt(n int) int {
+	before := c.written
+	c.written += n
+	if c.faults.DropAfter == 0 || before >= c.faults.DropAfter ||
+		c.written < c.faults.DropAfter {
+		return -1
+	}
+	if chance := c.faults.DropChance; chance != 0 {
+		roll := rand.Float64
+		if c.faults.Rand != nil {
+			roll = c.faults.Rand.Float64
+		}
+		if roll() >= chance {
+			return -1
+		}
+	}
+	return c.faults.DropAfter - before
+}
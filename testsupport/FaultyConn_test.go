@@ -0,0 +1,164 @@
+package testsupport
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeWithFaults returns a faulty conn and its peer, which reads everything it's
+// sent into the returned channel, one read at a time, closing it on EOF
+func pipeWithFaults(t *testing.T, faults Faults) (*FaultyConn, <-chan []byte) {
+	t.Helper()
+	conn, peer := net.Pipe()
+	faulty := NewFaultyConn(conn, faults)
+	t.Cleanup(func() {
+		faulty.Close()
+		peer.Close()
+	})
+	reads := make(chan []byte, 1024)
+	go func() {
+		defer close(reads)
+		for {
+			buf := make([]byte, 1024)
+			n, err := peer.Read(buf)
+			if n != 0 {
+				reads <- buf[:n]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return faulty, reads
+}
+
+// readAll reads until the peer's done or, failing that, for a second
+func readAll(reads <-chan []byte) (all []byte, pieces int, closed bool) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case read, ok := <-reads:
+			if !ok {
+				return all, pieces, true
+			}
+			all = append(all, read...)
+			pieces++
+		case <-timeout:
+			return all, pieces, false
+		}
+	}
+}
+
+// TestFaultyConnLatency checks writes don't wait for the latency, and that
+// the peer reads each of them that late, not one latency after the other
+func TestFaultyConnLatency(t *testing.T) {
+	conn, reads := pipeWithFaults(t, Faults{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	conn.Write([]byte("one\n"))
+	conn.Write([]byte("two\n"))
+	if took := time.Since(start); took >= 50*time.Millisecond {
+		t.Fatalf("expected the writes not to wait, they took %s", took)
+	}
+	for _, expected := range []string{"one\n", "two\n"} {
+		if read := <-reads; string(read) != expected {
+			t.Fatalf("expected %q, got %q", expected, read)
+		}
+	}
+	if took := time.Since(start); took < 50*time.Millisecond || took >= 100*time.Millisecond {
+		t.Fatalf("expected the lines to take 50ms, they took %s", took)
+	}
+}
+
+func TestFaultyConnBandwidth(t *testing.T) {
+	conn, reads := pipeWithFaults(t, Faults{BytesPerSecond: 1000, MaxWriteSize: 10})
+	start := time.Now()
+	conn.Write(bytes.Repeat([]byte("x"), 100))
+	read := 0
+	for read < 100 {
+		read += len(<-reads)
+	}
+	if took := time.Since(start); took < 100*time.Millisecond {
+		t.Fatalf("expected 100 bytes at 1000 bytes/s to take 100ms, they took %s", took)
+	}
+}
+
+func TestFaultyConnSplitsWrites(t *testing.T) {
+	conn, reads := pipeWithFaults(t, Faults{MaxWriteSize: 1})
+	conn.Write([]byte("héllo\n"))
+	// what's written still goes out
+	go conn.Close()
+	all, pieces, closed := readAll(reads)
+	if !closed || string(all) != "héllo\n" || pieces != len(all) {
+		t.Fatalf("expected the line a byte at a time, got %q in %d reads", all, pieces)
+	}
+}
+
+func TestFaultyConnDrops(t *testing.T) {
+	conn, reads := pipeWithFaults(t, Faults{})
+	conn.Write([]byte("before\n"))
+	conn.SetFaults(Faults{DropAfter: 9, MaxWriteSize: 4})
+	if n, err := conn.Write([]byte("hello world\n")); n != 12 || err != nil {
+		t.Fatalf("expected the write to look whole, got %d, %v", n, err)
+	}
+	all, _, closed := readAll(reads)
+	if !closed || string(all) != "before\nhello wor" {
+		t.Fatalf("expected the line cut 9 bytes in, then EOF, got %q, closed %t", all, closed)
+	}
+	if _, err := conn.Write([]byte("after\n")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected writes to fail after the drop, got %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("expected closing the dropped conn to be fine, got %v", err)
+	}
+}
+
+func TestFaultyConnDropChance(t *testing.T) {
+	// the seed's first roll is over a half, and its second is under it
+	seeded := rand.New(rand.NewSource(7))
+	rolls := []float64{seeded.Float64(), seeded.Float64()}
+	if rolls[0] < 0.5 || rolls[1] >= 0.5 {
+		t.Fatalf("the seed's rolls changed: %v", rolls)
+	}
+	faults := Faults{DropAfter: 3, DropChance: 0.5, Rand: rand.New(rand.NewSource(7))}
+	conn, reads := pipeWithFaults(t, faults)
+	conn.Write([]byte("one\n"))
+	if read := <-reads; string(read) != "one\n" {
+		t.Fatalf("expected the first line whole, got %q", read)
+	}
+	conn.SetFaults(faults)
+	conn.Write([]byte("two\n"))
+	all, _, closed := readAll(reads)
+	if !closed || string(all) != "two" {
+		t.Fatalf("expected the second line to be cut, got %q, closed %t", all, closed)
+	}
+}
+
+func TestFaultyConnPause(t *testing.T) {
+	conn, reads := pipeWithFaults(t, Faults{})
+	conn.Pause()
+	conn.Write([]byte("hi\n"))
+	select {
+	case read := <-reads:
+		t.Fatalf("expected nothing while paused, got %q", read)
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.Resume()
+	if read := <-reads; string(read) != "hi\n" {
+		t.Fatalf("expected the line once resumed, got %q", read)
+	}
+
+	// closing a paused conn loses what's on its way
+	conn.Pause()
+	conn.Write([]byte("bye\n"))
+	conn.Close()
+	if all, _, closed := readAll(reads); !closed || len(all) != 0 {
+		t.Fatalf("expected nothing but EOF, got %q, closed %t", all, closed)
+	}
+	if _, err := conn.Write([]byte("more\n")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected writes to fail once closed, got %v", err)
+	}
+}
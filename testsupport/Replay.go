@@ -0,0 +1,358 @@
+// Package testsupport holds helpers shared by the client's and the server's
+// tests
+package testsupport
+
+import (
+	"bufio"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	. "util"
+)
+
+// StepKind tells where a session step's line goes, or comes from
+type StepKind string
+
+const (
+	FromClient StepKind = "C" // a protocol line the client sends
+	FromServer StepKind = "S" // a protocol line the server sends
+	UserTypes  StepKind = "U" // a line the user types into the client
+	UserSees   StepKind = "O" // a line the client outputs to the user
+)
+
+// EOFLine as the line of a FromClient or FromServer step means that side closes
+// the connection
+const EOFLine = "<EOF>"
+
+type Step struct {
+	Kind StepKind
+	Line string
+	// lineNo is the step's line in its session file, for error messages
+	lineNo int
+}
+
+// Session is a recorded exchange between a client and a server, replayable
+// against either of them.
+//
+// Lines may contain placeholders for parts that legitimately vary: {*} matches
+// anything, and {name} matches anything the first time and binds it, e.g to
+// the id of a message, after which it stands for the bound value. A {name} in a
+// line the replayer sends is replaced by its bound value, or binds a fresh one.
+type Session struct {
+	Name string
+	// Only, when set, is the single side the session applies to
+	Only Side
+	// Outbox is what the client's outbox file holds before the session, i.e
+	// the messages a previous run of the client left unacked
+	Outbox []string
+	// OnLogin are the commands the client is configured to run after logging
+	// in, see client.ClientOptions
+	OnLogin []string
+	// AuthAction is what the client is configured to answer the register or
+	// login prompt with, see client.ClientOptions
+	AuthAction AuthAction
+	Steps      []Step
+}
+
+type Side string
+
+const (
+	SideClient Side = "client"
+	SideServer Side = "server"
+)
+
+//go:embed sessions/*.session
+var sessionFiles embed.FS
+
+// Sessions returns the golden sessions in the sessions dir. Adding a case to the
+// conformance tests only takes adding a file there.
+func Sessions() ([]*Session, error) {
+	names, err := fs.Glob(sessionFiles, "sessions/*.session")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	sessions := make([]*Session, 0, len(names))
+	for _, name := range names {
+		f, err := sessionFiles.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		session, err := ParseSession(strings.TrimSuffix(path.Base(name), ".session"), f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// ParseSession reads a session file. Each line is a step of the form "C: line",
+// with the kinds of StepKind. Empty lines and lines starting with '#' are
+// skipped, and an "only: client" or "only: server" line restricts the session
+// to that side. Each "outbox: line" line adds a line to Session.Outbox, each
+// "onlogin: line" line one to Session.OnLogin, and an "authaction: l" line
+// sets Session.AuthAction.
+func ParseSession(name string, r io.Reader) (*Session, error) {
+	session := &Session{Name: name}
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: missing ':'", name, lineNo)
+		}
+		value = strings.TrimPrefix(value, " ")
+		switch kind := StepKind(key); kind {
+		case FromClient, FromServer, UserTypes, UserSees:
+			session.Steps = append(session.Steps, Step{kind, value, lineNo})
+		case "outbox":
+			session.Outbox = append(session.Outbox, value)
+		case "onlogin":
+			session.OnLogin = append(session.OnLogin, value)
+		case "authaction":
+			session.AuthAction = AuthAction(value)
+			if session.AuthAction != ActionLogin && session.AuthAction != ActionRegister {
+				return nil, fmt.Errorf("%s:%d: unknown auth action %q", name, lineNo, value)
+			}
+		case "only":
+			session.Only = Side(value)
+			if session.Only != SideClient && session.Only != SideServer {
+				return nil, fmt.Errorf("%s:%d: unknown side %q", name, lineNo, value)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown step kind %q", name, lineNo, key)
+		}
+	}
+	return session, scanner.Err()
+}
+
+func (session *Session) RunsAgainst(side Side) bool {
+	return session.Only == "" || session.Only == side
+}
+
+// WithFraming is the session as it goes in framing f, so each session checks
+// both framings. Its client asks for f, prefixing a capabilities line if it
+// had none, and the messages, responses and commands it has go in f, but not
+// the credentials, which aren't framed.
+func (session *Session) WithFraming(f Framing) *Session {
+	if f == FramingV1 {
+		return session
+	}
+	framed := *session
+	framed.Steps = nil
+	// sentCaps is whether the client sent its capabilities line yet
+	sentCaps := false
+	// credentials is how many of the client's next lines are credentials
+	credentials := 0
+	for _, step := range session.Steps {
+		if step.Kind == FromClient && !sentCaps && !isCapabilitiesStep(step) {
+			line := Capabilities{}.WithFraming(f).Serialize()
+			framed.Steps = append(framed.Steps, Step{FromClient, line, step.lineNo})
+		}
+		sentCaps = sentCaps || step.Kind == FromClient
+		switch {
+		case isCapabilitiesStep(step):
+			caps, _ := ParseCapabilities(step.Line)
+			step.Line = caps.WithFraming(f).Serialize()
+		case step.Kind == FromClient && credentials != 0:
+			credentials--
+		case step.Kind == FromClient && isAuthAction(step.Line):
+			credentials = 2
+		case step.Kind == FromClient || step.Kind == FromServer:
+			step.Line = f.Frame(step.Line)
+		}
+		framed.Steps = append(framed.Steps, step)
+	}
+	return &framed
+}
+
+func isCapabilitiesStep(step Step) bool {
+	_, ok := ParseCapabilities(step.Line)
+	return step.Kind == FromClient && ok
+}
+
+func isAuthAction(line string) bool {
+	return line == string(ActionRegister) || line == string(ActionLogin)
+}
+
+// ReplayTimeout is how long a replay waits for each expected line
+var ReplayTimeout = time.Second * 2
+
+// ReplayAgainstServer plays the client's part over server, the client's end
+// of a connection to the server, checking that the server answers as recorded
+func (session *Session) ReplayAgainstServer(server io.ReadWriteCloser) error {
+	r := newReplayer(session)
+	fromServer := readLinesAsync(server)
+	for _, step := range session.Steps {
+		var err error
+		switch step.Kind {
+		case FromClient:
+			err = r.send(server, step)
+		case FromServer:
+			err = r.expect(fromServer, step)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplayAgainstClient plays the server's part over client, the server's end of
+// a connection to the client, along with typing into the client's userInput and
+// reading its userOutput
+func (session *Session) ReplayAgainstClient(client io.ReadWriteCloser,
+	userInput io.Writer, userOutput io.Reader) error {
+	r := newReplayer(session)
+	fromClient := readLinesAsync(client)
+	shownToUser := readLinesAsync(userOutput)
+	for _, step := range session.Steps {
+		var err error
+		switch step.Kind {
+		case FromServer:
+			err = r.send(client, step)
+		case FromClient:
+			err = r.expect(fromClient, step)
+		case UserTypes:
+			err = r.send(userInput, step)
+		case UserSees:
+			err = r.expect(shownToUser, step)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type replayer struct {
+	session  *Session
+	bindings map[string]string
+	// lastFresh numbers the values bound by sent lines
+	lastFresh int
+}
+
+func newReplayer(session *Session) *replayer {
+	return &replayer{session: session, bindings: make(map[string]string)}
+}
+
+func (r *replayer) errorf(step Step, format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", r.session.Name, step.lineNo, fmt.Sprintf(format, args...))
+}
+
+var placeholder = regexp.MustCompile(`\{(\*|[A-Za-z0-9_]+)\}`)
+
+func (r *replayer) send(w io.Writer, step Step) error {
+	if step.Line == EOFLine {
+		if closer, ok := w.(io.Closer); ok {
+			return closer.Close()
+		}
+		return r.errorf(step, "can't close this side")
+	}
+	line := placeholder.ReplaceAllStringFunc(step.Line, func(match string) string {
+		name := match[1 : len(match)-1]
+		if name == "*" {
+			return ""
+		}
+		if value, ok := r.bindings[name]; ok {
+			return value
+		}
+		r.lastFresh++
+		r.bindings[name] = strconv.Itoa(r.lastFresh)
+		return r.bindings[name]
+	})
+	_, err := w.Write([]byte(line + "\n"))
+	if err != nil {
+		return r.errorf(step, "sending %q: %s", line, err)
+	}
+	return nil
+}
+
+func (r *replayer) expect(lines <-chan ReadInput, step Step) error {
+	var got ReadInput
+	select {
+	case got = <-lines:
+	case <-time.After(ReplayTimeout):
+		return r.errorf(step, "timed out expecting %q", step.Line)
+	}
+	if step.Line == EOFLine {
+		if got.Err == nil {
+			return r.errorf(step, "expected the connection to close, got %q", got.Val)
+		}
+		return nil
+	}
+	if got.Err != nil {
+		return r.errorf(step, "expected %q, got error %s", step.Line, got.Err)
+	}
+	if !r.match(step.Line, got.Val) {
+		return r.errorf(step, "expected %q, got %q", step.Line, got.Val)
+	}
+	return nil
+}
+
+// match reports whether line fits pattern, and if so binds the pattern's
+// unbound placeholders
+func (r *replayer) match(pattern, line string) bool {
+	var expr strings.Builder
+	var unbound []string
+	last := 0
+	for _, loc := range placeholder.FindAllStringSubmatchIndex(pattern, -1) {
+		expr.WriteString(regexp.QuoteMeta(pattern[last:loc[0]]))
+		name := pattern[loc[2]:loc[3]]
+		if value, ok := r.bindings[name]; ok {
+			expr.WriteString(regexp.QuoteMeta(value))
+		} else if name == "*" {
+			expr.WriteString(".*")
+		} else {
+			expr.WriteString("(.*?)")
+			unbound = append(unbound, name)
+		}
+		last = loc[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(pattern[last:]))
+
+	groups := regexp.MustCompile("^" + expr.String() + "$").FindStringSubmatch(line)
+	if groups == nil {
+		return false
+	}
+	newBindings := make(map[string]string)
+	for i, name := range unbound {
+		if value, ok := newBindings[name]; ok && value != groups[i+1] {
+			return false
+		}
+		newBindings[name] = groups[i+1]
+	}
+	for name, value := range newBindings {
+		r.bindings[name] = value
+	}
+	return true
+}
+
+// readLinesAsync is like ReadAsyncIntoChan, but buffers lines so the side
+// writing them doesn't block on the replay reaching them
+func readLinesAsync(r io.Reader) <-chan ReadInput {
+	lines := make(chan ReadInput, 1024)
+	scanner := bufio.NewScanner(r)
+	go func() {
+		for {
+			str, err := ScanLine(scanner)
+			lines <- ReadInput{Val: str, Err: err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return lines
+}
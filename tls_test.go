@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"client"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"server"
+	"strings"
+	"testing"
+	"testsupport"
+	"time"
+	. "util"
+)
+
+// TestTLSOnlyServer has a plaintext and a TLS client connect to a server that
+// requires TLS. The plaintext one is told why it's refused, and gives up.
+func TestTLSOnlyServer(t *testing.T) {
+	certPath, keyPath, pool, err := testsupport.WriteSelfSignedCert(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	s, err := server.BuildServer(listener.Addr().String(), server.ServerOptions{
+		TLSCertFile: certPath, TLSKeyFile: keyPath, RequireTLS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListeners(listener)
+	addr := listener.Addr().String()
+
+	done := make(chan error)
+	go func() {
+		done <- client.RunClientWithOptions(addr, strings.NewReader("l\nalice\n1234\n"),
+			io.Discard, client.ClientOptions{ReconnectDelay: time.Millisecond})
+	}()
+	select {
+	case err := <-done:
+		var refused *client.RefusedError
+		if !errors.As(err, &refused) || refused.Reason != ReasonTLSRequired {
+			t.Fatalf("expected the plaintext client to be refused, got %v", err)
+		}
+	case <-time.After(lineTimeout):
+		t.Fatal("the plaintext client didn't give up")
+	}
+
+	userInput, typed := io.Pipe()
+	shown, userOutput := io.Pipe()
+	defer typed.Close()
+	defer shown.Close()
+	go client.RunClientWithOptions(addr, userInput, userOutput,
+		client.ClientOptions{TLS: &tls.Config{RootCAs: pool}})
+	output := ReadAsyncIntoChan(bufio.NewScanner(shown))
+	typeLines(t, typed, "r", "alice", "1234", "1234")
+	waitForLine(t, output, "Logged in as alice")
+}
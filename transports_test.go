@@ -0,0 +1,154 @@
+package main
+
+import (
+	"client"
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"server"
+	"testing"
+	"testsupport"
+	"time"
+	. "util"
+)
+
+// transport is a way for clients to reach the server. listen binds the
+// server's side, and returns the options clients connect with.
+type transport struct {
+	name   string
+	listen func(t *testing.T) (net.Listener, client.ClientOptions)
+}
+
+var transports = []transport{
+	{"tcp", func(t *testing.T) (net.Listener, client.ClientOptions) {
+		listener, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return listener, client.ClientOptions{}
+	}},
+	{"tls", func(t *testing.T) (net.Listener, client.ClientOptions) {
+		certPath, keyPath, pool, err := testsupport.WriteSelfSignedCert(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, err := tls.Listen("tcp4", "127.0.0.1:0",
+			&tls.Config{Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return listener, client.ClientOptions{TLS: &tls.Config{RootCAs: pool}}
+	}},
+	{"unix", func(t *testing.T) (net.Listener, client.ClientOptions) {
+		listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "chat.sock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return listener, client.ClientOptions{Dialer: client.NetDialer{Network: "unix"}}
+	}},
+}
+
+// env is a hub served over a transport, for a scenario to drive
+type env struct {
+	t       *testing.T
+	hub     *server.Hub
+	addr    string
+	options client.ClientOptions
+}
+
+// user is a client logged in through env's transport
+type user struct {
+	typed  func(lines ...string)
+	output <-chan ReadInput
+}
+
+func (e *env) register(name string) user {
+	e.t.Helper()
+	typed, output := startClientWithOptions(e.t, e.addr, name, e.options)
+	return user{func(lines ...string) { typeLines(e.t, typed, lines...) }, output}
+}
+
+func (e *env) expect(u user, line string) {
+	e.t.Helper()
+	waitForLine(e.t, u.output, line)
+}
+
+// waitForLogout waits for the hub to be done with name's session, which may
+// still be ending when the client already reconnected
+func (e *env) waitForLogout(name string) {
+	e.t.Helper()
+	for start := time.Now(); time.Since(start) < lineTimeout; time.Sleep(time.Millisecond) {
+		online := false
+		for _, active := range e.hub.ActiveUsers() {
+			online = online || active == name
+		}
+		if !online {
+			return
+		}
+	}
+	e.t.Fatalf("%s is still logged in", name)
+}
+
+// scenarios run against every transport. Run them with -race.
+var scenarios = []struct {
+	name string
+	run  func(e *env)
+}{
+	{"login", func(e *env) {
+		alice := e.register("alice")
+		alice.typed("/quit", "l", "alice", "1234")
+		e.expect(alice, "Logged in as alice")
+	}},
+	{"broadcast", func(e *env) {
+		alice, bob, carol := e.register("alice"), e.register("bob"), e.register("carol")
+		alice.typed("hi all")
+		e.expect(bob, "alice: hi all")
+		e.expect(carol, "alice: hi all")
+	}},
+	{"dm", func(e *env) {
+		alice, bob := e.register("alice"), e.register("bob")
+		alice.typed("/msg bob psst")
+		e.expect(bob, "[dm] alice: psst")
+	}},
+	{"kick", func(e *env) {
+		alice := e.register("alice")
+		e.hub.Kick("alice", "the test", LogoutReason{Code: LogoutKicked, Text: "spamming"})
+		e.expect(alice, "Logged out by the server: kicked (spamming)")
+	}},
+	{"reconnect", func(e *env) {
+		alice := e.register("alice")
+		e.hub.Kick("alice", "the test", LogoutReason{Code: LogoutShutdown, RetryAfter: time.Millisecond})
+		e.expect(alice, "Reconnecting in 1ms")
+		e.waitForLogout("alice")
+		// typed before the prompt, it would be queued as messages
+		e.expect(alice, "Type r to register, l to login")
+		alice.typed("l", "alice", "1234")
+		e.expect(alice, "Logged in as alice")
+		bob := e.register("bob")
+		alice.typed("back")
+		e.expect(bob, "alice: back")
+	}},
+}
+
+// TestTransports runs each scenario against a fresh hub over each transport,
+// in each framing
+func TestTransports(t *testing.T) {
+	for _, framing := range []Framing{FramingV1, FramingV2} {
+		for _, transport := range transports {
+			for _, scenario := range scenarios {
+				name := framing.String() + "/" + transport.name + "/" + scenario.name
+				t.Run(name, func(t *testing.T) {
+					listener, options := transport.listen(t)
+					options.Framing = framing
+					hub := server.NewHub()
+					addr := serveOn(hub, listener, t)
+					scenario.run(&env{t, hub, addr, options})
+				})
+			}
+		}
+	}
+}
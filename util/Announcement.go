@@ -0,0 +1,19 @@
+package util
+
+import "strings"
+
+// AnnouncementTag starts a message from the server itself rather than a user,
+// e.g an admin's AnnounceCmd, which clients show prominently. Names can't have
+// brackets, so no user's message looks like one.
+const AnnouncementTag = "[server]"
+
+func SerializeAnnouncement(text string) string {
+	return MsgPrefix + AnnouncementTag + " " + text
+}
+
+func ParseAnnouncement(s string) (text string, ok bool) {
+	if !strings.HasPrefix(s, MsgPrefix+AnnouncementTag+" ") {
+		return "", false
+	}
+	return s[len(MsgPrefix+AnnouncementTag+" "):], true
+}
@@ -0,0 +1,82 @@
+package util
+
+import (
+	"sort"
+	"strings"
+)
+
+// Capability is an optional protocol feature. Clients advertise the ones they
+// support on a capabilities line, the first line they send on a connection,
+// and the server only uses those. A client that sends no such line is a
+// legacy client with none of them.
+type Capability string
+
+const (
+	// CapPresence is understanding PresenceEvent lines
+	CapPresence Capability = "presence"
+	// CapReconnect is understanding reconnect notices, see ReconnectPrefix
+	CapReconnect Capability = "reconnect"
+	// CapRoomNotices is understanding room notices, see RoomNoticePrefix
+	CapRoomNotices Capability = "roomnotices"
+	// CapQueue is waiting in line for a full server, see QueuePrefix
+	CapQueue Capability = "queue"
+)
+
+type Capabilities map[Capability]bool
+
+// ClientCapabilities are the ones this package's client supports
+func ClientCapabilities() Capabilities {
+	return Capabilities{CapPresence: true, CapReconnect: true,
+		CapRoomNotices: true, CapQueue: true}.WithFraming(DefaultFraming)
+}
+
+const CapabilitiesPrefix = "c"
+const capabilitySeparator = ","
+
+func (caps Capabilities) Supports(capability Capability) bool {
+	return caps[capability]
+}
+
+// sorted keeps the capabilities' order stable on the wire and in listings
+func (caps Capabilities) sorted() []string {
+	names := make([]string, 0, len(caps))
+	for capability := range caps {
+		names = append(names, string(capability))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (caps Capabilities) Serialize() string {
+	return CapabilitiesPrefix + strings.Join(caps.sorted(), capabilitySeparator)
+}
+
+func (caps Capabilities) String() string {
+	return strings.Join(caps.sorted(), " ")
+}
+
+// Common returns the capabilities both caps and other have
+func (caps Capabilities) Common(other Capabilities) Capabilities {
+	common := make(Capabilities)
+	for capability := range caps {
+		if other.Supports(capability) {
+			common[capability] = true
+		}
+	}
+	return common
+}
+
+// ParseCapabilities keeps capabilities it doesn't know, they're just never
+// asked about
+func ParseCapabilities(s string) (Capabilities, bool) {
+	if !strings.HasPrefix(s, CapabilitiesPrefix) {
+		return nil, false
+	}
+	caps := make(Capabilities)
+	for _, name := range strings.Split(s[len(CapabilitiesPrefix):], capabilitySeparator) {
+		if name != "" {
+			caps[Capability(name)] = true
+		}
+	}
+	return caps, true
+}
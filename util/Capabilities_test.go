@@ -0,0 +1,51 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCapabilitiesRoundTrip(t *testing.T) {
+	for _, caps := range []Capabilities{
+		ClientCapabilities(),
+		{CapPresence: true},
+		{},
+	} {
+		line := caps.Serialize()
+		parsed, ok := ParseCapabilities(line)
+		if !ok || !reflect.DeepEqual(parsed, caps) {
+			t.Errorf("%q: parsed %v, %v", line, parsed, ok)
+		}
+	}
+	if line := ClientCapabilities().Serialize(); line != "cpresence,queue,reconnect,roomnotices" {
+		t.Errorf("expected the capabilities sorted, got %q", line)
+	}
+}
+
+func TestParseUnknownCapabilities(t *testing.T) {
+	caps, ok := ParseCapabilities("cpresence,emoji")
+	if !ok {
+		t.Fatal("expected a capabilities line")
+	}
+	if !caps.Supports(CapPresence) || !caps.Supports("emoji") || caps.Supports(CapReconnect) {
+		t.Errorf("unexpected capabilities %v", caps)
+	}
+	if caps.String() != "emoji presence" {
+		t.Errorf("unknown capabilities should be kept, got %q", caps.String())
+	}
+}
+
+func TestParseBareCapabilitiesLine(t *testing.T) {
+	caps, ok := ParseCapabilities(CapabilitiesPrefix)
+	if !ok || len(caps) != 0 {
+		t.Errorf("expected no capabilities, got %v, %v", caps, ok)
+	}
+}
+
+func TestParseNonCapabilitiesLine(t *testing.T) {
+	for _, line := range []string{"r", "l", "", "mhi;there"} {
+		if _, ok := ParseCapabilities(line); ok {
+			t.Errorf("%q shouldn't parse as capabilities", line)
+		}
+	}
+}
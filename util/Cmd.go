@@ -16,6 +16,85 @@ func (cmd Cmd) Serialize() string {
 	return CmdPrefix + string(cmd)
 }
 
+// Split separates the command's name from its arguments, e.g "displayname Bob"
+// becomes ("displayname", "Bob")
+func (cmd Cmd) Split() (name Cmd, args string) {
+	nameStr, args, _ := strings.Cut(string(cmd), " ")
+	return Cmd(nameStr), args
+}
+
 const (
-	LogoutCmd Cmd = "quit"
+	LogoutCmd      Cmd = "quit"
+	DisplayNameCmd Cmd = "displayname"
+	WhoCmd         Cmd = "who"
+	SubscribeCmd   Cmd = "subscribe"
+	UnsubscribeCmd Cmd = "unsubscribe"
+	// PingCmd is answered right away, for measuring round trips
+	PingCmd Cmd = "ping"
+	// SessionsCmd lists the online users' byte counts, for diagnostics.
+	// "sessions ended" lists the last sessions to end and why, for admins
+	// only.
+	SessionsCmd Cmd = "sessions"
+	// PendingCmd lists the ids of our messages still being broadcast, and
+	// CancelCmd stops one of them
+	PendingCmd Cmd = "pending"
+	CancelCmd  Cmd = "cancel"
+	// HistoryCmd shows the room's last messages, "history N" only the last N
+	HistoryCmd Cmd = "history"
+	// DirectMsgCmd sends a message to one user, "msg NAME CONTENT". Users who
+	// are offline get it once they log in.
+	DirectMsgCmd Cmd = "msg"
+	// ReactCmd adds a reaction to a message in the history, "react ID EMOJI"
+	ReactCmd Cmd = "react"
+	// TimeCmd is answered with the server's time, see SerializeServerTime
+	TimeCmd Cmd = "time"
+	// SetCmd changes a server setting at runtime, "set SETTING VALUE", for
+	// admins only
+	SetCmd Cmd = "set"
+	// VersionCmd is answered with the server's version, the client's if it
+	// reported one, and the protocol capabilities the session uses, for
+	// debugging interop. "version clients" counts the connected clients by
+	// version instead, for admins only.
+	VersionCmd Cmd = "version"
+	// AdminsCmd sends a message to the online admins only, "admins CONTENT",
+	// for admins only
+	AdminsCmd Cmd = "admins"
+	// MOTDCmd is answered with the message of the day
+	MOTDCmd Cmd = "motd"
+	// TTLCmd sends a message that's dropped rather than delivered late,
+	// "ttl SECONDS CONTENT". CONTENT is a message or a DirectMsgCmd, and
+	// SECONDS may be a duration like "90s" instead.
+	TTLCmd Cmd = "ttl"
+	// AnnounceCmd has the server announce something to everyone online,
+	// "announce CONTENT", for admins only. The users it couldn't reach are
+	// listed before the response.
+	AnnounceCmd Cmd = "announce"
+	// ExportCmd sends us our own messages still in the room's history, up
+	// to the server's limit, as ExportedMsg lines before the response
+	ExportCmd Cmd = "export"
+	// BlockDMsCmd refuses the DMs sent to us for the rest of the session,
+	// with ResponseDMsBlocked, and AllowDMsCmd takes them again
+	BlockDMsCmd Cmd = "block-dms"
+	AllowDMsCmd Cmd = "allow-dms"
+	// BlockWordCmd has admins refuse messages with a word, or mask it, see
+	// the server's BlocklistPolicySetting. UnblockWordCmd allows it again.
+	BlockWordCmd   Cmd = "blockword"
+	UnblockWordCmd Cmd = "unblockword"
+	// VerifyCmd verifies our new account with the code we were sent, when the
+	// server requires it, see ResponseNotVerified
+	VerifyCmd Cmd = "verify"
+	// ShedCmd has admins shed load, "shed PERCENT%[ ADDR]": that share of
+	// the clients, the idlest first, are sent ReconnectCmd, to ADDR if given.
+	// The users shed are listed before the response.
+	ShedCmd Cmd = "shed"
+	// ReconnectCmd is sent by the server, for the client to reconnect after a
+	// while, see ReconnectOrder
+	ReconnectCmd Cmd = "reconnect"
 )
+
+// EndedSessionsArg is SessionsCmd's argument for the sessions that ended
+const EndedSessionsArg = "ended"
+
+// ClientVersionsArg is VersionCmd's argument for the connected clients'
+// versions
+const ClientVersionsArg = "clients"
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"strings"
+	"time"
+)
+
+// DirectMsg is a message to a single user. It goes out as a message line whose
+// content is marked, e.g "m(DM) alice: hi", so legacy clients show it as is.
+type DirectMsg struct {
+	// Sender is the sender's account name, which replies are addressed to
+	Sender  Username
+	Content string
+	// Sent is when a DM that waited for its recipient to log in was sent, and
+	// zero for a DM delivered right away
+	Sent time.Time
+	// Expires, when set, is when the DM is no longer worth delivering, see
+	// TTLCmd. It's the server's, and not sent.
+	Expires time.Time
+}
+
+const (
+	directMsgMarker = "(DM"
+	directMsgEnd    = ") "
+)
+
+func (dm DirectMsg) Serialize() string {
+	marker := directMsgMarker
+	if !dm.Sent.IsZero() {
+		marker += " " + dm.Sent.UTC().Format(time.RFC3339)
+	}
+	return MsgPrefix + marker + directMsgEnd + string(dm.Sender) + ": " + dm.Content
+}
+
+func ParseDirectMsg(s string) (DirectMsg, bool) {
+	if !strings.HasPrefix(s, MsgPrefix+directMsgMarker) {
+		return DirectMsg{}, false
+	}
+	marker, rest, ok := strings.Cut(s[len(MsgPrefix+directMsgMarker):], directMsgEnd)
+	if !ok {
+		return DirectMsg{}, false
+	}
+	var dm DirectMsg
+	if marker != "" {
+		var err error
+		dm.Sent, err = time.Parse(time.RFC3339, strings.TrimPrefix(marker, " "))
+		if err != nil || !strings.HasPrefix(marker, " ") {
+			return DirectMsg{}, false
+		}
+	}
+	sender, content, ok := strings.Cut(rest, ": ")
+	if !ok {
+		return DirectMsg{}, false
+	}
+	dm.Sender, dm.Content = Username(sender), content
+	return dm, true
+}
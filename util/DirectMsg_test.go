@@ -0,0 +1,25 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDirectMsgRoundTrip(t *testing.T) {
+	sent := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, dm := range []DirectMsg{
+		{Sender: "alice", Content: "hi"},
+		{Sender: "alice", Content: "hi: there", Sent: sent},
+	} {
+		parsed, ok := ParseDirectMsg(dm.Serialize())
+		if !ok || parsed != dm {
+			t.Errorf("%q parsed as %+v, %t", dm.Serialize(), parsed, ok)
+		}
+	}
+	for _, line := range []string{"malice: hi", "m(DM)alice: hi", "m(DM yesterday) alice: hi",
+		"m(DMX) alice: hi", "m(DM) alice"} {
+		if dm, ok := ParseDirectMsg(line); ok {
+			t.Errorf("%q parsed as %+v", line, dm)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package util
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// ExportNoticePrefix starts each ExportCmd line, which is followed by the
+// message as JSON
+const ExportNoticePrefix = "Export: "
+
+// ExportedMsg is one of the user's own messages, as ExportCmd sends it
+type ExportedMsg struct {
+	// ID is the message's in the room's history, as for ReactCmd
+	ID      uint64    `json:"id"`
+	Time    time.Time `json:"time"`
+	Content string    `json:"content"`
+}
+
+// Serialize is the notice's text, always on one line since JSON escapes
+// newlines
+func (m ExportedMsg) Serialize() string {
+	m.Time = m.Time.UTC()
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		panic(err) // it's only strings, numbers and a time
+	}
+	return ExportNoticePrefix + string(encoded)
+}
+
+func ParseExportedMsg(s string) (ExportedMsg, bool) {
+	if !strings.HasPrefix(s, ExportNoticePrefix) {
+		return ExportedMsg{}, false
+	}
+	var m ExportedMsg
+	if err := json.Unmarshal([]byte(s[len(ExportNoticePrefix):]), &m); err != nil {
+		return ExportedMsg{}, false
+	}
+	return m, true
+}
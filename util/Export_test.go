@@ -0,0 +1,19 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExportedMsgRoundTrip(t *testing.T) {
+	msg := ExportedMsg{ID: 7, Time: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+		Content: `quotes " and a: colon`}
+	if parsed, ok := ParseExportedMsg(msg.Serialize()); !ok || parsed != msg {
+		t.Errorf("%q parsed as %+v, %t", msg.Serialize(), parsed, ok)
+	}
+	for _, line := range []string{"History: x", "Export: ", "Export: {"} {
+		if msg, ok := ParseExportedMsg(line); ok {
+			t.Errorf("%q parsed as %+v", line, msg)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package util
+
+import "strings"
+
+// Framing is how a connection's message, response and command lines start.
+// FramingV1's single letters are easily mistaken for content, e.g the auth
+// action "register" would parse as a response, and are hard to pick out in
+// captured traffic. FramingV2 spells them out.
+//
+// A client that wants FramingV2 advertises CapFraming2, and then both sides
+// write it. Either way, both sides read either framing on any connection while
+// FramingV1 is being phased out, see Unframe.
+type Framing int
+
+const (
+	FramingV1 Framing = iota + 1
+	FramingV2
+)
+
+// DefaultFraming is the framing clients ask for unless told otherwise.
+// Switching to FramingV2 is all it takes to make it the default.
+const DefaultFraming = FramingV1
+
+// CapFraming2 is asking for FramingV2
+const CapFraming2 Capability = "framing2"
+
+// FramingV2's prefixes, for MsgPrefix, ServerResponsePrefix and CmdPrefix
+const (
+	MsgPrefixV2      = "MSG "
+	ResponsePrefixV2 = "RSP "
+	CmdPrefixV2      = "CMD "
+)
+
+// framingPrefixes pairs each kind of line's prefixes, FramingV1's first
+var framingPrefixes = [][2]string{
+	{MsgPrefix, MsgPrefixV2},
+	{ServerResponsePrefix, ResponsePrefixV2},
+	{CmdPrefix, CmdPrefixV2},
+}
+
+// FramingOf is the framing a connection with caps uses
+func FramingOf(caps Capabilities) Framing {
+	if caps.Supports(CapFraming2) {
+		return FramingV2
+	}
+	return FramingV1
+}
+
+// WithFraming is caps asking for f
+func (caps Capabilities) WithFraming(f Framing) Capabilities {
+	with := Capabilities{}
+	for capability := range caps {
+		with[capability] = true
+	}
+	delete(with, CapFraming2)
+	if f == FramingV2 {
+		with[CapFraming2] = true
+	}
+	return with
+}
+
+func (f Framing) String() string {
+	if f == FramingV2 {
+		return "v2"
+	}
+	return "v1"
+}
+
+// Frame turns a message, response or command line, as this package serializes
+// them, into f's framing. Other lines are left as they are.
+func (f Framing) Frame(line string) string {
+	if f != FramingV2 {
+		return line
+	}
+	for _, prefixes := range framingPrefixes {
+		if strings.HasPrefix(line, prefixes[0]) {
+			return prefixes[1] + line[len(prefixes[0]):]
+		}
+	}
+	return line
+}
+
+// Unframe turns a line in either framing into the one this package parses.
+// FramingV2's prefixes start with capitals that no FramingV1 line starts
+// with, so they can't be mistaken for one another.
+func Unframe(line string) string {
+	for _, prefixes := range framingPrefixes {
+		if strings.HasPrefix(line, prefixes[1]) {
+			return prefixes[0] + line[len(prefixes[1]):]
+		}
+	}
+	return line
+}
@@ -0,0 +1,36 @@
+package util
+
+import "testing"
+
+func TestFramingRoundTrip(t *testing.T) {
+	for line, framed := range map[string]string{
+		"m1;hi":            "MSG 1;hi",
+		"rauth;Ok":         "RSP auth;Ok",
+		"/quit kicked":     "CMD quit kicked",
+		"p+alice":          "p+alice",
+		"cpresence":        "cpresence",
+		"mbob: /not a cmd": "MSG bob: /not a cmd",
+	} {
+		if got := FramingV2.Frame(line); got != framed {
+			t.Errorf("expected %q framed as %q, got %q", line, framed, got)
+		}
+		if got := FramingV1.Frame(line); got != line {
+			t.Errorf("expected %q left as is in v1, got %q", line, got)
+		}
+		if got := Unframe(framed); got != line {
+			t.Errorf("expected %q unframed as %q, got %q", framed, line, got)
+		}
+		if got := Unframe(line); got != line {
+			t.Errorf("expected the v1 line %q left as is, got %q", line, got)
+		}
+	}
+}
+
+func TestFramingOf(t *testing.T) {
+	if f := FramingOf(Capabilities{CapPresence: true}); f != FramingV1 {
+		t.Errorf("expected v1 without %s, got %s", CapFraming2, f)
+	}
+	if f := FramingOf(Capabilities{CapFraming2: true}); f != FramingV2 {
+		t.Errorf("expected v2 with %s, got %s", CapFraming2, f)
+	}
+}
@@ -0,0 +1,118 @@
+package util
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultLogThrottleWindow is how long a LogThrottle suppresses the lines
+// like one it just logged, by default
+const DefaultLogThrottleWindow = 10 * time.Second
+
+// LogThrottle keeps bursts of the same log line, e.g an error per recipient of
+// each message while a connection flaps, from flooding the log. The first line
+// of a kind is logged, and the others within the window after it are counted,
+// then summed up once it ends, e.g "42 similar errors suppressed: Error sending
+// msg".
+type LogThrottle struct {
+	logger *log.Logger
+	window time.Duration
+
+	lock sync.Mutex
+	// windows are the kinds of lines logged lately, by kind
+	windows map[string]*throttleWindow
+}
+
+type throttleWindow struct {
+	start      time.Time
+	suppressed int
+	// summary sums up the suppressed lines once the window ends, nil until
+	// there are some
+	summary *time.Timer
+}
+
+// NewLogThrottle logs to logger. A zero window is DefaultLogThrottleWindow,
+// and a negative one logs every line.
+func NewLogThrottle(logger *log.Logger, window time.Duration) *LogThrottle {
+	if window == 0 {
+		window = DefaultLogThrottleWindow
+	}
+	return &LogThrottle{logger: logger, window: window,
+		windows: make(map[string]*throttleWindow)}
+}
+
+// Printf logs like log.Printf, unless a line of the same kind was logged within
+// the window
+func (t *LogThrottle) Printf(kind string, format string, v ...interface{}) {
+	if t.window < 0 {
+		t.logger.Printf(format, v...)
+		return
+	}
+	t.lock.Lock()
+	now := time.Now()
+	for other, w := range t.windows {
+		if w.summary == nil && now.Sub(w.start) >= t.window {
+			delete(t.windows, other)
+		}
+	}
+	w, suppress := t.windows[kind]
+	if !suppress {
+		t.windows[kind] = &throttleWindow{start: now}
+	} else {
+		w.suppressed++
+		if w.summary == nil {
+			w.summary = time.AfterFunc(w.start.Add(t.window).Sub(now), func() {
+				t.endWindow(kind, w)
+			})
+		}
+	}
+	t.lock.Unlock()
+	if !suppress {
+		t.logger.Printf(format, v...)
+	}
+}
+
+// endWindow logs how many lines of kind w suppressed, and lets the next one
+// through
+func (t *LogThrottle) endWindow(kind string, w *throttleWindow) {
+	t.lock.Lock()
+	if t.windows[kind] != w {
+		// Flush already did
+		t.lock.Unlock()
+		return
+	}
+	delete(t.windows, kind)
+	suppressed := w.suppressed
+	t.lock.Unlock()
+	t.logSummary(kind, suppressed)
+}
+
+func (t *LogThrottle) logSummary(kind string, suppressed int) {
+	if suppressed == 1 {
+		t.logger.Printf("1 similar error suppressed: %s\n", kind)
+	} else {
+		t.logger.Printf("%d similar errors suppressed: %s\n", suppressed, kind)
+	}
+}
+
+// Flush sums up the lines suppressed so far without waiting for their windows
+// to end, e.g before exiting
+func (t *LogThrottle) Flush() {
+	t.lock.Lock()
+	windows := t.windows
+	t.windows = make(map[string]*throttleWindow)
+	t.lock.Unlock()
+	kinds := make([]string, 0, len(windows))
+	for kind, w := range windows {
+		if w.summary != nil {
+			w.summary.Stop()
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		t.logSummary(kind, windows[kind].suppressed)
+	}
+}
@@ -0,0 +1,73 @@
+package util
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer lets the test read the log while the timers write it
+type lockedBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) lines() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return strings.Split(strings.TrimSuffix(b.buf.String(), "\n"), "\n")
+}
+
+func TestLogThrottleCoalescesBursts(t *testing.T) {
+	var out lockedBuffer
+	throttle := NewLogThrottle(log.New(&out, "", 0), time.Hour)
+	for i := 0; i < 100; i++ {
+		throttle.Printf("send", "Error sending msg: %d\n", i)
+		if i%10 == 0 {
+			throttle.Printf("other", "Other error: %d\n", i)
+		}
+	}
+	throttle.Flush()
+	expected := []string{"Error sending msg: 0", "Other error: 0",
+		"9 similar errors suppressed: other", "99 similar errors suppressed: send"}
+	if lines := out.lines(); strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+}
+
+func TestLogThrottleWindowEnds(t *testing.T) {
+	var out lockedBuffer
+	window := 20 * time.Millisecond
+	throttle := NewLogThrottle(log.New(&out, "", 0), window)
+	throttle.Printf("send", "first\n")
+	throttle.Printf("send", "second\n")
+	for start := time.Now(); len(out.lines()) < 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("expected the window to end with a summary, got %q", out.lines())
+		}
+	}
+	// the next window starts with the next line
+	throttle.Printf("send", "third\n")
+	expected := []string{"first", "1 similar error suppressed: send", "third"}
+	if lines := out.lines(); strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+
+	var all lockedBuffer
+	unthrottled := NewLogThrottle(log.New(&all, "", 0), -1)
+	for i := 0; i < 3; i++ {
+		unthrottled.Printf("send", "again\n")
+	}
+	if lines := all.lines(); len(lines) != 3 {
+		t.Fatalf("expected every line logged with a negative window, got %q", lines)
+	}
+}
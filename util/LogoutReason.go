@@ -0,0 +1,68 @@
+package util
+
+import (
+	"strings"
+	"time"
+)
+
+// LogoutReason is why the server logged a user out. It's sent as the argument
+// of a LogoutCmd line, "/quit CODE[ RETRY_AFTER]:TEXT", e.g "/quit
+// kicked:spamming" or "/quit shutdown 30s:maintenance". A bare "/quit" from
+// older servers gives none.
+type LogoutReason struct {
+	Code LogoutCode
+	Text string
+	// RetryAfter is how long to wait before reconnecting, only for
+	// LogoutShutdown, zero when the server didn't say
+	RetryAfter time.Duration
+}
+
+type LogoutCode string
+
+const (
+	LogoutKicked LogoutCode = "kicked"
+	LogoutBanned LogoutCode = "banned"
+	LogoutIdle   LogoutCode = "idle"
+	// LogoutShutdown is the only one worth reconnecting after
+	LogoutShutdown LogoutCode = "shutdown"
+)
+
+const logoutTextSeparator = ":"
+
+// Cmd is the LogoutCmd carrying the reason
+func (r LogoutReason) Cmd() Cmd {
+	code := string(r.Code)
+	if r.RetryAfter != 0 {
+		code += " " + r.RetryAfter.String()
+	}
+	return LogoutCmd + " " + Cmd(code+logoutTextSeparator+r.Text)
+}
+
+// String is the reason as shown to the user, e.g "kicked (spamming)"
+func (r LogoutReason) String() string {
+	if r.Text == "" {
+		return string(r.Code)
+	}
+	return string(r.Code) + " (" + r.Text + ")"
+}
+
+// ParseLogoutReason parses the arguments of a LogoutCmd line. Codes it doesn't
+// know are kept, and the text may be empty.
+func ParseLogoutReason(args string) (LogoutReason, bool) {
+	code, text, ok := strings.Cut(args, logoutTextSeparator)
+	if !ok {
+		return LogoutReason{}, false
+	}
+	reason := LogoutReason{Code: LogoutCode(code), Text: text}
+	if code, retryAfter, hasDelay := strings.Cut(code, " "); hasDelay {
+		delay, err := time.ParseDuration(retryAfter)
+		if err != nil || delay < 0 {
+			return LogoutReason{}, false
+		}
+		reason.Code, reason.RetryAfter = LogoutCode(code), delay
+	}
+	if reason.Code == "" {
+		return LogoutReason{}, false
+	}
+	return reason, true
+}
@@ -0,0 +1,27 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLogoutReasonRoundTrip(t *testing.T) {
+	for _, reason := range []LogoutReason{
+		{Code: LogoutKicked, Text: "spamming"},
+		{Code: LogoutBanned},
+		{Code: LogoutShutdown, Text: "maintenance: back at 10:00", RetryAfter: 30 * time.Second},
+		{Code: "unknown", Text: "kept anyway"},
+	} {
+		name, args := reason.Cmd().Split()
+		parsed, ok := ParseLogoutReason(args)
+		if name != LogoutCmd || !ok || parsed != reason {
+			t.Errorf("%q parsed as %+v, %t", reason.Cmd(), parsed, ok)
+		}
+	}
+	for _, args := range []string{"", "kicked", ":no code", "shutdown soon:maintenance",
+		"shutdown -1s:maintenance"} {
+		if reason, ok := ParseLogoutReason(args); ok {
+			t.Errorf("%q parsed as %+v", args, reason)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package util
+
+import "strings"
+
+// PresenceEvent tells subscribed clients that a user joined or left. It has its
+// own prefix so clients can tell it apart from chat messages.
+type PresenceEvent struct {
+	Name   Username
+	Online bool
+}
+
+const PresencePrefix = "p"
+
+const (
+	presenceJoined = "+"
+	presenceLeft   = "-"
+)
+
+func (e PresenceEvent) Serialize() string {
+	if e.Online {
+		return PresencePrefix + presenceJoined + string(e.Name)
+	}
+	return PresencePrefix + presenceLeft + string(e.Name)
+}
+
+func ParsePresenceEvent(s string) (PresenceEvent, bool) {
+	if !strings.HasPrefix(s, PresencePrefix) {
+		return PresenceEvent{}, false
+	}
+	s = s[len(PresencePrefix):]
+	if strings.HasPrefix(s, presenceJoined) {
+		return PresenceEvent{Username(s[len(presenceJoined):]), true}, true
+	} else if strings.HasPrefix(s, presenceLeft) {
+		return PresenceEvent{Username(s[len(presenceLeft):]), false}, true
+	}
+	return PresenceEvent{}, false
+}
+
+// PresenceTopic is the argument of SubscribeCmd/UnsubscribeCmd for presence
+// events
+const PresenceTopic = "presence"
@@ -0,0 +1,31 @@
+package util
+
+import (
+	"strconv"
+	"strings"
+)
+
+// QueuePrefix starts the line a full server sends a client waiting for a
+// connection to end, see CapQueue. The rest of the line is the client's place
+// in line, 1 being next, or 0 once it's its turn, after which it's served like
+// any other client.
+const QueuePrefix = "w"
+
+// ReasonServerFull is the refusal a client gets from a server that's serving
+// all the connections it can, and has no room left in line
+const ReasonServerFull = "the server is full, try again later"
+
+func SerializeQueuePosition(position int) string {
+	return QueuePrefix + strconv.Itoa(position)
+}
+
+func ParseQueuePosition(s string) (position int, ok bool) {
+	if !strings.HasPrefix(s, QueuePrefix) {
+		return 0, false
+	}
+	position, err := strconv.Atoi(s[len(QueuePrefix):])
+	if err != nil || position < 0 {
+		return 0, false
+	}
+	return position, true
+}
@@ -0,0 +1,50 @@
+package util
+
+import (
+	"strings"
+	"time"
+)
+
+// ReconnectPrefix starts the line a draining server sends its clients before
+// going away. The rest of the line is the address to reconnect to, empty for
+// the same address.
+const ReconnectPrefix = "x"
+
+func SerializeReconnectNotice(addr string) string {
+	return ReconnectPrefix + addr
+}
+
+func ParseReconnectNotice(s string) (addr string, ok bool) {
+	if !strings.HasPrefix(s, ReconnectPrefix) {
+		return "", false
+	}
+	return s[len(ReconnectPrefix):], true
+}
+
+// ReconnectOrder has a client finish what it's sending, disconnect, and
+// reconnect after Delay, to Addr or to the same address if it's empty. It's
+// sent as the argument of a ReconnectCmd line, "/reconnect DELAY[ ADDR]", e.g
+// "/reconnect 2.5s 10.0.0.2:7000", by a server shedding load.
+type ReconnectOrder struct {
+	Delay time.Duration
+	Addr  string
+}
+
+// Cmd is the ReconnectCmd carrying the order
+func (o ReconnectOrder) Cmd() Cmd {
+	args := o.Delay.String()
+	if o.Addr != "" {
+		args += " " + o.Addr
+	}
+	return ReconnectCmd + " " + Cmd(args)
+}
+
+// ParseReconnectOrder parses the arguments of a ReconnectCmd line
+func ParseReconnectOrder(args string) (ReconnectOrder, bool) {
+	delayStr, addr, _ := strings.Cut(args, " ")
+	delay, err := time.ParseDuration(delayStr)
+	if err != nil || delay < 0 || strings.Contains(addr, " ") {
+		return ReconnectOrder{}, false
+	}
+	return ReconnectOrder{delay, addr}, true
+}
@@ -0,0 +1,23 @@
+package util
+
+import "strings"
+
+// RefusalPrefix starts the line a server sends a client it won't serve, right
+// before closing the connection. The rest of the line is the reason, for the
+// client to show rather than retry.
+const RefusalPrefix = "e"
+
+// ReasonTLSRequired is the refusal a plaintext client gets from a server that
+// only accepts TLS
+const ReasonTLSRequired = "this server only accepts TLS connections"
+
+func SerializeRefusal(reason string) string {
+	return RefusalPrefix + reason
+}
+
+func ParseRefusal(s string) (reason string, ok bool) {
+	if !strings.HasPrefix(s, RefusalPrefix) {
+		return "", false
+	}
+	return s[len(RefusalPrefix):], true
+}
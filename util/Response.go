@@ -2,23 +2,125 @@ package util
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 )
 
 type Response string
 
 var (
-	ResponseOk                 Response = "Ok"
-	ResponseUserAlreadyOnline           = Response("User already online")
-	ResponseUsernameExists              = Response("Username already exists")
-	ResponseInvalidCredentials          = Response("Wrong username or password")
-	ResponseMsgFailedForSome            = Response("Message failed to send to some users")
-	ResponseMsgFailedForAll             = Response("Message failed to send to any users")
+	ResponseOk                   Response = "Ok"
+	ResponseUserAlreadyOnline             = Response("User already online")
+	ResponseUsernameExists                = Response("Username already exists")
+	ResponseUsernameShownByOther          = Response("Username is in use as someone's display name")
+	ResponseInvalidCredentials            = Response("Wrong username or password")
+	ResponseMsgFailedForSome              = Response("Message failed to send to some users")
+	ResponseMsgFailedForAll               = Response("Message failed to send to any users")
+	ResponseDisplayNameTaken              = Response("Display name already in use")
+	ResponseInvalidDisplayName            = Response("Invalid display name")
+	ResponseUnknownCmd                    = Response("Unknown command")
+	ResponseUnknownTopic                  = Response("Unknown subscription topic")
+	ResponseTooManySubscribers            = Response("Too many subscribers, try again later")
+	ResponseNotAuthenticated              = Response("Please authenticate first")
+	ResponseEmptyMessage                  = Response("Empty messages aren't allowed")
+	ResponseRegistrationClosed            = Response("Registration is closed, log in with an existing account")
+	ResponseUnsupportedByClient           = Response("Your client doesn't support this")
+	ResponseCancelled                     = Response("Message cancelled")
+	ResponseUnknownOperation              = Response("No such message in progress")
+	ResponseMsgIDInProgress               = Response("A message with this id is still in progress")
+	ResponseInvalidArgument               = Response("Invalid argument")
+	ResponseUnknownMessage                = Response("No such message in the history")
+	ResponseAlreadyReacted                = Response("You already reacted with this")
+	ResponseNoSuchUser                    = Response("No such user")
+	ResponseNotAdmin                      = Response("Only admins can do this")
+	ResponseUnknownSetting                = Response("Unknown setting")
+	// ResponseQueuedForOffline means the message will be delivered once the
+	// recipient logs in, so they haven't read it yet
+	ResponseQueuedForOffline = Response("Queued for offline delivery")
+	ResponseOfflineQueueFull = Response("Too many messages are waiting for this user")
+	// ResponseMsgExpiredForSome means the message's TTL ran out before it got
+	// to some users, the others getting it, see TTLCmd
+	ResponseMsgExpiredForSome = Response("Message expired before reaching some users")
+	ResponseMsgExpiredForAll  = Response("Message expired before reaching any users")
+	// ResponseMsgTimedOutForSome means some users weren't reading, so the
+	// message couldn't be written to them in time, the others getting it
+	ResponseMsgTimedOutForSome = Response("Message timed out reaching some users")
+	ResponseMsgTimedOutForAll  = Response("Message timed out reaching any users")
+	// ResponseServerShuttingDown refuses messages sent while the server
+	// drains, the client being told where to reconnect
+	ResponseServerShuttingDown = Response("The server is shutting down")
+	// ResponseSlowDown refuses a message sent too soon after the sender's
+	// last one, which they can send again in a moment
+	ResponseSlowDown = Response("You're sending messages too fast, wait a moment")
+	// ResponseRegistrationFull refuses registering past the server's cap on
+	// accounts, see ResponseRegistrationClosed for when it's closed instead
+	ResponseRegistrationFull = Response("Registration is full, log in with an existing account")
+	// ResponseDMsBlocked refuses a DM to a user who blocked them, see
+	// BlockDMsCmd
+	ResponseDMsBlocked = Response("They aren't accepting direct messages")
+	// ResponseControlChars refuses a message with control characters, when
+	// the server doesn't strip them instead
+	ResponseControlChars = Response("Messages can't have control characters")
+	// ResponseBlockedContent refuses a message with a word admins blocked,
+	// see BlockWordCmd
+	ResponseBlockedContent = Response("Your message has a blocked word")
+	// ResponseClientTooOld refuses to log in a client older than the server
+	// allows, which won't get further by trying again
+	ResponseClientTooOld = Response("Your client is too old for this server, please upgrade it")
+	// ResponseNotVerified refuses to log in to an account, or send from its
+	// session, until it's verified with VerifyCmd
+	ResponseNotVerified           = Response("Your account isn't verified yet")
+	ResponseWrongVerificationCode = Response("Wrong verification code")
+	// ResponseRegisteredPleaseLogin answers registering on a server that
+	// only creates the account, which is then logged in to like any other
+	ResponseRegisteredPleaseLogin = Response("Registered, log in to start chatting")
 	// ResponseIoErrorOccurred should be returned along with a normal error type
 	ResponseIoErrorOccurred = Response("IO error, couldn't get a response")
 )
 
+// MsgID is the id a message is sent with, which its response is sent with
+// too. Message and response lines are, past their prefix, an id, IdSeparator
+// and a payload, see SplitIDLine.
 type MsgID string
+
+const MaxMsgIDLen = 32
+
+// IsValid reports whether id is fine to echo back in a response: not empty, not
+// too long, not AuthResponseID, and only made of ID characters
+func (id MsgID) IsValid() bool {
+	return id != "" && len(id) <= MaxMsgIDLen && id != AuthResponseID && id.hasIDChars()
+}
+
+// hasIDChars reports whether id is only ASCII letters, digits, '-' and '_',
+// which is what ids are made of on the wire. It may be empty.
+func (id MsgID) hasIDChars() bool {
+	for _, r := range id {
+		if !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') &&
+			!('0' <= r && r <= '9') && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// SplitIDLine splits a message or response line, past its prefix, into its id
+// and payload. The id is everything before the first IdSeparator, and may be
+// empty, e.g a message no response is wanted for. The payload is everything
+// after it, verbatim, separators included. It fails on a line with no
+// separator, or an id with characters ids aren't made of. Long ids split fine,
+// it's up to the caller whether they're valid, see MsgID.IsValid.
+func SplitIDLine(s string) (id MsgID, payload string, ok bool) {
+	before, payload, found := strings.Cut(s, IdSeparator)
+	if !found || !MsgID(before).hasIDChars() {
+		return "", "", false
+	}
+	return MsgID(before), payload, true
+}
+
+// AuthResponseID is the id of responses to auth attempts, so clients can tell
+// them apart from late acks for messages
+const AuthResponseID MsgID = "auth"
+
 type ServerResponse struct {
 	Response Response
 	Id       MsgID
@@ -26,19 +128,36 @@ type ServerResponse struct {
 
 const ServerResponsePrefix = "r"
 
+func (r ServerResponse) Serialize() string {
+	return ServerResponsePrefix + string(r.Id) + IdSeparator + string(r.Response)
+}
+
 func ParseServerResponse(s string) (ServerResponse, bool) {
 	if !strings.HasPrefix(s, ServerResponsePrefix) {
 		return ServerResponse{}, false
 	}
-	s = s[len(ServerResponsePrefix):]
-	parts := strings.Split(s, IdSeparator)
-	if len(parts) < 2 {
+	id, response, ok := SplitIDLine(s[len(ServerResponsePrefix):])
+	if !ok {
 		return ServerResponse{}, false
 	}
-	id := MsgID(parts[0])
-	response := Response(s[len(id)+len(IdSeparator):])
-	return ServerResponse{Response: response, Id: id}, true
+	return ServerResponse{Response: Response(response), Id: id}, true
+}
+
+// ErrOddOutput is the other side sending something that makes no sense to us,
+// see OddOutputError
+var ErrOddOutput = errors.New("unexpected output")
+
+// OddOutputError is Line making no sense to us. It is ErrOddOutput.
+type OddOutputError struct {
+	Line string
+}
+
+func (e *OddOutputError) Error() string {
+	return fmt.Sprintf("%s: %q", ErrOddOutput, e.Line)
+}
+
+func (e *OddOutputError) Is(target error) bool {
+	return target == ErrOddOutput
 }
 
-var ErrOddOutput = errors.New("unexpected output from server")
 var ResponseUnknown Response = "unexpected output from server"
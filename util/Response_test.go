@@ -0,0 +1,127 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var atLimitID = strings.Repeat("a", MaxMsgIDLen)
+
+func TestSplitIDLine(t *testing.T) {
+	for _, c := range []struct {
+		line    string
+		id      MsgID
+		payload string
+		ok      bool
+	}{
+		{"1;hi", "1", "hi", true},
+		{";hi", "", "hi", true},
+		{";/quit", "", "/quit", true},
+		{"1;", "1", "", true},
+		{";", "", "", true},
+		{";;", "", ";", true},
+		{"1;;;", "1", ";;", true},
+		{";a;b;", "", "a;b;", true},
+		{"a-Z_9;x", "a-Z_9", "x", true},
+		{atLimitID + ";x", MsgID(atLimitID), "x", true},
+		// too long to be valid, which is the caller's to check
+		{atLimitID + "a;x", MsgID(atLimitID + "a"), "x", true},
+		{"", "", "", false},
+		{"hi", "", "", false},
+		{"1 2;x", "", "", false},
+		{"bob: hi;there", "", "", false},
+		{"é;x", "", "", false},
+	} {
+		id, payload, ok := SplitIDLine(c.line)
+		if id != c.id || payload != c.payload || ok != c.ok {
+			t.Errorf("%q split as %q, %q, %t, expected %q, %q, %t", c.line,
+				id, payload, ok, c.id, c.payload, c.ok)
+		}
+	}
+}
+
+func TestMsgIDIsValid(t *testing.T) {
+	for id, valid := range map[MsgID]bool{
+		"1": true, "a-Z_9": true, MsgID(atLimitID): true,
+		"": false, MsgID(atLimitID + "a"): false, AuthResponseID: false, "1;": false,
+		"1 2": false,
+	} {
+		if id.IsValid() != valid {
+			t.Errorf("expected %q valid: %t", id, valid)
+		}
+	}
+}
+
+func TestParseServerResponse(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		r    ServerResponse
+		ok   bool
+	}{
+		{"r1;Ok", ServerResponse{"Ok", "1"}, true},
+		{"rauth;Ok", ServerResponse{"Ok", AuthResponseID}, true},
+		{"r;a;b", ServerResponse{"a;b", ""}, true},
+		{"r1;", ServerResponse{"", "1"}, true},
+		{"r;;;", ServerResponse{";;", ""}, true},
+		{"r", ServerResponse{}, false},
+		{"r1", ServerResponse{}, false},
+		{"rbad id;Ok", ServerResponse{}, false},
+		{"m1;Ok", ServerResponse{}, false},
+	} {
+		r, ok := ParseServerResponse(c.line)
+		if r != c.r || ok != c.ok {
+			t.Errorf("%q parsed as %+v, %t, expected %+v, %t", c.line, r, ok, c.r, c.ok)
+		}
+		if ok && r.Serialize() != c.line {
+			t.Errorf("%q serialized back as %q", c.line, r.Serialize())
+		}
+	}
+}
+
+func FuzzSplitIDLine(f *testing.F) {
+	for _, seed := range []string{"1;hi", ";", ";;", "1", "", atLimitID + ";x", "a b;c"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		id, payload, ok := SplitIDLine(line)
+		if !ok {
+			return
+		}
+		if joined := string(id) + IdSeparator + payload; joined != line {
+			t.Fatalf("%q split as %q and %q, which join as %q", line, id, payload, joined)
+		}
+		if strings.Contains(string(id), IdSeparator) {
+			t.Fatalf("%q split with the separator in the id %q", line, id)
+		}
+	})
+}
+
+func FuzzParseServerResponse(f *testing.F) {
+	for _, seed := range []string{"r1;Ok", "rauth;Ok", "r;a;b", "r", "r1", "x"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		r, ok := ParseServerResponse(line)
+		if !ok {
+			return
+		}
+		if r.Serialize() != line {
+			t.Fatalf("%q parsed as %+v, which serializes as %q", line, r, r.Serialize())
+		}
+		if again, ok := ParseServerResponse(r.Serialize()); !ok || again != r {
+			t.Fatalf("%+v serialized and parsed again as %+v, %t", r, again, ok)
+		}
+	})
+}
+
+func TestOddOutputErrorIs(t *testing.T) {
+	err := fmt.Errorf("reading: %w", &OddOutputError{Line: "huh"})
+	if !errors.Is(err, ErrOddOutput) {
+		t.Errorf("expected %v to be %v", err, ErrOddOutput)
+	}
+	if err.Error() != `reading: unexpected output: "huh"` {
+		t.Errorf("expected the line in the error, got %q", err)
+	}
+}
@@ -0,0 +1,20 @@
+package util
+
+import "strings"
+
+// RoomNoticePrefix starts a notice the server sends everyone, e.g a reaction
+// tally, rather than one for a single user, like the output of their
+// commands. Clients that don't support CapRoomNotices get such notices as
+// messages instead.
+const RoomNoticePrefix = "n"
+
+func SerializeRoomNotice(notice string) string {
+	return RoomNoticePrefix + notice
+}
+
+func ParseRoomNotice(s string) (notice string, ok bool) {
+	if !strings.HasPrefix(s, RoomNoticePrefix) {
+		return "", false
+	}
+	return s[len(RoomNoticePrefix):], true
+}
@@ -0,0 +1,25 @@
+package util
+
+import "time"
+
+// The server answers TimeCmd with its current time as the response, so clients
+// can correct the timestamps it sends for their clock's skew
+
+func SerializeServerTime(t time.Time) Response {
+	return Response(t.UTC().Format(time.RFC3339Nano))
+}
+
+func ParseServerTime(response Response) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, string(response))
+}
+
+// ClockOffset estimates how far the server's clock is ahead of ours, from a
+// time request sent at sent and answered with serverTime at received. The
+// server is assumed to have answered halfway through the round trip.
+func ClockOffset(serverTime, sent, received time.Time) time.Duration {
+	return serverTime.Sub(sent.Add(received.Sub(sent) / 2))
+}
+
+// HistoryNoticePrefix starts each HistoryCmd line, which is followed by the
+// message's server time in RFC3339
+const HistoryNoticePrefix = "History: "
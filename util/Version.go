@@ -0,0 +1,166 @@
+package util
+
+import (
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// BuildVersion is this build's version, set with
+// -ldflags "-X util.BuildVersion=1.2.3". See BinaryVersion for when it isn't.
+var BuildVersion string
+
+// DevelVersion is the version of a build that doesn't know its own, e.g one
+// built from a checkout
+const DevelVersion = "devel"
+
+// BinaryVersion is BuildVersion, or else the main module's version as the Go
+// toolchain recorded it, or else DevelVersion
+func BinaryVersion() string {
+	if BuildVersion != "" {
+		return BuildVersion
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" &&
+		info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return DevelVersion
+}
+
+// versionCapPrefix marks the capability that carries a version, e.g
+// "version=1.2.3". The client's capabilities line has its version, and the
+// server answers a client that sent one with its own, on a capabilities line
+// of its own. A server that doesn't know about versions keeps the client's as
+// a capability it doesn't know.
+const versionCapPrefix = "version="
+
+// WithVersion returns a copy of the capabilities that carries version. The
+// characters that would break the line up are replaced.
+func (caps Capabilities) WithVersion(version string) Capabilities {
+	withVersion := make(Capabilities, len(caps)+1)
+	for capability := range caps {
+		if !strings.HasPrefix(string(capability), versionCapPrefix) {
+			withVersion[capability] = true
+		}
+	}
+	version = strings.Map(func(r rune) rune {
+		if r == ',' || r <= ' ' {
+			return '_'
+		}
+		return r
+	}, version)
+	withVersion[Capability(versionCapPrefix+version)] = true
+	return withVersion
+}
+
+// Version is the version the capabilities carry, empty if none
+func (caps Capabilities) Version() string {
+	for capability := range caps {
+		if version := strings.TrimPrefix(string(capability), versionCapPrefix); version !=
+			string(capability) {
+			return version
+		}
+	}
+	return ""
+}
+
+// SemVer is a semantic version, e.g "1.2.3-rc.1", see semver.org
+type SemVer struct {
+	Major, Minor, Patch int
+	// Pre are the pre-release's dot separated identifiers, e.g "rc" and "1"
+	Pre []string
+}
+
+// ParseSemVer parses a semantic version, with or without a leading "v". A
+// missing minor or patch number is 0, e.g "v1.2", and build metadata, e.g
+// "+abc123", is ignored.
+func ParseSemVer(s string) (SemVer, bool) {
+	s = strings.TrimPrefix(s, "v")
+	s, _, _ = strings.Cut(s, "+")
+	s, pre, hasPre := strings.Cut(s, "-")
+	numbers := strings.Split(s, ".")
+	if len(numbers) > 3 {
+		return SemVer{}, false
+	}
+	var v SemVer
+	fields := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, number := range numbers {
+		n, err := strconv.Atoi(number)
+		if err != nil || n < 0 || number != strconv.Itoa(n) {
+			return SemVer{}, false
+		}
+		*fields[i] = n
+	}
+	if hasPre {
+		v.Pre = strings.Split(pre, ".")
+		for _, identifier := range v.Pre {
+			if identifier == "" {
+				return SemVer{}, false
+			}
+		}
+	}
+	return v, true
+}
+
+// Compare returns -1, 0 or 1 as v is older than, the same as, or newer than
+// other. A pre-release is older than its release.
+func (v SemVer) Compare(other SemVer) int {
+	for _, diff := range []int{v.Major - other.Major, v.Minor - other.Minor,
+		v.Patch - other.Patch} {
+		if diff != 0 {
+			return sign(diff)
+		}
+	}
+	switch {
+	case len(v.Pre) == 0 && len(other.Pre) == 0:
+		return 0
+	case len(v.Pre) == 0:
+		return 1
+	case len(other.Pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.Pre) && i < len(other.Pre); i++ {
+		if c := comparePreRelease(v.Pre[i], other.Pre[i]); c != 0 {
+			return c
+		}
+	}
+	return sign(len(v.Pre) - len(other.Pre))
+}
+
+// comparePreRelease compares numeric identifiers as numbers, which are older
+// than the others, compared as strings
+func comparePreRelease(a, b string) int {
+	aN, aErr := strconv.Atoi(a)
+	bN, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return sign(aN - bN)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// VersionAtLeast reports whether version is min or newer. A version that isn't
+// a semantic one, e.g DevelVersion, passes, since there's no telling how old
+// it is.
+func VersionAtLeast(version, min string) bool {
+	v, ok := ParseSemVer(version)
+	if !ok {
+		return true
+	}
+	m, ok := ParseSemVer(min)
+	return !ok || v.Compare(m) >= 0
+}
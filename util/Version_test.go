@@ -0,0 +1,47 @@
+package util
+
+import "testing"
+
+func TestVersionAtLeast(t *testing.T) {
+	for _, test := range []struct {
+		version, min string
+		atLeast      bool
+	}{
+		{"1.2.3", "1.2.3", true},
+		{"v1.10.0", "1.9.9", true},
+		{"1.2", "1.2.1", false},
+		{"1.2.3+build.7", "1.2.3", true},
+		// pre-releases come before their release, numbers before words
+		{"1.2.3-rc.1", "1.2.3", false},
+		{"1.2.3-rc.10", "1.2.3-rc.9", true},
+		{"1.2.3-rc.1", "1.2.3-1", true},
+		{"1.2.3-rc", "1.2.3-rc.1", false},
+		// there's no telling how old these are
+		{DevelVersion, "1.0.0", true},
+		{"", "1.0.0", true},
+		{"1.2.03", "1.2.4", true},
+		// nor what this minimum means
+		{"0.1.0", "latest", true},
+	} {
+		if got := VersionAtLeast(test.version, test.min); got != test.atLeast {
+			t.Errorf("expected %q at least %q to be %t", test.version, test.min, test.atLeast)
+		}
+	}
+}
+
+func TestVersionCapability(t *testing.T) {
+	line := ClientCapabilities().WithVersion("1.2.3 (patched, twice)").Serialize()
+	caps, ok := ParseCapabilities(line)
+	if !ok || caps.Version() != "1.2.3_(patched__twice)" {
+		t.Fatalf("expected the version to stay one capability, got %q", line)
+	}
+	if !caps.Supports(CapPresence) {
+		t.Fatalf("expected the other capabilities kept, got %q", line)
+	}
+	if version := caps.WithVersion("2.0.0").Version(); version != "2.0.0" {
+		t.Fatalf("expected the version replaced, got %q", version)
+	}
+	if version := ClientCapabilities().Version(); version != "" {
+		t.Fatalf("expected no version, got %q", version)
+	}
+}
@@ -1,9 +1,40 @@
 package util
 
+import (
+	"strings"
+	"unicode"
+)
+
 type Username string
 type Password string
 
+// DisplayName is what other users see as the sender of our messages. The
+// Username stays the identity used for authentication.
+type DisplayName string
+
 type UserCredentials struct {
 	Name     Username
 	Password Password
 }
+
+const MaxDisplayNameLen = 32
+
+// IsValid reports whether name can be shown to other users: not too long, no
+// surrounding spaces, and only ASCII letters, digits, spaces and a few
+// punctuation marks. ':' is notably excluded since it separates the sender from
+// the content in serialized messages. Non-ASCII letters are excluded since
+// lookalikes, e.g a Cyrillic 'А' in "Аlice", would pass case-insensitive
+// collision checks.
+func (name DisplayName) IsValid() bool {
+	s := string(name)
+	if s == "" || len([]rune(s)) > MaxDisplayNameLen || strings.TrimSpace(s) != s {
+		return false
+	}
+	for _, r := range s {
+		if r > unicode.MaxASCII ||
+			!unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" ()-_.'", r) {
+			return false
+		}
+	}
+	return true
+}
@@ -2,6 +2,7 @@ package util
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"io"
 	"log"
@@ -24,11 +25,23 @@ type ReadInput struct {
 }
 
 func ReadAsyncIntoChan(scanner *bufio.Scanner) <-chan ReadInput {
+	return ReadAsyncIntoChanUntil(scanner, nil)
+}
+
+// ReadAsyncIntoChanUntil is ReadAsyncIntoChan for a reader that may be
+// abandoned: once done is closed, the reading goroutine stops instead of
+// waiting for its lines to be taken. It still has to be unblocked from
+// reading, e.g by closing the connection.
+func ReadAsyncIntoChanUntil(scanner *bufio.Scanner, done <-chan struct{}) <-chan ReadInput {
 	inputs := make(chan ReadInput)
 	go func() {
 		for {
 			str, err := ScanLine(scanner)
-			inputs <- ReadInput{str, err}
+			select {
+			case inputs <- ReadInput{str, err}:
+			case <-done:
+				return
+			}
 			if err != nil {
 				return
 			}
@@ -37,6 +50,58 @@ func ReadAsyncIntoChan(scanner *bufio.Scanner) <-chan ReadInput {
 	return inputs
 }
 
+// ErrTruncatedLine is a connection ending in the middle of a line
+var ErrTruncatedLine = errors.New("connection ended mid-line")
+
+// ScanProtocolLines splits like bufio.ScanLines, except that a last line with
+// no newline fails with ErrTruncatedLine. A protocol line is only whole once
+// its newline came, and the rest of a line cut by a dropped connection must not
+// pass for one, e.g as a message only half sent.
+//
+// Like bufio.ScanLines, it drops a single \r before the newline, so lines from
+// clients that end theirs with CRLF read the same. Any other \r is part of the
+// line, e.g a message's content, which the server strips or refuses like other
+// control characters. Lines are only ever written with a bare \n.
+func ScanProtocolLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) != 0 && bytes.IndexByte(data, '\n') < 0 {
+		return 0, nil, ErrTruncatedLine
+	}
+	return bufio.ScanLines(data, atEOF)
+}
+
+// NewProtocolScanner scans the protocol lines r sends, see ScanProtocolLines
+func NewProtocolScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(ScanProtocolLines)
+	return scanner
+}
+
+// ErrLineTooLong is a protocol line over a scanner's cap, see
+// NewProtocolScannerMax
+var ErrLineTooLong = errors.New("line too long")
+
+// NewProtocolScannerMax is NewProtocolScanner for lines of up to maxLen bytes,
+// not counting the line ending. A longer one fails with ErrLineTooLong as soon
+// as it's past maxLen, so it's never buffered whole.
+func NewProtocolScannerMax(r io.Reader, maxLen int) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	// the buffer holds a line and its \r\n, which it grows to as needed
+	initial := bufio.MaxScanTokenSize / 16
+	if initial > maxLen+2 {
+		initial = maxLen + 2
+	}
+	scanner.Buffer(make([]byte, 0, initial), maxLen+2)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := ScanProtocolLines(data, atEOF)
+		// with no line yet, all but a \r waiting for its \n is the line's
+		if len(token) > maxLen || token == nil && len(data) > maxLen+1 {
+			return 0, nil, ErrLineTooLong
+		}
+		return advance, token, err
+	})
+	return scanner
+}
+
 // ScanLine is a wrapper around Scanner.Scan() that returns EOF as errors
 // instead of bools
 func ScanLine(s *bufio.Scanner) (string, error) {
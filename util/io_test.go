@@ -0,0 +1,89 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestScanProtocolLinesCRLF(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		lines []string
+		err   error
+	}{
+		{"l\r\nalice\r\n", []string{"l", "alice"}, nil},
+		{"\r\n\n", []string{"", ""}, nil},
+		// a single \r is stripped, and only at the end
+		{"a\r\r\n", []string{"a\r"}, nil},
+		{"a\rb\r\n", []string{"a\rb"}, nil},
+		{"\r\rb\n", []string{"\r\rb"}, nil},
+		// a lone \r doesn't end a line
+		{"a\rb\rc\n", []string{"a\rb\rc"}, nil},
+		{"a\n\r", []string{"a"}, ErrTruncatedLine},
+		{"a\r", nil, ErrTruncatedLine},
+	} {
+		scanner := NewProtocolScanner(strings.NewReader(test.input))
+		var lines []string
+		var err error
+		for {
+			var line string
+			if line, err = ScanLine(scanner); err != nil {
+				break
+			}
+			lines = append(lines, line)
+		}
+		if test.err == nil {
+			test.err = io.EOF
+		}
+		if strings.Join(lines, "|") != strings.Join(test.lines, "|") ||
+			len(lines) != len(test.lines) || !errors.Is(err, test.err) {
+			t.Errorf("%q: expected %q then %v, got %q then %v", test.input, test.lines, test.err,
+				lines, err)
+		}
+	}
+}
+
+func TestProtocolScannerMax(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		lines []string
+		err   error
+	}{
+		{"abcd\nabcd\r\n", []string{"abcd", "abcd"}, nil},
+		{"ab\nabcde\n", []string{"ab"}, ErrLineTooLong},
+		{"abcde\r\n", nil, ErrLineTooLong},
+		// too long before it ends
+		{"abcdefgh", nil, ErrLineTooLong},
+		{"abcd\r", nil, ErrTruncatedLine},
+	} {
+		scanner := NewProtocolScannerMax(strings.NewReader(test.input), 4)
+		var lines []string
+		var err error
+		for {
+			var line string
+			if line, err = ScanLine(scanner); err != nil {
+				break
+			}
+			lines = append(lines, line)
+		}
+		if test.err == nil {
+			test.err = io.EOF
+		}
+		if strings.Join(lines, "|") != strings.Join(test.lines, "|") ||
+			len(lines) != len(test.lines) || !errors.Is(err, test.err) {
+			t.Errorf("%q: expected %q then %v, got %q then %v", test.input, test.lines, test.err,
+				lines, err)
+		}
+	}
+
+	// refused long before it's read whole
+	huge := strings.NewReader(strings.Repeat("a", 4<<20) + "\n")
+	if _, err := ScanLine(NewProtocolScannerMax(huge, 1024)); !errors.Is(err, ErrLineTooLong) {
+		t.Fatalf("expected a 4MB line to be too long, got %v", err)
+	}
+	if read := huge.Size() - int64(huge.Len()); read > 64<<10 {
+		t.Fatalf("expected at most 64KB read, got %d bytes", read)
+	}
+}
@@ -0,0 +1,109 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// TraceDirection tells whether a traced line was read from the connection or
+// written to it
+type TraceDirection string
+
+const (
+	TraceIn  TraceDirection = "<-"
+	TraceOut TraceDirection = "->"
+)
+
+// Redactor may replace a line before it's traced, e.g to hide passwords
+type Redactor func(dir TraceDirection, line string) string
+
+const RedactedLine = "<redacted>"
+
+// RedactPasswords masks the password line of each auth exchange. fromClient is
+// the direction of the lines the client sends, i.e TraceOut on the client's side
+// and TraceIn on the server's.
+func RedactPasswords(fromClient TraceDirection) Redactor {
+	linesUntilPassword := 0
+	return func(dir TraceDirection, line string) string {
+		if dir != fromClient {
+			return line
+		}
+		switch {
+		case linesUntilPassword == 1:
+			linesUntilPassword = 0
+			return RedactedLine
+		case linesUntilPassword == 2:
+			linesUntilPassword--
+		case AuthAction(line) == ActionLogin || AuthAction(line) == ActionRegister:
+			linesUntilPassword = 2
+		}
+		return line
+	}
+}
+
+// traceWriteLock serializes trace lines of different conns that share a writer
+var traceWriteLock sync.Mutex
+
+// TracedConn writes every protocol line going through the conn to a trace
+// writer, along with a timestamp, the conn's id and the line's direction
+type TracedConn struct {
+	net.Conn
+	trace  io.Writer
+	id     string
+	redact Redactor
+
+	// lock guards the partial lines, since writes can come from several
+	// goroutines
+	lock       sync.Mutex
+	partialIn  []byte
+	partialOut []byte
+}
+
+func NewTracedConn(conn net.Conn, trace io.Writer, id string, redact Redactor) *TracedConn {
+	return &TracedConn{Conn: conn, trace: trace, id: id, redact: redact}
+}
+
+func (c *TracedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.tap(TraceIn, b[:n])
+	return n, err
+}
+
+// Write traces before writing, so the trace keeps its order even when the peer
+// answers before the write returns, and shows writes that end up blocking
+func (c *TracedConn) Write(b []byte) (int, error) {
+	c.tap(TraceOut, b)
+	return c.Conn.Write(b)
+}
+
+// tap traces each line completed by data. Reads and writes don't have to
+// align with lines, so the rest is kept until its newline arrives.
+func (c *TracedConn) tap(dir TraceDirection, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	partial := &c.partialIn
+	if dir == TraceOut {
+		partial = &c.partialOut
+	}
+	*partial = append(*partial, data...)
+	for {
+		i := bytes.IndexByte(*partial, '\n')
+		if i == -1 {
+			return
+		}
+		line := string((*partial)[:i])
+		*partial = (*partial)[i+1:]
+		if c.redact != nil {
+			line = c.redact(dir, line)
+		}
+		traceWriteLock.Lock()
+		fmt.Fprintf(c.trace, "%s [%s] %s %s\n",
+			time.Now().Format("15:04:05.000000"), c.id, dir, line)
+		traceWriteLock.Unlock()
+	}
+}